@@ -0,0 +1,48 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// clientContextKey is the custom field of the client context holding the trace headers, where the wrapper of the
+// invoked lambda reads them from
+const clientContextKey = "_datadog"
+
+// lambdaClientContext is the client context of a direct invocation, as decoded by the lambda runtime
+type lambdaClientContext struct {
+	Custom map[string]string `json:"custom"`
+}
+
+// InjectLambdaClientContext returns the base64 encoded client context of a direct invocation, to set as the
+// ClientContext of the Invoke input of the AWS SDK, so the invoked lambda continues the trace of ctx. The trace
+// headers, as returned by GetTraceHeaders, are JSON encoded in its `_datadog` custom field, as the custom fields are
+// strings. It returns an empty string when ctx has no trace context.
+func InjectLambdaClientContext(ctx context.Context) (string, error) {
+	headers := GetTraceHeaders(ctx)
+	if headers[tracer.DefaultTraceIDHeader] == "" {
+		return "", nil
+	}
+
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode the trace headers: %w", err)
+	}
+	clientContext, err := json.Marshal(lambdaClientContext{Custom: map[string]string{clientContextKey: string(encodedHeaders)}})
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode the client context: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(clientContext), nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-lambda-go/internal/trace"
+)
+
+func TestInjectLambdaClientContextRoundTrip(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), stepFunctionTraceHeaders)
+
+	encoded, err := InjectLambdaClientContext(ctx)
+	assert.NoError(t, err)
+
+	// The lambda runtime decodes the client context of the invocation into the lambda context of the invoked lambda
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	clientContext := lambdacontext.ClientContext{}
+	assert.NoError(t, json.Unmarshal(decoded, &clientContext))
+	assert.Contains(t, clientContext.Custom, "_datadog")
+	calleeCtx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{ClientContext: clientContext})
+
+	headers := trace.DefaultTraceExtractor(calleeCtx, json.RawMessage(`{"orderId":"o-1"}`))
+	assert.Equal(t, "1231452342", headers["x-datadog-trace-id"])
+	assert.Equal(t, "45678910", headers["x-datadog-parent-id"])
+	assert.Equal(t, "2", headers["x-datadog-sampling-priority"])
+}
+
+func TestInjectLambdaClientContextWithoutTraceContext(t *testing.T) {
+	encoded, err := InjectLambdaClientContext(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, encoded)
+}
@@ -11,18 +11,26 @@ package ddlambda
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/logs"
 	"github.com/DataDog/datadog-lambda-go/internal/metrics"
 	"github.com/DataDog/datadog-lambda-go/internal/trace"
 	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
@@ -31,32 +39,67 @@ import (
 type (
 	// Config gives options for how ddlambda should behave
 	Config struct {
+		// Disabled turns ddlambda off for this handler, which is returned unwrapped, so the public functions called
+		// from it have no listener, and don't make any request nor construct any client. DD_LAMBDA_DISABLED=true turns
+		// it off for the whole process, the public functions being no-ops. This is stronger than DiscardMetrics, which
+		// still instruments the invocations.
+		Disabled bool
 		// APIKey is your Datadog API key. This is used for sending metrics.
 		APIKey string
 		// KMSAPIKey is your Datadog API key, encrypted using the AWS KMS service. This is used for sending metrics.
 		KMSAPIKey string
+		// DisableKeyDecryption only uses the plaintext API key sources: Config.APIKey, DD_API_KEY_FILE and DD_API_KEY.
+		// Config.KMSAPIKey, DD_KMS_API_KEY and DD_API_KEY_SECRET_ARN are ignored, even when set, so neither KMS nor
+		// Secrets Manager is ever called. WrapHandlerStrict returns ErrMissingAPIKey when only these are set.
+		DisableKeyDecryption bool
+		// ApplicationKey is your Datadog application key. It is only used by SetDistributionPercentiles.
+		// If empty, this value is read from the 'DD_APP_KEY' environment variable.
+		ApplicationKey string
 		// ShouldRetryOnFailure is used to turn on retry logic when sending metrics via the API. This can negatively effect the performance of your lambda,
 		// and should only be turned on if you can't afford to lose metrics data under poor network conditions.
 		ShouldRetryOnFailure bool
 		// ShouldUseLogForwarder enabled the log forwarding method for sending metrics to Datadog. This approach requires the user to set up a custom lambda
 		// function that forwards metrics from cloudwatch to the Datadog api. This approach doesn't have any impact on the performance of your lambda function.
 		ShouldUseLogForwarder bool
+		// DualWrite writes every metric to stdout for the log forwarder, on top of sending it to the API (or the extension),
+		// e.g. to compare both during a migration. The API key is then required even when ShouldUseLogForwarder is set.
+		DualWrite bool
 		// BatchInterval is the period of time which metrics are grouped together for processing to be sent to the API or written to logs.
 		// Any pending metrics are flushed at the end of the lambda.
 		BatchInterval time.Duration
+		// FlushJitter bounds the random delay added to the BatchInterval of each container, so the containers started
+		// together, e.g. during a traffic spike, don't all flush at the same instants. Defaults to 300ms, a negative
+		// value turns it off.
+		FlushJitter time.Duration
 		// Site is the host to send metrics to. If empty, this value is read from the 'DD_SITE' environment variable, or if that is empty
 		// will default to 'datadoghq.com'.
 		Site string
 		// DebugLogging will turn on extended debug logging.
 		DebugLogging bool
+		// LogErrorInterval makes ddlambda log the same internal error at most once per interval, e.g. when every flush
+		// fails during an outage of the Datadog API. The next time an error is logged, it mentions how many times it was
+		// suppressed in between. If 0, every error is logged.
+		LogErrorInterval time.Duration
 		// EnhancedMetrics enables the reporting of enhanced metrics under `aws.lambda.enhanced*` and adds enhanced metric tags
 		EnhancedMetrics bool
+		// EnhancedMetricTags are added to the enhanced metrics, e.g. "team:payments", on top of the function, region and
+		// cold start tags added automatically. Unlike DefaultTags, they aren't added to the custom metrics.
+		EnhancedMetricTags []string
+		// Region is the value of the region tag of the enhanced metrics, e.g. for local emulators where AWS_REGION is
+		// unset or wrong. It defaults to AWS_REGION, then AWS_DEFAULT_REGION, then the region of the function's ARN;
+		// the tag is omitted when none is set.
+		Region string
 		// DDTraceEnabled enables the Datadog tracer.
 		DDTraceEnabled bool
 		// MergeXrayTraces will cause Datadog traces to be merged with traces from AWS X-Ray.
 		MergeXrayTraces bool
 		// HTTPClientTimeout specifies a time limit for requests to the API. It defaults to 5s.
 		HTTPClientTimeout time.Duration
+		// CACertPath is the path of a PEM file of certificate authorities trusted when sending metrics to the API, along with
+		// the system ones, e.g. the internal CA of a proxy intercepting TLS.
+		CACertPath string
+		// CACertPEM holds PEM certificate authorities trusted along with the system ones, like CACertPath.
+		CACertPEM []byte
 		// CircuitBreakerInterval is the cyclic period of the closed state
 		// for the CircuitBreaker to clear the internal Counts.
 		// default: 30s
@@ -75,6 +118,172 @@ type (
 		TraceContextExtractor trace.ContextExtractor
 		// TracerOptions are additional options passed to the tracer.
 		TracerOptions []tracer.StartOption
+		// CaptureHandlerErrors marks the function execution span as errored when the handler returns a non-nil error.
+		// If nil, this value is read from the 'DD_CAPTURE_HANDLER_ERRORS' environment variable, or defaults to true.
+		CaptureHandlerErrors *bool
+		// NonErroringErrors are the expected errors of the handler, e.g. a not found error. The handler errors matching
+		// one of them, according to errors.Is, neither mark the function execution span as errored nor count in the
+		// aws.lambda.enhanced.errors metric. The handler still returns them.
+		NonErroringErrors []error
+		// ServiceMapping renames services on spans, from the key to the value. It is merged with the mapping read from DD_SERVICE_MAPPING,
+		// with the entries from this field taking precedence.
+		ServiceMapping map[string]string
+		// APIGatewaySpanTags tags the function execution span of API Gateway invocations with `http.route`, `http.method`,
+		// `stage` and `resource`. The route is the resource path template, e.g. `/users/{id}`, to keep a low cardinality.
+		// If nil, this value is read from the 'DD_TRACE_API_GATEWAY_TAGS' environment variable, or defaults to true.
+		APIGatewaySpanTags *bool
+		// SpanIDGenerator returns the non-zero 64-bit ID of each function execution span. When the span starts a new trace,
+		// its ID is also used as the trace ID. Defaults to random IDs.
+		SpanIDGenerator func() uint64
+		// TagFunctionVersion tags the function execution span with executedversion, the version of the function that
+		// ran, and resource, the function name suffixed with the alias or version it was invoked with, e.g.
+		// "my-function:canary". The enhanced metrics then have the executedversion tag for every invocation, not only
+		// the ones through an alias. The resource tag of API Gateway events, see APIGatewaySpanTags, takes precedence.
+		TagFunctionVersion bool
+		// WarmupEventDetector returns true for the keep-warm invocations, which the wrapper then passes to the handler
+		// without any instrumentation: no span, no metric and no flush. The event is the json.RawMessage payload of the
+		// invocation. It defaults to DefaultWarmupEventDetector.
+		WarmupEventDetector func(event interface{}) bool
+		// OnSpanFinish is called with the function execution span and the spans started with StartSpanFromContext, once
+		// they're finished and submitted to the tracer, e.g. to mirror them to another system or assert on them in tests.
+		// It runs on the goroutine finishing the span, so it should return quickly.
+		OnSpanFinish func(SpanData)
+		// PropagationStyleExtract are the header formats the trace context of the invocation is extracted from, in
+		// order, the first one that matches winning: "datadog", "tracecontext" for W3C `traceparent` headers, and "b3"
+		// or "b3multi". Defaults to "datadog" then "tracecontext".
+		PropagationStyleExtract []string
+		// IgnoreResources skips the function execution span and the enhanced metrics of the invocations whose span
+		// resource, as returned by SpanResourceFunc, or whose request route or path matches one of them, like the health
+		// checks of a load balancer. They are globs, like "/health/*", and the ones ending with "*" also match the
+		// resources they prefix, like "/health/live/db". Custom metrics are still sent.
+		IgnoreResources []string
+		// PropagateHeaders are the names of the headers of the incoming request event, e.g. "x-request-id", captured
+		// into the context of the invocation. AddTraceHeaders then sets them on outbound requests, along with the
+		// trace headers. The names are case insensitive.
+		PropagateHeaders []string
+		// SpanResourceFunc computes the resource name of the function execution span from the invocation's context and
+		// event, which is its json.RawMessage payload. For instance, returning the HTTP route of API Gateway events groups
+		// traces by endpoint. It falls back to the function name when nil or when it returns an empty string.
+		SpanResourceFunc func(ctx context.Context, event interface{}) string
+		// MetricFilter is called every time a metric is submitted, with the metric name and the tags it was submitted with.
+		// Returning false silently drops the metric. A nil MetricFilter keeps every metric.
+		// It may be called concurrently, and should be cheap to run.
+		MetricFilter func(name string, tags []string) bool
+		// FlushTimeout bounds the time spent flushing metrics at the end of each invocation, so a handler that used up
+		// most of its time fails fast rather than being frozen mid-flush. Defaults to no bound.
+		FlushTimeout time.Duration
+		// OnFlushError is called with the error whenever a batch of metrics fails to be sent to the API.
+		OnFlushError func(error)
+		// OnFlushSuccess is called with the number of series and points, and the size of the payload, of every batch of
+		// metrics sent to the API successfully. It is called from the goroutine sending the metrics.
+		OnFlushSuccess func(FlushStats)
+		// RollupDistributions pre-aggregates the points of each distribution metric that share a name and tags within a batch
+		// into `<metric>.min`, `<metric>.max`, `<metric>.avg` and `<metric>.sum` gauges, and a `<metric>.count` count whose
+		// interval is the batch interval, so its rate is per second. This reduces the payload size for high-volume metrics, at the cost of fidelity: percentiles can no longer be computed, and
+		// summaries from different containers can't be combined exactly. Only applies when sending metrics via the API.
+		RollupDistributions bool
+		// MaxBufferBytes sends the buffered metrics to the API as soon as their estimated size exceeds it, instead of
+		// waiting for the end of the batch interval. The estimate is rough. 0, the default, means no limit.
+		MaxBufferBytes int
+		// QueueCapacity is the number of metrics submitted that wait to be batched, which bounds the memory used by
+		// bursts of metrics. Once it's reached, QueuePolicy applies. Defaults to 2000.
+		// Only applies when sending metrics via the API.
+		QueueCapacity int
+		// QueuePolicy is what happens to the metrics submitted once the queue is full: QueuePolicyBlock, the default,
+		// makes the caller wait for room, while QueuePolicyDropNewest and QueuePolicyDropOldest drop a metric and count
+		// it in the datadog.lambda_go.queue_dropped metric, tagged with the function name.
+		QueuePolicy QueuePolicy
+		// FlushOnlyAtEnd sends the metrics once, synchronously, when the handler returns, instead of also sending them
+		// every BatchInterval from a background goroutine started for every invocation. It's recommended for the
+		// functions that run for less than a second, which return before the first BatchInterval anyway.
+		// AsyncFlush doesn't apply then, and it doesn't apply with PersistAcrossInvocations, which relies on the
+		// BatchInterval. Only applies when sending metrics via the API.
+		FlushOnlyAtEnd bool
+		// BeforeSubmit is called with every batch of metrics, aggregated and about to be sent, and returns the series to
+		// send instead, e.g. with a derived tag added, or without some series. Returning an empty slice sends nothing.
+		// Unlike MetricFilter, it sees the whole batch. The series are distributions, rolled up after the hook when
+		// RollupDistributions is set. Counts returned without an Interval get the batch interval.
+		// Only applies when sending metrics via the API.
+		BeforeSubmit func([]Series) []Series
+		// MaxTagsPerMetric caps the number of distinct tag combinations of the metrics it names, e.g. to protect against
+		// one metric tagged with a user ID. Within an invocation, once a metric reaches its cap, the points with a new
+		// tag combination are dropped with a warning, while the combinations seen already are still submitted.
+		// Only applies when sending metrics via the API.
+		MaxTagsPerMetric map[string]int
+		// DefaultMaxTagsPerMetric is the cap of the metrics missing from MaxTagsPerMetric. 0, the default, means no limit.
+		DefaultMaxTagsPerMetric int
+		// Aggregator replaces the default aggregation of the metrics submitted with Metric, which merges the points of
+		// a metric with the same tags. MaxBufferBytes, MaxTagsPerMetric, DefaultMaxTagsPerMetric and BeforeSubmit still
+		// apply to its series, and its Shutdown is only called with FlushOnShutdown. Only applies when sending metrics via
+		// the API.
+		Aggregator Aggregator
+		// PersistAcrossInvocations keeps batching the metrics sent to the API across invocations, instead of sending
+		// them at the end of every invocation. They are sent every BatchInterval, whatever the invocation boundaries,
+		// which saves a request per invocation for very short and frequent functions. The tradeoff is data loss: the
+		// metrics batched when the container is frozen or shut down, up to a BatchInterval of them, are only sent on
+		// the next invocation, and lost if there is none. Set FlushOnShutdown to send them on shutdown, on a best
+		// effort basis. It doesn't apply to the extension, statsd and the log forwarder.
+		PersistAcrossInvocations bool
+		// UseSketches aggregates the points of each distribution sent to the API into sketches, one per 10 seconds,
+		// and sends those instead. The payload no longer grows with the number of points, and the percentiles stay
+		// within 1% of the exact ones. It doesn't apply to the extension, statsd and the log forwarder.
+		UseSketches bool
+		// HealthMetrics sends the datadog.lambda_go.flush_success and datadog.lambda_go.flush_errors counts along with
+		// the metrics, tagged with the function name. The failed flushes are counted with the next successful one.
+		HealthMetrics bool
+		// RequestDecorator is called with each request submitting metrics to the Datadog API, right before it's sent.
+		// It runs after the API key is set, so it can add headers, change the URL or override the credentials.
+		RequestDecorator func(*http.Request)
+		// SeriesV2 sends the series other than distributions, like the ones of SubmitSeries and the rolled up
+		// distributions, to the v2 series intake, which attributes them to resources. Distributions aren't affected.
+		SeriesV2 bool
+		// MetricResources are the resources of the series sent to the v2 intake. They default to the lambda function,
+		// of type "aws.lambda" and named after its ARN.
+		MetricResources []MetricResource
+		// StatsdAddr is the "host:port" address of a DogStatsD server, like a statsd relay, that metrics are sent to over UDP.
+		// When set, it is used instead of the Datadog extension and of the API.
+		StatsdAddr string
+		// TagInvocationID adds an `invocation_id` tag to every metric, holding the AWS request ID of the invocation.
+		// This tag has a very high cardinality, so it should only be turned on for short debugging sessions,
+		// e.g. to find out whether metrics are submitted twice.
+		TagInvocationID bool
+		// AsyncFlush makes the flush of metrics to the API at the end of each invocation run in the background, so it doesn't
+		// add to the invocation's duration. Lambda can freeze the function as soon as the handler returns: the flush then
+		// resumes when the next invocation starts, which waits for it to complete first. The metrics are lost if the function
+		// is shut down while frozen, so this should only be used when eventual delivery is acceptable.
+		// It has no effect when metrics are sent to the extension or via the log forwarder.
+		AsyncFlush bool
+		// ContextTagExtractor returns tags to add to every metric of an invocation, e.g. from values stored in the context by
+		// a TraceContextExtractor. It is called with the context of the invocation, once, when its first metric is added.
+		ContextTagExtractor func(ctx context.Context) []string
+		// FlushOnShutdown installs a SIGTERM handler that flushes the metrics still buffered, e.g. by AsyncFlush, before the
+		// function is shut down, bounded by a short timeout. The handler is installed once, and removed by Shutdown.
+		FlushOnShutdown bool
+		// TruncateTags truncates the tags and metric names longer than the 200 characters allowed by Datadog, ending them
+		// with "...", instead of leaving it to the backend. If nil, it defaults to true.
+		TruncateTags *bool
+		// MaxTagsPerPoint caps the number of tags of each point, so one metric tagged with too many tags isn't rejected
+		// by Datadog. The tags are merged with DefaultTags first, then the ones past MaxTagsPerPoint are dropped.
+		// Defaults to 1000.
+		MaxTagsPerPoint int
+		// NormalizeTags lowercases the tag keys of metrics and removes the duplicate tags, before MetricFilter is called
+		// and the metrics are submitted, so `Env:Prod` and `env:Prod` are the same tag, like they are for Datadog.
+		// If nil, defaults to true.
+		NormalizeTags *bool
+		// NormalizeTagValues also lowercases the tag values, when NormalizeTags is on: `Env:Prod` becomes `env:prod`.
+		NormalizeTagValues bool
+		// DefaultTags are added to every metric. They are merged with the tags read from the DD_TAGS environment variable,
+		// which the Datadog extension applies itself when it is running.
+		DefaultTags []string
+		// TagRuntime tags every metric with the Go version and the architecture the function runs on, e.g.
+		// `runtime:go1.21.5` and `arch:arm64`, to compare them across Go upgrades and Graviton migrations.
+		TagRuntime bool
+		// Env is the environment the function runs in. It defaults to the value of the DD_ENV environment variable.
+		Env string
+		// SubmitInEnvs restricts the submission of metrics to the listed environments, matched against Env. Elsewhere,
+		// metrics are batched as usual, then dropped instead of being sent, so the same code runs in every environment
+		// without sending data from e.g. development. Metrics are submitted in every environment when it is empty.
+		SubmitInEnvs []string
 	}
 )
 
@@ -83,6 +292,12 @@ const (
 	DatadogAPIKeyEnvVar = "DD_API_KEY"
 	// DatadogKMSAPIKeyEnvVar is the environment variable that will be sent to KMS for decryption, then used as an API key.
 	DatadogKMSAPIKeyEnvVar = "DD_KMS_API_KEY"
+	// DatadogAPIKeySecretARNEnvVar is the environment variable holding the ARN of a Secrets Manager secret, whose value is used as an API key.
+	DatadogAPIKeySecretARNEnvVar = "DD_API_KEY_SECRET_ARN"
+	// DatadogAPIKeyFileEnvVar is the environment variable holding the path of a file, whose content is used as an API key.
+	DatadogAPIKeyFileEnvVar = "DD_API_KEY_FILE"
+	// DatadogAppKeyEnvVar is the environment variable that will be used to set the application key.
+	DatadogAppKeyEnvVar = "DD_APP_KEY"
 	// DatadogSiteEnvVar is the environment variable that will be used as the API host.
 	DatadogSiteEnvVar = "DD_SITE"
 	// LogLevelEnvVar is the environment variable that will be used to set the log level.
@@ -97,6 +312,24 @@ const (
 	UniversalInstrumentation = "DD_UNIVERSAL_INSTRUMENTATION"
 	// Initialize otel tracer provider if enabled
 	OtelTracerEnabled = "DD_TRACE_OTEL_ENABLED"
+	// CaptureHandlerErrorsEnvVar is the environment variable that controls whether handler errors are tagged on the function execution span.
+	CaptureHandlerErrorsEnvVar = "DD_CAPTURE_HANDLER_ERRORS"
+	// ServiceMappingEnvVar is the environment variable that renames services on spans, in the "from1:to1,from2:to2" format.
+	ServiceMappingEnvVar = "DD_SERVICE_MAPPING"
+	// DatadogEnvEnvVar is the environment variable holding the environment the function runs in.
+	DatadogEnvEnvVar = "DD_ENV"
+	// DatadogServiceEnvVar is the environment variable holding the service of the spans and logs.
+	DatadogServiceEnvVar = "DD_SERVICE"
+	// DatadogTagsEnvVar is the environment variable holding tags added to every metric, in the "key1:value1,key2:value2"
+	// or "key1:value1 key2:value2" format.
+	DatadogTagsEnvVar = "DD_TAGS"
+	// APIGatewaySpanTagsEnvVar is the environment variable that controls whether API Gateway request details are tagged on the function execution span.
+	APIGatewaySpanTagsEnvVar = "DD_TRACE_API_GATEWAY_TAGS"
+	// DisabledEnvVar is the environment variable that turns ddlambda off when true, see Config.Disabled.
+	DisabledEnvVar = "DD_LAMBDA_DISABLED"
+	// AWSRegionEnvVar and AWSDefaultRegionEnvVar hold the region of the function, see Config.Region.
+	AWSRegionEnvVar        = "AWS_REGION"
+	AWSDefaultRegionEnvVar = "AWS_DEFAULT_REGION"
 
 	// DefaultSite to send API messages to.
 	DefaultSite = "datadoghq.com"
@@ -108,6 +341,12 @@ const (
 	serverlessAppSecEnabledEnvVar = "DD_SERVERLESS_APPSEC_ENABLED"
 	// awsLambdaRuntimeApiEnvVar is the environment variable used to redirect AWS Lambda runtime API calls to the proxy.
 	awsLambdaRuntimeApiEnvVar = "AWS_LAMBDA_RUNTIME_API"
+	// enhancedMetricsEnvVar turns the enhanced metrics on or off, they are on by default.
+	enhancedMetricsEnvVar = "DD_ENHANCED_METRICS"
+	// localTestEnvVar makes the extension flush the metrics at the end of each invocation, for local tests.
+	localTestEnvVar = "DD_LOCAL_TEST"
+	// awsLambdaFunctionNameEnvVar is set by AWS Lambda in the environment of every function.
+	awsLambdaFunctionNameEnvVar = "AWS_LAMBDA_FUNCTION_NAME"
 	// datadogAgentUrl is the URL of the agent and proxy started by the Datadog lambda extension.
 	datadogAgentUrl = "127.0.0.1:9000"
 	// ddExtensionFilePath is the path on disk of the datadog lambda extension.
@@ -119,18 +358,32 @@ const (
 	awsLambdaServerPortEnvVar = "_LAMBDA_SERVER_PORT"
 )
 
+var (
+	// ErrMissingAPIKey is returned by WrapHandlerStrict when metrics are sent to the API, but no API key is configured.
+	ErrMissingAPIKey = errors.New("no Datadog API key configured")
+	// ErrInvalidSite is returned by WrapHandlerStrict when the Datadog site doesn't form a valid URL.
+	ErrInvalidSite = errors.New("invalid Datadog site")
+)
+
 // WrapLambdaHandlerInterface is used to instrument your lambda functions.
 // It returns a modified handler that can be passed directly to the lambda.StartHandler function from aws-lambda-go.
 func WrapLambdaHandlerInterface(handler lambda.Handler, cfg *Config) lambda.Handler {
-	setupAppSec()
+	if isDisabled(cfg) {
+		return handler
+	}
+	setupAppSec(loadEnvConfig(os.Getenv))
 	listeners := initializeListeners(cfg)
 	return wrapper.WrapHandlerInterfaceWithListeners(handler, listeners...)
 }
 
 // WrapFunction is used to instrument your lambda functions.
 // It returns a modified handler that can be passed directly to the lambda.Start function from aws-lambda-go.
+// Handlers that don't take a context are supported, functions like Metric then use the context of the current invocation.
 func WrapFunction(handler interface{}, cfg *Config) interface{} {
-	setupAppSec()
+	if isDisabled(cfg) {
+		return handler
+	}
+	setupAppSec(loadEnvConfig(os.Getenv))
 	listeners := initializeListeners(cfg)
 	return wrapper.WrapHandlerWithListeners(handler, listeners...)
 }
@@ -142,24 +395,245 @@ func WrapHandler(handler interface{}, cfg *Config) interface{} {
 	return WrapFunction(handler, cfg)
 }
 
+// WrapHandlerStrict is like WrapFunction, but returns an error instead of only logging it when cfg, completed from
+// the environment, can't work: ErrMissingAPIKey when metrics are sent to the API without an API key, and ErrInvalidSite
+// when the site is unparseable, or the error reading the CA certificates. It doesn't make any request, see Validate to check that the API key is valid.
+func WrapHandlerStrict(handler interface{}, cfg *Config) (interface{}, error) {
+	if isDisabled(cfg) {
+		return handler, nil
+	}
+	setupAppSec(loadEnvConfig(os.Getenv))
+	listeners, err := newListeners(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper.WrapHandlerWithListeners(handler, listeners...), nil
+}
+
 // GetTraceHeaders returns a map containing Datadog trace headers that reflect the
-// current X-Ray subsegment.
+// current X-Ray subsegment, or the trace continued with ExtractTraceContext.
 // Deprecated: use native Datadog tracing instead.
 func GetTraceHeaders(ctx context.Context) map[string]string {
-	result := trace.ConvertCurrentXrayTraceContext(ctx)
+	var result map[string]string
+	if extracted, ok := trace.ExtractedTraceContext(ctx); ok {
+		result = make(map[string]string, len(extracted))
+		for k, v := range extracted {
+			result[k] = v
+		}
+	} else {
+		result = trace.ConvertCurrentXrayTraceContext(ctx)
+	}
+	trace.ApplySamplingPriority(ctx, result)
+	trace.AddBaggageHeader(ctx, result)
 	return result
 }
 
+// listHeaders are the trace headers whose value is a comma-separated list, see GetTraceHTTPHeaders
+var listHeaders = []string{"tracestate", "baggage"}
+
+// GetTraceHTTPHeaders returns the headers of GetTraceHeaders as an http.Header, with canonical keys. The members of
+// the list headers, like the W3C `tracestate` and `baggage`, are separate values.
+// Deprecated: use native Datadog tracing instead.
+func GetTraceHTTPHeaders(ctx context.Context) http.Header {
+	headers := GetTraceHeaders(ctx)
+	result := make(http.Header, len(headers))
+	for key, value := range headers {
+		if !containsFold(listHeaders, key) {
+			result.Set(key, value)
+			continue
+		}
+		for _, member := range strings.Split(value, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				result.Add(key, member)
+			}
+		}
+	}
+	return result
+}
+
+// The sampling priorities of SetSamplingPriority
+const (
+	// PriorityUserReject drops the trace, as chosen by the user
+	PriorityUserReject = ext.PriorityUserReject
+	// PriorityAutoReject drops the trace, as chosen by the sampler
+	PriorityAutoReject = ext.PriorityAutoReject
+	// PriorityAutoKeep keeps the trace, as chosen by the sampler
+	PriorityAutoKeep = ext.PriorityAutoKeep
+	// PriorityUserKeep keeps the trace, as chosen by the user
+	PriorityUserKeep = ext.PriorityUserKeep
+)
+
+// SetSamplingPriority overrides the sampling decision of the trace of the invocation, e.g. to keep the trace of a
+// request that hit an error path with PriorityUserKeep. The priority is set on the span of ctx, or else on the function
+// execution span, and GetTraceHeaders, AddTraceHeaders and TraceContext return it for the rest of the invocation.
+func SetSamplingPriority(ctx context.Context, priority int) {
+	if !trace.SetSamplingPriority(ctx, priority) {
+		logger.Debug("the sampling priority is only set on the span, the context isn't the context of an invocation")
+	}
+}
+
+// ExtractTraceContext returns a copy of ctx continuing the trace described by headers, for events whose trace headers
+// aren't found by the wrapper, e.g. messages of a batch. GetTraceHeaders and TraceContext then return that trace.
+// Datadog headers are read first, then W3C trace context and B3 ones. ctx is returned unchanged when there is none.
+func ExtractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	newCtx, ok := trace.ContextWithTraceHeaders(ctx, headers)
+	if !ok {
+		logger.Debug("no valid trace context found in headers")
+	}
+	return newCtx
+}
+
+// NewTestTraceContext returns a context continuing the trace traceID from the span parentID, with the sampling
+// priority priority, e.g. PriorityUserKeep. It's meant for testing the headers added by GetTraceHeaders and
+// AddTraceHeaders with known values, without wrapping a handler.
+func NewTestTraceContext(traceID, parentID uint64, priority int) context.Context {
+	return ExtractTraceContext(context.Background(), map[string]string{
+		tracer.DefaultTraceIDHeader:  strconv.FormatUint(traceID, 10),
+		tracer.DefaultParentIDHeader: strconv.FormatUint(parentID, 10),
+		tracer.DefaultPriorityHeader: strconv.Itoa(priority),
+	})
+}
+
+// DefaultWarmupEventDetector recognizes the keep-warm events of lambda-warmer, {"warmer": true}, and of
+// serverless-plugin-warmup, {"source": "serverless-plugin-warmup"}. The event must be a json.RawMessage.
+func DefaultWarmupEventDetector(event interface{}) bool {
+	msg, ok := event.(json.RawMessage)
+	return ok && wrapper.IsWarmupEvent(msg)
+}
+
+// IsColdStart returns true when ctx is the context of the first invocation of the container, as tagged by the
+// cold_start tag of the enhanced metrics and of the function execution span. It is false after that invocation, and
+// outside of a wrapped handler.
+func IsColdStart(ctx context.Context) bool {
+	return wrapper.IsColdStart(ctx)
+}
+
+// IsLambdaEnvironment returns true when running in AWS Lambda, false e.g. when a wrapped handler is invoked by a local
+// process. Outside Lambda, custom metrics are sent as usual, but enhanced metrics aren't, and the wrapper doesn't try
+// to continue an X-Ray trace.
+func IsLambdaEnvironment() bool {
+	return loadEnvConfig(os.Getenv).FunctionName != ""
+}
+
+// DetachedContext returns a context carrying the values of ctx, like its trace context and metrics listener, but not
+// its deadline nor its cancellation, for work that outlives the handler, e.g. a goroutine started without waiting for it.
+// The function execution span and the metrics of the invocation are flushed when the handler returns, after which the
+// lambda can be frozen at any time: the metrics submitted through the detached context once the handler returned are
+// sent with the metrics of the next invocation, and lost if there's none, and the spans started from it are children
+// of a finished span, sent with a later flush if any.
+func DetachedContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// BackgroundContext returns a context derived from context.Background, carrying the trace context and metrics
+// listener of the current invocation, for a goroutine outliving the handler that doesn't have the handler's context.
+// It must be called during the invocation, before starting the goroutine, and returns context.Background outside of
+// one. Use the handler's context for work finished before the handler returns, and DetachedContext to detach a
+// context at hand: like DetachedContext, the metrics submitted once the handler returned are sent with the next
+// invocation.
+func BackgroundContext() context.Context {
+	ctx := GetContext()
+	if ctx == nil {
+		return context.Background()
+	}
+	return DetachedContext(ctx)
+}
+
+// DatadogTraceContext is a Datadog trace context, in a structured form.
+type DatadogTraceContext struct {
+	TraceID  uint64
+	ParentID uint64
+	// SamplingPriority is the sampling decision of the trace, e.g. 1 to keep it or 2 when the user chose to.
+	SamplingPriority int
+}
+
+// TraceContext returns the Datadog trace context of ctx: the incoming trace the invocation continues, or the
+// one converted from the current X-Ray subsegment like GetTraceHeaders does. It returns false when there is none.
+func TraceContext(ctx context.Context) (DatadogTraceContext, bool) {
+	headers, ok := trace.ExtractedTraceContext(ctx)
+	if !ok {
+		headers, ok = trace.RootTraceContext(ctx)
+	}
+	if !ok {
+		headers = trace.ConvertCurrentXrayTraceContext(ctx)
+	}
+	if _, overridden := trace.SamplingPriority(ctx); overridden {
+		copied := make(map[string]string, len(headers))
+		for k, v := range headers {
+			copied[k] = v
+		}
+		headers = copied
+		trace.ApplySamplingPriority(ctx, headers)
+	}
+	return parseTraceContext(headers)
+}
+
+func parseTraceContext(headers map[string]string) (DatadogTraceContext, bool) {
+	traceID, err := strconv.ParseUint(headers[tracer.DefaultTraceIDHeader], 10, 64)
+	if err != nil {
+		return DatadogTraceContext{}, false
+	}
+	parentID, err := strconv.ParseUint(headers[tracer.DefaultParentIDHeader], 10, 64)
+	if err != nil {
+		return DatadogTraceContext{}, false
+	}
+	samplingPriority, err := strconv.Atoi(headers[tracer.DefaultPriorityHeader])
+	if err != nil {
+		samplingPriority = 1 // sampler-keep, like for incoming traces without a sampling priority
+	}
+	return DatadogTraceContext{TraceID: traceID, ParentID: parentID, SamplingPriority: samplingPriority}, true
+}
+
+// SpanContext returns the dd-trace-go span context of ctx, to parent the spans started with dd-trace-go directly, e.g.
+// by shared libraries, that aren't given ctx: the context of the span of ctx, like the function execution span, or
+// else the one of the trace returned by TraceContext. It returns nil when ctx has neither.
+func SpanContext(ctx context.Context) ddtrace.SpanContext {
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		return span.Context()
+	}
+	traceContext, ok := TraceContext(ctx)
+	if !ok {
+		return nil
+	}
+	spanCtx, err := trace.ConvertTraceContextToSpanContext(trace.TraceContext{
+		tracer.DefaultTraceIDHeader:  strconv.FormatUint(traceContext.TraceID, 10),
+		tracer.DefaultParentIDHeader: strconv.FormatUint(traceContext.ParentID, 10),
+		tracer.DefaultPriorityHeader: strconv.Itoa(traceContext.SamplingPriority),
+	})
+	if err != nil {
+		return nil
+	}
+	return spanCtx
+}
+
 // AddTraceHeaders adds Datadog trace headers to a HTTP Request reflecting the current X-Ray
-// subsegment.
+// subsegment. Trace headers already on the request are replaced, so a request can be reused.
+// The headers of Config.PropagateHeaders captured from the incoming event are added too.
 // Deprecated: use native Datadog tracing instead.
 func AddTraceHeaders(ctx context.Context, req *http.Request) {
-	headers := trace.ConvertCurrentXrayTraceContext(ctx)
+	headers := GetTraceHeaders(ctx)
 	for key, value := range headers {
-		req.Header.Add(key, value)
+		req.Header.Set(key, value)
+	}
+	for key, value := range trace.PropagatedHeaders(ctx) {
+		req.Header.Set(key, value)
 	}
 }
 
+// WithBaggage returns a copy of ctx carrying the baggage item key=value.
+// The item is set as a tag on the function execution span and on every span created by StartSpan with the
+// returned context (or a context derived from it), and is propagated in the W3C `baggage` header by
+// GetTraceHeaders and AddTraceHeaders.
+func WithBaggage(ctx context.Context, key, value string) context.Context {
+	return trace.ContextWithBaggage(ctx, key, value)
+}
+
+// StartSpan starts a new span as a child of the span in ctx, tagged with the baggage items set with WithBaggage.
+// It returns the span, and a context containing it, to be used to create child spans.
+func StartSpan(ctx context.Context, operationName string, opts ...tracer.StartSpanOption) (tracer.Span, context.Context) {
+	return trace.StartSpanFromContext(ctx, operationName, opts...)
+}
+
 // GetContext retrieves the last created lambda context.
 // Only use this if you aren't manually passing context through your call hierarchy.
 func GetContext() context.Context {
@@ -174,29 +648,440 @@ func Distribution(metric string, value float64, tags ...string) {
 
 // Metric sends a distribution metric to DataDog
 func Metric(metric string, value float64, tags ...string) {
-	MetricWithTimestamp(metric, value, time.Now(), tags...)
+	if isDisabled(nil) {
+		return
+	}
+	if listener := getCurrentMetricsListener(); listener != nil {
+		listener.AddDistributionMetric(metric, value, listener.Now(), false, tags...)
+	}
 }
 
 // MetricWithTimestamp sends a distribution metric to DataDog with a custom timestamp
 func MetricWithTimestamp(metric string, value float64, timestamp time.Time, tags ...string) {
-	ctx := GetContext()
+	if isDisabled(nil) {
+		return
+	}
+	if listener := getCurrentMetricsListener(); listener != nil {
+		listener.AddDistributionMetric(metric, value, timestamp, false, tags...)
+	}
+}
+
+// WithMetricTags returns a copy of ctx carrying tags, which are added to the metrics submitted with DistributionCtx or
+// DistributionSync using the returned context, or a context derived from it. ctx itself is left unchanged, so the tags
+// can be scoped, e.g. to one iteration of a loop.
+func WithMetricTags(ctx context.Context, tags ...string) context.Context {
+	return metrics.ContextWithTags(ctx, tags...)
+}
 
+// DistributionCtx sends a distribution metric to Datadog, tagged with tags and with the tags added to ctx by WithMetricTags.
+// If ctx is nil, the last created lambda context is used.
+func DistributionCtx(ctx context.Context, metric string, value float64, tags ...string) {
+	if isDisabled(nil) {
+		return
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
 	if ctx == nil {
 		logger.Debug("no context available, did you wrap your handler?")
 		return
 	}
 
 	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
+		return
+	}
+	listener.AddDistributionMetric(metric, value, listener.Now(), false, withContextTags(ctx, tags)...)
+}
+
+// DistributionBatch sends the values as points of a distribution metric, like calling DistributionCtx with each of
+// them, but with the tags merged once and the points batched together, which is faster for many values.
+// If ctx is nil, the last created lambda context is used.
+func DistributionBatch(ctx context.Context, metric string, values []float64, tags ...string) {
+	if isDisabled(nil) {
+		return
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		logger.Debug("no context available, did you wrap your handler?")
+		return
+	}
+
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
+		return
+	}
+	listener.AddDistributionMetrics(metric, values, listener.Now(), false, withContextTags(ctx, tags)...)
+}
+
+// withContextTags returns tags, with the tags added to ctx by WithMetricTags
+func withContextTags(ctx context.Context, tags []string) []string {
+	contextTags := metrics.TagsFromContext(ctx)
+	if len(contextTags) == 0 {
+		return tags
+	}
+	result := make([]string, 0, len(tags)+len(contextTags))
+	result = append(result, tags...)
+	return append(result, contextTags...)
+}
+
+func getCurrentMetricsListener() *metrics.Listener {
+	ctx := GetContext()
+
+	if ctx == nil {
+		logger.Debug("no context available, did you wrap your handler?")
+		return nil
+	}
+
+	listener := metrics.GetListener(ctx)
+
+	if listener == nil {
+		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
+	}
+	return listener
+}
+
+// DistributionSync sends a distribution metric to Datadog straight away, instead of batching it with the other metrics,
+// and returns the error if it couldn't be sent. Sending a metric this way costs a request, and waiting for it to complete,
+// so it should be reserved for a few critical metrics, which need to be sent even if the function is stopped right after.
+// Like DistributionCtx, it adds the tags added to ctx by WithMetricTags. If ctx is nil, the last created lambda context is used.
+func DistributionSync(ctx context.Context, metric string, value float64, tags ...string) error {
+	if isDisabled(nil) {
+		return nil
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		return errors.New("no context available, did you wrap your handler?")
+	}
+
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		return errors.New("couldn't get metrics listener from current context")
+	}
+	return listener.AddDistributionMetricSync(metric, value, listener.Now(), withContextTags(ctx, tags)...)
+}
+
+// PendingFlush is a flush started by FlushAsync.
+type PendingFlush struct {
+	done chan struct{}
+	err  error
+}
+
+// Wait blocks until the flush completes, and returns its error, if any.
+func (f *PendingFlush) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// FlushAsync starts sending the metrics submitted so far during the invocation in a goroutine, and returns straight
+// away, so the flush overlaps with other work, e.g. some cleanup done before returning from the handler. The flush
+// stops when ctx is done. The metrics submitted after it are sent as usual when the handler returns.
+// If ctx is nil, the last created lambda context is used.
+func FlushAsync(ctx context.Context) *PendingFlush {
+	f := &PendingFlush{done: make(chan struct{})}
+	if isDisabled(nil) {
+		close(f.done)
+		return f
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		f.err = errors.New("no context available, did you wrap your handler?")
+		close(f.done)
+		return f
+	}
 
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		f.err = errors.New("couldn't get metrics listener from current context")
+		close(f.done)
+		return f
+	}
+	go func() {
+		defer close(f.done)
+		f.err = listener.Flush(ctx)
+	}()
+	return f
+}
+
+// QueuePolicy is what happens to a metric submitted when the queue of the metrics waiting to be batched is full,
+// see Config.QueuePolicy
+type QueuePolicy = metrics.QueuePolicy
+
+// The policies of Config.QueuePolicy
+const (
+	// QueuePolicyBlock makes the caller wait until there is room in the queue
+	QueuePolicyBlock = metrics.QueuePolicyBlock
+	// QueuePolicyDropNewest drops the metric being submitted
+	QueuePolicyDropNewest = metrics.QueuePolicyDropNewest
+	// QueuePolicyDropOldest drops the oldest metric of the queue, to make room for the one being submitted
+	QueuePolicyDropOldest = metrics.QueuePolicyDropOldest
+)
+
+// FlushStats describes a batch of metrics sent to the API: the number of series, of points across these series, and
+// the size in bytes of the payload.
+type FlushStats = metrics.FlushStats
+
+// Metrics is a handle for submitting metrics during an invocation, obtained with MetricsHandle.
+// It avoids looking up the metrics listener in the context on every call, which makes it
+// a better fit than Metric for submitting metrics in hot loops.
+type Metrics struct {
+	listener *metrics.Listener
+}
+
+// MetricsHandle returns a handle for submitting metrics to the listener of the invocation ctx belongs to.
+// If ctx is nil, the last created lambda context is used. The handle should not be used after the invocation ends.
+func MetricsHandle(ctx context.Context) Metrics {
+	if isDisabled(nil) {
+		return Metrics{}
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		logger.Debug("no context available, did you wrap your handler?")
+		return Metrics{}
+	}
+
+	listener := metrics.GetListener(ctx)
 	if listener == nil {
 		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
+	}
+	return Metrics{listener: listener}
+}
+
+// Distribution sends a distribution metric to Datadog
+func (m Metrics) Distribution(metric string, value float64, tags ...string) {
+	if m.listener == nil {
 		return
 	}
-	listener.AddDistributionMetric(metric, value, timestamp, false, tags...)
+	m.listener.AddDistributionMetric(metric, value, m.listener.Now(), false, tags...)
+}
+
+// DistributionWithTimestamp sends a distribution metric to Datadog with a custom timestamp
+func (m Metrics) DistributionWithTimestamp(metric string, value float64, timestamp time.Time, tags ...string) {
+	if m.listener == nil {
+		return
+	}
+	m.listener.AddDistributionMetric(metric, value, timestamp, false, tags...)
+}
+
+// Series is a metric aggregated by the caller, that can be submitted with SubmitSeries.
+type Series struct {
+	// Metric is the name of the metric.
+	Metric string
+	// Type is the type of the metric, one of "distribution", "gauge" or "count".
+	Type string
+	// Tags are the tags of the metric, in the "key:value" format.
+	Tags []string
+	// Host is the host the metric is reported for. It is optional.
+	Host string
+	// Interval is the interval the points were aggregated over. It is optional, and only used for counts.
+	Interval time.Duration
+	// Points are the datapoints of the metric.
+	Points []SeriesPoint
+	// Resources are the entities the series is attributed to when Config.SeriesV2 is set, Config.MetricResources when empty.
+	Resources []MetricResource
+}
+
+// Aggregator aggregates the metrics submitted with Metric between two flushes, see Config.Aggregator. Its methods are
+// called from the goroutine sending the metrics, one at a time.
+type Aggregator interface {
+	// Add adds a distribution submitted with Metric, as a series of its points
+	Add(series Series)
+	// Flush returns the series to send, and starts a new batch
+	Flush() []Series
+	// Shutdown is called once the function shuts down, after the last flush. It is only called by the SIGTERM handler
+	// of Config.FlushOnShutdown.
+	Shutdown()
+}
+
+// aggregatorAdapter adapts a Config.Aggregator to the internal series
+type aggregatorAdapter struct {
+	aggregator Aggregator
+}
+
+func (a aggregatorAdapter) Add(series metrics.Series) {
+	a.aggregator.Add(seriesFromInternal(series))
+}
+
+func (a aggregatorAdapter) Flush() []metrics.Series {
+	series := a.aggregator.Flush()
+	result := make([]metrics.Series, len(series))
+	for i := range series {
+		result[i] = series[i].toInternal()
+	}
+	return result
+}
+
+func (a aggregatorAdapter) Shutdown() {
+	a.aggregator.Shutdown()
+}
+
+// SpanData describes a finished span, see Config.OnSpanFinish.
+type SpanData = trace.SpanData
+
+// MetricResource is an entity a series sent to the v2 intake is attributed to, e.g. {Type: "aws.lambda", Name: <ARN>}.
+type MetricResource = metrics.Resource
+
+// SeriesPoint is a datapoint of a Series.
+type SeriesPoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+func (s *Series) toInternal() metrics.Series {
+	points := make([]metrics.MetricValue, len(s.Points))
+	for i, point := range s.Points {
+		points[i] = metrics.MetricValue{Timestamp: point.Timestamp, Value: point.Value}
+	}
+	var host *string
+	if s.Host != "" {
+		host = &s.Host
+	}
+	return metrics.Series{
+		Name:      s.Metric,
+		Type:      metrics.MetricType(s.Type),
+		Tags:      s.Tags,
+		Host:      host,
+		Interval:  s.Interval.Seconds(),
+		Points:    points,
+		Resources: s.Resources,
+	}
+}
+
+func seriesFromInternal(s metrics.Series) Series {
+	points := make([]SeriesPoint, len(s.Points))
+	for i, point := range s.Points {
+		points[i] = SeriesPoint{Timestamp: point.Timestamp, Value: point.Value}
+	}
+	host := ""
+	if s.Host != nil {
+		host = *s.Host
+	}
+	return Series{
+		Metric:    s.Name,
+		Type:      string(s.Type),
+		Tags:      s.Tags,
+		Host:      host,
+		Interval:  time.Duration(s.Interval * float64(time.Second)),
+		Points:    points,
+		Resources: s.Resources,
+	}
+}
+
+// beforeSubmitHook adapts a Config.BeforeSubmit hook to the internal series
+func beforeSubmitHook(hook func([]Series) []Series) func([]metrics.Series) []metrics.Series {
+	return func(batch []metrics.Series) []metrics.Series {
+		series := make([]Series, len(batch))
+		for i, s := range batch {
+			series[i] = seriesFromInternal(s)
+		}
+		series = hook(series)
+		result := make([]metrics.Series, len(series))
+		for i := range series {
+			result[i] = series[i].toInternal()
+		}
+		return result
+	}
+}
+
+// SubmitSeries sends series aggregated by the caller to Datadog straight away, bypassing the aggregation done for Metric.
+// The series are validated first, and nothing is sent if any of them is malformed.
+// If ctx is nil, the last created lambda context is used.
+func SubmitSeries(ctx context.Context, series []Series) error {
+	if isDisabled(nil) {
+		return nil
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		return errors.New("no context available, did you wrap your handler?")
+	}
+
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		return errors.New("couldn't get metrics listener from current context")
+	}
+
+	converted := make([]metrics.Series, len(series))
+	for i := range series {
+		converted[i] = series[i].toInternal()
+	}
+	return listener.SubmitSeries(converted)
+}
+
+// SetDistributionPercentiles requests the percentiles of a distribution metric to be turned on, sparing configuring them
+// in the Datadog UI. The configuration is sent once per container, at the end of the first invocation submitting the
+// metric, using the tag configuration API. This requires Config.ApplicationKey, and an API key the library can use.
+// Datadog computes p50, p75, p90, p95 and p99 together, percentiles lists the ones needed, which must be among those.
+func SetDistributionPercentiles(metric string, percentiles ...int) error {
+	if isDisabled(nil) {
+		return nil
+	}
+	return metrics.SetDistributionPercentiles(metric, percentiles)
+}
+
+// ResolvedMetricsURL returns the URL distribution metrics are posted to when sent to the API, resolved from cfg and the
+// environment like when wrapping a handler, e.g. to log it at startup. It doesn't include the API key.
+func ResolvedMetricsURL(cfg *Config) string {
+	site := ""
+	if cfg != nil {
+		site = cfg.Site
+	}
+	if site == "" {
+		site = loadEnvConfig(os.Getenv).Site
+	}
+	return metrics.DistributionsURL(resolveMetricsSiteURL(site))
+}
+
+// Validate checks that cfg, completed from the environment like it is when wrapping a handler, has a valid API key for its site.
+// It makes a single request to the Datadog API, and doesn't submit any metrics, so it can be used in smoke tests.
+func Validate(cfg *Config) error {
+	if isDisabled(cfg) {
+		return nil
+	}
+	mc := cfg.toMetricsConfig(false)
+	return metrics.ValidateConfig(context.Background(), mc)
+}
+
+// Log sends a structured log event to the Datadog logs intake, with the attributes added to it.
+// The event is correlated with the span held by ctx. Events are sent when the invocation finishes,
+// or written to stdout straight away when using the log forwarder.
+func Log(ctx context.Context, level, message string, attributes map[string]interface{}) {
+	if isDisabled(nil) {
+		return
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		logger.Debug("no context available, did you wrap your handler?")
+		return
+	}
+
+	listener := logs.GetListener(ctx)
+	if listener == nil {
+		logger.Error(fmt.Errorf("couldn't get logs listener from current context"))
+		return
+	}
+	listener.AddLog(ctx, level, message, attributes)
 }
 
 // InvokeDryRun is a utility to easily run your lambda for testing
 func InvokeDryRun(callback func(ctx context.Context), cfg *Config) (interface{}, error) {
+	if isDisabled(cfg) {
+		callback(context.Background())
+		return nil, nil
+	}
 	wrapped := WrapHandler(callback, cfg)
 	// Convert the wrapped handler to it's underlying raw handler type
 	handler, ok := wrapped.(func(ctx context.Context, msg json.RawMessage) (interface{}, error))
@@ -206,12 +1091,98 @@ func InvokeDryRun(callback func(ctx context.Context), cfg *Config) (interface{},
 	return handler(context.Background(), json.RawMessage("{}"))
 }
 
+// ResolvedConfig is the configuration ddlambda runs with, once the environment and defaults are applied to a Config.
+// It is meant for logging and debugging, so the API key is redacted.
+type ResolvedConfig struct {
+	// Site is the URL metrics are sent to when using the API.
+	Site string
+	// LogsSite is the URL logs are sent to when using the API.
+	LogsSite string
+	// APIKey is the redacted API key, or the ARN of the secret holding it. It is empty when no API key is configured.
+	APIKey string
+	// APIKeySource is where the API key is read from, e.g. "Config.APIKey" or "DD_API_KEY". It is empty when no API key is configured.
+	APIKeySource          string
+	BatchInterval         time.Duration
+	FlushJitter           time.Duration
+	HTTPClientTimeout     time.Duration
+	FlushTimeout          time.Duration
+	ShouldRetryOnFailure  bool
+	ShouldUseLogForwarder bool
+	EnhancedMetrics       bool
+	RollupDistributions   bool
+	TruncateTags          bool
+	NormalizeTags         bool
+	DefaultTags           []string
+	DiscardMetrics        bool
+	StatsdAddr            string
+	// Disabled is true when ddlambda is turned off, see Config.Disabled.
+	Disabled                 bool
+	DDTraceEnabled           bool
+	MergeXrayTraces          bool
+	UniversalInstrumentation bool
+	OtelTracerEnabled        bool
+	CaptureHandlerErrors     bool
+	APIGatewaySpanTags       bool
+	ServiceMapping           map[string]string
+}
+
+// ResolveConfig returns the configuration a handler wrapped with cfg would run with, without wrapping a handler.
+func ResolveConfig(cfg *Config) ResolvedConfig {
+	env := loadEnvConfig(os.Getenv)
+	mc, apiKeySource := cfg.toMetricsConfigWithEnv(env, false)
+	mc = mc.WithDefaults()
+	tc := cfg.toTraceConfigWithEnv(env)
+
+	apiKey := logger.Mask(mc.APIKey)
+	if mc.KMSAPIKey != "" {
+		apiKey = logger.Mask(mc.KMSAPIKey)
+	} else if mc.APIKeySecretARN != "" {
+		// The ARN isn't a secret, and is more useful to debug with than a redacted value.
+		apiKey = mc.APIKeySecretARN
+	}
+
+	return ResolvedConfig{
+		Site:                     mc.Site,
+		LogsSite:                 cfg.toLogsConfig(mc, env).Site,
+		APIKey:                   apiKey,
+		APIKeySource:             apiKeySource,
+		BatchInterval:            mc.BatchInterval,
+		FlushJitter:              mc.FlushJitter,
+		HTTPClientTimeout:        mc.HTTPClientTimeout,
+		FlushTimeout:             mc.FlushTimeout,
+		ShouldRetryOnFailure:     mc.ShouldRetryOnFailure,
+		ShouldUseLogForwarder:    mc.ShouldUseLogForwarder,
+		EnhancedMetrics:          mc.EnhancedMetrics,
+		RollupDistributions:      mc.RollupDistributions,
+		TruncateTags:             mc.TruncateTags,
+		NormalizeTags:            mc.NormalizeTags,
+		DefaultTags:              mc.DefaultTags,
+		DiscardMetrics:           mc.DiscardMetrics,
+		StatsdAddr:               mc.StatsdAddr,
+		Disabled:                 (cfg != nil && cfg.Disabled) || env.Disabled,
+		DDTraceEnabled:           tc.DDTraceEnabled,
+		MergeXrayTraces:          tc.MergeXrayTraces,
+		UniversalInstrumentation: tc.UniversalInstrumentation,
+		OtelTracerEnabled:        tc.OtelTracerEnabled,
+		CaptureHandlerErrors:     tc.CaptureHandlerErrors,
+		APIGatewaySpanTags:       tc.APIGatewaySpanTags,
+		ServiceMapping:           tc.ServiceMapping,
+	}
+}
+
 func (cfg *Config) toTraceConfig() trace.Config {
+	return cfg.toTraceConfigWithEnv(loadEnvConfig(os.Getenv))
+}
+
+// toTraceConfigWithEnv merges cfg over the settings read from the environment
+func (cfg *Config) toTraceConfigWithEnv(env envConfig) trace.Config {
 	traceConfig := trace.Config{
 		DDTraceEnabled:           true,
 		MergeXrayTraces:          false,
 		UniversalInstrumentation: true,
 		OtelTracerEnabled:        false,
+		CaptureHandlerErrors:     true,
+		APIGatewaySpanTags:       true,
 	}
 
 	if cfg != nil {
@@ -219,125 +1190,443 @@ func (cfg *Config) toTraceConfig() trace.Config {
 		traceConfig.MergeXrayTraces = cfg.MergeXrayTraces
 		traceConfig.TraceContextExtractor = cfg.TraceContextExtractor
 		traceConfig.TracerOptions = cfg.TracerOptions
+		traceConfig.IDGenerator = cfg.SpanIDGenerator
+		traceConfig.SpanResourceFunc = cfg.SpanResourceFunc
+		traceConfig.PropagateHeaders = cfg.PropagateHeaders
+		traceConfig.TagFunctionVersion = cfg.TagFunctionVersion
+		traceConfig.OnSpanFinish = cfg.OnSpanFinish
+		traceConfig.PropagationStyleExtract = cfg.PropagationStyleExtract
+		traceConfig.IgnoreInvocation = trace.MakeInvocationFilter(cfg.IgnoreResources, cfg.SpanResourceFunc)
+	}
+	traceConfig.OutsideLambda = env.FunctionName == ""
+	traceConfig.Service = env.Service
+
+	if cfg != nil && cfg.CaptureHandlerErrors != nil {
+		traceConfig.CaptureHandlerErrors = *cfg.CaptureHandlerErrors
+	} else if env.CaptureHandlerErrors != nil {
+		traceConfig.CaptureHandlerErrors = *env.CaptureHandlerErrors
+	}
+
+	if cfg != nil && cfg.APIGatewaySpanTags != nil {
+		traceConfig.APIGatewaySpanTags = *cfg.APIGatewaySpanTags
+	} else if env.APIGatewaySpanTags != nil {
+		traceConfig.APIGatewaySpanTags = *env.APIGatewaySpanTags
+	}
+
+	serviceMapping := make(map[string]string, len(env.ServiceMapping))
+	for from, to := range env.ServiceMapping {
+		serviceMapping[from] = to
+	}
+	if cfg != nil {
+		for from, to := range cfg.ServiceMapping {
+			serviceMapping[from] = to
+		}
+	}
+	if len(serviceMapping) > 0 {
+		traceConfig.ServiceMapping = serviceMapping
 	}
 
 	if traceConfig.TraceContextExtractor == nil {
 		traceConfig.TraceContextExtractor = trace.DefaultTraceExtractor
 	}
 
-	if tracingEnabled, err := strconv.ParseBool(os.Getenv(DatadogTraceEnabledEnvVar)); err == nil {
-		traceConfig.DDTraceEnabled = tracingEnabled
+	if env.TraceEnabled != nil {
+		traceConfig.DDTraceEnabled = *env.TraceEnabled
 		// Only read the OTEL env var if DD tracing is disabled
-		if tracingEnabled {
-			if otelTracerEnabled, err := strconv.ParseBool(os.Getenv(OtelTracerEnabled)); err == nil {
-				traceConfig.OtelTracerEnabled = otelTracerEnabled
-			}
+		if *env.TraceEnabled && env.OtelTracerEnabled != nil {
+			traceConfig.OtelTracerEnabled = *env.OtelTracerEnabled
 		}
 	}
 
 	if !traceConfig.MergeXrayTraces {
-		traceConfig.MergeXrayTraces, _ = strconv.ParseBool(os.Getenv(MergeXrayTracesEnvVar))
+		traceConfig.MergeXrayTraces = env.MergeXrayTraces
 	}
 
-	if universalInstrumentation, err := strconv.ParseBool(os.Getenv(UniversalInstrumentation)); err == nil {
-		traceConfig.UniversalInstrumentation = universalInstrumentation
+	if env.UniversalInstrumentation != nil {
+		traceConfig.UniversalInstrumentation = *env.UniversalInstrumentation
 	}
 
 	return traceConfig
 }
 
 func initializeListeners(cfg *Config) []wrapper.HandlerListener {
-	logLevel := os.Getenv(LogLevelEnvVar)
-	if strings.EqualFold(logLevel, "debug") || (cfg != nil && cfg.DebugLogging) {
+	listeners, _ := newListeners(cfg, false)
+	return listeners
+}
+
+// newListeners builds the listeners of the wrapped handlers, it's replaced in tests
+var newListeners = buildListeners
+
+// disabledByEnv reports whether DD_LAMBDA_DISABLED turns ddlambda off, it's read once per process
+var disabledByEnv = sync.OnceValue(readDisabledEnv)
+
+func readDisabledEnv() bool {
+	return loadEnvConfig(os.Getenv).Disabled
+}
+
+// isDisabled reports whether ddlambda is turned off, by cfg or DD_LAMBDA_DISABLED
+func isDisabled(cfg *Config) bool {
+	return (cfg != nil && cfg.Disabled) || disabledByEnv()
+}
+
+// buildListeners creates the listeners for cfg. When strict is true, it returns an error instead of the listeners
+// if the configuration can't work, see checkConfig.
+func buildListeners(cfg *Config, strict bool) ([]wrapper.HandlerListener, error) {
+	env := loadEnvConfig(os.Getenv)
+	if strings.EqualFold(env.LogLevel, "debug") || (cfg != nil && cfg.DebugLogging) {
 		logger.SetLogLevel(logger.LevelDebug)
 	}
-	traceConfig := cfg.toTraceConfig()
+	if cfg != nil {
+		logger.SetErrorInterval(cfg.LogErrorInterval)
+	}
+	traceConfig := cfg.toTraceConfigWithEnv(env)
 	extensionManager := extension.BuildExtensionManager(traceConfig.UniversalInstrumentation)
 	isExtensionRunning := extensionManager.IsExtensionRunning()
-	metricsConfig := cfg.toMetricsConfig(isExtensionRunning)
+	metricsConfig, _ := cfg.toMetricsConfigWithEnv(env, isExtensionRunning)
+	if strict {
+		if err := checkConfig(metricsConfig, isExtensionRunning); err != nil {
+			return nil, err
+		}
+	}
 
 	// Wrap the handler with listeners that add instrumentation for traces and metrics.
 	tl := trace.MakeListener(traceConfig, extensionManager)
 	ml := metrics.MakeListener(metricsConfig, extensionManager)
-	return []wrapper.HandlerListener{
-		&tl, &ml,
+	ll := logs.MakeListener(cfg.toLogsConfig(metricsConfig, env))
+	if cfg != nil && cfg.FlushOnShutdown {
+		installShutdownHandler(&ml)
+	}
+	listeners := []wrapper.HandlerListener{&tl, &ml, &ll}
+	isWarmupEvent := DefaultWarmupEventDetector
+	if cfg != nil && cfg.WarmupEventDetector != nil {
+		isWarmupEvent = cfg.WarmupEventDetector
+	}
+	if cfg != nil && len(cfg.NonErroringErrors) > 0 {
+		listeners = []wrapper.HandlerListener{wrapper.IgnoreErrors(cfg.isNonErroringError, listeners...)}
 	}
+	skip := func(msg json.RawMessage) bool { return isWarmupEvent(msg) }
+	return []wrapper.HandlerListener{wrapper.SkipInvocations(skip, listeners...)}, nil
+}
+
+// isNonErroringError returns true when err matches one of cfg.NonErroringErrors
+func (cfg *Config) isNonErroringError(err error) bool {
+	for _, target := range cfg.NonErroringErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig returns the misconfiguration of mc that would keep metrics from being sent, if any
+func checkConfig(mc metrics.Config, isExtensionRunning bool) error {
+	if requiresAPIKey(mc, isExtensionRunning) && mc.APIKey == "" && mc.KMSAPIKey == "" && mc.APIKeySecretARN == "" {
+		if mc.DisableKeyDecryption {
+			return fmt.Errorf(
+				"%w: set Config.APIKey, %s or %s, the encrypted keys are ignored since key decryption is disabled",
+				ErrMissingAPIKey, DatadogAPIKeyEnvVar, DatadogAPIKeyFileEnvVar,
+			)
+		}
+		return fmt.Errorf(
+			"%w: set Config.APIKey, Config.KMSAPIKey, %s, %s, %s or %s", ErrMissingAPIKey,
+			DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar, DatadogAPIKeyFileEnvVar,
+		)
+	}
+	u, err := url.Parse(mc.Site)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSite, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%w: %q has no host", ErrInvalidSite, mc.Site)
+	}
+	if _, err := metrics.LoadCertPool(mc.CACertPath, mc.CACertPEM); err != nil {
+		return err
+	}
+	return nil
+}
+
+// requiresAPIKey returns true when metrics are sent to the API, which requires an API key
+func requiresAPIKey(mc metrics.Config, isExtensionRunning bool) bool {
+	return !isExtensionRunning && (!mc.ShouldUseLogForwarder || mc.DualWrite) && mc.StatsdAddr == "" && !mc.DiscardMetrics
 }
 
 func (cfg *Config) toMetricsConfig(isExtensionRunning bool) metrics.Config {
+	mc, _ := cfg.toMetricsConfigWithAPIKeySource(isExtensionRunning)
+	return mc
+}
+
+// toMetricsConfigWithAPIKeySource also returns the name of the source the API key was read from, or an empty string if there is none.
+func (cfg *Config) toMetricsConfigWithAPIKeySource(isExtensionRunning bool) (metrics.Config, string) {
+	return cfg.toMetricsConfigWithEnv(loadEnvConfig(os.Getenv), isExtensionRunning)
+}
+
+// toMetricsConfigWithEnv merges cfg over the settings read from the environment, and also returns the source of the API key
+func (cfg *Config) toMetricsConfigWithEnv(env envConfig, isExtensionRunning bool) (metrics.Config, string) {
 
 	mc := metrics.Config{
 		ShouldRetryOnFailure: false,
+		TruncateTags:         true,
+		NormalizeTags:        true,
+		OutsideLambda:        env.FunctionName == "",
 	}
 
 	if cfg != nil {
 		mc.BatchInterval = cfg.BatchInterval
+		mc.FlushJitter = cfg.FlushJitter
 		mc.ShouldRetryOnFailure = cfg.ShouldRetryOnFailure
 		mc.APIKey = cfg.APIKey
 		mc.KMSAPIKey = cfg.KMSAPIKey
+		mc.ApplicationKey = cfg.ApplicationKey
 		mc.Site = cfg.Site
 		mc.ShouldUseLogForwarder = cfg.ShouldUseLogForwarder
+		mc.DualWrite = cfg.DualWrite
 		mc.HTTPClientTimeout = cfg.HTTPClientTimeout
+		mc.CACertPath = cfg.CACertPath
+		mc.CACertPEM = cfg.CACertPEM
+		mc.MetricFilter = cfg.MetricFilter
+		mc.FlushTimeout = cfg.FlushTimeout
+		mc.OnFlushError = cfg.OnFlushError
+		mc.OnFlushSuccess = cfg.OnFlushSuccess
+		mc.RollupDistributions = cfg.RollupDistributions
+		mc.MaxBufferBytes = cfg.MaxBufferBytes
+		mc.QueueCapacity = cfg.QueueCapacity
+		mc.QueuePolicy = cfg.QueuePolicy
+		mc.FlushOnlyAtEnd = cfg.FlushOnlyAtEnd
+		if cfg.BeforeSubmit != nil {
+			mc.BeforeSubmit = beforeSubmitHook(cfg.BeforeSubmit)
+		}
+		if cfg.Aggregator != nil {
+			mc.Aggregator = aggregatorAdapter{cfg.Aggregator}
+		}
+		mc.MaxTagsPerMetric = cfg.MaxTagsPerMetric
+		mc.DefaultMaxTagsPerMetric = cfg.DefaultMaxTagsPerMetric
+		mc.SeriesV2 = cfg.SeriesV2
+		mc.RequestDecorator = cfg.RequestDecorator
+		mc.HealthMetrics = cfg.HealthMetrics
+		mc.UseSketches = cfg.UseSketches
+		mc.PersistAcrossInvocations = cfg.PersistAcrossInvocations
+		mc.TagFunctionVersion = cfg.TagFunctionVersion
+		mc.EnhancedMetricTags = cfg.EnhancedMetricTags
+		mc.Region = cfg.Region
+		// The trace listener, started first, decides once per invocation
+		mc.IgnoreInvocation = trace.IsIgnoredInvocation
+		mc.Resources = cfg.MetricResources
+		mc.StatsdAddr = cfg.StatsdAddr
+		mc.TagInvocationID = cfg.TagInvocationID
+		mc.AsyncFlush = cfg.AsyncFlush
+		mc.ContextTagExtractor = cfg.ContextTagExtractor
+		mc.DefaultTags = append(mc.DefaultTags, cfg.DefaultTags...)
+		if cfg.TagRuntime {
+			mc.DefaultTags = append(mc.DefaultTags, runtimeTags()...)
+		}
+		if cfg.TruncateTags != nil {
+			mc.TruncateTags = *cfg.TruncateTags
+		}
+		mc.MaxTagsPerPoint = cfg.MaxTagsPerPoint
+		if cfg.NormalizeTags != nil {
+			mc.NormalizeTags = *cfg.NormalizeTags
+		}
+		mc.NormalizeTagValues = cfg.NormalizeTagValues
 	}
 
-	if mc.Site == "" {
-		mc.Site = os.Getenv(DatadogSiteEnvVar)
+	if cfg != nil && len(cfg.SubmitInEnvs) > 0 {
+		environment := cfg.Env
+		if environment == "" {
+			environment = env.Env
+		}
+		mc.DiscardMetrics = !containsFold(cfg.SubmitInEnvs, environment)
+		if mc.DiscardMetrics {
+			logger.Debug(fmt.Sprintf("metrics won't be submitted in the %q environment", environment))
+		}
+	}
+
+	if !isExtensionRunning {
+		// The extension adds the tags of DD_TAGS to the metrics it receives
+		mc.DefaultTags = append(append([]string{}, env.Tags...), mc.DefaultTags...)
+	}
+	if len(mc.DefaultTags) == 0 {
+		mc.DefaultTags = nil
 	}
+
 	if mc.Site == "" {
-		mc.Site = DefaultSite
+		mc.Site = env.Site
 	}
-	if strings.HasPrefix(mc.Site, "https://") || strings.HasPrefix(mc.Site, "http://") {
-		mc.Site = fmt.Sprintf("%s/api/v1", mc.Site)
-	} else {
-		mc.Site = fmt.Sprintf("https://api.%s/api/v1", mc.Site)
+	mc.Site = resolveMetricsSiteURL(mc.Site)
+	if mc.Region == "" {
+		mc.Region = env.Region
+	}
+	mc.FunctionName = env.FunctionName
+	if mc.ApplicationKey == "" {
+		mc.ApplicationKey = env.AppKey
 	}
 
 	if !mc.ShouldUseLogForwarder {
-		shouldUseLogForwarder := os.Getenv(ShouldUseLogForwarderEnvVar)
-		mc.ShouldUseLogForwarder = strings.EqualFold(shouldUseLogForwarder, "true")
+		mc.ShouldUseLogForwarder = env.ShouldUseLogForwarder
 	}
 
-	if mc.APIKey == "" {
-		mc.APIKey = os.Getenv(DatadogAPIKeyEnvVar)
-
+	// Only the first available API key source is used, in this order:
+	// Config.APIKey, DD_API_KEY_FILE, Config.KMSAPIKey, DD_API_KEY_SECRET_ARN, DD_API_KEY, then DD_KMS_API_KEY.
+	apiKey, kmsAPIKey := mc.APIKey, mc.KMSAPIKey
+	mc.APIKey, mc.KMSAPIKey = "", ""
+	decryptKey := cfg == nil || !cfg.DisableKeyDecryption
+	if !decryptKey {
+		mc.DisableKeyDecryption = true
+		if apiKey == "" && (kmsAPIKey != "" || env.KMSAPIKey != "" || env.APIKeySecretARN != "") {
+			logger.Error(fmt.Errorf(
+				"ignoring Config.KMSAPIKey, %s and %s, key decryption is disabled",
+				DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar,
+			))
+		}
+		kmsAPIKey = ""
 	}
-	if mc.KMSAPIKey == "" {
-		mc.KMSAPIKey = os.Getenv(DatadogKMSAPIKeyEnvVar)
+	fileAPIKey := ""
+	if apiKey == "" && env.APIKeyFile != "" {
+		fileAPIKey = readAPIKeyFile(env.APIKeyFile)
 	}
-	if !isExtensionRunning && mc.APIKey == "" && mc.KMSAPIKey == "" && !mc.ShouldUseLogForwarder {
+	apiKeySource := ""
+	switch {
+	case apiKey != "":
+		apiKeySource = "Config.APIKey"
+		mc.APIKey = apiKey
+	case fileAPIKey != "":
+		apiKeySource = DatadogAPIKeyFileEnvVar
+		mc.APIKey = fileAPIKey
+	case kmsAPIKey != "":
+		apiKeySource = "Config.KMSAPIKey"
+		mc.KMSAPIKey = kmsAPIKey
+	case env.APIKeySecretARN != "" && decryptKey:
+		apiKeySource = DatadogAPIKeySecretARNEnvVar
+		mc.APIKeySecretARN = env.APIKeySecretARN
+	case env.APIKey != "":
+		apiKeySource = DatadogAPIKeyEnvVar
+		mc.APIKey = env.APIKey
+	case env.KMSAPIKey != "" && decryptKey:
+		apiKeySource = DatadogKMSAPIKeyEnvVar
+		mc.KMSAPIKey = env.KMSAPIKey
+	}
+	if apiKeySource != "" {
+		logger.Debug(fmt.Sprintf("using the API key from %s", apiKeySource))
+	} else if requiresAPIKey(mc, isExtensionRunning) {
 		logger.Error(fmt.Errorf(
-			"couldn't read %s or %s from environment", DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar,
+			"couldn't read %s, %s, %s or %s from environment",
+			DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar, DatadogAPIKeyFileEnvVar,
 		))
 	}
 
-	enhancedMetrics := os.Getenv("DD_ENHANCED_METRICS")
-	if enhancedMetrics == "" {
+	if env.EnhancedMetrics == nil {
 		mc.EnhancedMetrics = DefaultEnhancedMetrics
+	} else if !mc.EnhancedMetrics {
+		mc.EnhancedMetrics = *env.EnhancedMetrics
+	}
+
+	mc.LocalTest = env.LocalTest
+
+	return mc, apiKeySource
+}
+
+// readAPIKeyFile returns the API key in the file at path, without the surrounding spaces, or an empty string when it can't be read
+func readAPIKeyFile(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error(fmt.Errorf("couldn't read the API key from %s=%s, falling back to the other sources: %w", DatadogAPIKeyFileEnvVar, path, err))
+		return ""
 	}
-	if !mc.EnhancedMetrics {
-		mc.EnhancedMetrics = strings.EqualFold(enhancedMetrics, "true")
+	apiKey := strings.TrimSpace(string(content))
+	if apiKey == "" {
+		logger.Error(fmt.Errorf("the file %s=%s is empty, falling back to the other sources", DatadogAPIKeyFileEnvVar, path))
 	}
+	return apiKey
+}
+
+// runtimeTags returns the tags of the Go version and the architecture of the function, see Config.TagRuntime
+func runtimeTags() []string {
+	return []string{"runtime:" + runtime.Version(), "arch:" + runtime.GOARCH}
+}
 
-	if localTest := os.Getenv("DD_LOCAL_TEST"); localTest == "1" || strings.ToLower(localTest) == "true" {
-		mc.LocalTest = true
+// containsFold reports whether values contains value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
 	}
+	return false
+}
 
-	return mc
+// parseDDTags parses tags separated by commas and/or spaces, like the Datadog agent does for DD_TAGS.
+// Entries with an empty key or value, like ":value" or "key:", are skipped.
+func parseDDTags(value string) []string {
+	tags := []string{}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if key, val, found := strings.Cut(entry, ":"); found && (key == "" || val == "") {
+			logger.Debug(fmt.Sprintf("skipping malformed tag %q", entry))
+			continue
+		}
+		tags = append(tags, entry)
+	}
+	return tags
 }
 
-// setupAppSec checks if DD_SERVERLESS_APPSEC_ENABLED is set (to true) and when that
-// is the case, redirects `AWS_LAMBDA_RUNTIME_API` to the agent extension, and turns
-// on universal instrumentation unless it was already configured by the customer, so
-// that the HTTP context (invocation details span tags) is available on AppSec traces.
-func setupAppSec() {
-	enabled := false
-	if env := os.Getenv(serverlessAppSecEnabledEnvVar); env != "" {
-		if on, err := strconv.ParseBool(env); err == nil {
-			enabled = on
+// parseServiceMapping parses a service mapping in the "from1:to1,from2:to2" format. Malformed entries are skipped.
+func parseServiceMapping(value string) map[string]string {
+	mapping := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
+		from, to, found := strings.Cut(entry, ":")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !found || from == "" || to == "" {
+			logger.Debug(fmt.Sprintf("skipping malformed service mapping entry %q", entry))
+			continue
+		}
+		mapping[from] = to
 	}
+	return mapping
+}
 
-	if !enabled {
+func (cfg *Config) toLogsConfig(mc metrics.Config, env envConfig) logs.Config {
+	lc := logs.Config{
+		APIKey:                mc.APIKey,
+		KMSAPIKey:             mc.KMSAPIKey,
+		APIKeySecretARN:       mc.APIKeySecretARN,
+		ShouldUseLogForwarder: mc.ShouldUseLogForwarder,
+		HTTPClientTimeout:     mc.HTTPClientTimeout,
+		FunctionName:          mc.FunctionName,
+		Service:               env.Service,
+	}
+	site := env.Site
+	if cfg != nil && cfg.Site != "" {
+		site = cfg.Site
+	}
+	lc.Site = resolveSiteURL(site, "https://http-intake.logs.%s/api/v2/logs", "%s/api/v2/logs")
+	return lc
+}
+
+// resolveMetricsSiteURL returns the base URL of the metrics API for site
+func resolveMetricsSiteURL(site string) string {
+	return resolveSiteURL(site, "https://api.%s/api/v1", "%s/api/v1")
+}
+
+// resolveSiteURL falls back to the default site when site is empty.
+// It then formats the url of a Datadog endpoint with hostFormat, or with urlFormat when the site is already a url.
+func resolveSiteURL(site, hostFormat, urlFormat string) string {
+	if site == "" {
+		site = DefaultSite
+	}
+	if strings.HasPrefix(site, "https://") || strings.HasPrefix(site, "http://") {
+		return fmt.Sprintf(urlFormat, site)
+	}
+	return fmt.Sprintf(hostFormat, site)
+}
+
+// setupAppSec checks if DD_SERVERLESS_APPSEC_ENABLED is set (to true) in env and when that
+// is the case, redirects `AWS_LAMBDA_RUNTIME_API` to the agent extension, and turns
+// on universal instrumentation unless it was already configured by the customer, so
+// that the HTTP context (invocation details span tags) is available on AppSec traces.
+func setupAppSec(env envConfig) {
+	if !env.AppSecEnabled {
 		return
 	}
 
@@ -347,7 +1636,7 @@ func setupAppSec() {
 	}
 
 	if awsLambdaRpcSupport {
-		if port := os.Getenv(awsLambdaServerPortEnvVar); port != "" {
+		if env.LambdaServerPort != "" {
 			logger.Warn(fmt.Sprintf("%s activation with the go1.x AWS Lambda runtime requires setting the `lambda.norpc` go build tag", serverlessAppSecEnabledEnvVar))
 		}
 	}
@@ -358,7 +1647,7 @@ func setupAppSec() {
 		logger.Debug(fmt.Sprintf("successfully set %s=%s", awsLambdaRuntimeApiEnvVar, datadogAgentUrl))
 	}
 
-	if val := os.Getenv(UniversalInstrumentation); val == "" {
+	if env.UniversalInstrumentation == nil {
 		if err := os.Setenv(UniversalInstrumentation, "1"); err != nil {
 			logger.Debug(fmt.Sprintf("failed to set %s=%d: %v", UniversalInstrumentation, 1, err))
 		} else {
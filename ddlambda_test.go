@@ -9,13 +9,30 @@ package ddlambda
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
 )
 
 func TestInvokeDryRun(t *testing.T) {
@@ -104,3 +121,1426 @@ func TestToMetricConfigLocalTest(t *testing.T) {
 		})
 	}
 }
+
+func TestToMetricsConfigAPIKeyPrecedence(t *testing.T) {
+	// The sources, from highest to lowest precedence
+	sources := []struct {
+		name   string
+		set    func(t *testing.T, cfg *Config)
+		expect metrics.Config
+	}{
+		{
+			name:   "Config.APIKey",
+			set:    func(t *testing.T, cfg *Config) { cfg.APIKey = "config-key" },
+			expect: metrics.Config{APIKey: "config-key"},
+		},
+		{
+			name:   DatadogAPIKeyFileEnvVar,
+			set:    func(t *testing.T, cfg *Config) { t.Setenv(DatadogAPIKeyFileEnvVar, writeAPIKeyFile(t, "file-key")) },
+			expect: metrics.Config{APIKey: "file-key"},
+		},
+		{
+			name:   "Config.KMSAPIKey",
+			set:    func(t *testing.T, cfg *Config) { cfg.KMSAPIKey = "config-kms-key" },
+			expect: metrics.Config{KMSAPIKey: "config-kms-key"},
+		},
+		{
+			name:   DatadogAPIKeySecretARNEnvVar,
+			set:    func(t *testing.T, cfg *Config) { t.Setenv(DatadogAPIKeySecretARNEnvVar, "env-secret-arn") },
+			expect: metrics.Config{APIKeySecretARN: "env-secret-arn"},
+		},
+		{
+			name:   DatadogAPIKeyEnvVar,
+			set:    func(t *testing.T, cfg *Config) { t.Setenv(DatadogAPIKeyEnvVar, "env-key") },
+			expect: metrics.Config{APIKey: "env-key"},
+		},
+		{
+			name:   DatadogKMSAPIKeyEnvVar,
+			set:    func(t *testing.T, cfg *Config) { t.Setenv(DatadogKMSAPIKeyEnvVar, "env-kms-key") },
+			expect: metrics.Config{KMSAPIKey: "env-kms-key"},
+		},
+	}
+
+	for combination := 0; combination < 1<<len(sources); combination++ {
+		names := []string{}
+		expected := metrics.Config{}
+		for i := len(sources) - 1; i >= 0; i-- {
+			if combination&(1<<i) != 0 {
+				names = append(names, sources[i].name)
+				expected = sources[i].expect
+			}
+		}
+		t.Run(strings.Join(names, ","), func(t *testing.T) {
+			t.Setenv(DatadogAPIKeyFileEnvVar, "")
+			t.Setenv(DatadogAPIKeySecretARNEnvVar, "")
+			t.Setenv(DatadogAPIKeyEnvVar, "")
+			t.Setenv(DatadogKMSAPIKeyEnvVar, "")
+			cfg := Config{}
+			for i, source := range sources {
+				if combination&(1<<i) != 0 {
+					source.set(t, &cfg)
+				}
+			}
+
+			mc := cfg.toMetricsConfig(true)
+			assert.Equal(t, expected.APIKey, mc.APIKey)
+			assert.Equal(t, expected.KMSAPIKey, mc.KMSAPIKey)
+			assert.Equal(t, expected.APIKeySecretARN, mc.APIKeySecretARN)
+		})
+	}
+}
+
+// writeAPIKeyFile writes content to a temporary file and returns its path
+func writeAPIKeyFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "api-key")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestToMetricsConfigAPIKeyFile(t *testing.T) {
+	env := envConfig{APIKeyFile: writeAPIKeyFile(t, "  file-key\n"), APIKey: "env-key"}
+	mc, source := (&Config{}).toMetricsConfigWithEnv(env, true)
+	assert.Equal(t, "file-key", mc.APIKey)
+	assert.Equal(t, DatadogAPIKeyFileEnvVar, source)
+}
+
+func TestToMetricsConfigAPIKeyFileFallsBack(t *testing.T) {
+	for name, path := range map[string]string{
+		"missing": filepath.Join(t.TempDir(), "missing"),
+		"empty":   writeAPIKeyFile(t, " \n"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLogs(t)
+			env := envConfig{APIKeyFile: path, APIKey: "env-key"}
+			mc, source := (&Config{}).toMetricsConfigWithEnv(env, true)
+			assert.Equal(t, "env-key", mc.APIKey)
+			assert.Equal(t, DatadogAPIKeyEnvVar, source)
+			assert.Contains(t, logs.String(), DatadogAPIKeyFileEnvVar+"="+path)
+		})
+	}
+}
+
+func TestToMetricsConfigDisableKeyDecryption(t *testing.T) {
+	env := envConfig{KMSAPIKey: "env-encrypted", APIKeySecretARN: "arn:aws:secretsmanager:us-east-1:123:secret:dd"}
+	cfg := &Config{KMSAPIKey: "encrypted", DisableKeyDecryption: true}
+
+	logs := captureLogs(t)
+	mc, source := cfg.toMetricsConfigWithEnv(env, false)
+	assert.Empty(t, source)
+	assert.Empty(t, mc.KMSAPIKey)
+	assert.Empty(t, mc.APIKeySecretARN)
+	assert.True(t, mc.DisableKeyDecryption)
+	assert.Contains(t, logs.String(), "key decryption is disabled")
+
+	env.APIKey = "env-key"
+	mc, source = cfg.toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, DatadogAPIKeyEnvVar, source)
+	assert.Equal(t, "env-key", mc.APIKey)
+}
+
+func TestToTraceConfigCaptureHandlerErrors(t *testing.T) {
+	disabled := false
+
+	assert.True(t, (*Config)(nil).toTraceConfig().CaptureHandlerErrors)
+	assert.True(t, (&Config{}).toTraceConfig().CaptureHandlerErrors)
+	assert.False(t, (&Config{CaptureHandlerErrors: &disabled}).toTraceConfig().CaptureHandlerErrors)
+
+	t.Setenv(CaptureHandlerErrorsEnvVar, "false")
+	assert.False(t, (&Config{}).toTraceConfig().CaptureHandlerErrors)
+}
+
+func TestToTraceConfigAPIGatewaySpanTags(t *testing.T) {
+	disabled := false
+
+	assert.True(t, (*Config)(nil).toTraceConfig().APIGatewaySpanTags)
+	assert.True(t, (&Config{}).toTraceConfig().APIGatewaySpanTags)
+	assert.False(t, (&Config{APIGatewaySpanTags: &disabled}).toTraceConfig().APIGatewaySpanTags)
+
+	t.Setenv(APIGatewaySpanTagsEnvVar, "false")
+	assert.False(t, (&Config{}).toTraceConfig().APIGatewaySpanTags)
+}
+
+func TestGetTraceHeadersWithBaggage(t *testing.T) {
+	ctx := WithBaggage(context.Background(), "tenant", "acme")
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, "tenant=acme", headers["baggage"])
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	AddTraceHeaders(ctx, req)
+	assert.Equal(t, "tenant=acme", req.Header.Get("baggage"))
+}
+
+func TestSetSamplingPriority(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	t.Setenv(UniversalInstrumentation, "false")
+
+	var before, after map[string]string
+	var traceContext DatadogTraceContext
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		ctx = ExtractTraceContext(ctx, map[string]string{
+			"x-datadog-trace-id":          "1231452342",
+			"x-datadog-parent-id":         "45678910",
+			"x-datadog-sampling-priority": "1",
+		})
+		before = GetTraceHeaders(ctx)
+		SetSamplingPriority(ctx, PriorityUserKeep)
+		after = GetTraceHeaders(ctx)
+		traceContext, _ = TraceContext(ctx)
+	}, &Config{ShouldUseLogForwarder: true})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "1", before["x-datadog-sampling-priority"])
+	assert.Equal(t, "2", after["x-datadog-sampling-priority"])
+	assert.Equal(t, "1231452342", after["x-datadog-trace-id"])
+	assert.Equal(t, PriorityUserKeep, traceContext.SamplingPriority)
+}
+
+func TestAddTraceHeadersWithPropagateHeaders(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	t.Setenv(UniversalInstrumentation, "false")
+
+	var outbound *http.Request
+	handler := func(ctx context.Context, ev json.RawMessage) error {
+		outbound, _ = http.NewRequest(http.MethodGet, "http://example.com", nil)
+		AddTraceHeaders(ctx, outbound)
+		return nil
+	}
+
+	cfg := &Config{ShouldUseLogForwarder: true, PropagateHeaders: []string{"x-request-id", "X-Tenant", "x-missing"}}
+	wrapped := WrapFunction(handler, cfg).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err := wrapped(context.Background(), json.RawMessage(`{"headers":{"X-Request-Id":"req-1","Other":"ignored"},"multiValueHeaders":{"x-tenant":["acme"]}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "req-1", outbound.Header.Get("x-request-id"))
+	assert.Equal(t, "acme", outbound.Header.Get("x-tenant"))
+	assert.Empty(t, outbound.Header.Get("x-missing"))
+	assert.Empty(t, outbound.Header.Get("other"))
+}
+
+func TestAddTraceHeadersReplacesExistingHeaders(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5ce31dc2-2c779014b90ce44db5e03875;Parent=0b11cc4230d3e09e;Sampled=1")
+	ctx = WithBaggage(ctx, "tenant", "acme")
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("x-custom", "keep")
+	AddTraceHeaders(ctx, req)
+	AddTraceHeaders(ctx, req)
+
+	for _, key := range []string{"x-datadog-trace-id", "x-datadog-parent-id", "x-datadog-sampling-priority", "baggage"} {
+		assert.Len(t, req.Header.Values(key), 1, key)
+	}
+	assert.Equal(t, "4110911582297405557", req.Header.Get("x-datadog-trace-id"))
+	assert.Equal(t, "keep", req.Header.Get("x-custom"))
+}
+
+func TestGetTraceHTTPHeaders(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5ce31dc2-2c779014b90ce44db5e03875;Parent=0b11cc4230d3e09e;Sampled=1")
+	ctx = WithBaggage(ctx, "tenant", "acme")
+	ctx = WithBaggage(ctx, "user", "u-1")
+
+	headers := GetTraceHTTPHeaders(ctx)
+
+	assert.Equal(t, []string{"4110911582297405557"}, headers["X-Datadog-Trace-Id"])
+	assert.Equal(t, []string{"797643193680388254"}, headers["X-Datadog-Parent-Id"])
+	assert.Equal(t, []string{"2"}, headers["X-Datadog-Sampling-Priority"])
+	assert.Equal(t, []string{"tenant=acme", "user=u-1"}, headers["Baggage"])
+	assert.Len(t, headers, 4)
+}
+
+func TestTraceContextMatchesTraceHeaders(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5ce31dc2-2c779014b90ce44db5e03875;Parent=0b11cc4230d3e09e;Sampled=1")
+
+	traceContext, ok := TraceContext(ctx)
+	assert.True(t, ok)
+
+	headers := GetTraceHeaders(ctx)
+	assert.Equal(t, headers["x-datadog-trace-id"], fmt.Sprint(traceContext.TraceID))
+	assert.Equal(t, headers["x-datadog-parent-id"], fmt.Sprint(traceContext.ParentID))
+	assert.Equal(t, headers["x-datadog-sampling-priority"], fmt.Sprint(traceContext.SamplingPriority))
+	assert.Equal(t, DatadogTraceContext{TraceID: 4110911582297405557, ParentID: 797643193680388254, SamplingPriority: 2}, traceContext)
+}
+
+func TestExtractTraceContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected DatadogTraceContext
+	}{
+		{
+			name:     "datadog",
+			headers:  map[string]string{"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910", "x-datadog-sampling-priority": "2"},
+			expected: DatadogTraceContext{TraceID: 1231452342, ParentID: 45678910, SamplingPriority: 2},
+		},
+		{
+			name:     "w3c",
+			headers:  map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			expected: DatadogTraceContext{TraceID: 9532127138774266268, ParentID: 13235353014750950193, SamplingPriority: 1},
+		},
+		{
+			name:     "b3",
+			headers:  map[string]string{"b3": "463ac35c9f6413ad-a2fb4a1d1a96d312-1"},
+			expected: DatadogTraceContext{TraceID: 5060571933882717101, ParentID: 11744061942159299346, SamplingPriority: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := ExtractTraceContext(WithBaggage(context.Background(), "tenant", "acme"), tt.headers)
+
+			traceContext, ok := TraceContext(ctx)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, traceContext)
+
+			headers := GetTraceHeaders(ctx)
+			assert.Equal(t, fmt.Sprint(tt.expected.TraceID), headers["x-datadog-trace-id"])
+			assert.Equal(t, fmt.Sprint(tt.expected.ParentID), headers["x-datadog-parent-id"])
+			assert.Equal(t, fmt.Sprint(tt.expected.SamplingPriority), headers["x-datadog-sampling-priority"])
+			assert.Equal(t, "tenant=acme", headers["baggage"])
+		})
+	}
+}
+
+func TestExtractTraceContextWithoutHeaders(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5ce31dc2-2c779014b90ce44db5e03875;Parent=0b11cc4230d3e09e;Sampled=1")
+
+	extracted := ExtractTraceContext(ctx, map[string]string{"content-type": "application/json"})
+	assert.Equal(t, ctx, extracted)
+	assert.Equal(t, "4110911582297405557", GetTraceHeaders(extracted)["x-datadog-trace-id"])
+}
+
+func TestNewTestTraceContext(t *testing.T) {
+	for _, priority := range []int{PriorityUserReject, PriorityAutoReject, PriorityAutoKeep, PriorityUserKeep} {
+		ctx := NewTestTraceContext(1231452342, 45678910, priority)
+
+		assert.Equal(t, map[string]string{
+			"x-datadog-trace-id":          "1231452342",
+			"x-datadog-parent-id":         "45678910",
+			"x-datadog-sampling-priority": fmt.Sprint(priority),
+		}, GetTraceHeaders(ctx))
+
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		AddTraceHeaders(ctx, req)
+		assert.Equal(t, "1231452342", req.Header.Get("x-datadog-trace-id"))
+		assert.Equal(t, "45678910", req.Header.Get("x-datadog-parent-id"))
+		assert.Equal(t, fmt.Sprint(priority), req.Header.Get("x-datadog-sampling-priority"))
+	}
+
+	traceContext, ok := TraceContext(NewTestTraceContext(1, 2, PriorityUserKeep))
+	assert.True(t, ok)
+	assert.Equal(t, DatadogTraceContext{TraceID: 1, ParentID: 2, SamplingPriority: 2}, traceContext)
+}
+
+func TestTraceContextWithoutTrace(t *testing.T) {
+	_, ok := TraceContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestSpanContext(t *testing.T) {
+	spanCtx := SpanContext(NewTestTraceContext(1231452342, 45678910, PriorityUserKeep))
+	assert.NotNil(t, spanCtx)
+	assert.Equal(t, uint64(1231452342), spanCtx.TraceID())
+	assert.Equal(t, uint64(45678910), spanCtx.SpanID())
+	priority, ok := spanCtx.(interface{ SamplingPriority() (int, bool) }).SamplingPriority()
+	assert.True(t, ok)
+	assert.Equal(t, PriorityUserKeep, priority)
+
+	assert.Nil(t, SpanContext(context.Background()))
+}
+
+func TestSpanContextOfTheSpanOfTheContext(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	span, ctx := tracer.StartSpanFromContext(NewTestTraceContext(1231452342, 45678910, PriorityUserKeep), "aws.lambda")
+	defer span.Finish()
+
+	spanCtx := SpanContext(ctx)
+	assert.Equal(t, span.Context().TraceID(), spanCtx.TraceID())
+	assert.Equal(t, span.Context().SpanID(), spanCtx.SpanID())
+}
+
+func TestWithMetricTagsIsScoped(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		batchCtx := WithMetricTags(ctx, "batch:1")
+		for _, itemType := range []string{"x", "y"} {
+			itemCtx := WithMetricTags(batchCtx, "item_type:"+itemType)
+			DistributionCtx(itemCtx, "item-metric", 1, "call:tag")
+		}
+		DistributionCtx(batchCtx, "batch-metric", 1)
+		DistributionCtx(ctx, "parent-metric", 1)
+
+		assert.Empty(t, metrics.TagsFromContext(ctx))
+		assert.Equal(t, []string{"batch:1"}, metrics.TagsFromContext(batchCtx))
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+
+	var payload struct {
+		Series []struct {
+			Metric string   `json:"metric"`
+			Tags   []string `json:"tags"`
+		} `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &payload))
+	tagsByMetric := map[string][][]string{}
+	for _, series := range payload.Series {
+		tagsByMetric[series.Metric] = append(tagsByMetric[series.Metric], series.Tags)
+	}
+
+	itemTags := tagsByMetric["item-metric"]
+	assert.Len(t, itemTags, 2)
+	for _, tags := range itemTags {
+		assert.Contains(t, tags, "batch:1")
+		assert.Contains(t, tags, "call:tag")
+	}
+	assert.ElementsMatch(t, []string{"item_type:x", "item_type:y"}, []string{
+		findTagWithPrefix(itemTags[0], "item_type:"), findTagWithPrefix(itemTags[1], "item_type:"),
+	})
+
+	assert.Len(t, tagsByMetric["batch-metric"], 1)
+	assert.Contains(t, tagsByMetric["batch-metric"][0], "batch:1")
+	assert.Empty(t, findTagWithPrefix(tagsByMetric["batch-metric"][0], "item_type:"))
+
+	assert.Len(t, tagsByMetric["parent-metric"], 1)
+	assert.NotContains(t, tagsByMetric["parent-metric"][0], "batch:1")
+}
+
+func findTagWithPrefix(tags []string, prefix string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return tag
+		}
+	}
+	return ""
+}
+
+func TestSubmitInEnvs(t *testing.T) {
+	testcases := []struct {
+		name      string
+		env       string
+		envVar    string
+		submitted bool
+	}{
+		{"allowed env", "prod", "", true},
+		{"allowed env from DD_ENV", "", "Prod", true},
+		{"disallowed env", "dev", "prod", false},
+		{"no env", "", "", false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(DatadogEnvEnvVar, tc.envVar)
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer server.Close()
+
+			_, err := InvokeDryRun(func(ctx context.Context) {
+				Metric("my-metric", 1)
+			}, &Config{
+				APIKey:       "abc-123",
+				Site:         server.URL,
+				Env:          tc.env,
+				SubmitInEnvs: []string{"staging", "prod"},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.submitted, requests > 0)
+		})
+	}
+}
+
+func TestMetricsHandleSubmitWithWrapper(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		h := MetricsHandle(ctx)
+		for i := 0; i < 3; i++ {
+			h.Distribution("my-metric", float64(i), "my:tag")
+		}
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, body, `"metric":"my-metric"`)
+	assert.Contains(t, body, `[0]],`)
+	assert.Contains(t, body, `[2]]]`)
+}
+
+func TestDistributionBatchMatchesLoop(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		ctx = WithMetricTags(ctx, "batch:1")
+		for _, value := range values {
+			DistributionCtx(ctx, "loop-metric", value, "my:tag")
+		}
+		DistributionBatch(ctx, "batch-metric", values, "my:tag")
+		DistributionBatch(ctx, "empty-metric", nil)
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+
+	var payload struct {
+		Series []struct {
+			Metric string          `json:"metric"`
+			Tags   []string        `json:"tags"`
+			Points [][]interface{} `json:"points"`
+		} `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &payload))
+	counts, sums, tags := map[string]int{}, map[string]float64{}, map[string][]string{}
+	for _, series := range payload.Series {
+		tags[series.Metric] = series.Tags
+		for _, point := range series.Points {
+			for _, value := range point[1].([]interface{}) {
+				counts[series.Metric]++
+				sums[series.Metric] += value.(float64)
+			}
+		}
+	}
+	assert.Equal(t, 100, counts["batch-metric"])
+	assert.Equal(t, counts["loop-metric"], counts["batch-metric"])
+	assert.Equal(t, 5050.0, sums["batch-metric"])
+	assert.Equal(t, sums["loop-metric"], sums["batch-metric"])
+	assert.Equal(t, tags["loop-metric"], tags["batch-metric"])
+	assert.NotContains(t, counts, "empty-metric")
+}
+
+func TestMetricsHandleSilentFailWithoutWrapper(t *testing.T) {
+	MetricsHandle(context.Background()).Distribution("my-metric", 100, "my:tag")
+	MetricsHandle(nil).Distribution("my-metric", 100, "my:tag") //nolint:staticcheck
+}
+
+func benchmarkWithWrapper(b *testing.B, benchmark func(ctx context.Context)) {
+	b.Setenv(DatadogTraceEnabledEnvVar, "false")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		benchmark(ctx)
+		b.StopTimer()
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(b, err)
+}
+
+func BenchmarkDistribution(b *testing.B) {
+	benchmarkWithWrapper(b, func(ctx context.Context) {
+		for i := 0; i < b.N; i++ {
+			Distribution("my-metric", 100, "my:tag", "other:tag")
+		}
+	})
+}
+
+func BenchmarkDistributionLoop(b *testing.B) {
+	values := make([]float64, 100)
+	benchmarkWithWrapper(b, func(ctx context.Context) {
+		for i := 0; i < b.N; i++ {
+			for _, value := range values {
+				DistributionCtx(ctx, "my-metric", value, "my:tag", "other:tag")
+			}
+		}
+	})
+}
+
+func BenchmarkDistributionBatch(b *testing.B) {
+	values := make([]float64, 100)
+	benchmarkWithWrapper(b, func(ctx context.Context) {
+		for i := 0; i < b.N; i++ {
+			DistributionBatch(ctx, "my-metric", values, "my:tag", "other:tag")
+		}
+	})
+}
+
+func BenchmarkMetricsHandleDistribution(b *testing.B) {
+	benchmarkWithWrapper(b, func(ctx context.Context) {
+		h := MetricsHandle(ctx)
+		for i := 0; i < b.N; i++ {
+			h.Distribution("my-metric", 100, "my:tag", "other:tag")
+		}
+	})
+}
+
+func TestSubmitSeriesWithWrapper(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/series" {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	var err error
+	_, _ = InvokeDryRun(func(ctx context.Context) {
+		err = SubmitSeries(ctx, []Series{{
+			Metric:   "my.count",
+			Type:     "count",
+			Tags:     []string{"a:b"},
+			Host:     "my-host",
+			Interval: 10 * time.Second,
+			Points:   []SeriesPoint{{Timestamp: time.Unix(1000, 0), Value: 3}},
+		}})
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"series":[{"metric":"my.count","host":"my-host","tags":["a:b"],"type":"count","interval":10,"points":[[1000,3]]}]}`, body)
+}
+
+func TestFlushAsync(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	var err error
+	var requestsBeforeReturn int32
+	_, _ = InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1)
+		pending := FlushAsync(ctx)
+		err = pending.Wait()
+		requestsBeforeReturn = atomic.LoadInt32(&requests)
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), requestsBeforeReturn)
+}
+
+func TestFlushAsyncError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var err error
+	_, _ = InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1)
+		err = FlushAsync(ctx).Wait()
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.Error(t, err)
+}
+
+func TestFlushAsyncWithoutWrapper(t *testing.T) {
+	assert.Error(t, FlushAsync(context.Background()).Wait())
+}
+
+func TestSubmitSeriesWithoutWrapper(t *testing.T) {
+	err := SubmitSeries(context.Background(), []Series{})
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/validate", r.URL.Path)
+		if r.URL.Query().Get("api_key") == "good-key" {
+			w.Write([]byte(`{"valid":true}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["Forbidden"]}`))
+	}))
+	defer server.Close()
+
+	assert.NoError(t, Validate(&Config{APIKey: "good-key", Site: server.URL}))
+	assert.Error(t, Validate(&Config{APIKey: "bad-key", Site: server.URL}))
+}
+
+func TestValidateWithoutAPIKey(t *testing.T) {
+	t.Setenv(DatadogAPIKeyEnvVar, "")
+	t.Setenv(DatadogKMSAPIKeyEnvVar, "")
+	t.Setenv(DatadogAPIKeySecretARNEnvVar, "")
+	assert.EqualError(t, Validate(&Config{}), "no API key is configured")
+}
+
+func TestLogWithWrapper(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/logs" {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		Log(ctx, "info", "audit event", map[string]interface{}{"action": "delete"})
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"action":"delete","ddsource":"lambda","message":"audit event","status":"info"}]`, body)
+}
+
+func TestResolvedMetricsURL(t *testing.T) {
+	t.Setenv(DatadogSiteEnvVar, "")
+	assert.Equal(t, "https://api.datadoghq.com/api/v1/distribution_points", ResolvedMetricsURL(nil))
+	assert.Equal(t, "https://api.datadoghq.eu/api/v1/distribution_points", ResolvedMetricsURL(&Config{Site: "datadoghq.eu"}))
+	// A site given as a URL overrides the host of the API, e.g. for a proxy
+	assert.Equal(t, "https://proxy.example.com/api/v1/distribution_points", ResolvedMetricsURL(&Config{Site: "https://proxy.example.com"}))
+
+	t.Setenv(DatadogSiteEnvVar, "us5.datadoghq.com")
+	assert.Equal(t, "https://api.us5.datadoghq.com/api/v1/distribution_points", ResolvedMetricsURL(&Config{APIKey: "abc-123"}))
+	assert.NotContains(t, ResolvedMetricsURL(&Config{APIKey: "abc-123"}), "abc-123")
+}
+
+func TestToLogsConfigSite(t *testing.T) {
+	t.Setenv(DatadogSiteEnvVar, "")
+	cfg := &Config{}
+	assert.Equal(t, "https://http-intake.logs.datadoghq.com/api/v2/logs", cfg.toLogsConfig(cfg.toMetricsConfig(true), loadEnvConfig(os.Getenv)).Site)
+
+	cfg = &Config{Site: "datadoghq.eu"}
+	assert.Equal(t, "https://http-intake.logs.datadoghq.eu/api/v2/logs", cfg.toLogsConfig(cfg.toMetricsConfig(true), loadEnvConfig(os.Getenv)).Site)
+}
+
+func TestParseServiceMapping(t *testing.T) {
+	assert.Equal(t, map[string]string{}, parseServiceMapping(""))
+	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, parseServiceMapping("a:b, c:d"))
+	assert.Equal(t, map[string]string{"c": "d"}, parseServiceMapping("malformed,a:,c:d"))
+}
+
+func TestParseDDTags(t *testing.T) {
+	testcases := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{"empty", "", []string{}},
+		{"only separators", " , ,, ", []string{}},
+		{"comma separated", "env:prod,team:payments", []string{"env:prod", "team:payments"}},
+		{"space separated", "env:prod team:payments", []string{"env:prod", "team:payments"}},
+		{"mixed", " env:prod, team:payments\towner:me ,,version:1.2 ", []string{"env:prod", "team:payments", "owner:me", "version:1.2"}},
+		{"tag without value", "env:prod,canary", []string{"env:prod", "canary"}},
+		{"value with colons", "url:https://example.com", []string{"url:https://example.com"}},
+		{"malformed", ":prod,env:,:,team:payments", []string{"team:payments"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseDDTags(tc.value))
+		})
+	}
+}
+
+func TestToMetricsConfigDefaultTags(t *testing.T) {
+	t.Setenv(DatadogTagsEnvVar, "")
+	assert.Nil(t, (&Config{}).toMetricsConfig(false).DefaultTags)
+
+	t.Setenv(DatadogTagsEnvVar, "env:prod team:payments")
+	cfg := &Config{DefaultTags: []string{"owner:me"}}
+	assert.Equal(t, []string{"env:prod", "team:payments", "owner:me"}, cfg.toMetricsConfig(false).DefaultTags)
+	// The extension applies DD_TAGS itself
+	assert.Equal(t, []string{"owner:me"}, cfg.toMetricsConfig(true).DefaultTags)
+}
+
+func TestToMetricsConfigTagRuntime(t *testing.T) {
+	t.Setenv(DatadogTagsEnvVar, "")
+	assert.Nil(t, (&Config{}).toMetricsConfig(true).DefaultTags)
+
+	cfg := &Config{DefaultTags: []string{"owner:me"}, TagRuntime: true}
+	expected := []string{"owner:me", "runtime:" + runtime.Version(), "arch:" + runtime.GOARCH}
+	assert.Equal(t, expected, cfg.toMetricsConfig(true).DefaultTags)
+	assert.Contains(t, cfg.toMetricsConfig(true).DefaultTags[1], "runtime:go")
+}
+
+func TestToMetricsConfigRegion(t *testing.T) {
+	env := loadEnvConfig(fakeEnv(map[string]string{AWSRegionEnvVar: "eu-west-1", AWSDefaultRegionEnvVar: "us-east-2"}))
+	mc, _ := (&Config{Region: "us-west-2"}).toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, "us-west-2", mc.Region)
+	mc, _ = (&Config{}).toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, "eu-west-1", mc.Region)
+
+	env = loadEnvConfig(fakeEnv(map[string]string{AWSDefaultRegionEnvVar: "us-east-2"}))
+	mc, _ = (*Config)(nil).toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, "us-east-2", mc.Region)
+
+	mc, _ = (&Config{}).toMetricsConfigWithEnv(loadEnvConfig(fakeEnv(nil)), false)
+	assert.Empty(t, mc.Region)
+}
+
+func TestToMetricsConfigQueue(t *testing.T) {
+	mc := (&Config{QueueCapacity: 100, QueuePolicy: QueuePolicyDropOldest}).toMetricsConfig(false)
+	assert.Equal(t, 100, mc.QueueCapacity)
+	assert.Equal(t, metrics.QueuePolicyDropOldest, mc.QueuePolicy)
+
+	mc = (*Config)(nil).toMetricsConfig(false)
+	assert.Equal(t, 0, mc.QueueCapacity)
+	assert.Equal(t, QueuePolicyBlock, mc.QueuePolicy)
+}
+
+func TestToMetricsConfigFlushOnlyAtEnd(t *testing.T) {
+	assert.True(t, (&Config{FlushOnlyAtEnd: true}).toMetricsConfig(false).FlushOnlyAtEnd)
+	assert.False(t, (*Config)(nil).toMetricsConfig(false).FlushOnlyAtEnd)
+}
+
+func TestToTraceConfigServiceMapping(t *testing.T) {
+	t.Setenv(ServiceMappingEnvVar, "")
+	assert.Nil(t, (&Config{}).toTraceConfig().ServiceMapping)
+
+	t.Setenv(ServiceMappingEnvVar, "orders:orders-queue,payments:payments-queue")
+	cfg := &Config{ServiceMapping: map[string]string{"payments": "payments-api"}}
+	assert.Equal(t, map[string]string{"orders": "orders-queue", "payments": "payments-api"}, cfg.toTraceConfig().ServiceMapping)
+}
+
+func TestToMetricsConfigTruncateTags(t *testing.T) {
+	disabled := false
+
+	assert.True(t, (*Config)(nil).toMetricsConfig(true).TruncateTags)
+	assert.True(t, (&Config{}).toMetricsConfig(true).TruncateTags)
+	assert.False(t, (&Config{TruncateTags: &disabled}).toMetricsConfig(true).TruncateTags)
+}
+
+func TestToMetricsConfigNormalizeTags(t *testing.T) {
+	disabled := false
+
+	assert.True(t, (*Config)(nil).toMetricsConfig(true).NormalizeTags)
+	assert.True(t, (&Config{}).toMetricsConfig(true).NormalizeTags)
+	assert.False(t, (&Config{NormalizeTags: &disabled}).toMetricsConfig(true).NormalizeTags)
+	assert.True(t, (&Config{NormalizeTagValues: true}).toMetricsConfig(true).NormalizeTagValues)
+}
+
+func TestResolveConfigDefaults(t *testing.T) {
+	for _, envVar := range []string{DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar, DatadogSiteEnvVar,
+		ShouldUseLogForwarderEnvVar, DatadogTraceEnabledEnvVar, MergeXrayTracesEnvVar, UniversalInstrumentation,
+		CaptureHandlerErrorsEnvVar, APIGatewaySpanTagsEnvVar, ServiceMappingEnvVar, DatadogTagsEnvVar, "DD_ENHANCED_METRICS"} {
+		t.Setenv(envVar, "")
+	}
+	t.Setenv(DatadogAPIKeyEnvVar, "0123456789abcdef")
+
+	resolved := ResolveConfig(nil)
+	assert.Equal(t, ResolvedConfig{
+		Site:                     "https://api.datadoghq.com/api/v1",
+		LogsSite:                 "https://http-intake.logs.datadoghq.com/api/v2/logs",
+		APIKey:                   "***cdef",
+		APIKeySource:             DatadogAPIKeyEnvVar,
+		BatchInterval:            15 * time.Second,
+		FlushJitter:              300 * time.Millisecond,
+		HTTPClientTimeout:        5 * time.Second,
+		EnhancedMetrics:          true,
+		TruncateTags:             true,
+		NormalizeTags:            true,
+		DDTraceEnabled:           true,
+		UniversalInstrumentation: true,
+		CaptureHandlerErrors:     true,
+		APIGatewaySpanTags:       true,
+	}, resolved)
+}
+
+func TestResolveConfigRedactsAPIKey(t *testing.T) {
+	resolved := ResolveConfig(&Config{APIKey: "0123456789abcdef", Site: "datadoghq.eu", BatchInterval: time.Second})
+	assert.Equal(t, "***cdef", resolved.APIKey)
+	assert.Equal(t, "Config.APIKey", resolved.APIKeySource)
+	assert.Equal(t, "https://api.datadoghq.eu/api/v1", resolved.Site)
+	assert.Equal(t, time.Second, resolved.BatchInterval)
+	assert.NotContains(t, fmt.Sprintf("%+v", resolved), "0123456789abcdef")
+
+	resolved = ResolveConfig(&Config{KMSAPIKey: "short"})
+	assert.Equal(t, "***", resolved.APIKey)
+	assert.Equal(t, "Config.KMSAPIKey", resolved.APIKeySource)
+}
+
+func TestDistributionSyncWithWrapper(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		assert.NoError(t, DistributionSync(ctx, "critical.metric", 1, "a:b"))
+		assert.Equal(t, 1, calls)
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+	})
+	assert.NoError(t, err)
+}
+
+func TestWrapFunctionSkipsWarmupEvents(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	t.Setenv(UniversalInstrumentation, "false")
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	handler := func(ctx context.Context, ev json.RawMessage) error {
+		Metric("my-metric", 1)
+		return nil
+	}
+	detector := func(event interface{}) bool {
+		return string(event.(json.RawMessage)) == `{"ping":true}`
+	}
+
+	testCases := []struct {
+		name          string
+		cfg           *Config
+		event         string
+		expectedCalls int
+	}{
+		{"default warmup event", &Config{APIKey: "abc-123", Site: server.URL}, `{"warmer":true}`, 0},
+		{"real event", &Config{APIKey: "abc-123", Site: server.URL}, `{"name":"alice"}`, 1},
+		{"custom warmup event", &Config{APIKey: "abc-123", Site: server.URL, WarmupEventDetector: detector}, `{"ping":true}`, 0},
+		{"default warmup event with a custom detector", &Config{APIKey: "abc-123", Site: server.URL, WarmupEventDetector: detector}, `{"warmer":true}`, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls = 0
+			wrapped := WrapFunction(handler, tc.cfg).(func(context.Context, json.RawMessage) (interface{}, error))
+			_, err := wrapped(context.Background(), json.RawMessage(tc.event))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
+
+func TestWrapFunctionDecidesOnceToIgnoreAnInvocation(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	t.Setenv(UniversalInstrumentation, "false")
+	t.Setenv(awsLambdaFunctionNameEnvVar, "my-function")
+
+	spanResourceCalls := 0
+	cfg := &Config{
+		ShouldUseLogForwarder: true,
+		EnhancedMetrics:       true,
+		IgnoreResources:       []string{"/health"},
+		SpanResourceFunc: func(ctx context.Context, event interface{}) string {
+			spanResourceCalls++
+			return ""
+		},
+	}
+	wrapped := WrapFunction(func(ctx context.Context) error { return nil }, cfg).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	logs := captureLogs(t)
+	_, err := wrapped(context.Background(), json.RawMessage(`{"path":"/health"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, spanResourceCalls)
+	assert.NotContains(t, logs.String(), "aws.lambda.enhanced.invocations")
+
+	_, err = wrapped(context.Background(), json.RawMessage(`{"path":"/orders"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, spanResourceCalls)
+	assert.Contains(t, logs.String(), "aws.lambda.enhanced.invocations")
+}
+
+func TestIsColdStart(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	t.Setenv(UniversalInstrumentation, "false")
+
+	coldStarts := []bool{}
+	handler := func(ctx context.Context) error {
+		// The result is stable within an invocation
+		assert.Equal(t, IsColdStart(ctx), IsColdStart(ctx))
+		coldStarts = append(coldStarts, IsColdStart(ctx))
+		return nil
+	}
+	wrapped := WrapFunction(handler, &Config{ShouldUseLogForwarder: true}).(func(context.Context, json.RawMessage) (interface{}, error))
+	for i := 0; i < 2; i++ {
+		_, err := wrapped(context.Background(), json.RawMessage(`{}`))
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []bool{true, false}, coldStarts)
+	assert.False(t, IsColdStart(context.Background()))
+}
+
+func TestDistributionSyncWithoutWrapper(t *testing.T) {
+	assert.Error(t, DistributionSync(context.Background(), "critical.metric", 1))
+}
+
+func TestWrapFunctionWithoutContextSubmitsMetrics(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	type event struct {
+		Name string `json:"name"`
+	}
+	handler := func(ev event) (string, error) {
+		Metric("no-context-metric", 1, "name:"+ev.Name)
+		return "hello " + ev.Name, nil
+	}
+
+	wrapped := WrapFunction(handler, &Config{APIKey: "abc-123", Site: server.URL}).(func(context.Context, json.RawMessage) (interface{}, error))
+	result, err := wrapped(context.Background(), json.RawMessage(`{"name":"alice"}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "hello alice", result)
+	assert.Contains(t, body, `"metric":"no-context-metric"`)
+	assert.Contains(t, body, `"name:alice"`)
+}
+
+func TestWrapFunctionWithoutArgumentsSubmitsMetrics(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	handler := func() error {
+		Metric("no-argument-metric", 1)
+		return nil
+	}
+
+	wrapped := WrapFunction(handler, &Config{APIKey: "abc-123", Site: server.URL}).(func(context.Context, json.RawMessage) (interface{}, error))
+	_, err := wrapped(context.Background(), json.RawMessage(`{}`))
+
+	assert.NoError(t, err)
+	assert.Contains(t, body, `"metric":"no-argument-metric"`)
+}
+
+func TestNonErroringErrors(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "true")
+	t.Setenv(UniversalInstrumentation, "false")
+	errNotFound := errors.New("not found")
+
+	var spans []SpanData
+	var handlerErr error
+	handler := func(ctx context.Context) error { return handlerErr }
+	cfg := &Config{
+		DDTraceEnabled:        true,
+		ShouldUseLogForwarder: true,
+		NonErroringErrors:     []error{errNotFound},
+		OnSpanFinish:          func(span SpanData) { spans = append(spans, span) },
+	}
+	wrapped := WrapFunction(handler, cfg).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	handlerErr = fmt.Errorf("order o-1: %w", errNotFound)
+	_, err := wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.ErrorIs(t, err, errNotFound)
+	handlerErr = errors.New("boom")
+	_, err = wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.Error(t, err)
+
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "aws.lambda", spans[0].Name)
+	assert.NotContains(t, spans[0].Tags, ext.Error)
+	assert.Equal(t, handlerErr, spans[1].Tags[ext.Error])
+}
+
+// countListenerBuilds counts the listeners built for the wrapped handlers, until the end of the test
+func countListenerBuilds(t *testing.T) *int {
+	builds := 0
+	newListeners = func(cfg *Config, strict bool) ([]wrapper.HandlerListener, error) {
+		builds++
+		return buildListeners(cfg, strict)
+	}
+	t.Cleanup(func() { newListeners = buildListeners })
+	return &builds
+}
+
+// setDisabledEnv sets DD_LAMBDA_DISABLED to value, and reads it again, until the end of the test
+func setDisabledEnv(t *testing.T, value string) {
+	t.Setenv(DisabledEnvVar, value)
+	disabledByEnv = sync.OnceValue(readDisabledEnv)
+	t.Cleanup(func() { disabledByEnv = sync.OnceValue(readDisabledEnv) })
+}
+
+func TestDisabled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name string
+		env  string
+		cfg  *Config
+	}{
+		{"env", "true", &Config{APIKey: "abc-123", Site: server.URL}},
+		{"config", "", &Config{Disabled: true, APIKey: "abc-123", Site: server.URL}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setDisabledEnv(t, tc.env)
+			builds := countListenerBuilds(t)
+			handler := func(ctx context.Context) error {
+				Metric("my-metric", 1)
+				DistributionCtx(ctx, "my-metric", 1)
+				_ = DistributionSync(ctx, "my-metric", 1)
+				_ = SubmitSeries(ctx, []Series{{Metric: "my-metric"}})
+				return nil
+			}
+
+			wrapped := WrapFunction(handler, tc.cfg)
+			strict, err := WrapHandlerStrict(handler, tc.cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, reflect.ValueOf(handler).Pointer(), reflect.ValueOf(wrapped).Pointer())
+			assert.Equal(t, reflect.ValueOf(handler).Pointer(), reflect.ValueOf(strict).Pointer())
+
+			invoked := false
+			_, err = InvokeDryRun(func(ctx context.Context) { invoked = true }, tc.cfg)
+			assert.NoError(t, err)
+			assert.True(t, invoked)
+
+			assert.NoError(t, wrapped.(func(context.Context) error)(context.Background()))
+			assert.NoError(t, Validate(tc.cfg))
+
+			assert.Equal(t, 0, *builds)
+			assert.Equal(t, 0, requests)
+			assert.True(t, ResolveConfig(tc.cfg).Disabled)
+		})
+	}
+}
+
+func TestDisabledByEnvMakesThePublicFunctionsNoOps(t *testing.T) {
+	setDisabledEnv(t, "true")
+	logs := captureLogs(t)
+	ctx := context.Background()
+
+	Metric("my-metric", 1)
+	MetricWithTimestamp("my-metric", 1, time.Now())
+	DistributionCtx(ctx, "my-metric", 1)
+	DistributionBatch(ctx, "my-metric", []float64{1, 2})
+	MetricsHandle(ctx).Distribution("my-metric", 1)
+	Log(ctx, "info", "my message", nil)
+	Event(ctx, "my title", "my text")
+	assert.NoError(t, DistributionSync(ctx, "my-metric", 1))
+	assert.NoError(t, SubmitSeries(ctx, []Series{{Metric: "my-metric"}}))
+	assert.NoError(t, FlushAsync(ctx).Wait())
+	assert.NoError(t, SetDistributionPercentiles("my-metric", 99))
+
+	assert.Empty(t, logs.String())
+}
+
+func TestDisabledByEnvIsReadOnce(t *testing.T) {
+	setDisabledEnv(t, "not-a-bool")
+	logs := captureLogs(t)
+
+	assert.False(t, isDisabled(nil))
+	assert.False(t, isDisabled(nil))
+	assert.Equal(t, 1, strings.Count(logs.String(), DisabledEnvVar))
+}
+
+func TestDisabledByConfigOnlyDisablesItsHandler(t *testing.T) {
+	setDisabledEnv(t, "")
+	builds := countListenerBuilds(t)
+	WrapFunction(func() {}, &Config{Disabled: true})
+	WrapFunction(func() {}, &Config{APIKey: "abc-123"})
+
+	assert.False(t, isDisabled(nil))
+	assert.Equal(t, 1, *builds)
+}
+
+func TestWrapHandlerStrict(t *testing.T) {
+	t.Setenv(UniversalInstrumentation, "false")
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	for _, envVar := range []string{DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar, DatadogSiteEnvVar, ShouldUseLogForwarderEnvVar} {
+		t.Setenv(envVar, "")
+	}
+	handler := func(ctx context.Context) error { return nil }
+
+	testCases := []struct {
+		name     string
+		cfg      *Config
+		expected error
+	}{
+		{"valid", &Config{APIKey: "abc-123"}, nil},
+		{"no API key with the log forwarder", &Config{ShouldUseLogForwarder: true}, nil},
+		{"no API key", &Config{}, ErrMissingAPIKey},
+		{"no config", nil, ErrMissingAPIKey},
+		{"encrypted API key with key decryption disabled", &Config{KMSAPIKey: "encrypted", DisableKeyDecryption: true}, ErrMissingAPIKey},
+		{"site with a space", &Config{APIKey: "abc-123", Site: "datadoghq .com"}, ErrInvalidSite},
+		{"site url without a host", &Config{APIKey: "abc-123", Site: "https://"}, ErrInvalidSite},
+		{"missing CA certificates", &Config{APIKey: "abc-123", CACertPath: "/nonexistent/ca.pem"}, fs.ErrNotExist},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wrapped, err := WrapHandlerStrict(handler, tc.cfg)
+			if tc.expected == nil {
+				assert.NoError(t, err)
+				assert.NotNil(t, wrapped)
+			} else {
+				assert.ErrorIs(t, err, tc.expected)
+				assert.Nil(t, wrapped)
+			}
+		})
+	}
+}
+
+func TestDetachedContextKeepsTraceContext(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5ce31dc2-2c779014b90ce44db5e03875;Parent=0b11cc4230d3e09e;Sampled=1")
+	ctx = WithBaggage(ctx, "tenant", "acme")
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	expected := GetTraceHeaders(ctx)
+
+	detached := DetachedContext(ctx)
+	cancel()
+
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, detached.Err())
+	_, hasDeadline := detached.Deadline()
+	assert.False(t, hasDeadline)
+	assert.Equal(t, expected, GetTraceHeaders(detached))
+	assert.Equal(t, "tenant=acme", GetTraceHeaders(detached)["baggage"])
+}
+
+func TestDetachedContextKeepsMetricsListener(t *testing.T) {
+	t.Setenv(UniversalInstrumentation, "false")
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		assert.NotNil(t, metrics.GetListener(DetachedContext(ctx)))
+	}, &Config{ShouldUseLogForwarder: true})
+	assert.NoError(t, err)
+}
+
+func TestBackgroundContextSubmitsMetricsAfterTheHandlerReturned(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	var mu sync.Mutex
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	returned := make(chan struct{})
+	submitted := make(chan struct{})
+	invocations := 0
+	handler := func(ctx context.Context) error {
+		invocations++
+		if invocations == 1 {
+			bg := BackgroundContext()
+			go func() {
+				<-returned
+				DistributionCtx(bg, "background-metric", 1)
+				close(submitted)
+			}()
+		}
+		Metric("handler-metric", 1)
+		return nil
+	}
+	wrapped := WrapFunction(handler, &Config{APIKey: "abc-123", Site: server.URL}).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.NoError(t, err)
+	close(returned)
+	<-submitted
+	_, err = wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, bodies, 2)
+	assert.NotContains(t, bodies[0], "background-metric")
+	assert.Contains(t, bodies[1], `"metric":"background-metric"`)
+	assert.Contains(t, bodies[1], `"metric":"handler-metric"`)
+}
+
+func TestBackgroundContextOutsideOfAnInvocation(t *testing.T) {
+	assert.Equal(t, context.Background(), BackgroundContext())
+}
+
+func TestBeforeSubmit(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		Distribution("kept-metric", 1.25, "a:b")
+		Distribution("dropped-metric", 2)
+	}, &Config{
+		APIKey: "abc-123",
+		Site:   server.URL,
+		BeforeSubmit: func(batch []Series) []Series {
+			result := []Series{}
+			for _, s := range batch {
+				if s.Metric == "dropped-metric" {
+					continue
+				}
+				s.Tags = append(s.Tags, "derived:tag")
+				result = append(result, s)
+			}
+			return result
+		},
+	})
+	assert.NoError(t, err)
+
+	var payload struct {
+		Series []struct {
+			Metric string   `json:"metric"`
+			Tags   []string `json:"tags"`
+		} `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &payload))
+	tagsByMetric := map[string][]string{}
+	for _, series := range payload.Series {
+		tagsByMetric[series.Metric] = series.Tags
+	}
+	assert.NotContains(t, tagsByMetric, "dropped-metric")
+	assert.Contains(t, tagsByMetric["kept-metric"], "a:b")
+	assert.Contains(t, tagsByMetric["kept-metric"], "derived:tag")
+}
+
+// sumAggregator sends the sum of the points of each metric as a gauge
+type sumAggregator struct {
+	sums map[string]float64
+}
+
+func (a *sumAggregator) Add(series Series) {
+	for _, point := range series.Points {
+		a.sums[series.Metric] += point.Value
+	}
+}
+
+func (a *sumAggregator) Flush() []Series {
+	series := []Series{}
+	for metric, sum := range a.sums {
+		series = append(series, Series{Metric: metric + ".sum", Type: "gauge", Points: []SeriesPoint{{Timestamp: time.Now(), Value: sum}}})
+	}
+	a.sums = map[string]float64{}
+	return series
+}
+
+func (a *sumAggregator) Shutdown() {}
+
+func TestCustomAggregator(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1.5)
+		Metric("my-metric", 2)
+	}, &Config{APIKey: "abc-123", Site: server.URL, EnhancedMetrics: false, Aggregator: &sumAggregator{sums: map[string]float64{}}})
+	assert.NoError(t, err)
+
+	var payload struct {
+		Series []struct {
+			Metric string          `json:"metric"`
+			Type   string          `json:"type"`
+			Points [][]interface{} `json:"points"`
+		} `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &payload))
+	assert.Len(t, payload.Series, 1)
+	assert.Equal(t, "my-metric.sum", payload.Series[0].Metric)
+	assert.Equal(t, "gauge", payload.Series[0].Type)
+	assert.Equal(t, 3.5, payload.Series[0].Points[0][1])
+}
+
+func TestDualWriteRequiresAPIKey(t *testing.T) {
+	assert.False(t, requiresAPIKey((&Config{ShouldUseLogForwarder: true}).toMetricsConfig(false), false))
+	assert.True(t, requiresAPIKey((&Config{ShouldUseLogForwarder: true, DualWrite: true}).toMetricsConfig(false), false))
+}
+
+func TestIsLambdaEnvironment(t *testing.T) {
+	t.Setenv(awsLambdaFunctionNameEnvVar, "")
+	assert.False(t, IsLambdaEnvironment())
+	assert.True(t, (&Config{}).toMetricsConfig(false).OutsideLambda)
+	assert.True(t, (&Config{}).toTraceConfig().OutsideLambda)
+
+	t.Setenv(awsLambdaFunctionNameEnvVar, "my-function")
+	assert.True(t, IsLambdaEnvironment())
+	assert.False(t, (&Config{}).toMetricsConfig(false).OutsideLambda)
+	assert.False(t, (&Config{}).toTraceConfig().OutsideLambda)
+}
+
+func TestMissingAPIKeyIsOnlyLoggedWhenRequired(t *testing.T) {
+	for _, envVar := range []string{DatadogAPIKeyEnvVar, DatadogKMSAPIKeyEnvVar, DatadogAPIKeySecretARNEnvVar, ShouldUseLogForwarderEnvVar} {
+		t.Setenv(envVar, "")
+	}
+	const missingAPIKey = "couldn't read DD_API_KEY"
+
+	testCases := []struct {
+		name               string
+		cfg                *Config
+		isExtensionRunning bool
+		env                map[string]string
+		expectError        bool
+	}{
+		{"direct API", &Config{}, false, nil, true},
+		{"log forwarder", &Config{ShouldUseLogForwarder: true}, false, nil, false},
+		{"log forwarder from the environment", &Config{}, false, map[string]string{ShouldUseLogForwarderEnvVar: "true"}, false},
+		{"extension", &Config{}, true, nil, false},
+		{"DogStatsD server", &Config{StatsdAddr: "127.0.0.1:8125"}, false, nil, false},
+		{"dual write", &Config{ShouldUseLogForwarder: true, DualWrite: true}, false, nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			logs := captureLogs(t)
+			tc.cfg.toMetricsConfig(tc.isExtensionRunning)
+			assert.Equal(t, tc.expectError, strings.Contains(logs.String(), missingAPIKey), logs.String())
+		})
+	}
+}
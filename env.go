@@ -0,0 +1,186 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// envConfig holds the settings read from the environment. The optional settings are nil when unset or invalid,
+// and the explicit Config is merged over them.
+type envConfig struct {
+	APIKey          string
+	KMSAPIKey       string
+	APIKeySecretARN string
+	// APIKeyFile is the path of the file holding the API key
+	APIKeyFile string
+	AppKey     string
+	Site       string
+	Env        string
+	Service    string
+	LogLevel   string
+	// FunctionName is set by AWS Lambda, see IsLambdaEnvironment
+	FunctionName string
+	// Region is AWS_REGION, or AWS_DEFAULT_REGION when it's unset
+	Region string
+	// Tags are the tags of DD_TAGS
+	Tags []string
+	// ServiceMapping is the mapping of DD_SERVICE_MAPPING
+	ServiceMapping map[string]string
+	// LambdaServerPort is set by the go1.x runtime, see setupAppSec
+	LambdaServerPort string
+
+	Disabled                 bool
+	AppSecEnabled            bool
+	ShouldUseLogForwarder    bool
+	LocalTest                bool
+	MergeXrayTraces          bool
+	EnhancedMetrics          *bool
+	TraceEnabled             *bool
+	OtelTracerEnabled        *bool
+	UniversalInstrumentation *bool
+	CaptureHandlerErrors     *bool
+	APIGatewaySpanTags       *bool
+}
+
+// EnvVarType is the type of the value of an environment variable
+type EnvVarType string
+
+const (
+	// EnvVarTypeString is a free-form value
+	EnvVarTypeString EnvVarType = "string"
+	// EnvVarTypeBool is a boolean, in one of the formats of strconv.ParseBool
+	EnvVarTypeBool EnvVarType = "bool"
+	// EnvVarTypeTags is a list of tags, in the "key1:value1,key2:value2" or "key1:value1 key2:value2" format
+	EnvVarTypeTags EnvVarType = "tags"
+	// EnvVarTypeMapping is a list of renames, in the "from1:to1,from2:to2" format
+	EnvVarTypeMapping EnvVarType = "mapping"
+)
+
+// EnvVarInfo describes an environment variable read by ddlambda
+type EnvVarInfo struct {
+	Name string
+	Type EnvVarType
+	// Default is the value used when the variable is unset, empty when there is none
+	Default     string
+	Description string
+}
+
+// supportedEnvVars are the environment variables read by loadEnvConfig
+var supportedEnvVars = []EnvVarInfo{
+	{DatadogAPIKeyEnvVar, EnvVarTypeString, "", "The Datadog API key."},
+	{DatadogKMSAPIKeyEnvVar, EnvVarTypeString, "", "The Datadog API key, encrypted with KMS."},
+	{DatadogAPIKeySecretARNEnvVar, EnvVarTypeString, "", "The ARN of a Secrets Manager secret holding the Datadog API key."},
+	{DatadogAPIKeyFileEnvVar, EnvVarTypeString, "", "The path of a file holding the Datadog API key."},
+	{DatadogAppKeyEnvVar, EnvVarTypeString, "", "The Datadog application key."},
+	{DatadogSiteEnvVar, EnvVarTypeString, DefaultSite, "The Datadog site metrics and logs are sent to."},
+	{DatadogEnvEnvVar, EnvVarTypeString, "", "The environment the function runs in."},
+	{DatadogServiceEnvVar, EnvVarTypeString, "", "The service of the spans and logs, the spans defaulting to \"aws.lambda\"."},
+	{LogLevelEnvVar, EnvVarTypeString, "", "The log level of ddlambda, \"debug\" logs the debug messages."},
+	{awsLambdaFunctionNameEnvVar, EnvVarTypeString, "", "The name of the function, set by AWS Lambda."},
+	{AWSRegionEnvVar, EnvVarTypeString, "", "The region of the function, set by AWS Lambda, tagging the enhanced metrics."},
+	{AWSDefaultRegionEnvVar, EnvVarTypeString, "", "The region of the function when AWS_REGION is unset."},
+	{DatadogTagsEnvVar, EnvVarTypeTags, "", "The tags added to every metric."},
+	{ServiceMappingEnvVar, EnvVarTypeMapping, "", "The renames of the services of the spans."},
+	{awsLambdaServerPortEnvVar, EnvVarTypeString, "", "The port of the RPC server of the go1.x runtime, set by AWS Lambda."},
+	{DisabledEnvVar, EnvVarTypeBool, "false", "Turns ddlambda off: the handler isn't wrapped, and nothing is sent."},
+	{serverlessAppSecEnabledEnvVar, EnvVarTypeBool, "false", "Enables AppSec, through the runtime API proxy of the extension."},
+	{ShouldUseLogForwarderEnvVar, EnvVarTypeBool, "false", "Writes the metrics to the logs, for the log forwarder, instead of sending them."},
+	{localTestEnvVar, EnvVarTypeBool, "false", "Makes the extension flush the metrics at the end of each invocation, for local tests."},
+	{MergeXrayTracesEnvVar, EnvVarTypeBool, "false", "Merges the X-Ray and Datadog traces."},
+	{enhancedMetricsEnvVar, EnvVarTypeBool, "true", "Submits the enhanced metrics of the invocations."},
+	{DatadogTraceEnabledEnvVar, EnvVarTypeBool, "true", "Enables Datadog tracing."},
+	{OtelTracerEnabled, EnvVarTypeBool, "false", "Uses the OpenTelemetry tracer provider, when Datadog tracing is enabled."},
+	{UniversalInstrumentation, EnvVarTypeBool, "true", "Lets the extension start the function execution spans."},
+	{CaptureHandlerErrorsEnvVar, EnvVarTypeBool, "true", "Tags the function execution span with the errors of the handler."},
+	{APIGatewaySpanTagsEnvVar, EnvVarTypeBool, "true", "Tags the function execution span with the details of API Gateway requests."},
+}
+
+// SupportedEnvVars returns the environment variables ddlambda reads its configuration from
+func SupportedEnvVars() []EnvVarInfo {
+	return append([]EnvVarInfo(nil), supportedEnvVars...)
+}
+
+// envReader reads typed settings from an environment, like os.Getenv. Invalid values are logged and ignored.
+type envReader func(name string) string
+
+// loadEnvConfig reads the settings supported by ddlambda from getenv
+func loadEnvConfig(getenv func(name string) string) envConfig {
+	env := envReader(getenv)
+	return envConfig{
+		APIKey:          env.string(DatadogAPIKeyEnvVar),
+		KMSAPIKey:       env.string(DatadogKMSAPIKeyEnvVar),
+		APIKeySecretARN: env.string(DatadogAPIKeySecretARNEnvVar),
+		APIKeyFile:      env.string(DatadogAPIKeyFileEnvVar),
+		AppKey:          env.string(DatadogAppKeyEnvVar),
+		Site:            env.string(DatadogSiteEnvVar),
+		Env:             env.string(DatadogEnvEnvVar),
+		Service:         env.string(DatadogServiceEnvVar),
+		LogLevel:        env.string(LogLevelEnvVar),
+		FunctionName:    env.string(awsLambdaFunctionNameEnvVar),
+		Region:          env.firstString(AWSRegionEnvVar, AWSDefaultRegionEnvVar),
+		Tags:            parseDDTags(env.string(DatadogTagsEnvVar)),
+		ServiceMapping:  parseServiceMapping(env.string(ServiceMappingEnvVar)),
+
+		LambdaServerPort: env.string(awsLambdaServerPortEnvVar),
+
+		Disabled:                 env.boolOrDefault(DisabledEnvVar, false),
+		AppSecEnabled:            env.boolOrDefault(serverlessAppSecEnabledEnvVar, false),
+		ShouldUseLogForwarder:    env.boolOrDefault(ShouldUseLogForwarderEnvVar, false),
+		LocalTest:                env.boolOrDefault(localTestEnvVar, false),
+		MergeXrayTraces:          env.boolOrDefault(MergeXrayTracesEnvVar, false),
+		EnhancedMetrics:          env.bool(enhancedMetricsEnvVar),
+		TraceEnabled:             env.bool(DatadogTraceEnabledEnvVar),
+		OtelTracerEnabled:        env.bool(OtelTracerEnabled),
+		UniversalInstrumentation: env.bool(UniversalInstrumentation),
+		CaptureHandlerErrors:     env.bool(CaptureHandlerErrorsEnvVar),
+		APIGatewaySpanTags:       env.bool(APIGatewaySpanTagsEnvVar),
+	}
+}
+
+// string returns the value of the variable, without the surrounding spaces
+func (env envReader) string(name string) string {
+	return strings.TrimSpace(env(name))
+}
+
+// firstString returns the value of the first of the variables that is set
+func (env envReader) firstString(names ...string) string {
+	for _, name := range names {
+		if value := env.string(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// bool returns the boolean value of the variable, in one of the formats of strconv.ParseBool, or nil when it's unset or invalid
+func (env envReader) bool(name string) *bool {
+	value := env.string(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("ignoring %s=%q, it isn't a boolean", name, value))
+		return nil
+	}
+	return &parsed
+}
+
+// boolOrDefault is like bool, but returns defaultValue when the variable is unset or invalid
+func (env envReader) boolOrDefault(name string, defaultValue bool) bool {
+	if value := env.bool(name); value != nil {
+		return *value
+	}
+	return defaultValue
+}
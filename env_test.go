@@ -0,0 +1,170 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeEnv(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	t.Cleanup(func() { logger.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestLoadEnvConfig(t *testing.T) {
+	env := loadEnvConfig(fakeEnv(map[string]string{
+		DatadogAPIKeyEnvVar:         "abc-123",
+		DatadogSiteEnvVar:           " datadoghq.eu ",
+		DatadogTagsEnvVar:           "team:payments,owner:me",
+		ServiceMappingEnvVar:        "orders:orders-queue",
+		ShouldUseLogForwarderEnvVar: "TRUE",
+		localTestEnvVar:             "1",
+		enhancedMetricsEnvVar:       "false",
+		DatadogTraceEnabledEnvVar:   "true",
+	}))
+
+	assert.Equal(t, "abc-123", env.APIKey)
+	assert.Equal(t, "datadoghq.eu", env.Site)
+	assert.Equal(t, []string{"team:payments", "owner:me"}, env.Tags)
+	assert.Equal(t, map[string]string{"orders": "orders-queue"}, env.ServiceMapping)
+	assert.True(t, env.ShouldUseLogForwarder)
+	assert.True(t, env.LocalTest)
+	assert.False(t, *env.EnhancedMetrics)
+	assert.True(t, *env.TraceEnabled)
+	assert.Nil(t, env.CaptureHandlerErrors)
+}
+
+func TestLoadEnvConfigInvalidBool(t *testing.T) {
+	logs := captureLogs(t)
+	env := loadEnvConfig(fakeEnv(map[string]string{
+		ShouldUseLogForwarderEnvVar: "yes please",
+		enhancedMetricsEnvVar:       "maybe",
+	}))
+
+	assert.False(t, env.ShouldUseLogForwarder)
+	assert.Nil(t, env.EnhancedMetrics)
+	assert.Contains(t, logs.String(), `ignoring DD_FLUSH_TO_LOG=\"yes please\", it isn't a boolean`)
+	assert.Contains(t, logs.String(), `ignoring DD_ENHANCED_METRICS=\"maybe\", it isn't a boolean`)
+
+	// The invalid value falls back to the default
+	mc, _ := (&Config{}).toMetricsConfigWithEnv(env, false)
+	assert.True(t, mc.EnhancedMetrics)
+	assert.False(t, mc.ShouldUseLogForwarder)
+}
+
+func TestSupportedEnvVarsAreRead(t *testing.T) {
+	read := map[string]bool{}
+	loadEnvConfig(func(name string) string {
+		read[name] = true
+		return ""
+	})
+
+	supported := map[string]bool{}
+	for _, info := range SupportedEnvVars() {
+		assert.False(t, supported[info.Name], "%s is listed twice", info.Name)
+		supported[info.Name] = true
+		assert.True(t, read[info.Name], "%s isn't read", info.Name)
+		assert.NotEmpty(t, info.Type, info.Name)
+		assert.NotEmpty(t, info.Description, info.Name)
+	}
+	for name := range read {
+		assert.True(t, supported[name], "%s is missing from SupportedEnvVars", name)
+	}
+}
+
+// TestEnvIsOnlyReadByLoadEnvConfig fails on the environment variables read without loadEnvConfig, which would be
+// missing from SupportedEnvVars
+func TestEnvIsOnlyReadByLoadEnvConfig(t *testing.T) {
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		// os.Getenv may only be passed to loadEnvConfig
+		allowed := map[ast.Node]bool{}
+		ast.Inspect(file, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok {
+				if fun, ok := call.Fun.(*ast.Ident); ok && fun.Name == "loadEnvConfig" {
+					for _, arg := range call.Args {
+						allowed[arg] = true
+					}
+				}
+			}
+			return true
+		})
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok || allowed[sel] {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "os" {
+				switch sel.Sel.Name {
+				case "Getenv", "LookupEnv", "Environ":
+					t.Errorf("%s reads the environment without loadEnvConfig", fset.Position(sel.Pos()))
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestConfigTakesPrecedenceOverEnv(t *testing.T) {
+	env := loadEnvConfig(fakeEnv(map[string]string{
+		DatadogAPIKeyEnvVar:        "from-env",
+		DatadogSiteEnvVar:          "datadoghq.eu",
+		CaptureHandlerErrorsEnvVar: "false",
+	}))
+	enabled := true
+
+	mc, apiKeySource := (&Config{APIKey: "from-config", Site: "us3.datadoghq.com"}).toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, "from-config", mc.APIKey)
+	assert.Equal(t, "Config.APIKey", apiKeySource)
+	assert.Equal(t, "https://api.us3.datadoghq.com/api/v1", mc.Site)
+	assert.True(t, (&Config{CaptureHandlerErrors: &enabled}).toTraceConfigWithEnv(env).CaptureHandlerErrors)
+
+	mc, apiKeySource = (&Config{}).toMetricsConfigWithEnv(env, false)
+	assert.Equal(t, "from-env", mc.APIKey)
+	assert.Equal(t, DatadogAPIKeyEnvVar, apiKeySource)
+	assert.Equal(t, "https://api.datadoghq.eu/api/v1", mc.Site)
+	assert.False(t, (&Config{}).toTraceConfigWithEnv(env).CaptureHandlerErrors)
+}
+
+func TestServiceIsReadFromEnv(t *testing.T) {
+	env := loadEnvConfig(fakeEnv(map[string]string{DatadogServiceEnvVar: "my-service"}))
+	var cfg *Config
+
+	assert.Equal(t, "my-service", cfg.toTraceConfigWithEnv(env).Service)
+	assert.Equal(t, "my-service", cfg.toLogsConfig(metrics.Config{}, env).Service)
+}
@@ -0,0 +1,85 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+)
+
+// The alert types and priorities of the events sent with Event.
+const (
+	EventAlertTypeError   = "error"
+	EventAlertTypeWarning = "warning"
+	EventAlertTypeInfo    = "info"
+	EventAlertTypeSuccess = "success"
+
+	EventPriorityNormal = "normal"
+	EventPriorityLow    = "low"
+)
+
+// EventOption sets an optional field of an event sent with Event.
+type EventOption func(*metrics.Event)
+
+// WithEventAlertType sets the alert type of the event, one of the EventAlertType constants. Defaults to "info".
+func WithEventAlertType(alertType string) EventOption {
+	return func(e *metrics.Event) { e.AlertType = alertType }
+}
+
+// WithEventPriority sets the priority of the event, one of the EventPriority constants. Defaults to "normal".
+func WithEventPriority(priority string) EventOption {
+	return func(e *metrics.Event) { e.Priority = priority }
+}
+
+// WithEventTags adds tags to the event, on top of the ones added to every metric.
+func WithEventTags(tags ...string) EventOption {
+	return func(e *metrics.Event) { e.Tags = append(e.Tags, tags...) }
+}
+
+// Event sends an event to the Datadog event stream, e.g. a deploy marker, with the API key and site metrics are sent
+// with. The event is sent straight away, costing a request the handler waits for, and the error is logged if it
+// couldn't be sent. It's tagged like the metrics, and with the trace and span IDs of the span held by ctx, if any.
+// With the log forwarder, the event is written to stdout in the JSON format of the events API instead.
+// If ctx is nil, the last created lambda context is used.
+func Event(ctx context.Context, title, text string, opts ...EventOption) {
+	if isDisabled(nil) {
+		return
+	}
+	if ctx == nil {
+		ctx = GetContext()
+	}
+	if ctx == nil {
+		logger.Debug("no context available, did you wrap your handler?")
+		return
+	}
+
+	listener := metrics.GetListener(ctx)
+	if listener == nil {
+		logger.Error(fmt.Errorf("couldn't get metrics listener from current context"))
+		return
+	}
+
+	event := metrics.Event{Title: title, Text: text}
+	for _, opt := range opts {
+		opt(&event)
+	}
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		event.Tags = append(event.Tags,
+			fmt.Sprintf("dd.trace_id:%d", span.Context().TraceID()),
+			fmt.Sprintf("dd.span_id:%d", span.Context().SpanID()))
+	}
+	if err := listener.AddEvent(ctx, event, listener.Now()); err != nil {
+		logger.Error(fmt.Errorf("couldn't send event: %w", err))
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// sentEvent is the part of the payload of the events API checked by the tests
+type sentEvent struct {
+	Title     string   `json:"title"`
+	Text      string   `json:"text"`
+	AlertType string   `json:"alert_type"`
+	Priority  string   `json:"priority"`
+	Tags      []string `json:"tags"`
+}
+
+func TestEventSendsToTheAPI(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var path string
+	var event sentEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			path = r.URL.Path
+			body, _ := io.ReadAll(r.Body)
+			assert.NoError(t, json.Unmarshal(body, &event))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	var traceID, spanID uint64
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		span, ctx := tracer.StartSpanFromContext(ctx, "deploy")
+		defer span.Finish()
+		traceID, spanID = span.Context().TraceID(), span.Context().SpanID()
+		Event(ctx, "Deployed", "v1.2.3",
+			WithEventAlertType(EventAlertTypeSuccess),
+			WithEventPriority(EventPriorityLow),
+			WithEventTags("version:1.2.3"))
+	}, &Config{APIKey: "abc-123", Site: server.URL})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/api/v1/events", path)
+	assert.Equal(t, "Deployed", event.Title)
+	assert.Equal(t, "v1.2.3", event.Text)
+	assert.Equal(t, "success", event.AlertType)
+	assert.Equal(t, "low", event.Priority)
+	assert.Contains(t, event.Tags, "version:1.2.3")
+	assert.Contains(t, event.Tags, fmt.Sprintf("dd.trace_id:%d", traceID))
+	assert.Contains(t, event.Tags, fmt.Sprintf("dd.span_id:%d", spanID))
+}
+
+func TestEventWithLogForwarder(t *testing.T) {
+	t.Setenv(DatadogTraceEnabledEnvVar, "false")
+	output := captureLogs(t)
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		Event(ctx, "Deployed", "v1.2.3", WithEventAlertType(EventAlertTypeWarning))
+	}, &Config{ShouldUseLogForwarder: true})
+	assert.NoError(t, err)
+
+	found := false
+	for _, line := range strings.Split(output.String(), "\n") {
+		var event sentEvent
+		if json.Unmarshal([]byte(line), &event) != nil || event.Title == "" {
+			continue
+		}
+		found = true
+		assert.Equal(t, "Deployed", event.Title)
+		assert.Equal(t, "v1.2.3", event.Text)
+		assert.Equal(t, "warning", event.AlertType)
+	}
+	assert.True(t, found)
+}
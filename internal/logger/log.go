@@ -28,6 +28,11 @@ func SetLogLevel(ll LogLevel) {
 	logLevel = ll
 }
 
+// IsDebugEnabled reports whether debug messages are logged. It can be used to avoid building messages that won't be logged.
+func IsDebugEnabled() bool {
+	return logLevel <= LevelDebug
+}
+
 // SetOutput changes the writer for the logger
 func SetOutput(w io.Writer) {
 	log.SetOutput(w)
@@ -36,9 +41,13 @@ func SetOutput(w io.Writer) {
 
 // Error logs a structured error message to stdout
 func Error(err error) {
+	message, ok := limitError(redact(fmt.Sprintf("datadog: %s", err.Error())))
+	if !ok {
+		return
+	}
 	finalMessage := logStructure{
 		Status:  "error",
-		Message: fmt.Sprintf("datadog: %s", err.Error()),
+		Message: message,
 	}
 	result, _ := json.Marshal(finalMessage)
 
@@ -52,7 +61,7 @@ func Debug(message string) {
 	}
 	finalMessage := logStructure{
 		Status:  "debug",
-		Message: fmt.Sprintf("datadog: %s", message),
+		Message: redact(fmt.Sprintf("datadog: %s", message)),
 	}
 
 	result, _ := json.Marshal(finalMessage)
@@ -67,7 +76,7 @@ func Warn(message string) {
 	}
 	finalMessage := logStructure{
 		Status:  "warning",
-		Message: fmt.Sprintf("datadog: %s", message),
+		Message: redact(fmt.Sprintf("datadog: %s", message)),
 	}
 
 	result, _ := json.Marshal(finalMessage)
@@ -77,7 +86,7 @@ func Warn(message string) {
 
 // Raw prints a raw message to the logs.
 func Raw(message string) {
-	fmt.Fprintln(output, message)
+	fmt.Fprintln(output, redact(message))
 }
 
 type logStructure struct {
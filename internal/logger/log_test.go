@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMask(t *testing.T) {
+	assert.Equal(t, "", Mask(""))
+	assert.Equal(t, "***", Mask("12345678"))
+	assert.Equal(t, "***cdef", Mask("0123456789abcdef"))
+}
+
+func TestLogsMaskSecrets(t *testing.T) {
+	const secret = "redact-test-0123456789abcdef"
+	AddSecret(secret)
+	AddSecret("short")
+
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	SetLogLevel(LevelDebug)
+	defer SetLogLevel(LevelWarn)
+
+	Error(errors.New("request failed: https://api.datadoghq.com/api/v1/series?api_key=" + secret))
+	Debug("using key " + secret)
+	Warn("using key " + secret)
+	Raw(`{"key":"` + secret + `"}`)
+
+	output := buf.String()
+	assert.NotContains(t, output, secret)
+	assert.Equal(t, 4, bytes.Count(buf.Bytes(), []byte("***cdef")))
+	assert.Equal(t, "short", redact("short"))
+}
+
+func TestErrorRateLimiting(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	SetErrorInterval(time.Minute)
+	defer SetErrorInterval(0)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := start
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	for i := 0; i < 5; i++ {
+		Error(errors.New("failed to flush metrics"))
+	}
+	Error(errors.New("another error"))
+	current = start.Add(time.Minute)
+	Error(errors.New("failed to flush metrics"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"message":"datadog: failed to flush metrics"`)
+	assert.Contains(t, lines[1], `"message":"datadog: another error"`)
+	assert.Contains(t, lines[2], `"message":"datadog: failed to flush metrics (suppressed 4 times since 2021-01-01T00:00:00Z)"`)
+}
+
+func TestErrorRateLimitingDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+
+	for i := 0; i < 3; i++ {
+		Error(errors.New("failed to flush metrics"))
+	}
+
+	assert.Equal(t, 3, strings.Count(buf.String(), "failed to flush metrics"))
+}
@@ -0,0 +1,66 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxTrackedErrors is the number of distinct error messages above which the ones outside of the window are forgotten
+const maxTrackedErrors = 100
+
+// errorLimiter keeps identical error messages from being logged more than once per interval
+var errorLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	errors   map[string]*trackedError
+}
+
+type trackedError struct {
+	loggedAt   time.Time
+	suppressed int
+}
+
+// now is replaced in tests
+var now = time.Now
+
+// SetErrorInterval makes Error log the same message at most once per interval. The next time a message is logged,
+// it mentions how many times it was suppressed in between. An interval of 0 or less logs every error.
+func SetErrorInterval(interval time.Duration) {
+	errorLimiter.Lock()
+	defer errorLimiter.Unlock()
+	errorLimiter.interval = interval
+	errorLimiter.errors = nil
+}
+
+// limitError returns the message to log for an error, or false when it is suppressed
+func limitError(message string) (string, bool) {
+	errorLimiter.Lock()
+	defer errorLimiter.Unlock()
+	if errorLimiter.interval <= 0 {
+		return message, true
+	}
+
+	t := now()
+	tracked, ok := errorLimiter.errors[message]
+	if ok && t.Sub(tracked.loggedAt) < errorLimiter.interval {
+		tracked.suppressed++
+		return "", false
+	}
+
+	if errorLimiter.errors == nil {
+		errorLimiter.errors = map[string]*trackedError{}
+	}
+	if !ok && len(errorLimiter.errors) >= maxTrackedErrors {
+		for key, other := range errorLimiter.errors {
+			if t.Sub(other.loggedAt) >= errorLimiter.interval {
+				delete(errorLimiter.errors, key)
+			}
+		}
+	}
+	errorLimiter.errors[message] = &trackedError{loggedAt: t}
+	if ok && tracked.suppressed > 0 {
+		return fmt.Sprintf("%s (suppressed %d times since %s)", message, tracked.suppressed, tracked.loggedAt.UTC().Format(time.RFC3339)), true
+	}
+	return message, true
+}
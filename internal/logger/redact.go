@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"strings"
+	"sync"
+)
+
+// secrets are masked in every message logged
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// minSecretLength is the length under which secrets aren't masked: they can't be real keys,
+// and masking them could garble unrelated parts of the messages.
+const minSecretLength = 8
+
+// AddSecret makes the logger mask secret, e.g. an API key or its KMS ciphertext, in every message it logs from now on.
+func AddSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, value := range secrets.values {
+		if value == secret {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, secret)
+}
+
+// Mask only keeps the last 4 characters of secret, like the Datadog UI does for API keys.
+// Secrets of 8 characters or less are masked entirely.
+func Mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "***"
+	}
+	return "***" + secret[len(secret)-4:]
+}
+
+// redact masks the secrets added with AddSecret in message
+func redact(message string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, secret := range secrets.values {
+		if strings.Contains(message, secret) {
+			message = strings.ReplaceAll(message, secret, Mask(secret))
+		}
+	}
+	return message
+}
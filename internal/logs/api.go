@@ -0,0 +1,121 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package logs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+)
+
+const (
+	apiKeyHeader         = "DD-API-KEY"
+	acceptEncodingHeader = "Accept-Encoding"
+	// maxEntriesPerPayload is the maximum number of entries accepted by the logs intake in a single request
+	maxEntriesPerPayload = 1000
+)
+
+type (
+	// APIClient sends logs to the Datadog logs intake
+	APIClient struct {
+		apiKey        string
+		resolveAPIKey func() (string, error)
+		resolveOnce   sync.Once
+		intakeURL     string
+		httpClient    *http.Client
+	}
+)
+
+// MakeAPIClient creates a new API client for the config. Encrypted API keys are only decrypted when the first logs are sent.
+func MakeAPIClient(config Config) *APIClient {
+	client := &APIClient{
+		apiKey:     config.APIKey,
+		intakeURL:  config.Site,
+		httpClient: &http.Client{Timeout: config.HTTPClientTimeout},
+	}
+	logger.AddSecret(config.APIKey)
+	logger.AddSecret(config.KMSAPIKey)
+	if config.APIKey == "" && config.KMSAPIKey != "" {
+		client.resolveAPIKey = func() (string, error) {
+			return metrics.MakeKMSDecrypter(config.FunctionName).Decrypt(config.KMSAPIKey)
+		}
+	} else if config.APIKey == "" && config.APIKeySecretARN != "" {
+		client.resolveAPIKey = func() (string, error) {
+			return metrics.MakeSecretsManagerDecrypter(config.APIKeySecretARN).Decrypt(config.APIKeySecretARN)
+		}
+	}
+	return client
+}
+
+// SendLogs posts the entries to the logs intake, split into payloads the intake accepts
+func (cl *APIClient) SendLogs(ctx context.Context, entries []Entry) error {
+	cl.resolveOnce.Do(func() {
+		if cl.resolveAPIKey == nil {
+			return
+		}
+		apiKey, err := cl.resolveAPIKey()
+		if err != nil {
+			logger.Error(fmt.Errorf("Couldn't decrypt api key for logs %s", err))
+		}
+		logger.AddSecret(apiKey)
+		cl.apiKey = apiKey
+	})
+
+	for start := 0; start < len(entries); start += maxEntriesPerPayload {
+		end := start + maxEntriesPerPayload
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err := cl.postLogs(ctx, entries[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cl *APIClient) postLogs(ctx context.Context, entries []Entry) error {
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("Couldn't marshal logs: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cl.intakeURL, bytes.NewBuffer(content))
+	if err != nil {
+		return fmt.Errorf("Couldn't create send logs request:%v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiKeyHeader, cl.apiKey)
+	req.Header.Set(acceptEncodingHeader, "gzip")
+
+	logger.Debug(fmt.Sprintf("Sending logs payload to url %s with body %s", cl.intakeURL, content))
+
+	resp, err := cl.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Failed to send logs to API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := metrics.ReadResponseBody(resp)
+		return fmt.Errorf("Failed to send logs to API. Status Code %d, Body %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package logs
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendLogsSplitsPayloads(t *testing.T) {
+	payloadSizes := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		entries := []Entry{}
+		assert.NoError(t, json.Unmarshal(body, &entries))
+		payloadSizes = append(payloadSizes, len(entries))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	entries := make([]Entry, maxEntriesPerPayload+1)
+	for i := range entries {
+		entries[i] = Entry{"message": "hello"}
+	}
+	cl := MakeAPIClient(Config{APIKey: "12345", Site: server.URL})
+	err := cl.SendLogs(context.Background(), entries)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{maxEntriesPerPayload, 1}, payloadSizes)
+}
+
+func TestSendLogsBadRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad"))
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(Config{APIKey: "12345", Site: server.URL})
+	err := cl.SendLogs(context.Background(), []Entry{{"message": "hello"}})
+
+	assert.EqualError(t, err, "Failed to send logs to API. Status Code 400, Body bad")
+}
+
+func TestSendLogsDecompressesTheErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte("bad"))
+		gw.Close()
+	}))
+	defer server.Close()
+
+	cl := MakeAPIClient(Config{APIKey: "12345", Site: server.URL})
+	err := cl.SendLogs(context.Background(), []Entry{{"message": "hello"}})
+
+	assert.EqualError(t, err, "Failed to send logs to API. Status Code 400, Body bad")
+}
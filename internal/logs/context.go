@@ -0,0 +1,29 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package logs
+
+import "context"
+
+type contextKeytype int
+
+var logsListenerKey = new(contextKeytype)
+
+// GetListener retrieves the logs listener from a context object.
+func GetListener(ctx context.Context) *Listener {
+	result := ctx.Value(logsListenerKey)
+	if result == nil {
+		return nil
+	}
+	return result.(*Listener)
+}
+
+// AddListener adds a logs listener to a context object
+func AddListener(ctx context.Context, listener *Listener) context.Context {
+	return context.WithValue(ctx, logsListenerKey, listener)
+}
@@ -0,0 +1,122 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package logs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+type (
+	// Listener implements wrapper.HandlerListener, collecting the logs submitted during an invocation,
+	// and sending them to Datadog when it finishes
+	Listener struct {
+		config    *Config
+		apiClient *APIClient
+		mutex     sync.Mutex
+		entries   []Entry
+	}
+
+	// Config gives options for how the listener should work
+	Config struct {
+		APIKey          string
+		KMSAPIKey       string
+		APIKeySecretARN string
+		// Site is the URL of the logs intake endpoint.
+		Site                  string
+		ShouldUseLogForwarder bool
+		HTTPClientTimeout     time.Duration
+		// FunctionName is the encryption context KMSAPIKey is decrypted with when it was encrypted in the Lambda console
+		FunctionName string
+		// Service is the service of the log events, they have none when it's empty
+		Service string
+	}
+
+	// Entry is a log event, in the format accepted by the logs intake
+	Entry map[string]interface{}
+)
+
+const defaultHTTPClientTimeout = time.Second * 5
+
+// MakeListener initializes a new logs lambda listener
+func MakeListener(config Config) Listener {
+	if config.HTTPClientTimeout <= 0 {
+		config.HTTPClientTimeout = defaultHTTPClientTimeout
+	}
+	return Listener{
+		config:    &config,
+		apiClient: MakeAPIClient(config),
+	}
+}
+
+// HandlerStarted adds the logs listener to the context
+func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	return AddListener(ctx, l)
+}
+
+// HandlerFinished sends the logs collected during the invocation
+func (l *Listener) HandlerFinished(ctx context.Context, err error) {
+	l.mutex.Lock()
+	entries := l.entries
+	l.entries = nil
+	l.mutex.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	if sendErr := l.apiClient.SendLogs(ctx, entries); sendErr != nil {
+		logger.Error(fmt.Errorf("failed to send logs: %v", sendErr))
+	}
+}
+
+// AddLog records a log event, correlated with the span held by ctx, if any.
+// The entry is written to stdout straight away when using the log forwarder, and sent when the invocation finishes otherwise.
+func (l *Listener) AddLog(ctx context.Context, level, message string, attributes map[string]interface{}) {
+	entry := makeEntry(ctx, l.config.Service, level, message, attributes)
+
+	if l.config.ShouldUseLogForwarder {
+		result, err := json.Marshal(entry)
+		if err != nil {
+			logger.Error(fmt.Errorf("failed to marshall log for log forwarder with error %v", err))
+			return
+		}
+		logger.Raw(string(result))
+		return
+	}
+
+	l.mutex.Lock()
+	l.entries = append(l.entries, entry)
+	l.mutex.Unlock()
+}
+
+func makeEntry(ctx context.Context, service, level, message string, attributes map[string]interface{}) Entry {
+	entry := make(Entry, len(attributes)+6)
+	for key, value := range attributes {
+		entry[key] = value
+	}
+	entry["message"] = message
+	entry["status"] = strings.ToLower(level)
+	entry["ddsource"] = "lambda"
+	if service != "" {
+		entry["service"] = service
+	}
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		entry["dd.trace_id"] = fmt.Sprint(span.Context().TraceID())
+		entry["dd.span_id"] = fmt.Sprint(span.Context().SpanID())
+	}
+	return entry
+}
@@ -0,0 +1,89 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package logs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+func TestAddLogWithAPI(t *testing.T) {
+	var entries []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "12345", r.Header.Get(apiKeyHeader))
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &entries))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	GetListener(ctx).AddLog(ctx, "INFO", "user logged in", map[string]interface{}{"user": "alice"})
+	assert.Nil(t, entries)
+
+	listener.HandlerFinished(ctx, nil)
+	assert.Equal(t, []map[string]interface{}{{
+		"message":  "user logged in",
+		"status":   "info",
+		"ddsource": "lambda",
+		"user":     "alice",
+	}}, entries)
+}
+
+func TestAddLogWithLogForwarder(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, ShouldUseLogForwarder: true})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stderr)
+	listener.AddLog(ctx, "warn", "disk almost full", nil)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Contains(t, buf.String(), `{"ddsource":"lambda","message":"disk almost full","status":"warn"}`)
+	assert.False(t, called)
+}
+
+func TestAddLogInjectsTraceIDs(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "my-span")
+	defer span.Finish()
+
+	entry := makeEntry(ctx, "", "error", "failed", nil)
+	assert.Equal(t, Entry{
+		"message":     "failed",
+		"status":      "error",
+		"ddsource":    "lambda",
+		"dd.trace_id": fmt.Sprint(span.Context().TraceID()),
+		"dd.span_id":  fmt.Sprint(span.Context().SpanID()),
+	}, entry)
+}
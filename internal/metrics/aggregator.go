@@ -0,0 +1,61 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+// Aggregator aggregates the metrics of the processor between two batches, the Batcher being the default one
+type Aggregator interface {
+	// Add adds a metric to the current batch
+	Add(series Series)
+	// Flush returns the current batch, and starts a new one
+	Flush() []Series
+	// Shutdown is called by Listener.FinalFlush, after the last batch was sent
+	Shutdown()
+}
+
+// sizedAggregator is implemented by the aggregators estimating the size of their batch once serialized, in bytes, for
+// MaxBufferBytes. The processor counts every series added as a new one for the others.
+type sizedAggregator interface {
+	EstimatedSize() int
+}
+
+// metricToSeries converts a metric added to the processor into the series passed to an Aggregator. The series takes
+// over the tags and points of the metric, which belongs to the processor once added.
+func metricToSeries(metric Metric) (Series, bool) {
+	d, ok := metric.(*Distribution)
+	if !ok {
+		return Series{}, false
+	}
+	return Series{
+		Name:   d.Name,
+		Type:   DistributionType,
+		Tags:   d.Tags,
+		Host:   d.Host,
+		Points: d.Values,
+	}, true
+}
+
+// estimatedSeriesListSize estimates the size of series once serialized, in bytes
+func estimatedSeriesListSize(series []Series) int {
+	size := 0
+	for _, s := range series {
+		size += estimatedSeriesSize(BatchKey{name: s.Name, tags: s.Tags, host: s.Host}) + estimatedPointSize*len(s.Points)
+	}
+	return size
+}
+
+// copySeries returns copies of series that don't share their tags and points
+func copySeries(series []Series) []Series {
+	copies := make([]Series, len(series))
+	for i, s := range series {
+		copies[i] = s
+		copies[i].Tags = append([]string(nil), s.Tags...)
+		copies[i].Points = append([]MetricValue(nil), s.Points...)
+	}
+	return copies
+}
@@ -10,11 +10,19 @@ package metrics
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
@@ -33,6 +41,16 @@ type (
 		baseAPIURL        string
 		httpClient        *http.Client
 		context           context.Context
+		// seriesV2 posts the series other than distributions to the v2 intake, which supports resources
+		seriesV2 bool
+		// resources are added to the v2 series without resources of their own
+		resources []Resource
+		// requestDecorator is called with each metrics submission request, right before it's sent
+		requestDecorator func(*http.Request)
+		// sketches posts the distributions to the sketches intake, aggregated into sketches, instead of their points
+		sketches bool
+		// payloadHook is called with the route and the JSON payload of each submission, before it's marshaled
+		payloadHook func(route string, payload interface{})
 	}
 
 	// APIClientOptions contains instantiation options from creating an APIClient.
@@ -41,12 +59,59 @@ type (
 		apiKey            string
 		kmsAPIKey         string
 		decrypter         Decrypter
+		apiKeySecretARN   string
+		secretsDecrypter  Decrypter
 		httpClientTimeout time.Duration
+		// rootCAs are the certificate authorities trusted by the client, the system ones when nil
+		rootCAs          *x509.CertPool
+		seriesV2         bool
+		requestDecorator func(*http.Request)
+		sketches         bool
+		payloadHook      func(route string, payload interface{})
 	}
 
+	// postMetricsModel is the payload of the v1 series and distribution points intakes
 	postMetricsModel struct {
 		Series []APIMetric `json:"series"`
 	}
+
+	// postSeriesV2Model is the payload of the v2 series intake
+	postSeriesV2Model struct {
+		Series []seriesV2 `json:"series"`
+	}
+
+	seriesV2 struct {
+		Metric    string     `json:"metric"`
+		Type      int        `json:"type"`
+		Interval  int64      `json:"interval,omitempty"`
+		Points    []pointV2  `json:"points"`
+		Tags      []string   `json:"tags,omitempty"`
+		Resources []Resource `json:"resources,omitempty"`
+	}
+
+	pointV2 struct {
+		Timestamp int64   `json:"timestamp"`
+		Value     float64 `json:"value"`
+	}
+
+	// tagConfigurationModel is the payload of the tag configuration endpoint, which turns on the percentiles of distributions
+	tagConfigurationModel struct {
+		Data tagConfigurationData `json:"data"`
+	}
+
+	tagConfigurationData struct {
+		Type       string                     `json:"type"`
+		ID         string                     `json:"id"`
+		Attributes tagConfigurationAttributes `json:"attributes"`
+	}
+
+	tagConfigurationAttributes struct {
+		MetricType         MetricType `json:"metric_type,omitempty"`
+		IncludePercentiles bool       `json:"include_percentiles"`
+		// ExcludeTagsMode with no Tags keeps every tag queryable, when creating the configuration
+		ExcludeTagsMode *bool    `json:"exclude_tags_mode,omitempty"`
+		Tags            []string `json:"tags,omitempty"`
+	}
 )
 
 // MakeAPIClient creates a new API client with the given api and app keys
@@ -54,21 +119,71 @@ func MakeAPIClient(ctx context.Context, options APIClientOptions) *APIClient {
 	httpClient := &http.Client{
 		Timeout: options.httpClientTimeout,
 	}
+	if options.rootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: options.rootCAs, MinVersion: tls.VersionTLS12}
+		httpClient.Transport = transport
+	}
 	client := &APIClient{
 		apiKey:     options.apiKey,
 		baseAPIURL: options.baseAPIURL,
 		httpClient: httpClient,
 		context:    ctx,
+		seriesV2:   options.seriesV2,
+
+		requestDecorator: options.requestDecorator,
+		sketches:         options.sketches,
+		payloadHook:      options.payloadHook,
 	}
+	logger.AddSecret(options.apiKey)
+	logger.AddSecret(options.kmsAPIKey)
 	if len(options.apiKey) == 0 && len(options.kmsAPIKey) != 0 {
 		client.apiKeyDecryptChan = client.decryptAPIKey(options.decrypter, options.kmsAPIKey)
+	} else if len(options.apiKey) == 0 && len(options.apiKeySecretARN) != 0 {
+		client.apiKeyDecryptChan = client.decryptAPIKey(options.secretsDecrypter, options.apiKeySecretARN)
 	}
 
 	return client
 }
 
+// LoadCertPool returns the system certificate authorities, along with the ones read from the PEM file at path and from
+// pemCerts, or nil when both are empty.
+func LoadCertPool(path string, pemCerts []byte) (*x509.CertPool, error) {
+	if path == "" && len(pemCerts) == 0 {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no valid PEM certificate found in %s", path)
+		}
+	}
+	if len(pemCerts) > 0 && !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, errors.New("no valid PEM certificate found in the CA certificates")
+	}
+	return pool, nil
+}
+
 // SendMetrics posts a batch metrics payload to the Datadog API
 func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
+	_, err := cl.SendMetricsWithSize(metrics)
+	return err
+}
+
+// SendMetricsWithSize posts a batch metrics payload to the Datadog API, and returns the size in bytes of the payloads sent
+func (cl *APIClient) SendMetricsWithSize(metrics []APIMetric) (int, error) {
+	return cl.SendMetricsWithContext(cl.context, metrics)
+}
+
+// SendMetricsWithContext is like SendMetricsWithSize, but the requests are bound to ctx instead of the client's context
+func (cl *APIClient) SendMetricsWithContext(ctx context.Context, metrics []APIMetric) (int, error) {
 
 	// If the api key was provided as a kms key, wait for it to finish decrypting
 	if cl.apiKeyDecryptChan != nil {
@@ -76,30 +191,115 @@ func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 		cl.apiKeyDecryptChan = nil
 	}
 
-	content, err := marshalAPIMetricsModel(metrics)
+	// Distribution metrics use the "distribution_points" endpoint.
+	// Other metric types use the "series" endpoint, which takes an identical payload.
+	distributions := []APIMetric{}
+	series := []APIMetric{}
+	for _, metric := range metrics {
+		if metric.MetricType == DistributionType {
+			distributions = append(distributions, metric)
+		} else {
+			series = append(series, metric)
+		}
+	}
+
+	size := 0
+	if len(distributions) > 0 && cl.sketches {
+		n, err := cl.postSketches(ctx, distributions)
+		if err != nil {
+			return size, err
+		}
+		size += n
+	} else if len(distributions) > 0 {
+		n, err := cl.postMetrics(ctx, distributionsRoute, distributions)
+		if err != nil {
+			return size, err
+		}
+		size += n
+	}
+	if len(series) > 0 && cl.seriesV2 {
+		n, err := cl.postSeriesV2(ctx, series)
+		if err != nil {
+			return size, err
+		}
+		size += n
+	} else if len(series) > 0 {
+		n, err := cl.postMetrics(ctx, "series", series)
+		if err != nil {
+			return size, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// SetResources sets the resources added to the v2 series without resources of their own
+func (cl *APIClient) SetResources(resources []Resource) {
+	cl.resources = resources
+}
+
+func (cl *APIClient) postSeriesV2(ctx context.Context, series []APIMetric) (int, error) {
+	pm, err := makeSeriesV2Model(series, cl.resources)
 	if err != nil {
-		return fmt.Errorf("Couldn't marshal metrics model: %v", err)
+		return 0, fmt.Errorf("Couldn't marshal metrics model: %v", err)
+	}
+	cl.capturePayload(seriesV2Route, pm)
+	content, err := json.Marshal(pm)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't marshal metrics model: %v", err)
 	}
-	body := bytes.NewBuffer(content)
 
-	// For the moment we only support distribution metrics.
-	// Other metric types use the "series" endpoint, which takes an identical payload.
-	req, err := http.NewRequest("POST", cl.makeRoute("distribution_points"), body)
+	logger.Debug(fmt.Sprintf("Sending payload with body %s", content))
+
+	route := fmt.Sprintf("%s/api/%s", strings.TrimSuffix(cl.baseAPIURL, "/api/v1"), seriesV2Route)
+	return cl.post(ctx, route, "application/json", content)
+}
+
+func (cl *APIClient) postSketches(ctx context.Context, distributions []APIMetric) (int, error) {
+	content, err := marshalSketchPayload(distributions)
 	if err != nil {
-		return fmt.Errorf("Couldn't create send metrics request:%v", err)
+		return 0, fmt.Errorf("Couldn't marshal sketches: %v", err)
 	}
-	req = req.WithContext(cl.context)
 
-	defer req.Body.Close()
+	logger.Debug(fmt.Sprintf("Sending %d distributions as sketches, in %d bytes", len(distributions), len(content)))
+
+	route := fmt.Sprintf("%s/%s", strings.TrimSuffix(cl.baseAPIURL, "/api/v1"), sketchesRoute)
+	return cl.post(ctx, route, "application/x-protobuf", content)
+}
+
+func (cl *APIClient) postMetrics(ctx context.Context, route string, metrics []APIMetric) (int, error) {
+	pm := makeAPIMetricsModel(metrics)
+	cl.capturePayload(route, pm)
+	content, err := json.Marshal(pm)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't marshal metrics model: %v", err)
+	}
 
 	logger.Debug(fmt.Sprintf("Sending payload with body %s", content))
 
-	cl.addAPICredentials(req)
+	// The v1 routes also take the api key as a query parameter, which request decorators may override
+	return cl.post(ctx, cl.makeRoute(route)+"?"+url.Values{apiKeyParam: {cl.apiKey}}.Encode(), "application/json", content)
+}
 
-	resp, err := cl.httpClient.Do(req)
+// post sends content to route with the api key, returning the number of bytes sent
+func (cl *APIClient) post(ctx context.Context, route string, contentType string, content []byte) (int, error) {
+	req, err := http.NewRequest("POST", route, bytes.NewReader(content))
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't create send metrics request:%v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(apiKeyHeader, cl.apiKey)
+	cl.decorateRequest(req)
 
+	resp, err := cl.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("Failed to send metrics to API")
+		// The url.Error wrapping err contains the request URL, which includes the api key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, fmt.Errorf("Failed to send metrics to API: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -107,17 +307,128 @@ func (cl *APIClient) SendMetrics(metrics []APIMetric) error {
 		if resp.StatusCode == 403 {
 			logger.Debug(fmt.Sprintf("authorization failed with api key of length %d characters", len(cl.apiKey)))
 		}
-		bodyBytes, err := io.ReadAll(resp.Body)
+		bodyBytes, err := ReadResponseBody(resp)
 		body := ""
 		if err == nil {
 			body = string(bodyBytes)
 		}
-		return fmt.Errorf("Failed to send metrics to API. Status Code %d, Body %s", resp.StatusCode, body)
+		return 0, fmt.Errorf("Failed to send metrics to API. Status Code %d, Body %s", resp.StatusCode, body)
+	}
+	return len(content), nil
+}
+
+// ValidateAPIKey checks that the API key is valid, using the validate endpoint
+func (cl *APIClient) ValidateAPIKey() error {
+	if cl.apiKeyDecryptChan != nil {
+		cl.apiKey = <-cl.apiKeyDecryptChan
+		cl.apiKeyDecryptChan = nil
+	}
+	if cl.apiKey == "" {
+		return errors.New("API key is empty")
+	}
+
+	req, err := http.NewRequest("GET", cl.makeRoute("validate"), nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't create validate request: %v", err)
+	}
+	req = req.WithContext(cl.context)
+	cl.addAPICredentials(req)
+
+	resp, err := cl.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Failed to reach the API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 403 {
+		return fmt.Errorf("API key of length %d characters is invalid", len(cl.apiKey))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := ReadResponseBody(resp)
+		return fmt.Errorf("Failed to validate API key. Status Code %d, Body %s", resp.StatusCode, string(bodyBytes))
 	}
 
+	result := struct {
+		Valid bool `json:"valid"`
+	}{}
+	body, err := ReadResponseBody(resp)
+	if err != nil {
+		return fmt.Errorf("Couldn't read validate response: %v", err)
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("Couldn't read validate response: %v", err)
+	}
+	if !result.Valid {
+		return errors.New("API key is invalid")
+	}
+	return nil
+}
+
+// EnableDistributionPercentiles turns on the percentiles of a distribution metric, using the tag configuration API.
+// It creates the tag configuration of the metric, keeping all its tags, or updates the existing one.
+// The API requires an application key on top of the API key.
+func (cl *APIClient) EnableDistributionPercentiles(metric string, appKey string) error {
+	if cl.apiKeyDecryptChan != nil {
+		cl.apiKey = <-cl.apiKeyDecryptChan
+		cl.apiKeyDecryptChan = nil
+	}
+	excludeTagsMode := true
+	created := tagConfigurationModel{Data: tagConfigurationData{
+		Type: "manage_tags",
+		ID:   metric,
+		Attributes: tagConfigurationAttributes{
+			MetricType:         DistributionType,
+			IncludePercentiles: true,
+			ExcludeTagsMode:    &excludeTagsMode,
+			Tags:               []string{},
+		},
+	}}
+	status, err := cl.sendTagConfiguration(http.MethodPost, metric, appKey, created)
+	if err == nil || status != http.StatusConflict {
+		return err
+	}
+	// The metric already has a tag configuration, only turn its percentiles on
+	updated := tagConfigurationModel{Data: tagConfigurationData{
+		Type:       "manage_tags",
+		ID:         metric,
+		Attributes: tagConfigurationAttributes{IncludePercentiles: true},
+	}}
+	_, err = cl.sendTagConfiguration(http.MethodPatch, metric, appKey, updated)
 	return err
 }
 
+func (cl *APIClient) sendTagConfiguration(method string, metric string, appKey string, model tagConfigurationModel) (int, error) {
+	content, err := json.Marshal(model)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't marshal tag configuration: %v", err)
+	}
+	route := fmt.Sprintf("%s/api/v2/metrics/%s/tags", strings.TrimSuffix(cl.baseAPIURL, "/api/v1"), url.PathEscape(metric))
+	req, err := http.NewRequest(method, route, bytes.NewReader(content))
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't create tag configuration request: %v", err)
+	}
+	req = req.WithContext(cl.context)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiKeyHeader, cl.apiKey)
+	req.Header.Set(appKeyHeader, appKey)
+
+	resp, err := cl.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to configure the percentiles of %s: %w", metric, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := ReadResponseBody(resp)
+		return resp.StatusCode, fmt.Errorf("Failed to configure the percentiles of %s. Status Code %d, Body %s", metric, resp.StatusCode, string(bodyBytes))
+	}
+	return resp.StatusCode, nil
+}
+
 func (cl *APIClient) decryptAPIKey(decrypter Decrypter, kmsAPIKey string) <-chan string {
 
 	ch := make(chan string)
@@ -127,6 +438,7 @@ func (cl *APIClient) decryptAPIKey(decrypter Decrypter, kmsAPIKey string) <-chan
 		if err != nil {
 			logger.Error(fmt.Errorf("Couldn't decrypt api kms key %s", err))
 		}
+		logger.AddSecret(result)
 		ch <- result
 		close(ch)
 	}()
@@ -139,14 +451,98 @@ func (cl *APIClient) addAPICredentials(req *http.Request) {
 	req.URL.RawQuery = query.Encode()
 }
 
+// ReadResponseBody reads the body of resp, decompressing it when it's gzipped. The transport only decompresses the
+// responses itself when the request doesn't set its own Accept-Encoding header, e.g. with a request decorator.
+func ReadResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress the response: %w", err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// DistributionsURL returns the URL distributions are posted to, for the base URL of the API
+func DistributionsURL(baseAPIURL string) string {
+	return fmt.Sprintf("%s/%s", baseAPIURL, distributionsRoute)
+}
+
+// decorateRequest asks for a gzipped response, read with ReadResponseBody, then lets the request decorator change a
+// submission request, after its credentials are set so it can override them
+func (cl *APIClient) decorateRequest(req *http.Request) {
+	req.Header.Set(acceptEncodingHeader, "gzip")
+	if cl.requestDecorator != nil {
+		cl.requestDecorator(req)
+	}
+}
+
 func (cl *APIClient) makeRoute(route string) string {
 	url := fmt.Sprintf("%s/%s", cl.baseAPIURL, route)
 	logger.Debug(fmt.Sprintf("posting to url %s", url))
 	return url
 }
 
+// capturePayload calls the payload hook of the client, if any, with the payload about to be posted to route
+func (cl *APIClient) capturePayload(route string, payload interface{}) {
+	if cl.payloadHook != nil {
+		cl.payloadHook(route, payload)
+	}
+}
+
+func makeAPIMetricsModel(metrics []APIMetric) postMetricsModel {
+	return postMetricsModel{Series: metrics}
+}
+
 func marshalAPIMetricsModel(metrics []APIMetric) ([]byte, error) {
-	pm := postMetricsModel{}
-	pm.Series = metrics
+	return json.Marshal(makeAPIMetricsModel(metrics))
+}
+
+// makeSeriesV2Model converts metrics to the v2 format, where the host is a resource, adding defaultResources to the
+// metrics without resources
+func makeSeriesV2Model(metrics []APIMetric, defaultResources []Resource) (postSeriesV2Model, error) {
+	pm := postSeriesV2Model{Series: make([]seriesV2, len(metrics))}
+	for i, metric := range metrics {
+		s := seriesV2{
+			Metric:    metric.Name,
+			Type:      seriesV2Types[metric.MetricType],
+			Points:    make([]pointV2, 0, len(metric.Points)),
+			Tags:      metric.Tags,
+			Resources: metric.Resources,
+		}
+		if metric.Interval != nil {
+			// The v2 intake takes whole seconds, a window shorter than a second still being one
+			s.Interval = int64(math.Max(1, math.Round(*metric.Interval)))
+		}
+		for _, point := range metric.Points {
+			pair, ok := point.([]interface{})
+			if !ok || len(pair) != 2 {
+				return postSeriesV2Model{}, fmt.Errorf("metric %s has a malformed point %v", metric.Name, point)
+			}
+			timestamp, okTimestamp := pair[0].(float64)
+			value, okValue := pair[1].(float64)
+			if !okTimestamp || !okValue {
+				return postSeriesV2Model{}, fmt.Errorf("metric %s has a malformed point %v", metric.Name, point)
+			}
+			s.Points = append(s.Points, pointV2{Timestamp: int64(timestamp), Value: value})
+		}
+		if len(s.Resources) == 0 {
+			s.Resources = defaultResources
+		}
+		if metric.Host != nil {
+			s.Resources = append(append([]Resource{}, s.Resources...), Resource{Type: "host", Name: *metric.Host})
+		}
+		pm.Series[i] = s
+	}
+	return pm, nil
+}
+
+func marshalSeriesV2Model(metrics []APIMetric, defaultResources []Resource) ([]byte, error) {
+	pm, err := makeSeriesV2Model(metrics, defaultResources)
+	if err != nil {
+		return nil, err
+	}
 	return json.Marshal(pm)
 }
@@ -9,15 +9,29 @@
 package metrics
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/stretchr/testify/assert"
 )
 
+// updateGolden rewrites the golden files with the payloads of the tests, run with go test ./internal/metrics -update
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
 const (
 	mockAPIKey          = "12345"
 	mockEncryptedAPIKey = "mockEncrypted"
@@ -112,6 +126,55 @@ func TestSendMetricsBadRequest(t *testing.T) {
 	assert.True(t, called)
 }
 
+// gzippedErrorServer answers every request with a gzipped 400 response, like the API does for the rejected payloads
+func gzippedErrorServer(t *testing.T, acceptEncodings *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*acceptEncodings = append(*acceptEncodings, r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		gw := gzip.NewWriter(w)
+		_, err := gw.Write([]byte(`{"errors":["Invalid metric"]}`))
+		assert.NoError(t, err)
+		assert.NoError(t, gw.Close())
+	}))
+}
+
+func TestSendMetricsDecompressesTheErrorResponse(t *testing.T) {
+	am := []APIMetric{{Name: "metric-1", MetricType: DistributionType, Points: []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}}}}
+	decorators := map[string]func(*http.Request){
+		"default":             nil,
+		"own accept-encoding": func(req *http.Request) { req.Header.Set("Accept-Encoding", "gzip") },
+	}
+	for name, decorator := range decorators {
+		t.Run(name, func(t *testing.T) {
+			acceptEncodings := []string{}
+			server := gzippedErrorServer(t, &acceptEncodings)
+			defer server.Close()
+
+			cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, requestDecorator: decorator})
+			err := cl.SendMetrics(am)
+
+			assert.EqualError(t, err, `Failed to send metrics to API. Status Code 400, Body {"errors":["Invalid metric"]}`)
+			assert.Equal(t, []string{"gzip"}, acceptEncodings)
+		})
+	}
+}
+
+func TestFailedFlushLogsTheDecompressedErrorResponse(t *testing.T) {
+	acceptEncodings := []string{}
+	server := gzippedErrorServer(t, &acceptEncodings)
+	defer server.Close()
+
+	ml := MakeListener(Config{APIKey: mockAPIKey, Site: server.URL}, &extension.ExtensionManager{})
+	output := captureOutput(func() {
+		ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+		ml.AddDistributionMetric("metric-1", 1, time.Now(), false)
+		ml.HandlerFinished(ctx, nil)
+	})
+
+	assert.Contains(t, output, `Status Code 400, Body {\"errors\":[\"Invalid metric\"]}`)
+}
+
 func TestSendMetricsCantReachServer(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -170,3 +233,371 @@ func TestDecryptsUsingKMSKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, called)
 }
+
+func TestDecryptedAPIKeyIsMaskedInLogs(t *testing.T) {
+	const encrypted = "AQICAHjEncryptedCiphertext"
+	const decrypted = "fedcba9876543210fedcba9876543210"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("bad request " + r.URL.String()))
+	}))
+	defer server.Close()
+
+	md := mockDecrypter{returnValue: decrypted}
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, kmsAPIKey: encrypted, decrypter: &md})
+	err := cl.SendMetrics([]APIMetric{{Name: "metric-1", MetricType: DistributionType}})
+	assert.Error(t, err)
+
+	output := captureOutput(func() {
+		logger.Error(err)
+		logger.Error(fmt.Errorf("couldn't decrypt %s", encrypted))
+	})
+	assert.Contains(t, output, "api_key=***3210")
+	assert.NotContains(t, output, decrypted)
+	assert.NotContains(t, output, encrypted)
+}
+
+func TestSendMetricsRoutesGaugesToSeries(t *testing.T) {
+	routes := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes = append(routes, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	am := []APIMetric{
+		{
+			Name:       "metric-1",
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}},
+		},
+		{
+			Name:       "metric-1.max",
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1), float64(2)}},
+		},
+	}
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	err := cl.SendMetrics(am)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/distribution_points", "/series"}, routes)
+}
+
+func TestEveryRouteHandlesTheFailedRequestsAlike(t *testing.T) {
+	logger.SetLogLevel(logger.LevelDebug)
+	defer logger.SetLogLevel(logger.LevelWarn)
+
+	routes := map[string]struct {
+		options APIClientOptions
+		metric  APIMetric
+	}{
+		"series":    {APIClientOptions{}, APIMetric{Name: "metric-1", MetricType: GaugeType, Points: []interface{}{[]interface{}{float64(1), float64(2)}}}},
+		"series v2": {APIClientOptions{seriesV2: true}, APIMetric{Name: "metric-1", MetricType: GaugeType, Points: []interface{}{[]interface{}{float64(1), float64(2)}}}},
+		"sketches":  {APIClientOptions{sketches: true}, APIMetric{Name: "metric-1", MetricType: DistributionType, Points: []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}}}},
+	}
+	for name, route := range routes {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer server.Close()
+
+			options := route.options
+			options.baseAPIURL = server.URL + "/api/v1"
+			options.apiKey = mockAPIKey
+			cl := MakeAPIClient(context.Background(), options)
+			output := captureOutput(func() {
+				assert.EqualError(t, cl.SendMetrics([]APIMetric{route.metric}), "Failed to send metrics to API. Status Code 403, Body ")
+			})
+			assert.Contains(t, output, "authorization failed with api key of length 5 characters")
+
+			// The error of an unreachable API doesn't contain the request URL
+			server.Close()
+			err := cl.SendMetrics([]APIMetric{route.metric})
+			assert.Error(t, err)
+			assert.NotContains(t, err.Error(), server.URL)
+		})
+	}
+}
+
+func TestSendMetricsWithSeriesV2(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusAccepted)
+		body, _ := io.ReadAll(r.Body)
+
+		assert.Equal(t, "/api/v2/series", r.URL.Path)
+		assert.Equal(t, mockAPIKey, r.Header.Get("DD-API-KEY"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, `{"series":[{"metric":"metric-1.max","type":3,"points":[{"timestamp":1000,"value":2}],"tags":["a","b"],"resources":[{"type":"aws.lambda","name":"arn:aws:lambda:us-east-1:123497558138:function:my-function"},{"type":"host","name":"my-host"}]}]}`, string(body))
+	}))
+	defer server.Close()
+
+	host := "my-host"
+	am := []APIMetric{
+		{
+			Name:       "metric-1.max",
+			Host:       &host,
+			Tags:       []string{"a", "b"},
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1000), float64(2)}},
+		},
+	}
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL + "/api/v1", apiKey: mockAPIKey, seriesV2: true})
+	cl.SetResources([]Resource{{Type: LambdaResourceType, Name: "arn:aws:lambda:us-east-1:123497558138:function:my-function"}})
+	err := cl.SendMetrics(am)
+
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestMarshalSeriesV2ModelKeepsOwnResources(t *testing.T) {
+	interval := 10.0
+	am := []APIMetric{
+		{
+			Name:       "metric-1",
+			MetricType: CountType,
+			Interval:   &interval,
+			Points:     []interface{}{[]interface{}{float64(1000), float64(3)}},
+			Resources:  []Resource{{Type: "service", Name: "my-service"}},
+		},
+	}
+
+	content, err := marshalSeriesV2Model(am, []Resource{{Type: LambdaResourceType, Name: "my-function"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"series":[{"metric":"metric-1","type":1,"interval":10,"points":[{"timestamp":1000,"value":3}],"resources":[{"type":"service","name":"my-service"}]}]}`, string(content))
+}
+
+func TestSendMetricsWithRequestDecorator(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusAccepted)
+
+		assert.Equal(t, "/proxy/series", r.URL.Path)
+		assert.Equal(t, "overridden", r.URL.Query().Get("api_key"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	am := []APIMetric{
+		{
+			Name:       "metric-1.max",
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1), float64(2)}},
+		},
+	}
+
+	decorator := func(req *http.Request) {
+		assert.Equal(t, mockAPIKey, req.URL.Query().Get("api_key"))
+		req.URL.Path = "/proxy" + req.URL.Path
+		req.URL.RawQuery = "api_key=overridden"
+		req.Header.Set("Authorization", "Bearer token")
+	}
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey, requestDecorator: decorator})
+	err := cl.SendMetrics(am)
+
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{"valid", http.StatusOK, `{"valid":true}`, ""},
+		{"invalid", http.StatusOK, `{"valid":false}`, "API key is invalid"},
+		{"forbidden", http.StatusForbidden, `{"errors":["Forbidden"]}`, "API key of length 5 characters is invalid"},
+		{"server error", http.StatusInternalServerError, `oops`, "Failed to validate API key. Status Code 500, Body oops"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "GET", r.Method)
+				assert.Equal(t, "/validate?api_key=12345", r.URL.String())
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+			err := cl.ValidateAPIKey()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSendMetricsWithCACertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caPath, caPEM, 0o600))
+	am := []APIMetric{{Name: "metric-1", MetricType: DistributionType, Points: []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}}}}
+
+	// The self-signed certificate of the server isn't trusted by default
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL, apiKey: mockAPIKey})
+	assert.Error(t, cl.SendMetrics(am))
+
+	for name, config := range map[string]Config{"path": {CACertPath: caPath}, "pem": {CACertPEM: caPEM}} {
+		t.Run(name, func(t *testing.T) {
+			config.Site = server.URL
+			config.APIKey = mockAPIKey
+			cl := makeAPIClientFromConfig(config.WithDefaults())
+			assert.NoError(t, cl.SendMetrics(am))
+		})
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	pool, err := LoadCertPool("", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, pool)
+
+	_, err = LoadCertPool(filepath.Join(t.TempDir(), "missing.pem"), nil)
+	assert.Error(t, err)
+
+	_, err = LoadCertPool("", []byte("not a certificate"))
+	assert.Error(t, err)
+}
+
+// goldenMetrics is a representative set of metrics, with each type and the optional fields
+func goldenMetrics() []APIMetric {
+	host := "my-host"
+	interval := 10.0
+	return []APIMetric{
+		{
+			Name:       "my.distribution",
+			Tags:       []string{"env:prod", "team:lambda"},
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1000), []interface{}{1.5, float64(2), 0.25}}},
+		},
+		{
+			Name:       "my.count",
+			Tags:       []string{"env:prod"},
+			MetricType: CountType,
+			Interval:   &interval,
+			Points:     []interface{}{[]interface{}{float64(1000), float64(3)}, []interface{}{float64(1010), float64(4)}},
+		},
+		{
+			Name:       "my.gauge",
+			Host:       &host,
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1000), 42.5}},
+			Resources:  []Resource{{Type: "service", Name: "my-service"}},
+		},
+	}
+}
+
+// assertGolden compares payload, marshaled like the client sends it, to the golden file testdata/name
+func assertGolden(t *testing.T, name string, payload interface{}) {
+	content, err := json.Marshal(payload)
+	assert.NoError(t, err)
+	var indented bytes.Buffer
+	assert.NoError(t, json.Indent(&indented, content, "", "  "))
+	indented.WriteString("\n")
+
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		assert.NoError(t, os.MkdirAll("testdata", 0o755))
+		assert.NoError(t, os.WriteFile(path, indented.Bytes(), 0o644))
+	}
+	expected, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), indented.String())
+}
+
+func TestSubmittedPayloadsMatchGoldenFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name     string
+		seriesV2 bool
+		golden   map[string]string
+	}{
+		{"v1", false, map[string]string{distributionsRoute: "distribution-points-v1.golden.json", "series": "series-v1.golden.json"}},
+		{"v2", true, map[string]string{distributionsRoute: "distribution-points-v1.golden.json", seriesV2Route: "series-v2.golden.json"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payloads := map[string]interface{}{}
+			cl := MakeAPIClient(context.Background(), APIClientOptions{
+				baseAPIURL:  server.URL + "/api/v1",
+				apiKey:      mockAPIKey,
+				seriesV2:    tc.seriesV2,
+				payloadHook: func(route string, payload interface{}) { payloads[route] = payload },
+			})
+			cl.SetResources([]Resource{{Type: LambdaResourceType, Name: "arn:aws:lambda:us-east-1:123497558138:function:my-function"}})
+
+			assert.NoError(t, cl.SendMetrics(goldenMetrics()))
+
+			assert.Len(t, payloads, len(tc.golden))
+			for route, golden := range tc.golden {
+				assert.Contains(t, payloads, route)
+				assertGolden(t, golden, payloads[route])
+			}
+		})
+	}
+}
+
+func TestSendMetricsWithSeriesV2RoundsTheWindowOfTheBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name     string
+		window   time.Duration
+		expected int64
+	}{
+		{"sub-second", 400 * time.Millisecond, 1},
+		{"fractional", 2500 * time.Millisecond, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var intervals []int64
+			cl := MakeAPIClient(context.Background(), APIClientOptions{
+				baseAPIURL: server.URL + "/api/v1",
+				apiKey:     mockAPIKey,
+				seriesV2:   true,
+				payloadHook: func(route string, payload interface{}) {
+					if route != seriesV2Route {
+						return
+					}
+					for _, s := range payload.(postSeriesV2Model).Series {
+						intervals = append(intervals, s.Interval)
+					}
+				},
+			})
+			mts := makeMockTimeService()
+			options := makeTestProcessorOptions()
+			options.BatchInterval = 10 * time.Second
+			options.HealthMetrics = true
+			processor := MakeProcessor(context.Background(), cl, &mts, options)
+			processor.StartProcessing()
+
+			mts.now = mts.now.Add(tc.window)
+			processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+			processor.FinishProcessing()
+
+			assert.Equal(t, []int64{tc.expected}, intervals)
+		})
+	}
+}
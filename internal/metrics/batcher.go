@@ -9,9 +9,9 @@
 package metrics
 
 import (
-	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +20,10 @@ type (
 	Batcher struct {
 		metrics       map[string]Metric
 		batchInterval time.Duration
+		// rollupDistributions summarizes distributions into gauges instead of sending every point
+		rollupDistributions bool
+		// size is a rough estimate of the size of the batch once serialized, in bytes
+		size int
 	}
 	// BatchKey identifies a batch of metrics
 	BatchKey struct {
@@ -45,34 +49,155 @@ func (b *Batcher) AddMetric(metric Metric) {
 		existing.Join(metric)
 	} else {
 		b.metrics[sk] = metric
+		b.size += estimatedSeriesSize(metric.ToBatchKey())
 	}
+	b.size += estimatedPointSize * pointCount(metric)
+}
+
+// Add adds the points of a distribution series to the batch, the Batcher being the default Aggregator of the processor
+func (b *Batcher) Add(series Series) {
+	b.AddMetric(&Distribution{Name: series.Name, Tags: series.Tags, Host: series.Host, Values: series.Points})
+}
+
+// Flush returns the batch as series, and starts a new one. Unlike ToSeries, the series take over the tags and points
+// of the batch.
+func (b *Batcher) Flush() []Series {
+	series := make([]Series, 0, len(b.metrics))
+	for _, metric := range b.metrics {
+		if s, ok := metricToSeries(metric); ok {
+			series = append(series, s)
+		}
+	}
+	b.metrics = map[string]Metric{}
+	b.size = 0
+	return series
+}
+
+// Shutdown does nothing, the Batcher has nothing to release
+func (b *Batcher) Shutdown() {}
+
+// EstimatedSize returns a rough estimate of the size of the batch once serialized, in bytes
+func (b *Batcher) EstimatedSize() int {
+	return b.size
 }
 
 // ToAPIMetrics converts the current batch of metrics into API metrics
 func (b *Batcher) ToAPIMetrics() []APIMetric {
+	return b.toAPIMetrics(b.batchInterval)
+}
 
+// toAPIMetrics converts the current batch of metrics into API metrics, the counts being over window
+func (b *Batcher) toAPIMetrics(window time.Duration) []APIMetric {
 	ar := []APIMetric{}
-	interval := b.batchInterval / time.Second
+	interval := window / time.Second
 
 	for _, metric := range b.metrics {
+		if d, ok := metric.(*Distribution); ok && b.rollupDistributions {
+			ar = append(ar, d.ToRollupAPIMetrics(window)...)
+			continue
+		}
 		values := metric.ToAPIMetric(interval)
 		ar = append(ar, values...)
 	}
 	return ar
 }
 
+// estimatedSeriesSize estimates the size of the JSON envelope of a series, excluding its points
+func estimatedSeriesSize(bk BatchKey) int {
+	size := estimatedSeriesOverhead + len(bk.name)
+	for _, tag := range bk.tags {
+		// Each tag is quoted and separated by a comma
+		size += len(tag) + 3
+	}
+	if bk.host != nil {
+		size += len(*bk.host)
+	}
+	return size
+}
+
+func pointCount(metric Metric) int {
+	if d, ok := metric.(*Distribution); ok {
+		return len(d.Values)
+	}
+	return 1
+}
+
+// ToSeries converts the current batch of metrics into series. The series own copies of the tags and points of the batch.
+func (b *Batcher) ToSeries() []Series {
+	series := make([]Series, 0, len(b.metrics))
+	for _, metric := range b.metrics {
+		d, ok := metric.(*Distribution)
+		if !ok {
+			continue
+		}
+		series = append(series, Series{
+			Name:   d.Name,
+			Type:   DistributionType,
+			Tags:   append([]string(nil), d.Tags...),
+			Host:   d.Host,
+			Points: append([]MetricValue(nil), d.Values...),
+		})
+	}
+	return series
+}
+
+// BatchSnapshot holds copies of the metrics of a batch, see Batcher.Snapshot
+type BatchSnapshot struct {
+	metrics []Metric
+}
+
+// Snapshot returns copies of the metrics of the batch, unaffected by the metrics added later
+func (b *Batcher) Snapshot() BatchSnapshot {
+	snapshot := BatchSnapshot{metrics: make([]Metric, 0, len(b.metrics))}
+	for _, metric := range b.metrics {
+		snapshot.metrics = append(snapshot.metrics, copyMetric(metric))
+	}
+	return snapshot
+}
+
+// Restore adds the metrics of snapshot back to the batch, merged with the metrics added since, e.g. to retry a batch
+// that failed to be sent. The snapshot can be restored more than once.
+func (b *Batcher) Restore(snapshot BatchSnapshot) {
+	for _, metric := range snapshot.metrics {
+		b.AddMetric(copyMetric(metric))
+	}
+}
+
+// copyMetric returns a copy of metric that doesn't share its points
+func copyMetric(metric Metric) Metric {
+	d, ok := metric.(*Distribution)
+	if !ok {
+		return metric
+	}
+	copied := *d
+	copied.Values = append([]MetricValue(nil), d.Values...)
+	return &copied
+}
+
 func (b *Batcher) getStringKey(bk BatchKey) string {
 	tagKey := getTagKey(bk.tags)
 
+	// This runs for every point added, so it avoids fmt.Sprintf.
 	if bk.host != nil {
-		return fmt.Sprintf("(%s)-(%s)-(%s)-(%s)", bk.metricType, bk.name, tagKey, *bk.host)
+		return "(" + string(bk.metricType) + ")-(" + bk.name + ")-(" + tagKey + ")-(" + *bk.host + ")"
 	}
-	return fmt.Sprintf("(%s)-(%s)-(%s)", bk.metricType, bk.name, tagKey)
+	return "(" + string(bk.metricType) + ")-(" + bk.name + ")-(" + tagKey + ")"
+}
+
+// tagBufferPool holds the buffers used to sort tags when computing batch keys, to avoid an allocation per point
+var tagBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]string, 0, 16)
+		return &buffer
+	},
 }
 
 func getTagKey(tags []string) string {
-	sortedTags := make([]string, len(tags))
-	copy(sortedTags, tags)
+	buffer := tagBufferPool.Get().(*[]string)
+	sortedTags := append((*buffer)[:0], tags...)
 	sort.Strings(sortedTags)
-	return strings.Join(sortedTags, ":")
+	tagKey := strings.Join(sortedTags, ":")
+	*buffer = sortedTags[:0]
+	tagBufferPool.Put(buffer)
+	return tagKey
 }
@@ -148,3 +148,76 @@ func TestToAPIMetricsSameInterval(t *testing.T) {
 
 	assert.Equal(t, expected, result)
 }
+
+func TestToAPIMetricsRollupDistributions(t *testing.T) {
+	first := time.Unix(1000, 0)
+	last := time.Unix(1005, 0)
+
+	batcher := MakeBatcher(10 * time.Second)
+	batcher.rollupDistributions = true
+	dm := Distribution{
+		Name:   "metric-1",
+		Tags:   []string{"a", "b"},
+		Values: []MetricValue{},
+	}
+
+	dm.AddPoint(first, 4)
+	dm.AddPoint(last, 1)
+	dm.AddPoint(first, 7)
+	dm.AddPoint(first, 8)
+
+	batcher.AddMetric(&dm)
+
+	floatTime := float64(last.Unix())
+	interval := float64(10)
+	result := batcher.ToAPIMetrics()
+	expected := []APIMetric{
+		{Name: "metric-1.min", Tags: []string{"a", "b"}, MetricType: GaugeType, Points: []interface{}{[]interface{}{floatTime, float64(1)}}},
+		{Name: "metric-1.max", Tags: []string{"a", "b"}, MetricType: GaugeType, Points: []interface{}{[]interface{}{floatTime, float64(8)}}},
+		{Name: "metric-1.avg", Tags: []string{"a", "b"}, MetricType: GaugeType, Points: []interface{}{[]interface{}{floatTime, float64(5)}}},
+		{Name: "metric-1.sum", Tags: []string{"a", "b"}, MetricType: GaugeType, Points: []interface{}{[]interface{}{floatTime, float64(20)}}},
+		{Name: "metric-1.count", Tags: []string{"a", "b"}, MetricType: CountType, Interval: &interval, Points: []interface{}{[]interface{}{floatTime, float64(4)}}},
+	}
+
+	assert.Equal(t, expected, result)
+
+	payload, err := marshalAPIMetricsModel(result[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, `{"series":[{"metric":"metric-1.min","tags":["a","b"],"type":"gauge","points":[[1005,1]]}]}`, string(payload))
+
+	payload, err = marshalAPIMetricsModel(result[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, `{"series":[{"metric":"metric-1.count","tags":["a","b"],"type":"count","interval":10,"points":[[1005,4]]}]}`, string(payload))
+}
+
+func TestEstimatedSize(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+	assert.Equal(t, 0, batcher.EstimatedSize())
+
+	batcher.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a:b"}, Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+	seriesSize := batcher.EstimatedSize()
+	assert.Equal(t, estimatedSeriesOverhead+len("metric-1")+len(`"a:b",`)+estimatedPointSize, seriesSize)
+
+	// Points joined to an existing series only add their own size
+	batcher.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a:b"}, Values: []MetricValue{{Timestamp: tm, Value: 2}, {Timestamp: tm, Value: 3}}})
+	assert.Equal(t, seriesSize+2*estimatedPointSize, batcher.EstimatedSize())
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	tm := time.Now()
+	batcher := MakeBatcher(10)
+	batcher.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a:b"}, Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+	snapshot := batcher.Snapshot()
+
+	// The metrics added later don't change the snapshot
+	batcher.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a:b"}, Values: []MetricValue{{Timestamp: tm, Value: 2}}})
+	batcher = MakeBatcher(10)
+	batcher.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a:b"}, Values: []MetricValue{{Timestamp: tm, Value: 3}}})
+	batcher.Restore(snapshot)
+
+	series := batcher.ToSeries()
+	assert.Len(t, series, 1)
+	assert.Equal(t, []MetricValue{{Timestamp: tm, Value: 3}, {Timestamp: tm, Value: 1}}, series[0].Points)
+	assert.Equal(t, estimatedSeriesOverhead+len("metric-1")+len(`"a:b",`)+2*estimatedPointSize, batcher.EstimatedSize())
+}
@@ -0,0 +1,69 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// cardinalityGuard caps the number of distinct tag combinations of each metric name, across the batches of a processor
+type cardinalityGuard struct {
+	limits       map[string]int
+	defaultLimit int
+	// seen holds the tag keys accepted so far, by metric name
+	seen map[string]map[string]struct{}
+	// warned holds the metric names whose drops were logged already, to log them once
+	warned map[string]bool
+}
+
+// makeCardinalityGuard returns nil when there is no limit to enforce
+func makeCardinalityGuard(limits map[string]int, defaultLimit int) *cardinalityGuard {
+	if len(limits) == 0 && defaultLimit <= 0 {
+		return nil
+	}
+	return &cardinalityGuard{
+		limits:       limits,
+		defaultLimit: defaultLimit,
+		seen:         map[string]map[string]struct{}{},
+		warned:       map[string]bool{},
+	}
+}
+
+// allow returns whether the tag combination identified by tagKey can be added to the metric. Combinations already
+// accepted stay allowed, and new ones are dropped once the limit of the metric is reached.
+func (g *cardinalityGuard) allow(name, tagKey string) bool {
+	limit, ok := g.limits[name]
+	if !ok {
+		limit = g.defaultLimit
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	tagKeys, ok := g.seen[name]
+	if !ok {
+		tagKeys = map[string]struct{}{}
+		g.seen[name] = tagKeys
+	}
+	if _, ok := tagKeys[tagKey]; ok {
+		return true
+	}
+	if len(tagKeys) >= limit {
+		if g.warned[name] {
+			return false
+		}
+		g.warned[name] = true
+		logger.Warn(fmt.Sprintf("dropping the new tag combinations of metric %s, it reached its limit of %d tag combinations", name, limit))
+		return false
+	}
+	tagKeys[tagKey] = struct{}{}
+	return true
+}
@@ -12,12 +12,42 @@ import "time"
 
 const (
 	apiKeyParam                        = "api_key"
+	apiKeyHeader                       = "DD-API-KEY"
+	appKeyHeader                       = "DD-APPLICATION-KEY"
+	acceptEncodingHeader               = "Accept-Encoding"
+	distributionsRoute                 = "distribution_points"
+	sketchesRoute                      = "api/beta/sketches"
+	seriesV2Route                      = "v2/series"
 	defaultRetryInterval               = time.Millisecond * 250
+	defaultMaxRetries                  = 2
+	defaultRetryDeadlineMargin         = time.Second
+	defaultCancelledFlushTimeout       = time.Millisecond * 500
 	defaultBatchInterval               = time.Second * 15
+	defaultFlushJitter                 = time.Millisecond * 300
+	defaultQueueCapacity               = 2000
 	defaultHttpClientTimeout           = time.Second * 5
 	defaultCircuitBreakerInterval      = time.Second * 30
 	defaultCircuitBreakerTimeout       = time.Second * 60
 	defaultCircuitBreakerTotalFailures = 4
+
+	// maxTagLength and maxMetricNameLength are the limits documented by Datadog, in characters
+	maxTagLength        = 200
+	maxMetricNameLength = 200
+	// defaultMaxTagsPerPoint is the number of tags a point keeps by default, see Config.MaxTagsPerPoint
+	defaultMaxTagsPerPoint = 1000
+	// truncationIndicator ends the tags and metric names that were truncated
+	truncationIndicator = "..."
+
+	// estimatedSeriesOverhead and estimatedPointSize are rough sizes, in bytes, of the JSON envelope of a series
+	// and of a [timestamp, [value]] point, used to decide when a batch grows past MaxBufferBytes
+	estimatedSeriesOverhead = 64
+	estimatedPointSize      = 32
+
+	// flushSuccessMetric and flushErrorsMetric count the successful and failed flushes, see ProcessorOptions.HealthMetrics
+	flushSuccessMetric = "datadog.lambda_go.flush_success"
+	flushErrorsMetric  = "datadog.lambda_go.flush_errors"
+	// queueDroppedMetric counts the metrics dropped because the queue of the processor was full, see QueuePolicy
+	queueDroppedMetric = "datadog.lambda_go.queue_dropped"
 )
 
 // MetricType enumerates all the available metric types
@@ -27,4 +57,17 @@ const (
 
 	// DistributionType represents a distribution metric
 	DistributionType MetricType = "distribution"
+	// GaugeType represents a gauge metric
+	GaugeType MetricType = "gauge"
+	// CountType represents a count metric
+	CountType MetricType = "count"
 )
+
+// seriesV2Types are the types of the v2 series intake, which are numbers. Distributions have their own intake.
+var seriesV2Types = map[MetricType]int{
+	CountType: 1,
+	GaugeType: 3,
+}
+
+// LambdaResourceType is the type of the resource attributing metrics to a lambda function, named after its ARN
+const LambdaResourceType = "aws.lambda"
@@ -14,6 +14,8 @@ type contextKeytype int
 
 var metricsListenerKey = new(contextKeytype)
 
+var metricsTagsKey = new(contextKeytype)
+
 // GetListener retrieves the metrics listener from a context object.
 func GetListener(ctx context.Context) *Listener {
 	result := ctx.Value(metricsListenerKey)
@@ -27,3 +29,18 @@ func GetListener(ctx context.Context) *Listener {
 func AddListener(ctx context.Context, listener *Listener) context.Context {
 	return context.WithValue(ctx, metricsListenerKey, listener)
 }
+
+// ContextWithTags returns a copy of ctx carrying tags, on top of the tags ctx already carries.
+func ContextWithTags(ctx context.Context, tags ...string) context.Context {
+	parentTags := TagsFromContext(ctx)
+	result := make([]string, 0, len(parentTags)+len(tags))
+	result = append(result, parentTags...)
+	result = append(result, tags...)
+	return context.WithValue(ctx, metricsTagsKey, result)
+}
+
+// TagsFromContext returns the tags added to ctx with ContextWithTags. The result must not be modified.
+func TagsFromContext(ctx context.Context) []string {
+	tags, _ := ctx.Value(metricsTagsKey).([]string)
+	return tags
+}
@@ -28,3 +28,15 @@ func TestGetProcessorSuccess(t *testing.T) {
 	result := GetListener(ctx)
 	assert.NotNil(t, result)
 }
+
+func TestContextWithTags(t *testing.T) {
+	assert.Nil(t, TagsFromContext(context.Background()))
+
+	parent := ContextWithTags(context.Background(), "a:1")
+	first := ContextWithTags(parent, "b:2")
+	second := ContextWithTags(parent, "b:3")
+
+	assert.Equal(t, []string{"a:1"}, TagsFromContext(parent))
+	assert.Equal(t, []string{"a:1", "b:2"}, TagsFromContext(first))
+	assert.Equal(t, []string{"a:1", "b:3"}, TagsFromContext(second))
+}
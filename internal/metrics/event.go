@@ -0,0 +1,104 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+const eventsRoute = "events"
+
+// Event is an event of the Datadog event stream, in the format of the events API
+type Event struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// DateHappened is the POSIX timestamp of the event, the time it's received when 0
+	DateHappened int64 `json:"date_happened,omitempty"`
+	// AlertType is one of "error", "warning", "info" and "success", "info" when empty
+	AlertType string `json:"alert_type,omitempty"`
+	// Priority is "normal" or "low", "normal" when empty
+	Priority string   `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// AddEvent sends an event straight away, with the tags the listener adds to every metric, and returns the error if it
+// couldn't be sent. With the log forwarder, the event is written to stdout in the format of the events API instead.
+func (l *Listener) AddEvent(ctx context.Context, event Event, timestamp time.Time) error {
+	if l.config.DiscardMetrics {
+		return nil
+	}
+	event.Tags = l.addListenerTags(event.Tags)
+	if event.DateHappened == 0 {
+		event.DateHappened = timestamp.Unix()
+	}
+
+	if l.config.ShouldUseLogForwarder || l.config.DualWrite {
+		result, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshall event for log forwarder with error %v", err)
+		}
+		logger.Raw(string(result))
+		if !l.config.DualWrite {
+			return nil
+		}
+	}
+	return l.apiClient.SendEvent(ctx, event)
+}
+
+// SendEvent posts an event to the events API
+func (cl *APIClient) SendEvent(ctx context.Context, event Event) error {
+	// If the api key was provided as a kms key, wait for it to finish decrypting
+	if cl.apiKeyDecryptChan != nil {
+		cl.apiKey = <-cl.apiKeyDecryptChan
+		cl.apiKeyDecryptChan = nil
+	}
+	if cl.apiKey == "" {
+		return errors.New("API key is empty")
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Couldn't marshal event: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cl.makeRoute(eventsRoute), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("Couldn't create send event request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cl.addAPICredentials(req)
+	cl.decorateRequest(req)
+
+	logger.Debug(fmt.Sprintf("Sending event with body %s", content))
+
+	resp, err := cl.httpClient.Do(req)
+	if err != nil {
+		// The url.Error wrapping err contains the request URL, which includes the api key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Failed to send event to API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := ReadResponseBody(resp)
+		return fmt.Errorf("Failed to send event to API. Status Code %d, Body %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
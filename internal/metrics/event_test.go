@@ -0,0 +1,91 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddEventSendsToTheAPI(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events", r.URL.Path)
+		assert.Equal(t, mockAPIKey, r.URL.Query().Get(apiKeyParam))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: mockAPIKey, Site: server.URL, DefaultTags: []string{"env:prod"}}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.AddEvent(ctx, Event{Title: "Deployed", Text: "v1.2.3", AlertType: "success", Tags: []string{"version:1.2.3"}}, time.Unix(1000, 0))
+	listener.HandlerFinished(ctx, nil)
+
+	assert.NoError(t, err)
+	event := Event{}
+	assert.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, "Deployed", event.Title)
+	assert.Equal(t, "v1.2.3", event.Text)
+	assert.Equal(t, "success", event.AlertType)
+	assert.Equal(t, int64(1000), event.DateHappened)
+	assert.Equal(t, []string{"version:1.2.3", "env:prod", runtimeTag}, event.Tags)
+}
+
+func TestAddEventReturnsTheErrorOfTheAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: mockAPIKey, Site: server.URL}, &extension.ExtensionManager{})
+	assert.Error(t, listener.AddEvent(context.Background(), Event{Title: "Deployed"}, time.Now()))
+
+	listener = MakeListener(Config{Site: server.URL}, &extension.ExtensionManager{})
+	assert.EqualError(t, listener.AddEvent(context.Background(), Event{Title: "Deployed"}, time.Now()), "API key is empty")
+}
+
+func TestAddEventWithLogForwarder(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: mockAPIKey, Site: server.URL, ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+	var err error
+	output := captureOutput(func() {
+		err = listener.AddEvent(context.Background(), Event{Title: "Deployed", Text: "v1.2.3", Priority: "low"}, time.Unix(1000, 0))
+	})
+
+	assert.NoError(t, err)
+	assert.False(t, called)
+	event := Event{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(output)), &event))
+	assert.Equal(t, Event{Title: "Deployed", Text: "v1.2.3", DateHappened: 1000, Priority: "low", Tags: []string{runtimeTag}}, event)
+}
+
+func TestAddEventWithDiscardMetrics(t *testing.T) {
+	listener := MakeListener(Config{DiscardMetrics: true}, &extension.ExtensionManager{})
+	output := captureOutput(func() {
+		assert.NoError(t, listener.AddEvent(context.Background(), Event{Title: "Deployed"}, time.Now()))
+	})
+	assert.Empty(t, output)
+}
@@ -11,7 +11,6 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"os"
 
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -25,7 +24,8 @@ type (
 	}
 
 	kmsDecrypter struct {
-		kmsClient *kms.Client
+		kmsClient    *kms.Client
+		functionName string
 	}
 
 	clientDecrypter interface {
@@ -33,31 +33,30 @@ type (
 	}
 )
 
-// functionNameEnvVar is the environment variable that stores the Lambda function name
-const functionNameEnvVar string = "AWS_LAMBDA_FUNCTION_NAME"
-
 // encryptionContextKey is the key added to the encryption context by the Lambda console UI
 const encryptionContextKey string = "LambdaFunctionName"
 
-// MakeKMSDecrypter creates a new decrypter which uses the AWS KMS service to decrypt variables
-func MakeKMSDecrypter() Decrypter {
+// MakeKMSDecrypter creates a new decrypter which uses the AWS KMS service to decrypt variables, encrypted with
+// functionName as encryption context when they were encrypted in the Lambda console
+func MakeKMSDecrypter(functionName string) Decrypter {
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		logger.Error(fmt.Errorf("could not create a new aws config: %v", err))
 		panic(err)
 	}
 	return &kmsDecrypter{
-		kmsClient: kms.NewFromConfig(cfg),
+		kmsClient:    kms.NewFromConfig(cfg),
+		functionName: functionName,
 	}
 }
 
 func (kd *kmsDecrypter) Decrypt(ciphertext string) (string, error) {
-	return decryptKMS(kd.kmsClient, ciphertext)
+	return decryptKMS(kd.kmsClient, ciphertext, kd.functionName)
 }
 
 // decryptKMS decodes and deciphers the base64-encoded ciphertext given as a parameter using KMS.
 // For this to work properly, the Lambda function must have the appropriate IAM permissions.
-func decryptKMS(kmsClient clientDecrypter, ciphertext string) (string, error) {
+func decryptKMS(kmsClient clientDecrypter, ciphertext, functionName string) (string, error) {
 	decodedBytes, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("failed to encode cipher text to base64: %v", err)
@@ -68,7 +67,6 @@ func decryptKMS(kmsClient clientDecrypter, ciphertext string) (string, error) {
 	// is added. We need to try decrypting the API key both with and without the encryption context.
 
 	// Try without encryption context, in case API key was encrypted using the AWS CLI
-	functionName := os.Getenv(functionNameEnvVar)
 	params := &kms.DecryptInput{
 		CiphertextBlob: decodedBytes,
 	}
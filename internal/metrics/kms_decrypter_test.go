@@ -9,7 +9,6 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"os"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/service/kms"
@@ -61,16 +60,13 @@ func (mockKMSClientNoEncryptionContext) Decrypt(_ context.Context, params *kms.D
 }
 
 func TestDecryptKMSWithEncryptionContext(t *testing.T) {
-	os.Setenv(functionNameEnvVar, mockFunctionName)
-	defer os.Setenv(functionNameEnvVar, "")
-
 	client := mockKMSClientWithEncryptionContext{}
-	result, _ := decryptKMS(client, mockEncryptedAPIKeyBase64)
+	result, _ := decryptKMS(client, mockEncryptedAPIKeyBase64, mockFunctionName)
 	assert.Equal(t, expectedDecryptedAPIKey, result)
 }
 
 func TestDecryptKMSNoEncryptionContext(t *testing.T) {
 	client := mockKMSClientNoEncryptionContext{}
-	result, _ := decryptKMS(client, mockEncryptedAPIKeyBase64)
+	result, _ := decryptKMS(client, mockEncryptedAPIKeyBase64, "")
 	assert.Equal(t, expectedDecryptedAPIKey, result)
 }
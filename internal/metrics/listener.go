@@ -11,18 +11,25 @@ package metrics
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/google/uuid"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/DataDog/datadog-lambda-go/internal/version"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
 )
 
 type (
@@ -34,12 +41,34 @@ type (
 		processor        Processor
 		isAgentRunning   bool
 		extensionManager *extension.ExtensionManager
+		// invocationIDTag is added to the metrics of the current invocation when Config.TagInvocationID is set
+		invocationIDTag string
+		// pendingFlush tracks the flush running in the background when Config.AsyncFlush is set
+		pendingFlush *sync.WaitGroup
+		// late guards the replacement of the processor, and holds the metrics added once it's finished
+		late *lateMetrics
+		// contextTags returns the tags extracted from the context of the current invocation, it is nil when there is no extractor
+		contextTags func() []string
+		timeService TimeService
+		// ignoredInvocation is true when the current invocation matches Config.IgnoreInvocation
+		ignoredInvocation bool
+	}
+
+	// lateMetrics holds the metrics added after the processor of their invocation finished, e.g. by a goroutine
+	// outliving the handler, until the processor of the next invocation starts
+	lateMetrics struct {
+		mu      sync.Mutex
+		metrics []Metric
 	}
 
 	// Config gives options for how the listener should work
 	Config struct {
-		APIKey                      string
-		KMSAPIKey                   string
+		APIKey    string
+		KMSAPIKey string
+		// APIKeySecretARN is the ARN of a Secrets Manager secret holding the API key. It is only used when APIKey and KMSAPIKey are empty.
+		APIKeySecretARN string
+		// DisableKeyDecryption ignores KMSAPIKey and APIKeySecretARN, so KMS and Secrets Manager are never called
+		DisableKeyDecryption        bool
 		Site                        string
 		ShouldRetryOnFailure        bool
 		ShouldUseLogForwarder       bool
@@ -50,6 +79,96 @@ type (
 		CircuitBreakerTimeout       time.Duration
 		CircuitBreakerTotalFailures uint32
 		LocalTest                   bool
+		// CACertPath and CACertPEM add certificate authorities trusted by the API client, on top of the system ones
+		CACertPath string
+		CACertPEM  []byte
+		// MetricFilter is consulted every time a metric is added. Returning false drops the metric.
+		// It can be called concurrently, and should be cheap to run.
+		MetricFilter func(name string, tags []string) bool
+		// FlushTimeout bounds the flush performed at the end of each invocation. Zero means no bound.
+		FlushTimeout time.Duration
+		// FlushJitter bounds the random delay added to the BatchInterval of each processor, so the flushes of the
+		// containers started together spread out. 0 means defaultFlushJitter, negative values turn the jitter off.
+		FlushJitter time.Duration
+		// OnFlushError is called with the error whenever a batch of metrics fails to be sent.
+		OnFlushError func(error)
+		// OnFlushSuccess is called with the stats of every batch of metrics sent successfully.
+		OnFlushSuccess func(FlushStats)
+		// RollupDistributions summarizes distributions into `.min`, `.max`, `.avg`, `.sum` and `.count` gauges when flushing.
+		RollupDistributions bool
+		// StatsdAddr is the address of a DogStatsD server metrics are sent to over UDP, instead of the extension or the API.
+		StatsdAddr string
+		// TagInvocationID adds an `invocation_id` tag to every metric, holding the AWS request ID of the invocation.
+		TagInvocationID bool
+		// AsyncFlush makes the end of invocation flush to the API run in the background, instead of delaying the handler's return.
+		// The lambda can be frozen before the flush completes, it then resumes when the next invocation starts, and is
+		// waited for before it begins. Metrics are lost if the lambda is shut down while frozen.
+		AsyncFlush bool
+		// ContextTagExtractor returns tags added to every metric of an invocation, from the invocation's context.
+		// It is called once per invocation, when the first metric is added.
+		ContextTagExtractor func(ctx context.Context) []string
+		// TruncateTags truncates tags and metric names longer than the limits of Datadog, ending them with "...".
+		TruncateTags bool
+		// MaxTagsPerPoint caps the number of tags of each point, the ones past it are dropped. 0 means
+		// defaultMaxTagsPerPoint.
+		MaxTagsPerPoint int
+		// NormalizeTags lowercases the tag keys and removes the duplicate tags, like Datadog does, before the metrics are
+		// filtered and submitted.
+		NormalizeTags bool
+		// NormalizeTagValues also lowercases the tag values, when NormalizeTags is set.
+		NormalizeTagValues bool
+		// DefaultTags are added to every metric
+		DefaultTags []string
+		// DiscardMetrics batches the metrics as usual, but drops them instead of sending them, whatever the destination.
+		DiscardMetrics bool
+		// MaxBufferBytes flushes the batch of metrics early once its estimated size exceeds it. 0 means no limit.
+		MaxBufferBytes int
+		// QueueCapacity is the number of metrics waiting to be batched, before QueuePolicy applies. 0 means
+		// defaultQueueCapacity.
+		QueueCapacity int
+		// QueuePolicy blocks the callers adding metrics to a full queue, or drops a metric, see ProcessorOptions
+		QueuePolicy QueuePolicy
+		// FlushOnlyAtEnd sends the metrics once, synchronously, at the end of the invocation, without the processing
+		// goroutine and its timer. AsyncFlush doesn't apply then, and it doesn't apply with PersistAcrossInvocations.
+		FlushOnlyAtEnd bool
+		// ApplicationKey is the Datadog application key, only used to turn on the percentiles of distributions.
+		ApplicationKey string
+		// BeforeSubmit is called with every batch of metrics sent to the API, and returns the series to send instead.
+		BeforeSubmit func([]Series) []Series
+		// MaxTagsPerMetric caps the number of distinct tag combinations of the metrics it names, within an invocation.
+		MaxTagsPerMetric map[string]int
+		// DefaultMaxTagsPerMetric is the cap of the metrics missing from MaxTagsPerMetric. 0 means no limit.
+		DefaultMaxTagsPerMetric int
+		// PersistAcrossInvocations keeps batching the metrics sent to the API across invocations, they are only sent
+		// on the batch interval and by FinalFlush, instead of at the end of every invocation
+		PersistAcrossInvocations bool
+		// UseSketches sends the distributions to the API aggregated into sketches, instead of their points
+		UseSketches bool
+		// HealthMetrics sends the datadog.lambda_go.flush_success and datadog.lambda_go.flush_errors counts with the batches
+		HealthMetrics bool
+		// RequestDecorator is called with each request submitting metrics to the API, right before it's sent
+		RequestDecorator func(*http.Request)
+		// SeriesV2 sends the series other than distributions to the v2 intake, attributed to Resources
+		SeriesV2 bool
+		// Resources are the resources of the v2 series, the lambda function by default
+		Resources []Resource
+		// OutsideLambda skips the enhanced metrics, which describe AWS Lambda invocations
+		OutsideLambda bool
+		// TagFunctionVersion tags the enhanced metrics with the executed version even when the function isn't invoked
+		// through an alias
+		TagFunctionVersion bool
+		// EnhancedMetricTags are added to the enhanced metrics, on top of the tags of the function
+		EnhancedMetricTags []string
+		// Region is the region tag of the enhanced metrics, the region of the function's ARN when empty
+		Region string
+		// FunctionName is the encryption context KMSAPIKey is decrypted with when it was encrypted in the Lambda console
+		FunctionName string
+		// IgnoreInvocation returns true for the invocations that get no enhanced metrics, like health checks
+		IgnoreInvocation func(ctx context.Context, msg json.RawMessage) bool
+		// Aggregator aggregates the metrics between two flushes in place of the default Batcher, under the same limits
+		Aggregator Aggregator
+		// DualWrite writes the metrics for the log forwarder, on top of sending them to the API or the extension.
+		DualWrite bool
 	}
 
 	logMetric struct {
@@ -63,34 +182,22 @@ type (
 // MakeListener initializes a new metrics lambda listener
 func MakeListener(config Config, extensionManager *extension.ExtensionManager) Listener {
 
-	apiClient := MakeAPIClient(context.Background(), APIClientOptions{
-		baseAPIURL:        config.Site,
-		apiKey:            config.APIKey,
-		decrypter:         MakeKMSDecrypter(),
-		kmsAPIKey:         config.KMSAPIKey,
-		httpClientTimeout: config.HTTPClientTimeout,
-	})
-	if config.HTTPClientTimeout <= 0 {
-		config.HTTPClientTimeout = defaultHttpClientTimeout
-	}
-	if config.CircuitBreakerInterval <= 0 {
-		config.CircuitBreakerInterval = defaultCircuitBreakerInterval
-	}
-	if config.CircuitBreakerTimeout <= 0 {
-		config.CircuitBreakerTimeout = defaultCircuitBreakerTimeout
-	}
-	if config.CircuitBreakerTotalFailures <= 0 {
-		config.CircuitBreakerTotalFailures = defaultCircuitBreakerTotalFailures
-	}
-	if config.BatchInterval <= 0 {
-		config.BatchInterval = defaultBatchInterval
-	}
+	config = config.WithDefaults()
+	apiClient := makeAPIClientFromConfig(config)
+	logger.AddSecret(config.ApplicationKey)
 
 	var statsdClient *statsd.Client
 	// immediate call to the Agent, if not a 200, fallback to API
 	// TODO(remy): we may want to use an environment var to force the use of the
 	// Agent instead of using this "discovery" implementation.
-	if extensionManager.IsExtensionRunning() {
+	if config.StatsdAddr != "" {
+		// The client splits the metrics into datagrams that fit in a UDP packet.
+		var err error
+		if statsdClient, err = statsd.New(config.StatsdAddr); err != nil {
+			logger.Error(fmt.Errorf("couldn't create a DogStatsD client for %s, falling back to the API: %s", config.StatsdAddr, err))
+			statsdClient = nil
+		}
+	} else if extensionManager.IsExtensionRunning() {
 		var err error
 		if statsdClient, err = statsd.New("127.0.0.1:8125"); err != nil {
 			statsdClient = nil // force nil if an error occurred during statsd client init
@@ -104,12 +211,83 @@ func MakeListener(config Config, extensionManager *extension.ExtensionManager) L
 		statsdClient:     statsdClient,
 		processor:        nil,
 		extensionManager: extensionManager,
+		pendingFlush:     &sync.WaitGroup{},
+		late:             &lateMetrics{},
+		timeService:      MakeTimeService(),
+	}
+}
+
+// WithDefaults returns a copy of config, with the defaults applied to the unset durations and thresholds
+func (config Config) WithDefaults() Config {
+	if config.HTTPClientTimeout <= 0 {
+		config.HTTPClientTimeout = defaultHttpClientTimeout
+	}
+	if config.CircuitBreakerInterval <= 0 {
+		config.CircuitBreakerInterval = defaultCircuitBreakerInterval
+	}
+	if config.CircuitBreakerTimeout <= 0 {
+		config.CircuitBreakerTimeout = defaultCircuitBreakerTimeout
+	}
+	if config.CircuitBreakerTotalFailures <= 0 {
+		config.CircuitBreakerTotalFailures = defaultCircuitBreakerTotalFailures
 	}
+	if config.BatchInterval <= 0 {
+		config.BatchInterval = defaultBatchInterval
+	}
+	if config.FlushJitter == 0 {
+		config.FlushJitter = defaultFlushJitter
+	}
+	if config.MaxTagsPerPoint <= 0 {
+		config.MaxTagsPerPoint = defaultMaxTagsPerPoint
+	}
+	return config
+}
+
+// makeKMSDecrypter and makeSecretsManagerDecrypter build the decrypters of the API key, they are replaced in tests
+var (
+	makeKMSDecrypter            = MakeKMSDecrypter
+	makeSecretsManagerDecrypter = MakeSecretsManagerDecrypter
+)
+
+func makeAPIClientFromConfig(config Config) *APIClient {
+	apiClientOptions := APIClientOptions{
+		baseAPIURL:        config.Site,
+		apiKey:            config.APIKey,
+		httpClientTimeout: config.HTTPClientTimeout,
+	}
+	if config.APIKey == "" && config.KMSAPIKey != "" && !config.DisableKeyDecryption {
+		apiClientOptions.kmsAPIKey = config.KMSAPIKey
+		apiClientOptions.decrypter = makeKMSDecrypter(config.FunctionName)
+	}
+	rootCAs, err := LoadCertPool(config.CACertPath, config.CACertPEM)
+	if err != nil {
+		logger.Error(fmt.Errorf("using the system certificate authorities only: %w", err))
+	}
+	apiClientOptions.rootCAs = rootCAs
+	apiClientOptions.seriesV2 = config.SeriesV2
+	apiClientOptions.requestDecorator = config.RequestDecorator
+	apiClientOptions.sketches = config.UseSketches
+	if config.APIKey == "" && config.KMSAPIKey == "" && config.APIKeySecretARN != "" && !config.DisableKeyDecryption {
+		apiClientOptions.apiKeySecretARN = config.APIKeySecretARN
+		apiClientOptions.secretsDecrypter = makeSecretsManagerDecrypter(config.APIKeySecretARN)
+	}
+	return MakeAPIClient(context.Background(), apiClientOptions)
+}
+
+// ValidateConfig checks that the API key of config is valid for its site, without sending any metrics
+func ValidateConfig(ctx context.Context, config Config) error {
+	config = config.WithDefaults()
+	if config.APIKey == "" && config.KMSAPIKey == "" && config.APIKeySecretARN == "" {
+		return errors.New("no API key is configured")
+	}
+	apiClient := makeAPIClientFromConfig(config)
+	apiClient.context = ctx
+	return apiClient.ValidateAPIKey()
 }
 
 // canSendMetrics reports whether l can send metrics.
 func (l *Listener) canSendMetrics() bool {
-	return l.isAgentRunning || l.apiClient.apiKey != "" || l.config.KMSAPIKey != "" || l.config.ShouldUseLogForwarder
+	return l.config.DiscardMetrics || l.isAgentRunning || l.apiClient.apiKey != "" || l.config.KMSAPIKey != "" || l.config.APIKeySecretARN != "" || (l.config.ShouldUseLogForwarder && !l.config.DualWrite)
 }
 
 // HandlerStarted adds metrics service to the context
@@ -118,24 +296,70 @@ func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) cont
 		logger.Error(fmt.Errorf("datadog api key isn't set, won't be able to send metrics"))
 	}
 
-	ts := MakeTimeService()
-	pr := MakeProcessor(ctx, l.apiClient, ts, l.config.BatchInterval, l.config.ShouldRetryOnFailure, l.config.CircuitBreakerInterval, l.config.CircuitBreakerTimeout, l.config.CircuitBreakerTotalFailures)
-	l.processor = pr
+	// The flush of the previous invocation may still be running in the background
+	l.pendingFlush.Wait()
+
+	if l.config.SeriesV2 {
+		resources := l.config.Resources
+		if len(resources) == 0 && !l.config.OutsideLambda {
+			resources = getLambdaResources(ctx)
+		}
+		l.apiClient.SetResources(resources)
+	}
+
+	processorCtx := ctx
+	if (l.config.AsyncFlush && !l.config.FlushOnlyAtEnd) || l.config.PersistAcrossInvocations {
+		// The flush outlives the invocation, so it can't be cancelled along with its context
+		processorCtx = context.WithoutCancel(ctx)
+	}
+
+	// The processor of the previous invocations goes on batching, it sends on the batch timer only
+	persisted := l.config.PersistAcrossInvocations && l.processor != nil && l.processor.IsProcessing()
+	if !persisted {
+		l.startProcessor(processorCtx)
+	}
+
+	l.ignoredInvocation = l.config.IgnoreInvocation != nil && l.config.IgnoreInvocation(ctx, msg)
+
+	l.invocationIDTag = ""
+	if l.config.TagInvocationID {
+		l.invocationIDTag = "invocation_id:" + getInvocationID(ctx)
+	}
 
 	ctx = AddListener(ctx, l)
-	// Setting the context on the client will mean that future requests will be cancelled correctly
-	// if the lambda times out.
-	l.apiClient.context = ctx
 
-	pr.StartProcessing()
+	l.contextTags = nil
+	if l.config.ContextTagExtractor != nil {
+		invocationCtx := ctx
+		l.contextTags = sync.OnceValue(func() []string {
+			return l.config.ContextTagExtractor(invocationCtx)
+		})
+	}
+
+	if !persisted {
+		// Setting the context on the client will mean that future requests will be cancelled correctly
+		// if the lambda times out.
+		l.apiClient.context = processorCtx
+	}
+
+	l.processor.StartProcessing()
+	l.addLateMetrics()
 	l.submitEnhancedMetrics("invocations", ctx)
+	if lambdacontext.MemoryLimitInMB > 0 {
+		l.submitEnhancedMetric("memorysize", float64(lambdacontext.MemoryLimitInMB), ctx)
+	}
+	if isColdStart, _ := ctx.Value("cold_start").(bool); isColdStart {
+		// The time since the package was initialized approximates the init duration of the container
+		l.submitEnhancedMetric("init_duration", l.Now().Sub(initTime).Seconds(), ctx)
+	}
 
 	return ctx
 }
 
 // HandlerFinished implemented as part of the wrapper.HandlerListener interface
 func (l *Listener) HandlerFinished(ctx context.Context, err error) {
-	if l.isAgentRunning {
+	// Discarded metrics are batched by the processor, whatever the destination
+	if l.isAgentRunning && !l.config.DiscardMetrics {
 		// use the agent
 		// flush the metrics from the DogStatsD client to the Agent
 		if l.statsdClient != nil {
@@ -149,72 +373,512 @@ func (l *Listener) HandlerFinished(ctx context.Context, err error) {
 				logger.Error(fmt.Errorf("error while flushing the metrics: %s", err))
 			}
 		}
+		l.configurePercentiles()
 	} else {
 		// use the api
 		if l.processor != nil {
 			if err != nil {
 				l.submitEnhancedMetrics("errors", ctx)
 			}
+			if duration, ok := wrapper.HandlerDuration(ctx); ok {
+				l.submitEnhancedMetric("duration", float64(duration)/float64(time.Millisecond), ctx)
+			}
+			if l.config.PersistAcrossInvocations {
+				// The batch is sent on the batch timer, or by FinalFlush
+				return
+			}
+			if l.config.AsyncFlush && !l.config.FlushOnlyAtEnd {
+				l.pendingFlush.Add(1)
+				go func() {
+					defer l.pendingFlush.Done()
+					l.flush(l.apiClient.context)
+					l.configurePercentiles()
+				}()
+			} else {
+				l.flush(ctx)
+				l.configurePercentiles()
+			}
+		}
+	}
+}
+
+// startProcessor replaces the processor with a new one, batching the metrics until it's finished
+func (l *Listener) startProcessor(ctx context.Context) {
+	l.late.mu.Lock()
+	defer l.late.mu.Unlock()
+	l.processor = MakeProcessor(ctx, l.apiClient, l.timeService, ProcessorOptions{
+		BatchInterval:               l.config.BatchInterval,
+		FlushJitter:                 l.config.FlushJitter,
+		ShouldRetryOnFail:           l.config.ShouldRetryOnFailure,
+		CircuitBreakerInterval:      l.config.CircuitBreakerInterval,
+		CircuitBreakerTimeout:       l.config.CircuitBreakerTimeout,
+		CircuitBreakerTotalFailures: l.config.CircuitBreakerTotalFailures,
+		OnFlushError:                l.config.OnFlushError,
+		OnFlushSuccess:              l.config.OnFlushSuccess,
+		DiscardMetrics:              l.config.DiscardMetrics,
+		RollupDistributions:         l.config.RollupDistributions,
+		MaxBufferBytes:              l.config.MaxBufferBytes,
+		BeforeSubmit:                l.config.BeforeSubmit,
+		MaxTagsPerMetric:            l.config.MaxTagsPerMetric,
+		DefaultMaxTagsPerMetric:     l.config.DefaultMaxTagsPerMetric,
+		HealthMetrics:               l.config.HealthMetrics,
+		HealthMetricsTags:           getHealthMetricsTags(),
+		Aggregator:                  l.config.Aggregator,
+		QueueCapacity:               l.config.QueueCapacity,
+		QueuePolicy:                 l.config.QueuePolicy,
+		FlushOnlyAtEnd:              l.config.FlushOnlyAtEnd && !l.config.PersistAcrossInvocations,
+	})
+}
+
+func (l *Listener) flush(ctx context.Context) {
+	if l.config.FlushTimeout > 0 {
+		// Give the final flush its own deadline, so it fails fast instead of running into the lambda freeze.
+		// Only the requests of the flush are bound to it, the client keeps its context for the ones that follow.
+		flushCtx, cancel := context.WithTimeout(ctx, l.config.FlushTimeout)
+		defer cancel()
+		l.processor.FinishProcessingWithContext(flushCtx)
+		return
+	}
+	l.processor.FinishProcessing()
+}
+
+// configurePercentiles turns on the percentiles of the distributions submitted that requested it.
+// It must not run concurrently with a flush, as both can wait for the API key to be decrypted.
+func (l *Listener) configurePercentiles() {
+	if l.config.DiscardMetrics {
+		return
+	}
+	toConfigure := takePercentilesToConfigure()
+	if len(toConfigure) == 0 {
+		return
+	}
+	hasAPIKey := l.apiClient.apiKey != "" || l.apiClient.apiKeyDecryptChan != nil
+	if !hasAPIKey || l.config.ApplicationKey == "" {
+		logger.Warn("an API key and an application key are required to turn on the percentiles of distributions")
+		return
+	}
+	for metric, percentiles := range toConfigure {
+		if err := l.apiClient.EnableDistributionPercentiles(metric, l.config.ApplicationKey); err != nil {
+			logger.Error(err)
+			continue
+		}
+		logger.Debug(fmt.Sprintf("turned on the percentiles of %s, requested %v", metric, percentiles))
+	}
+}
+
+// Now returns the current time, according to the listener's time service
+func (l *Listener) Now() time.Time {
+	return l.timeService.Now()
+}
+
+// SetTimeService replaces the time service used to timestamp metrics and schedule flushes.
+// It is meant for tests, and must be called before the first invocation starts.
+func (l *Listener) SetTimeService(timeService TimeService) {
+	l.timeService = timeService
+}
+
+// WaitForFlush waits for the flush running in the background, if any
+func (l *Listener) WaitForFlush() {
+	l.pendingFlush.Wait()
+}
+
+// Flush sends the metrics submitted so far during the invocation, without ending it, and returns the error of the send.
+// It returns the context's error if ctx is done first.
+func (l *Listener) Flush(ctx context.Context) error {
+	if l.isAgentRunning && !l.config.DiscardMetrics {
+		if l.statsdClient != nil {
+			if err := l.statsdClient.Flush(); err != nil {
+				return fmt.Errorf("can't flush the DogStatsD client: %w", err)
+			}
+		}
+		if l.config.LocalTest {
+			return l.extensionManager.Flush()
+		}
+		return nil
+	}
+	if l.processor == nil {
+		return nil
+	}
+	return l.processor.Flush(ctx)
+}
+
+// FinalFlush sends the metrics still buffered when the function shuts down: it waits for the flush running in the
+// background, if any, sends the batch kept across invocations, if any, shuts the aggregator down, then flushes the
+// DogStatsD client. It returns the context's error if ctx is done first.
+func (l *Listener) FinalFlush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.pendingFlush.Wait()
+		if l.config.PersistAcrossInvocations && l.processor != nil && l.processor.IsProcessing() {
 			l.processor.FinishProcessing()
 		}
+		if l.config.Aggregator != nil {
+			l.config.Aggregator.Shutdown()
+		}
+		if l.statsdClient != nil {
+			if err := l.statsdClient.Flush(); err != nil {
+				logger.Error(fmt.Errorf("can't flush the DogStatsD client: %s", err))
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // AddDistributionMetric sends a distribution metric
 func (l *Listener) AddDistributionMetric(metric string, value float64, timestamp time.Time, forceLogForwarder bool, tags ...string) {
+	l.AddDistributionMetrics(metric, []float64{value}, timestamp, forceLogForwarder, tags...)
+}
 
-	// We add our own runtime tag to the metric for version tracking
-	tags = append(tags, getRuntimeTag())
+// AddDistributionMetrics sends the values as points of a distribution metric sharing the timestamp and tags. The tags
+// are merged and the metric is filtered once, and the points are batched together.
+func (l *Listener) AddDistributionMetrics(metric string, values []float64, timestamp time.Time, forceLogForwarder bool, tags ...string) {
+	values = finiteValues(metric, values)
+	if len(values) == 0 {
+		return
+	}
+	if l.config.NormalizeTags {
+		tags = normalizedTags(tags, l.config.NormalizeTagValues)
+	}
+	if l.config.MetricFilter != nil && !l.config.MetricFilter(metric, tags) {
+		return
+	}
+
+	tags = l.addListenerTags(tags)
+	metric = l.truncateMetricName(metric)
+	distributionSubmitted(metric)
+
+	if l.config.DiscardMetrics {
+		l.addMetric(&Distribution{
+			Name:   metric,
+			Tags:   tags,
+			Values: toMetricValues(values, timestamp),
+		})
+		return
+	}
+
+	if l.config.DualWrite && !forceLogForwarder {
+		for _, value := range values {
+			l.writeToLogForwarder(metric, value, timestamp, tags)
+		}
+	}
 
 	if l.isAgentRunning {
-		err := l.statsdClient.Distribution(metric, value, tags, 1)
-		if err != nil {
-			logger.Error(fmt.Errorf("could not send metric %s: %s", metric, err.Error()))
+		for _, value := range values {
+			err := l.statsdClient.Distribution(metric, value, tags, 1)
+			if err != nil {
+				logger.Error(fmt.Errorf("could not send metric %s: %s", metric, err.Error()))
+			}
 		}
 		return
 	}
 
-	if l.config.ShouldUseLogForwarder || forceLogForwarder {
-		logger.Debug("sending metric via log forwarder")
-		unixTime := timestamp.Unix()
-		lm := logMetric{
-			MetricName: metric,
-			Value:      value,
-			Timestamp:  unixTime,
-			Tags:       tags,
-		}
-		result, err := json.Marshal(lm)
-		if err != nil {
-			logger.Error(fmt.Errorf("failed to marshall metric for log forwarder with error %v", err))
-			return
+	if (l.config.ShouldUseLogForwarder && !l.config.DualWrite) || forceLogForwarder {
+		for _, value := range values {
+			l.writeToLogForwarder(metric, value, timestamp, tags)
 		}
-		payload := string(result)
-		logger.Raw(payload)
 		return
 	}
 	m := Distribution{
 		Name:   metric,
 		Tags:   tags,
-		Values: []MetricValue{},
+		Values: toMetricValues(values, timestamp),
+	}
+	if logger.IsDebugEnabled() {
+		if len(values) == 1 {
+			logger.Debug(fmt.Sprintf("adding metric \"%s\", with value %f", metric, values[0]))
+		} else {
+			logger.Debug(fmt.Sprintf("adding metric \"%s\", with %d values", metric, len(values)))
+		}
+	}
+	l.addMetric(&m)
+}
+
+// addMetric adds metric to the batch of the processor, or keeps it for the next invocation once the processor is finished
+func (l *Listener) addMetric(metric Metric) {
+	l.late.mu.Lock()
+	defer l.late.mu.Unlock()
+	if l.processor != nil && l.processor.AddMetric(metric) {
+		return
+	}
+	logger.Debug("the metrics of the invocation were flushed already, the metric is sent with the next invocation")
+	l.late.metrics = append(l.late.metrics, metric)
+}
+
+// addLateMetrics adds the metrics kept by addMetric to the batch of the processor
+func (l *Listener) addLateMetrics() {
+	l.late.mu.Lock()
+	metrics := l.late.metrics
+	l.late.metrics = nil
+	l.late.mu.Unlock()
+	for _, metric := range metrics {
+		l.addMetric(metric)
+	}
+}
+
+// finiteValues returns values without NaN and infinite values, which Datadog rejects along with the whole payload.
+// values is returned as is when they are all finite.
+func finiteValues(metric string, values []float64) []float64 {
+	var finite []float64
+	for i, value := range values {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			if finite != nil {
+				finite = append(finite, value)
+			}
+			continue
+		}
+		logger.Debug(fmt.Sprintf("dropping the invalid value %v of metric \"%s\"", value, metric))
+		if finite == nil {
+			finite = append(make([]float64, 0, len(values)-1), values[:i]...)
+		}
+	}
+	if finite == nil {
+		return values
+	}
+	return finite
+}
+
+// toMetricValues returns the values as points with the same timestamp
+func toMetricValues(values []float64, timestamp time.Time) []MetricValue {
+	points := make([]MetricValue, len(values))
+	for i, value := range values {
+		points[i] = MetricValue{Timestamp: timestamp, Value: value}
+	}
+	return points
+}
+
+// writeToLogForwarder writes a metric to stdout, for the log forwarder to send it
+func (l *Listener) writeToLogForwarder(metric string, value float64, timestamp time.Time, tags []string) {
+	logger.Debug("sending metric via log forwarder")
+	result, err := json.Marshal(logMetric{
+		MetricName: metric,
+		Value:      value,
+		Timestamp:  timestamp.Unix(),
+		Tags:       tags,
+	})
+	if err != nil {
+		logger.Error(fmt.Errorf("failed to marshall metric for log forwarder with error %v", err))
+		return
+	}
+	logger.Raw(string(result))
+}
+
+// AddDistributionMetricSync sends a distribution metric straight away, bypassing the processor, and returns the error if it couldn't be sent
+func (l *Listener) AddDistributionMetricSync(metric string, value float64, timestamp time.Time, tags ...string) error {
+	if l.config.NormalizeTags {
+		tags = normalizedTags(tags, l.config.NormalizeTagValues)
+	}
+	if l.config.MetricFilter != nil && !l.config.MetricFilter(metric, tags) {
+		return nil
+	}
+
+	tags = l.addListenerTags(tags)
+	metric = l.truncateMetricName(metric)
+	distributionSubmitted(metric)
+
+	err := l.SubmitSeries([]Series{{
+		Name:   metric,
+		Type:   DistributionType,
+		Tags:   tags,
+		Points: []MetricValue{{Timestamp: timestamp, Value: value}},
+	}})
+	if err != nil {
+		return err
+	}
+	if l.isAgentRunning {
+		// The DogStatsD client buffers metrics, flush it so the metric is sent now
+		return l.statsdClient.Flush()
+	}
+	return nil
+}
+
+// addListenerTags returns a copy of tags, with the tags the listener adds to every metric.
+// The tags are copied, since they are retained until the batch is flushed, and the caller may reuse its slice.
+func (l *Listener) addListenerTags(tags []string) []string {
+	var contextTags []string
+	if l.contextTags != nil {
+		contextTags = l.contextTags()
+	}
+
+	result := make([]string, 0, len(tags)+len(l.config.DefaultTags)+len(contextTags)+2)
+	result = append(result, tags...)
+	result = append(result, l.config.DefaultTags...)
+	result = append(result, contextTags...)
+	// We add our own runtime tag to the metric for version tracking.
+	result = append(result, runtimeTag)
+	if l.invocationIDTag != "" {
+		result = append(result, l.invocationIDTag)
+	}
+	if l.config.TruncateTags {
+		for i, tag := range result {
+			if truncated, ok := truncate(tag, maxTagLength); ok {
+				logger.Debug(fmt.Sprintf("truncating tag \"%s\" to %d characters", tag, maxTagLength))
+				result[i] = truncated
+			}
+		}
+	}
+	if l.config.NormalizeTags {
+		result = normalizeTags(result, l.config.NormalizeTagValues)
 	}
-	m.AddPoint(timestamp, value)
-	logger.Debug(fmt.Sprintf("adding metric \"%s\", with value %f", metric, value))
-	l.processor.AddMetric(&m)
+	if l.config.MaxTagsPerPoint > 0 && len(result) > l.config.MaxTagsPerPoint {
+		logger.Debug(fmt.Sprintf("dropping %d tags past the first %d of a point", len(result)-l.config.MaxTagsPerPoint, l.config.MaxTagsPerPoint))
+		result = result[:l.config.MaxTagsPerPoint]
+	}
+	return result
 }
 
+// normalizeTags lowercases the keys of tags, or the whole tags when lowercaseValues is set, and removes the duplicates.
+// It keeps the order of the tags, and reuses the array of tags.
+func normalizeTags(tags []string, lowercaseValues bool) []string {
+	result := tags[:0]
+	for _, tag := range tags {
+		tag = normalizeTag(tag, lowercaseValues)
+		if !containsTag(result, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// normalizeTag lowercases the key of tag, or the whole tag when lowercaseValues is set
+func normalizeTag(tag string, lowercaseValues bool) string {
+	if lowercaseValues {
+		return strings.ToLower(tag)
+	}
+	if key, value, found := strings.Cut(tag, ":"); found {
+		// strings.ToLower doesn't allocate when the key is already lowercase
+		if lowerKey := strings.ToLower(key); lowerKey != key {
+			return lowerKey + ":" + value
+		}
+		return tag
+	}
+	return strings.ToLower(tag)
+}
+
+// normalizedTags returns tags normalized like normalizeTags, without copying them unless a tag has to be changed or
+// removed, as they belong to the caller
+func normalizedTags(tags []string, lowercaseValues bool) []string {
+	for i, tag := range tags {
+		if normalizeTag(tag, lowercaseValues) != tag || containsTag(tags[:i], tag) {
+			return normalizeTags(append([]string(nil), tags...), lowercaseValues)
+		}
+	}
+	return tags
+}
+
+// containsTag is a linear search, as metrics have few tags
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateMetricName truncates the metric name to the limit of Datadog when Config.TruncateTags is set
+func (l *Listener) truncateMetricName(metric string) string {
+	if !l.config.TruncateTags {
+		return metric
+	}
+	truncated, ok := truncate(metric, maxMetricNameLength)
+	if ok {
+		logger.Debug(fmt.Sprintf("truncating metric name \"%s\" to %d characters", metric, maxMetricNameLength))
+	}
+	return truncated
+}
+
+// truncate shortens s to maxLength characters, the last ones being the truncation indicator.
+// It reports whether s was truncated.
+func truncate(s string, maxLength int) (string, bool) {
+	if utf8.RuneCountInString(s) <= maxLength {
+		return s, false
+	}
+	runes := []rune(s)
+	return string(runes[:maxLength-len(truncationIndicator)]) + truncationIndicator, true
+}
+
+// getInvocationID returns the AWS request ID of the invocation, or a random ID when it isn't available
+func getInvocationID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	return uuid.NewString()
+}
+
+// getHealthMetricsTags returns the tags of the flush health metrics, only the function name to keep their cardinality low
+func getHealthMetricsTags() []string {
+	if lambdacontext.FunctionName == "" {
+		return nil
+	}
+	return []string{"functionname:" + lambdacontext.FunctionName}
+}
+
+// getLambdaResources returns the resource of the lambda function of the invocation, named after its ARN without alias nor version
+func getLambdaResources(ctx context.Context) []Resource {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok || lc.InvokedFunctionArn == "" {
+		return nil
+	}
+	// ex: arn:aws:lambda:us-east-1:123497558138:function:golang-layer:alias
+	splitArn := strings.Split(lc.InvokedFunctionArn, ":")
+	if len(splitArn) > 7 {
+		splitArn = splitArn[:7]
+	}
+	return []Resource{{Type: LambdaResourceType, Name: strings.Join(splitArn, ":")}}
+}
+
+// initTime is the time this package was initialized, close to the start of the container
+var initTime = time.Now()
+
+// runtimeTag is added to every metric, it doesn't change during the lifetime of the process
+var runtimeTag = getRuntimeTag()
+
 func getRuntimeTag() string {
 	v := runtime.Version()
 	return fmt.Sprintf("dd_lambda_layer:datadog-%s", v)
 }
 
+// submitEnhancedMetrics submits the enhanced metric as a distribution, so it stays correct when aggregated across containers.
+// It goes to the agent when it's running, and to the log forwarder otherwise, never to the API where it could be rolled up.
 func (l *Listener) submitEnhancedMetrics(metricName string, ctx context.Context) {
-	if l.config.EnhancedMetrics {
-		tags := getEnhancedMetricsTags(ctx)
-		l.AddDistributionMetric(fmt.Sprintf("aws.lambda.enhanced.%s", metricName), 1, time.Now(), true, tags...)
+	l.submitEnhancedMetric(metricName, 1, ctx)
+}
+
+// submitEnhancedMetric submits an enhanced metric with the given value, like submitEnhancedMetrics
+func (l *Listener) submitEnhancedMetric(metricName string, value float64, ctx context.Context) {
+	if l.config.EnhancedMetrics && !l.config.OutsideLambda && !l.ignoredInvocation {
+		tags := getEnhancedMetricsTags(ctx, l.config.Region)
+		if l.config.TagFunctionVersion && len(tags) > 0 {
+			tags = addExecutedVersionTag(tags)
+		}
+		tags = append(tags, l.config.EnhancedMetricTags...)
+		l.AddDistributionMetric(fmt.Sprintf("aws.lambda.enhanced.%s", metricName), value, l.Now(), true, tags...)
+	}
+}
+
+// addExecutedVersionTag adds the executedversion tag to tags, unless they have it already
+func addExecutedVersionTag(tags []string) []string {
+	if lambdacontext.FunctionVersion == "" {
+		return tags
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "executedversion:") {
+			return tags
+		}
 	}
+	return append(tags, "executedversion:"+lambdacontext.FunctionVersion)
 }
 
-func getEnhancedMetricsTags(ctx context.Context) []string {
+// getEnhancedMetricsTags returns the tags of the function the enhanced metrics get, the region tag having the value of
+// region, or else the region of the function's ARN, and being omitted when both are empty
+func getEnhancedMetricsTags(ctx context.Context, region string) []string {
 	isColdStart := ctx.Value("cold_start")
 
 	if lc, ok := lambdacontext.FromContext(ctx); ok {
@@ -230,15 +894,22 @@ func getEnhancedMetricsTags(ctx context.Context) []string {
 		var alias string
 		var executedVersion string
 
+		if region == "" {
+			region = splitArn[3]
+		}
+
 		functionName := fmt.Sprintf("functionname:%s", lambdacontext.FunctionName)
-		region := fmt.Sprintf("region:%s", splitArn[3])
 		accountId := fmt.Sprintf("account_id:%s", splitArn[4])
 		memorySize := fmt.Sprintf("memorysize:%d", lambdacontext.MemoryLimitInMB)
 		coldStart := fmt.Sprintf("cold_start:%t", isColdStart.(bool))
 		resource := fmt.Sprintf("resource:%s", lambdacontext.FunctionName)
 		datadogLambda := fmt.Sprintf("datadog_lambda:v%s", version.DDLambdaVersion)
 
-		tags := []string{functionName, region, accountId, memorySize, coldStart, datadogLambda}
+		tags := []string{functionName}
+		if region != "" {
+			tags = append(tags, fmt.Sprintf("region:%s", region))
+		}
+		tags = append(tags, accountId, memorySize, coldStart, datadogLambda)
 
 		// Check if our slice contains an alias or version
 		if len(splitArn) > 7 {
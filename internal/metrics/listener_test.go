@@ -14,17 +14,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/DataDog/datadog-lambda-go/internal/version"
+	"github.com/DataDog/datadog-lambda-go/internal/wrapper"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 
 	"github.com/stretchr/testify/assert"
@@ -70,6 +75,56 @@ func TestAddDistributionMetricWithAPI(t *testing.T) {
 	assert.True(t, called)
 }
 
+func TestAddDistributionMetricWithTooManyTags(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, DefaultTags: []string{"team:payments"}, MaxTagsPerPoint: 3}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a", "tag:b", "tag:c", "tag:d")
+	listener.AddDistributionMetric("other-metric", 2, time.Now(), false, "tag:a")
+	listener.HandlerFinished(ctx, nil)
+
+	var payload struct {
+		Series []APIMetric `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	tagsByName := map[string][]string{}
+	for _, series := range payload.Series {
+		tagsByName[series.Name] = series.Tags
+	}
+	assert.Equal(t, []string{"tag:a", "tag:b", "tag:c"}, tagsByName["the-metric"])
+	assert.Equal(t, []string{"tag:a", "team:payments", runtimeTag}, tagsByName["other-metric"])
+}
+
+func TestMakeListenerWithKeyDecryptionDisabled(t *testing.T) {
+	constructed := []string{}
+	makeKMSDecrypter = func(string) Decrypter {
+		constructed = append(constructed, "kms")
+		return &mockDecrypter{returnValue: mockDecryptedAPIKey}
+	}
+	makeSecretsManagerDecrypter = func(string) Decrypter {
+		constructed = append(constructed, "secretsmanager")
+		return &mockDecrypter{returnValue: mockDecryptedAPIKey}
+	}
+	defer func() {
+		makeKMSDecrypter = MakeKMSDecrypter
+		makeSecretsManagerDecrypter = MakeSecretsManagerDecrypter
+	}()
+
+	MakeListener(Config{KMSAPIKey: mockEncryptedAPIKey, DisableKeyDecryption: true}, &extension.ExtensionManager{})
+	MakeListener(Config{APIKeySecretARN: "arn:aws:secretsmanager:us-east-1:123:secret:dd", DisableKeyDecryption: true}, &extension.ExtensionManager{})
+	assert.Empty(t, constructed)
+
+	MakeListener(Config{KMSAPIKey: mockEncryptedAPIKey}, &extension.ExtensionManager{})
+	MakeListener(Config{APIKeySecretARN: "arn:aws:secretsmanager:us-east-1:123:secret:dd"}, &extension.ExtensionManager{})
+	assert.Equal(t, []string{"kms", "secretsmanager"}, constructed)
+}
+
 func TestAddDistributionMetricWithLogForwarder(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +139,71 @@ func TestAddDistributionMetricWithLogForwarder(t *testing.T) {
 	listener.HandlerFinished(ctx, nil)
 	assert.False(t, called)
 }
+func TestAddDistributionMetricDropsInvalidValues(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", math.NaN(), time.Unix(1000, 0), false)
+	listener.AddDistributionMetric("the-metric", 1, time.Unix(1000, 0), false)
+	listener.AddDistributionMetric("the-metric", math.Inf(1), time.Unix(1000, 0), false)
+	listener.AddDistributionMetrics("the-metric", []float64{math.Inf(-1), 2, math.NaN(), 3}, time.Unix(1000, 0), false)
+	listener.AddDistributionMetric("invalid-metric", math.NaN(), time.Unix(1000, 0), false)
+	listener.HandlerFinished(ctx, nil)
+
+	var payload struct {
+		Series []APIMetric `json:"series"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Len(t, payload.Series, 1)
+	values := []interface{}{}
+	for _, point := range payload.Series[0].Points {
+		values = append(values, point.([]interface{})[1].([]interface{})...)
+	}
+	assert.Equal(t, "the-metric", payload.Series[0].Name)
+	assert.Equal(t, []interface{}{float64(1), float64(2), float64(3)}, values)
+}
+
+func TestFiniteValues(t *testing.T) {
+	values := []float64{1, 2}
+	// Valid values are returned without a copy
+	assert.Same(t, &values[0], &finiteValues("the-metric", values)[0])
+	assert.Equal(t, []float64{2}, finiteValues("the-metric", []float64{math.NaN(), 2, math.Inf(1)}))
+	assert.Empty(t, finiteValues("the-metric", []float64{math.NaN()}))
+}
+
+func TestLogForwarderKeepsTheTimestampOfBackdatedMetrics(t *testing.T) {
+	backdated := time.Now().Add(-6 * time.Hour).Truncate(time.Second)
+	listener := MakeListener(Config{ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("single-metric", 1, backdated, false)
+		listener.AddDistributionMetrics("batch-metric", []float64{1, 2}, backdated, false)
+		assert.NoError(t, listener.SubmitSeries([]Series{{
+			Name:   "series-metric",
+			Type:   DistributionType,
+			Points: []MetricValue{{Timestamp: backdated, Value: 1}},
+		}}))
+		listener.HandlerFinished(ctx, nil)
+	})
+
+	lines := 0
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var metric logMetric
+		if json.Unmarshal([]byte(line), &metric) != nil || metric.MetricName == "" {
+			continue
+		}
+		lines++
+		assert.Equal(t, backdated.Unix(), metric.Timestamp, metric.MetricName)
+	}
+	assert.Equal(t, 4, lines)
+}
+
 func TestAddDistributionMetricWithForceLogForwarder(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +219,48 @@ func TestAddDistributionMetricWithForceLogForwarder(t *testing.T) {
 	assert.False(t, called)
 }
 
+func TestAddDistributionMetricWithDualWrite(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, ShouldUseLogForwarder: true, DualWrite: true}, &extension.ExtensionManager{})
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("the-metric", 2, time.Unix(1700000000, 0), false, "tag:a")
+		listener.HandlerFinished(ctx, nil)
+	})
+
+	assert.Contains(t, body, `"metric":"the-metric"`)
+	assert.Contains(t, output, `{"m":"the-metric","v":2,"e":1700000000,"t":["tag:a","`+runtimeTag+`"]}`)
+}
+
+func TestHandlerFinishedAfterCancellationFlushes(t *testing.T) {
+	called := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = listener.HandlerStarted(ctx, json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false)
+	cancel()
+	listener.HandlerFinished(ctx, nil)
+
+	select {
+	case <-called:
+	default:
+		assert.Fail(t, "the metrics weren't flushed after the context was cancelled")
+	}
+}
+
 func TestGetEnhancedMetricsTags(t *testing.T) {
 	//nolint
 	ctx := context.WithValue(context.Background(), "cold_start", false)
@@ -108,11 +270,22 @@ func TestGetEnhancedMetricsTags(t *testing.T) {
 	lc := &lambdacontext.LambdaContext{
 		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:$Latest",
 	}
-	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc))
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc), "")
 
 	assert.ElementsMatch(t, tags, []string{"functionname:go-lambda-test", "region:us-east-1", "memorysize:256", "cold_start:false", "account_id:123497558138", "resource:go-lambda-test:Latest", "datadog_lambda:v" + version.DDLambdaVersion})
 }
 
+func TestGetLambdaResources(t *testing.T) {
+	lc := &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:my-alias",
+	}
+
+	resources := getLambdaResources(lambdacontext.NewContext(context.Background(), lc))
+
+	assert.Equal(t, []Resource{{Type: LambdaResourceType, Name: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}}, resources)
+	assert.Nil(t, getLambdaResources(context.Background()))
+}
+
 func TestGetEnhancedMetricsTagsWithAlias(t *testing.T) {
 	//nolint
 	ctx := context.WithValue(context.Background(), "cold_start", false)
@@ -124,14 +297,55 @@ func TestGetEnhancedMetricsTagsWithAlias(t *testing.T) {
 		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:my-alias",
 	}
 
-	tags := getEnhancedMetricsTags((lambdacontext.NewContext(ctx, lc)))
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc), "")
 	assert.ElementsMatch(t, tags, []string{"functionname:go-lambda-test", "region:us-east-1", "memorysize:256", "cold_start:false", "account_id:123497558138", "resource:go-lambda-test:my-alias", "executedversion:1", "datadog_lambda:v" + version.DDLambdaVersion})
 }
 
+func TestGetEnhancedMetricsTagsRegion(t *testing.T) {
+	//nolint
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+	lambdacontext.FunctionName = "go-lambda-test"
+
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}
+	tags := getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc), "eu-west-1")
+	assert.Contains(t, tags, "region:eu-west-1")
+	assert.NotContains(t, tags, "region:us-east-1")
+
+	// Local emulators can invoke the function with an ARN without region
+	lc = &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda::123497558138:function:go-lambda-test"}
+	tags = getEnhancedMetricsTags(lambdacontext.NewContext(ctx, lc), "")
+	assert.Contains(t, tags, "functionname:go-lambda-test")
+	for _, tag := range tags {
+		assert.NotContains(t, tag, "region:")
+	}
+}
+
+func TestListenerFlushOnlyAtEnd(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	ml := MakeListener(Config{APIKey: "abc-123", Site: server.URL, FlushOnlyAtEnd: true, AsyncFlush: true}, &extension.ExtensionManager{})
+	mts := makeMockTimeService()
+	ml.SetTimeService(&mts)
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage{})
+	ml.AddDistributionMetric("metric-1", 1, time.Now(), false)
+	assert.Equal(t, 0, requests)
+	ml.HandlerFinished(ctx, nil)
+
+	// The metrics are sent by the time the handler returns, without a processing goroutine
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, mts.tickerDurations)
+	assert.Nil(t, ml.processor.(*processor).exited)
+}
+
 func TestGetEnhancedMetricsTagsNoLambdaContext(t *testing.T) {
 	//nolint
 	ctx := context.WithValue(context.Background(), "cold_start", true)
-	tags := getEnhancedMetricsTags(ctx)
+	tags := getEnhancedMetricsTags(ctx, "")
 
 	assert.Empty(t, tags)
 }
@@ -164,6 +378,139 @@ func TestSubmitEnhancedMetrics(t *testing.T) {
 	assert.True(t, strings.Contains(output, expected))
 }
 
+func TestSubmitEnhancedMetricsWithEnhancedMetricTags(t *testing.T) {
+	ml := MakeListener(Config{
+		ShouldUseLogForwarder: true,
+		EnhancedMetrics:       true,
+		EnhancedMetricTags:    []string{"team:payments", "cost_center:42"},
+	}, &extension.ExtensionManager{})
+	lambdacontext.FunctionName = "MyFunction"
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:MyFunction",
+	})
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", true)
+
+	output := captureOutput(func() {
+		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+		ml.AddDistributionMetric("custom-metric", 1, time.Now(), false)
+		ml.HandlerFinished(ctx, nil)
+	})
+
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, `"m":"aws.lambda.enhanced.invocations"`):
+			for _, tag := range []string{"team:payments", "cost_center:42", "functionname:MyFunction", "region:us-east-1", "cold_start:true"} {
+				assert.Contains(t, line, `"`+tag+`"`)
+			}
+		case strings.Contains(line, `"m":"custom-metric"`):
+			assert.NotContains(t, line, "team:payments")
+		}
+	}
+	assert.Contains(t, output, `"m":"aws.lambda.enhanced.invocations"`)
+	assert.Contains(t, output, `"m":"custom-metric"`)
+}
+
+func TestSubmitEnhancedMemoryAndInitDurationMetrics(t *testing.T) {
+	defer func(memoryLimit int) { lambdacontext.MemoryLimitInMB = memoryLimit }(lambdacontext.MemoryLimitInMB)
+	lambdacontext.MemoryLimitInMB = 512
+	lambdacontext.FunctionName = "go-lambda-test"
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test"}
+	ml := MakeListener(Config{ShouldUseLogForwarder: true, EnhancedMetrics: true}, &extension.ExtensionManager{})
+
+	for _, isColdStart := range []bool{true, false} {
+		//nolint
+		ctx := lambdacontext.NewContext(context.WithValue(context.Background(), "cold_start", isColdStart), lc)
+		output := captureOutput(func() {
+			ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+			ml.HandlerFinished(ctx, nil)
+		})
+
+		assert.Contains(t, output, `{"m":"aws.lambda.enhanced.memorysize","v":512,`)
+		assert.Contains(t, output, `"functionname:go-lambda-test","region:us-east-1"`)
+		assert.Equal(t, isColdStart, strings.Contains(output, `{"m":"aws.lambda.enhanced.init_duration","v":`))
+	}
+}
+
+func TestDoNotSubmitEnhancedMetricsOutsideLambda(t *testing.T) {
+	ml := MakeListener(Config{ShouldUseLogForwarder: true, EnhancedMetrics: true, OutsideLambda: true}, &extension.ExtensionManager{})
+	//nolint
+	ctx := context.WithValue(context.Background(), "cold_start", true)
+
+	output := captureOutput(func() {
+		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+		ml.AddDistributionMetric("custom-metric", 1, time.Now(), false)
+		ml.HandlerFinished(ctx, errors.New("something went wrong"))
+	})
+
+	assert.NotContains(t, output, "aws.lambda.enhanced")
+	assert.Contains(t, output, `{"m":"custom-metric","v":1,`)
+}
+
+func TestSubmitEnhancedMetricsWithTagFunctionVersion(t *testing.T) {
+	defer func(name, version string) {
+		lambdacontext.FunctionName, lambdacontext.FunctionVersion = name, version
+	}(lambdacontext.FunctionName, lambdacontext.FunctionVersion)
+	lambdacontext.FunctionName = "go-lambda-test"
+	lambdacontext.FunctionVersion = "3"
+
+	testCases := []struct {
+		arn      string
+		expected []string
+	}{
+		{"arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:3", []string{"executedversion:3", "resource:go-lambda-test:3"}},
+		{"arn:aws:lambda:us-east-1:123497558138:function:go-lambda-test:canary", []string{"executedversion:3", "resource:go-lambda-test:canary"}},
+	}
+	for _, tc := range testCases {
+		ml := MakeListener(Config{ShouldUseLogForwarder: true, EnhancedMetrics: true, TagFunctionVersion: true}, &extension.ExtensionManager{})
+		//nolint
+		ctx := lambdacontext.NewContext(context.WithValue(context.Background(), "cold_start", false), &lambdacontext.LambdaContext{InvokedFunctionArn: tc.arn})
+
+		output := captureOutput(func() {
+			ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+			ml.HandlerFinished(ctx, nil)
+		})
+
+		for _, tag := range tc.expected {
+			assert.Contains(t, output, `"`+tag+`"`, tc.arn)
+		}
+		// Once per enhanced metric, even when the alias already adds it
+		assert.Equal(t, strings.Count(output, "aws.lambda.enhanced."), strings.Count(output, "executedversion:"), output)
+	}
+}
+
+func TestDoNotSubmitEnhancedMetricsForIgnoredInvocations(t *testing.T) {
+	isHealthCheck := func(ctx context.Context, msg json.RawMessage) bool { return string(msg) == `{"path":"/health"}` }
+	ml := MakeListener(Config{ShouldUseLogForwarder: true, EnhancedMetrics: true, IgnoreInvocation: isHealthCheck}, &extension.ExtensionManager{})
+	//nolint
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+
+	output := captureOutput(func() {
+		invocationCtx := ml.HandlerStarted(ctx, json.RawMessage(`{"path":"/health"}`))
+		ml.AddDistributionMetric("custom-metric", 1, time.Now(), false)
+		ml.HandlerFinished(invocationCtx, errors.New("something went wrong"))
+	})
+	assert.NotContains(t, output, "aws.lambda.enhanced")
+	assert.Contains(t, output, `{"m":"custom-metric","v":1,`)
+
+	output = captureOutput(func() {
+		invocationCtx := ml.HandlerStarted(ctx, json.RawMessage(`{"path":"/orders"}`))
+		ml.HandlerFinished(invocationCtx, nil)
+	})
+	assert.Contains(t, output, `{"m":"aws.lambda.enhanced.invocations","v":1,`)
+}
+
+func TestHandlerStartedWithoutAPIKey(t *testing.T) {
+	for _, config := range []Config{{}, {ShouldUseLogForwarder: true}} {
+		listener := MakeListener(config, &extension.ExtensionManager{})
+		output := captureOutput(func() {
+			ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+			listener.HandlerFinished(ctx, nil)
+		})
+		assert.Equal(t, !config.ShouldUseLogForwarder, strings.Contains(output, "api key isn't set"), output)
+	}
+}
+
 func TestDoNotSubmitEnhancedMetrics(t *testing.T) {
 	called := false
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -247,3 +594,687 @@ func TestListenerHandlerFinishedFlushes(t *testing.T) {
 		})
 	}
 }
+
+func TestAddDistributionMetricWithFilterDropsByPrefix(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	filter := func(name string, tags []string) bool {
+		return !strings.HasPrefix(name, "noisy.")
+	}
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, MetricFilter: filter}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("noisy.metric", 2, time.Now(), false, "tag:a")
+	listener.AddDistributionMetric("useful.metric", 2, time.Now(), false, "tag:a")
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Contains(t, body, "useful.metric")
+	assert.NotContains(t, body, "noisy.metric")
+}
+
+func TestAddDistributionMetricWithFilterPassesAll(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	for _, filter := range []func(string, []string) bool{nil, func(string, []string) bool { return true }} {
+		body = ""
+		listener := MakeListener(Config{APIKey: "12345", Site: server.URL, MetricFilter: filter}, &extension.ExtensionManager{})
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("noisy.metric", 2, time.Now(), false, "tag:a")
+		listener.AddDistributionMetric("useful.metric", 2, time.Now(), false, "tag:a")
+		listener.HandlerFinished(ctx, nil)
+
+		assert.Contains(t, body, "useful.metric")
+		assert.Contains(t, body, "noisy.metric")
+	}
+}
+
+func TestHandlerFinishedWithFlushTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	var flushErr error
+	listener := MakeListener(Config{
+		APIKey:       "12345",
+		Site:         server.URL,
+		FlushTimeout: 50 * time.Millisecond,
+		OnFlushError: func(err error) { flushErr = err },
+	}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a")
+
+	start := time.Now()
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.ErrorIs(t, flushErr, context.DeadlineExceeded)
+}
+
+func TestSubmitEnhancedMetricsAsDistributionsWithAgent(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	statsdClient, err := statsd.New(conn.LocalAddr().String(), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+
+	ml := MakeListener(Config{EnhancedMetrics: true, RollupDistributions: true}, &extension.ExtensionManager{})
+	ml.statsdClient = statsdClient
+	ml.isAgentRunning = true
+
+	//nolint
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+	ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+	ml.HandlerFinished(ctx, errors.New("failed"))
+
+	// Each enhanced metric can come in its own datagram
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	lines := []string{}
+	for !slices.Contains(lines, "aws.lambda.enhanced.invocations:1|d|#"+runtimeTag) {
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestSubmitEnhancedMetricsAsDistributionsWithLogForwarder(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// Rolling up distributions into gauges must not apply to enhanced metrics.
+	ml := MakeListener(Config{APIKey: "abc-123", Site: server.URL, EnhancedMetrics: true, RollupDistributions: true}, &extension.ExtensionManager{})
+
+	//nolint
+	ctx := context.WithValue(context.Background(), "cold_start", false)
+	output := captureOutput(func() {
+		ctx = ml.HandlerStarted(ctx, json.RawMessage{})
+		ml.HandlerFinished(ctx, errors.New("failed"))
+	})
+
+	assert.False(t, called)
+	metrics := map[string]logMetric{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		metric := logMetric{}
+		assert.NoError(t, json.Unmarshal([]byte(line[strings.Index(line, "{"):]), &metric))
+		metrics[metric.MetricName] = metric
+	}
+	for _, name := range []string{"aws.lambda.enhanced.invocations", "aws.lambda.enhanced.errors"} {
+		assert.Equal(t, 1.0, metrics[name].Value, name)
+	}
+}
+
+func readDatagrams(t *testing.T, conn net.PacketConn) []string {
+	datagrams := []string{}
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return datagrams
+		}
+		datagrams = append(datagrams, string(buf[:n]))
+	}
+}
+
+func TestAddMetricsWithStatsdAddr(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	listener := MakeListener(Config{StatsdAddr: conn.LocalAddr().String()}, &extension.ExtensionManager{})
+	assert.True(t, listener.isAgentRunning)
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("my.distribution", 1.5, time.Now(), false, "a:b")
+	err = listener.SubmitSeries([]Series{
+		{Name: "my.gauge", Type: GaugeType, Tags: []string{"a:b"}, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+		{Name: "my.count", Type: CountType, Tags: []string{"a:b"}, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 3}}},
+	})
+	assert.NoError(t, err)
+	listener.HandlerFinished(ctx, nil)
+
+	lines := strings.Split(strings.Join(readDatagrams(t, conn), "\n"), "\n")
+	assert.Contains(t, lines, "my.distribution:1.5|d|#a:b,"+runtimeTag)
+	assert.Contains(t, lines, "my.gauge:2|g|#a:b|T1000")
+	assert.Contains(t, lines, "my.count:3|c|#a:b|T1000")
+}
+
+func TestAddMetricsWithStatsdAddrSplitsDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	listener := MakeListener(Config{StatsdAddr: conn.LocalAddr().String()}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	for i := 0; i < 100; i++ {
+		listener.AddDistributionMetric(fmt.Sprintf("my.distribution.%d", i), float64(i), time.Now(), false, "a:b")
+	}
+	listener.HandlerFinished(ctx, nil)
+
+	datagrams := readDatagrams(t, conn)
+	assert.Greater(t, len(datagrams), 1)
+	metricCount := 0
+	for _, datagram := range datagrams {
+		assert.LessOrEqual(t, len(datagram), statsd.OptimalUDPPayloadSize)
+		metricCount += len(strings.Split(strings.TrimSpace(datagram), "\n"))
+	}
+	assert.Equal(t, 100, metricCount)
+}
+
+func TestAddDistributionMetricSyncSendsImmediately(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/distribution_points", r.URL.Path)
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.AddDistributionMetricSync("critical.metric", 1, time.Unix(1000, 0), "a:b")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"series":[{"metric":"critical.metric","tags":["a:b","`+runtimeTag+`"],"type":"distribution","points":[[1000,[1]]]}]}`, body)
+	listener.HandlerFinished(ctx, nil)
+}
+
+func TestAddDistributionMetricSyncReturnsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	err := listener.AddDistributionMetricSync("critical.metric", 1, time.Now(), "a:b")
+	assert.Error(t, err)
+}
+
+func TestAddDistributionMetricWithInvocationIDTag(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, TagInvocationID: true}, &extension.ExtensionManager{})
+	lc := &lambdacontext.LambdaContext{AwsRequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd"}
+	ctx := listener.HandlerStarted(lambdacontext.NewContext(context.Background(), lc), json.RawMessage{})
+	listener.AddDistributionMetric("metric-1", 1, time.Now(), false, "a:b")
+	listener.AddDistributionMetric("metric-2", 2, time.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Equal(t, 2, strings.Count(body, `"invocation_id:8476a536-e9f4-11e8-9739-2dfe598c3fcd"`))
+}
+
+func TestInvocationIDTagIsStableWithinInvocation(t *testing.T) {
+	listener := MakeListener(Config{TagInvocationID: true, ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	first := listener.addListenerTags(nil)
+	second := listener.addListenerTags([]string{"a:b"})
+	listener.HandlerFinished(ctx, nil)
+	assert.True(t, strings.HasPrefix(first[len(first)-1], "invocation_id:"))
+	assert.Equal(t, first[len(first)-1], second[len(second)-1])
+
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage{})
+	next := listener.addListenerTags(nil)
+	listener.HandlerFinished(ctx, nil)
+	assert.NotEqual(t, first[len(first)-1], next[len(next)-1])
+}
+
+func TestNoInvocationIDTagByDefault(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, []string{"a:b", runtimeTag}, listener.addListenerTags([]string{"a:b"}))
+	listener.HandlerFinished(ctx, nil)
+}
+
+func TestAddDistributionMetricTruncatesTags(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	longTag := "key:" + strings.Repeat("v", 296)
+	longName := strings.Repeat("m", 300)
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, TruncateTags: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric(longName, 1, time.Now(), false, longTag, "short:tag")
+	listener.HandlerFinished(ctx, nil)
+
+	expectedTag := "key:" + strings.Repeat("v", 193) + "..."
+	assert.Len(t, expectedTag, maxTagLength)
+	assert.Contains(t, body, `"`+expectedTag+`"`)
+	assert.Contains(t, body, `"short:tag"`)
+	assert.Contains(t, body, `"metric":"`+strings.Repeat("m", 197)+`..."`)
+	assert.NotContains(t, body, longTag)
+}
+
+func TestAddDistributionMetricWithoutTruncateTags(t *testing.T) {
+	longTag := "key:" + strings.Repeat("v", 296)
+	listener := MakeListener(Config{ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, []string{longTag, runtimeTag}, listener.addListenerTags([]string{longTag}))
+	listener.HandlerFinished(ctx, nil)
+}
+
+func TestAddDistributionMetricNormalizesTags(t *testing.T) {
+	var filteredTags []string
+	listener := MakeListener(Config{
+		ShouldUseLogForwarder: true,
+		NormalizeTags:         true,
+		DefaultTags:           []string{"env:Prod"},
+		MetricFilter: func(name string, tags []string) bool {
+			filteredTags = tags
+			return true
+		},
+	}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	tags := []string{"Env:Prod", "Team:Payments", "env:Prod", "Standalone"}
+	listener.AddDistributionMetric("the-metric", 1, time.Now(), false, tags...)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Equal(t, []string{"env:Prod", "team:Payments", "standalone"}, filteredTags)
+	assert.Equal(t, []string{"env:Prod", "team:Payments", "standalone", runtimeTag}, listener.addListenerTags(tags))
+	// The tags of the caller are left untouched
+	assert.Equal(t, []string{"Env:Prod", "Team:Payments", "env:Prod", "Standalone"}, tags)
+}
+
+func TestNormalizeTags(t *testing.T) {
+	assert.Equal(t, []string{"env:Prod", "a:b:C"}, normalizeTags([]string{"Env:Prod", "env:Prod", "A:b:C"}, false))
+	assert.Equal(t, []string{"env:prod", "a:b:c"}, normalizeTags([]string{"Env:Prod", "env:prod", "A:b:C"}, true))
+	assert.Equal(t, []string{}, normalizeTags([]string{}, false))
+}
+
+func TestNormalizedTagsOnlyCopiesTheTagsToChange(t *testing.T) {
+	normalized := []string{"env:Prod", "a:b"}
+	assert.Equal(t, normalized, normalizedTags(normalized, false))
+	assert.Equal(t, 0.0, testing.AllocsPerRun(10, func() { normalizedTags(normalized, false) }))
+
+	tags := []string{"Env:Prod", "a:b", "a:b"}
+	assert.Equal(t, []string{"env:Prod", "a:b"}, normalizedTags(tags, false))
+	assert.Equal(t, []string{"Env:Prod", "a:b", "a:b"}, tags)
+}
+
+func TestNoTagNormalizationByDefault(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, []string{"Env:Prod", "env:Prod", runtimeTag}, listener.addListenerTags([]string{"Env:Prod", "env:Prod"}))
+	listener.HandlerFinished(ctx, nil)
+}
+
+func TestTruncate(t *testing.T) {
+	truncated, ok := truncate("short", 10)
+	assert.False(t, ok)
+	assert.Equal(t, "short", truncated)
+
+	// Multi-byte characters are counted once, and never split
+	truncated, ok = truncate(strings.Repeat("é", 12), 10)
+	assert.True(t, ok)
+	assert.Equal(t, strings.Repeat("é", 7)+"...", truncated)
+}
+
+func TestHandlerFinishedWithAsyncFlush(t *testing.T) {
+	release := make(chan struct{})
+	called := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		called <- struct{}{}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, AsyncFlush: true}, &extension.ExtensionManager{})
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = listener.HandlerStarted(ctx, json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a")
+
+	// The handler returns while the flush is still blocked on the server, and the runtime then cancels the context
+	listener.HandlerFinished(ctx, nil)
+	cancel()
+	assert.Len(t, called, 0)
+
+	close(release)
+	listener.WaitForFlush()
+	assert.Len(t, called, 1)
+}
+
+func TestHandlerStartedWaitsForAsyncFlush(t *testing.T) {
+	release := make(chan struct{})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, AsyncFlush: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 2, time.Now(), false, "tag:a")
+	listener.HandlerFinished(ctx, nil)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	ctx = listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, 1, requests)
+	listener.HandlerFinished(ctx, nil)
+	listener.WaitForFlush()
+}
+
+func TestAddDistributionMetricWithContextTagExtractor(t *testing.T) {
+	type tenantKey struct{}
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	calls := 0
+	listener := MakeListener(Config{
+		APIKey: "12345",
+		Site:   server.URL,
+		ContextTagExtractor: func(ctx context.Context) []string {
+			calls++
+			return []string{fmt.Sprintf("tenant:%s", ctx.Value(tenantKey{}))}
+		},
+	}, &extension.ExtensionManager{})
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	ctx = listener.HandlerStarted(ctx, json.RawMessage{})
+	listener.AddDistributionMetric("metric-1", 1, time.Now(), false, "a:b")
+	listener.AddDistributionMetric("metric-2", 2, time.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Equal(t, 1, calls)
+	assert.Contains(t, body, `"tags":["a:b","tenant:acme",`)
+	assert.Contains(t, body, `"tags":["tenant:acme",`)
+}
+
+// fakeClock is a TimeService whose time only moves when advanced, ticking every time it crosses a batch interval
+type fakeClock struct {
+	now      time.Time
+	interval time.Duration
+	nextTick time.Time
+	ticks    chan time.Time
+}
+
+func makeFakeClock(now time.Time, interval time.Duration) *fakeClock {
+	return &fakeClock{now: now, interval: interval, nextTick: now.Add(interval), ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) NewTicker(duration time.Duration) *time.Ticker {
+	return &time.Ticker{C: c.ticks}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(duration time.Duration) {
+	c.now = c.now.Add(duration)
+	for !c.now.Before(c.nextTick) {
+		c.ticks <- c.nextTick
+		c.nextTick = c.nextTick.Add(c.interval)
+	}
+}
+
+func TestListenerFlushesOncePerBatchInterval(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	start := time.Unix(1000, 0)
+	clock := makeFakeClock(start, 10*time.Second)
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, BatchInterval: 10 * time.Second}, &extension.ExtensionManager{})
+	listener.SetTimeService(clock)
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+
+	listener.AddDistributionMetric("the-metric", 1, listener.Now(), false)
+	clock.Advance(5 * time.Second)
+	listener.AddDistributionMetric("the-metric", 2, listener.Now(), false)
+	// Crossing the batch interval flushes both points, that were timestamped by the clock
+	clock.Advance(6 * time.Second)
+
+	select {
+	case body := <-bodies:
+		assert.Contains(t, body, `"points":[[1000,[1]],[1005,[2]]]`)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the batch wasn't flushed")
+	}
+
+	// Nothing was added since the flush, so finishing doesn't send anything
+	listener.HandlerFinished(ctx, nil)
+	assert.Len(t, bodies, 0)
+}
+
+func TestListenerPersistsAcrossInvocations(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	clock := makeFakeClock(time.Unix(1000, 0), 10*time.Second)
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, BatchInterval: 10 * time.Second, PersistAcrossInvocations: true}, &extension.ExtensionManager{})
+	listener.SetTimeService(clock)
+
+	// Invocations within the batch interval don't flush
+	for i := 1; i <= 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = listener.HandlerStarted(ctx, json.RawMessage{})
+		listener.AddDistributionMetric("the-metric", float64(i), listener.Now(), false)
+		listener.HandlerFinished(ctx, nil)
+		cancel()
+		clock.Advance(time.Second)
+	}
+	assert.Len(t, bodies, 0)
+
+	// The batch interval flushes the points of every invocation at once
+	clock.Advance(8 * time.Second)
+	select {
+	case body := <-bodies:
+		assert.Contains(t, body, `"points":[[1000,[1]],[1001,[2]],[1002,[3]]]`)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the batch wasn't flushed")
+	}
+
+	// The final flush sends what is left
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("the-metric", 4, listener.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+	assert.NoError(t, listener.FinalFlush(context.Background()))
+	assert.Len(t, bodies, 1)
+	assert.Contains(t, <-bodies, `"points":[[1011,[4]]]`)
+}
+
+func TestAPIKeyIsMaskedInLogs(t *testing.T) {
+	const apiKey = "0123456789abcdef0123456789abcdef"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Some servers echo the request in their error responses
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("bad request " + r.URL.String()))
+	}))
+	defer server.Close()
+
+	logger.SetLogLevel(logger.LevelDebug)
+	defer logger.SetLogLevel(logger.LevelWarn)
+
+	output := captureOutput(func() {
+		listener := MakeListener(Config{APIKey: apiKey, Site: server.URL}, &extension.ExtensionManager{})
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("metric-1", 1, time.Now(), false)
+		listener.HandlerFinished(ctx, nil)
+	})
+
+	assert.Contains(t, output, "api_key=***cdef")
+	assert.NotContains(t, output, apiKey)
+}
+
+func TestOnFlushSuccessReportsPayloadSize(t *testing.T) {
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received += len(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	stats := []FlushStats{}
+	listener := MakeListener(Config{
+		APIKey:         "12345",
+		Site:           server.URL,
+		OnFlushSuccess: func(s FlushStats) { stats = append(stats, s) },
+	}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	for i := 0; i < 3; i++ {
+		listener.AddDistributionMetric("metric-1", float64(i), time.Now(), false, "a:b")
+	}
+	listener.AddDistributionMetric("metric-2", 1, time.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].Series)
+	assert.Equal(t, 4, stats[0].Points)
+	assert.Equal(t, received, stats[0].Bytes)
+	assert.NotZero(t, stats[0].Bytes)
+}
+
+func TestAddListenerTagsWithDefaultTags(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true, DefaultTags: []string{"env:prod"}}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	assert.Equal(t, []string{"a:b", "env:prod", runtimeTag}, listener.addListenerTags([]string{"a:b"}))
+	listener.HandlerFinished(ctx, nil)
+}
+
+func TestDiscardMetrics(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true, EnhancedMetrics: true, DiscardMetrics: true}, &extension.ExtensionManager{})
+
+	var err error
+	output := captureOutput(func() {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("metric-1", 1, time.Now(), false)
+		err = listener.SubmitSeries([]Series{{Name: "metric-2", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Now(), Value: 1}}}})
+		listener.HandlerFinished(ctx, nil)
+	})
+
+	assert.NoError(t, err)
+	assert.NotContains(t, output, "metric-1")
+	assert.NotContains(t, output, "metric-2")
+	assert.NotContains(t, output, "aws.lambda.enhanced.invocations")
+}
+
+func TestSubmitEnhancedDurationMetric(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	ml := MakeListener(Config{APIKey: "abc-123", Site: server.URL, EnhancedMetrics: true}, &extension.ExtensionManager{})
+	lambdacontext.FunctionName = "MyFunction"
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:MyFunction",
+	})
+	handler := wrapper.WrapHandlerWithListeners(func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}, &ml).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	output := captureOutput(func() {
+		_, err := handler(ctx, json.RawMessage(`{}`))
+		assert.NoError(t, err)
+	})
+
+	var metric struct {
+		Metric string   `json:"m"`
+		Value  float64  `json:"v"`
+		Tags   []string `json:"t"`
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, `"m":"aws.lambda.enhanced.duration"`) {
+			assert.NoError(t, json.Unmarshal([]byte(line[strings.Index(line, "{"):]), &metric))
+		}
+	}
+	assert.Equal(t, "aws.lambda.enhanced.duration", metric.Metric, output)
+	// In milliseconds
+	assert.GreaterOrEqual(t, metric.Value, 20.0)
+	assert.Less(t, metric.Value, 1000.0)
+	assert.Contains(t, metric.Tags, "cold_start:true")
+	assert.Contains(t, metric.Tags, "functionname:MyFunction")
+}
+
+type recordingAggregator struct {
+	added    []Series
+	flushed  int
+	shutdown bool
+}
+
+func (a *recordingAggregator) Add(series Series) {
+	a.added = append(a.added, series)
+}
+
+func (a *recordingAggregator) Flush() []Series {
+	a.flushed++
+	return nil
+}
+
+func (a *recordingAggregator) Shutdown() {
+	a.shutdown = true
+}
+
+func TestListenerUsesAggregator(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	aggregator := &recordingAggregator{}
+	ml := MakeListener(Config{APIKey: "abc-123", Site: server.URL, Aggregator: aggregator}, &extension.ExtensionManager{})
+
+	ctx := ml.HandlerStarted(context.Background(), json.RawMessage(`{}`))
+	ml.AddDistributionMetric("metric-1", 2, time.Unix(1000, 0), false, "a:b")
+	ml.HandlerFinished(ctx, nil)
+	assert.False(t, aggregator.shutdown)
+	assert.NoError(t, ml.FinalFlush(context.Background()))
+
+	assert.Len(t, aggregator.added, 1)
+	assert.Equal(t, "metric-1", aggregator.added[0].Name)
+	assert.Equal(t, []MetricValue{{Value: 2, Timestamp: time.Unix(1000, 0)}}, aggregator.added[0].Points)
+	assert.Contains(t, aggregator.added[0].Tags, "a:b")
+	assert.Positive(t, aggregator.flushed)
+	assert.True(t, aggregator.shutdown)
+	// The aggregator returned nothing to send
+	assert.False(t, called)
+}
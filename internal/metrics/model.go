@@ -9,6 +9,7 @@
 package metrics
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -29,6 +30,14 @@ type (
 		MetricType MetricType    `json:"type"`
 		Interval   *float64      `json:"interval,omitempty"`
 		Points     []interface{} `json:"points"`
+		// Resources are only sent with the v2 series intake
+		Resources []Resource `json:"-"`
+	}
+
+	// Resource is an entity a v2 series is attributed to, like a host or a lambda function
+	Resource struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
 	}
 
 	// MetricValue represents a datapoint for a metric
@@ -94,3 +103,68 @@ func (d *Distribution) ToAPIMetric(interval time.Duration) []APIMetric {
 		},
 	}
 }
+
+// ToRollupAPIMetrics summarizes the points of a distribution into `.min`, `.max`, `.avg` and `.sum` gauges, and a
+// `.count` count over interval, the window the points were collected in.
+// This trades the fidelity of the distribution (percentiles can no longer be computed) for a much smaller payload.
+func (d *Distribution) ToRollupAPIMetrics(interval time.Duration) []APIMetric {
+	if len(d.Values) == 0 {
+		return []APIMetric{}
+	}
+
+	min := d.Values[0].Value
+	max := d.Values[0].Value
+	sum := 0.0
+	latest := d.Values[0].Timestamp
+	for _, val := range d.Values {
+		if val.Value < min {
+			min = val.Value
+		}
+		if val.Value > max {
+			max = val.Value
+		}
+		if val.Timestamp.After(latest) {
+			latest = val.Timestamp
+		}
+		sum += val.Value
+	}
+	count := float64(len(d.Values))
+	currentTime := float64(latest.Unix())
+
+	summary := []struct {
+		suffix     string
+		value      float64
+		metricType MetricType
+	}{
+		{"min", min, GaugeType},
+		{"max", max, GaugeType},
+		{"avg", sum / count, GaugeType},
+		{"sum", sum, GaugeType},
+		{"count", count, CountType},
+	}
+
+	apiMetrics := make([]APIMetric, len(summary))
+	for i, s := range summary {
+		apiMetrics[i] = APIMetric{
+			Name:       fmt.Sprintf("%s.%s", d.Name, s.suffix),
+			Host:       d.Host,
+			Tags:       d.Tags,
+			MetricType: s.metricType,
+			Points:     []interface{}{[]interface{}{currentTime, s.value}},
+		}
+		if s.metricType == CountType {
+			// Datadog divides counts by their interval to compute rates
+			apiMetrics[i].Interval = intervalSeconds(interval)
+		}
+	}
+	return apiMetrics
+}
+
+// intervalSeconds returns the interval field of a metric, in seconds, or nil when there is no interval
+func intervalSeconds(interval time.Duration) *float64 {
+	if interval <= 0 {
+		return nil
+	}
+	seconds := interval.Seconds()
+	return &seconds
+}
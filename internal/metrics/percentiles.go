@@ -0,0 +1,86 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// supportedPercentiles are the percentiles Datadog computes for distributions
+var supportedPercentiles = map[int]bool{50: true, 75: true, 90: true, 95: true, 99: true}
+
+// distributionPercentiles holds the distributions whose percentiles are to be turned on. They are configured at
+// most once per container, after they are first submitted.
+var distributionPercentiles = struct {
+	sync.Mutex
+	requested map[string][]int
+	// submitted holds the distributions submitted since they were requested, and configured the ones configured
+	submitted  map[string]bool
+	configured map[string]bool
+}{}
+
+// hasPercentileRequests avoids locking distributionPercentiles for every point when no percentiles were requested
+var hasPercentileRequests atomic.Bool
+
+// SetDistributionPercentiles requests the percentiles of the distribution metric to be turned on, the first time it's submitted.
+func SetDistributionPercentiles(metric string, percentiles []int) error {
+	if metric == "" {
+		return fmt.Errorf("the metric name is empty")
+	}
+	if len(percentiles) == 0 {
+		return fmt.Errorf("no percentiles given for metric %s", metric)
+	}
+	for _, percentile := range percentiles {
+		if !supportedPercentiles[percentile] {
+			return fmt.Errorf("unsupported percentile p%d for metric %s, only p50, p75, p90, p95 and p99 are supported", percentile, metric)
+		}
+	}
+
+	distributionPercentiles.Lock()
+	defer distributionPercentiles.Unlock()
+	if distributionPercentiles.requested == nil {
+		distributionPercentiles.requested = map[string][]int{}
+		distributionPercentiles.submitted = map[string]bool{}
+		distributionPercentiles.configured = map[string]bool{}
+	}
+	distributionPercentiles.requested[metric] = percentiles
+	hasPercentileRequests.Store(true)
+	return nil
+}
+
+// distributionSubmitted records that metric was submitted, if its percentiles are to be configured
+func distributionSubmitted(metric string) {
+	if !hasPercentileRequests.Load() {
+		return
+	}
+	distributionPercentiles.Lock()
+	defer distributionPercentiles.Unlock()
+	if _, ok := distributionPercentiles.requested[metric]; ok && !distributionPercentiles.configured[metric] {
+		distributionPercentiles.submitted[metric] = true
+	}
+}
+
+// takePercentilesToConfigure returns the distributions submitted whose percentiles aren't configured yet,
+// and marks them as configured, so they are configured at most once whatever the outcome.
+func takePercentilesToConfigure() map[string][]int {
+	distributionPercentiles.Lock()
+	defer distributionPercentiles.Unlock()
+	if len(distributionPercentiles.submitted) == 0 {
+		return nil
+	}
+	result := map[string][]int{}
+	for metric := range distributionPercentiles.submitted {
+		result[metric] = distributionPercentiles.requested[metric]
+		distributionPercentiles.configured[metric] = true
+		delete(distributionPercentiles.submitted, metric)
+	}
+	return result
+}
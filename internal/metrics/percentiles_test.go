@@ -0,0 +1,156 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/stretchr/testify/assert"
+)
+
+type tagConfigurationRequest struct {
+	method string
+	path   string
+	apiKey string
+	appKey string
+	body   string
+}
+
+// resetDistributionPercentiles forgets the percentiles requested and configured by previous tests
+func resetDistributionPercentiles() {
+	distributionPercentiles.Lock()
+	defer distributionPercentiles.Unlock()
+	distributionPercentiles.requested = nil
+	distributionPercentiles.submitted = nil
+	distributionPercentiles.configured = nil
+	hasPercentileRequests.Store(false)
+}
+
+func makeTagConfigurationServer(t *testing.T, status int) (*httptest.Server, func() []tagConfigurationRequest) {
+	var mu sync.Mutex
+	requests := []tagConfigurationRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v2/metrics/") {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, tagConfigurationRequest{
+			method: r.Method,
+			path:   r.URL.Path,
+			apiKey: r.Header.Get(apiKeyHeader),
+			appKey: r.Header.Get(appKeyHeader),
+			body:   string(body),
+		})
+		mu.Unlock()
+		if r.Method == http.MethodPost {
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []tagConfigurationRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestSetDistributionPercentilesValidates(t *testing.T) {
+	defer resetDistributionPercentiles()
+
+	assert.NoError(t, SetDistributionPercentiles("latency", []int{50, 75, 90, 95, 99}))
+	assert.EqualError(t, SetDistributionPercentiles("latency", []int{50, 42}), "unsupported percentile p42 for metric latency, only p50, p75, p90, p95 and p99 are supported")
+	assert.Error(t, SetDistributionPercentiles("latency", nil))
+	assert.Error(t, SetDistributionPercentiles("", []int{50}))
+}
+
+func TestListenerEnablesDistributionPercentilesOnce(t *testing.T) {
+	defer resetDistributionPercentiles()
+	server, requests := makeTagConfigurationServer(t, http.StatusCreated)
+	assert.NoError(t, SetDistributionPercentiles("latency", []int{50, 99}))
+
+	listener := MakeListener(Config{APIKey: "12345", ApplicationKey: "app-key-67890", Site: server.URL}, &extension.ExtensionManager{})
+	for i := 0; i < 2; i++ {
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("latency", 1, time.Now(), false)
+		listener.AddDistributionMetric("other", 1, time.Now(), false)
+		listener.HandlerFinished(ctx, nil)
+	}
+
+	assert.Len(t, requests(), 1)
+	request := requests()[0]
+	assert.Equal(t, http.MethodPost, request.method)
+	assert.Equal(t, "/api/v2/metrics/latency/tags", request.path)
+	assert.Equal(t, "12345", request.apiKey)
+	assert.Equal(t, "app-key-67890", request.appKey)
+	assert.JSONEq(t, `{"data":{"type":"manage_tags","id":"latency","attributes":{
+		"metric_type":"distribution","include_percentiles":true,"exclude_tags_mode":true}}}`, request.body)
+}
+
+func TestListenerUpdatesExistingTagConfiguration(t *testing.T) {
+	defer resetDistributionPercentiles()
+	server, requests := makeTagConfigurationServer(t, http.StatusConflict)
+	assert.NoError(t, SetDistributionPercentiles("latency", []int{95}))
+
+	listener := MakeListener(Config{APIKey: "12345", ApplicationKey: "app-key-67890", Site: server.URL}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("latency", 1, time.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Len(t, requests(), 2)
+	assert.Equal(t, http.MethodPatch, requests()[1].method)
+	assert.JSONEq(t, `{"data":{"type":"manage_tags","id":"latency","attributes":{"include_percentiles":true}}}`, requests()[1].body)
+}
+
+func TestListenerEnablesDistributionPercentilesWithFlushTimeout(t *testing.T) {
+	for _, asyncFlush := range []bool{false, true} {
+		resetDistributionPercentiles()
+		server, requests := makeTagConfigurationServer(t, http.StatusCreated)
+		assert.NoError(t, SetDistributionPercentiles("latency", []int{95}))
+
+		listener := MakeListener(Config{
+			APIKey:         "12345",
+			ApplicationKey: "app-key-67890",
+			Site:           server.URL,
+			FlushTimeout:   time.Second,
+			AsyncFlush:     asyncFlush,
+		}, &extension.ExtensionManager{})
+		ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+		listener.AddDistributionMetric("latency", 1, time.Now(), false)
+		listener.HandlerFinished(ctx, nil)
+		listener.pendingFlush.Wait()
+
+		// The tag configuration request isn't bound to the context of the flush, cancelled once it's done
+		assert.Len(t, requests(), 1, "async flush: %v", asyncFlush)
+	}
+	resetDistributionPercentiles()
+}
+
+func TestListenerSkipsPercentilesWithoutApplicationKey(t *testing.T) {
+	defer resetDistributionPercentiles()
+	server, requests := makeTagConfigurationServer(t, http.StatusCreated)
+	assert.NoError(t, SetDistributionPercentiles("latency", []int{95}))
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	listener.AddDistributionMetric("latency", 1, time.Now(), false)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Empty(t, requests())
+}
@@ -11,7 +11,9 @@ package metrics
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
@@ -22,48 +24,218 @@ import (
 type (
 	// Processor is used to batch metrics on a background thread, and send them on to a client periodically.
 	Processor interface {
-		// AddMetric sends a metric to the agent
-		AddMetric(metric Metric)
+		// AddMetric sends a metric to the agent, it returns false once the processor is finished
+		AddMetric(metric Metric) bool
 		// StartProcessing begins processing metrics asynchronously
 		StartProcessing()
 		// FinishProcessing shuts down the agent, and tries to flush any remaining metrics
 		FinishProcessing()
+		// FinishProcessingWithContext is like FinishProcessing, but the requests sending the last batch are bound to ctx
+		FinishProcessingWithContext(ctx context.Context)
 		// Whether the processor is still processing
 		IsProcessing() bool
+		// Flush sends the metrics batched so far without stopping the processing, and returns the error of the send
+		Flush(ctx context.Context) error
+		// Send sends metrics straight away, outside of the batches, through the circuit breaker and the retries of the batches
+		Send(metrics []APIMetric) error
 	}
 
 	processor struct {
 		context           context.Context
 		metricsChan       chan Metric
+		queuePolicy       QueuePolicy
+		flushChan         chan chan error
+		exited            chan struct{}
 		timeService       TimeService
 		waitGroup         sync.WaitGroup
 		batchInterval     time.Duration
+		flushJitter       time.Duration
 		client            Client
-		batcher           *Batcher
 		shouldRetryOnFail bool
 		isProcessing      bool
 		breaker           *gobreaker.CircuitBreaker
+		onFlushError      func(error)
+		onFlushSuccess    func(FlushStats)
+		rollup            bool
+		discard           bool
+		maxBufferBytes    int
+		beforeSubmit      func([]Series) []Series
+		cardinality       *cardinalityGuard
+		// cancelledFlushCtx bounds the final flush done once the context is cancelled, nil until then
+		cancelledFlushCtx context.Context
+		// finishCtx is the context of FinishProcessingWithContext, set before the metrics channel is closed. The
+		// sends of the last batch are bound to lastBatchCtx, which it's copied to once the channel is seen closed.
+		finishCtx    context.Context
+		lastBatchCtx context.Context
+		// windowStart is when the window of the current batch started, its counts being over the window up to the flush
+		windowStart time.Time
+		// stats describes the last batch sent
+		stats FlushStats
+		// healthMetrics adds the flush health metrics to the batches, tagged with healthMetricsTags
+		healthMetrics     bool
+		healthMetricsTags []string
+		// failedFlushes is the number of flushes that failed since the last successful one
+		failedFlushes int
+		// aggregator aggregates the metrics of the batch, unsent being the series it flushed that weren't sent yet
+		aggregator Aggregator
+		unsent     []Series
+		// addedSize estimates the size of the batch of an aggregator that doesn't estimate it, see sizedAggregator, and
+		// unsentSize the size of unsent
+		addedSize  int
+		unsentSize int
+		// finishMu guards finished, which is set once the metrics channel is closed
+		finishMu sync.Mutex
+		finished bool
+		// dropped is the number of metrics dropped by the queue policy since the last successful flush
+		dropped atomic.Int64
+		// flushOnlyAtEnd keeps the metrics added in added, under finishMu, instead of queuing them for a processing
+		// goroutine. They are batched by the send, sendMu serializing the sends in place of the goroutine.
+		flushOnlyAtEnd bool
+		added          []Metric
+		sendMu         sync.Mutex
+	}
+
+	// QueuePolicy is what AddMetric does with a metric when the queue of the metrics waiting to be batched is full
+	QueuePolicy int
+
+	// FlushStats describes a batch of metrics sent to the API
+	FlushStats struct {
+		// Series is the number of series sent, a series being the points of a metric with a given set of tags
+		Series int
+		// Points is the number of points sent, across all series
+		Points int
+		// Bytes is the size of the payloads sent. It is 0 when the client doesn't report it.
+		Bytes int
+	}
+
+	// sizeReportingClient is implemented by the clients able to report the size of the payloads they send
+	sizeReportingClient interface {
+		SendMetricsWithSize(metrics []APIMetric) (int, error)
+	}
+
+	// contextClient is implemented by the clients able to send metrics with another context than their own
+	contextClient interface {
+		SendMetricsWithContext(ctx context.Context, metrics []APIMetric) (int, error)
+	}
+
+	// ProcessorOptions contains instantiation options for creating a Processor.
+	ProcessorOptions struct {
+		BatchInterval               time.Duration
+		ShouldRetryOnFail           bool
+		CircuitBreakerInterval      time.Duration
+		CircuitBreakerTimeout       time.Duration
+		CircuitBreakerTotalFailures uint32
+		// FlushJitter bounds the random delay added to the BatchInterval between the flushes. 0 or less means none.
+		FlushJitter time.Duration
+		// OnFlushError is called with the error whenever a batch fails to be sent.
+		OnFlushError func(error)
+		// OnFlushSuccess is called with the stats of every batch sent successfully.
+		OnFlushSuccess func(FlushStats)
+		// RollupDistributions sends distributions as summary gauges and counts, see Distribution.ToRollupAPIMetrics.
+		RollupDistributions bool
+		// DiscardMetrics drops the batches instead of sending them.
+		DiscardMetrics bool
+		// MaxBufferBytes sends the batch early once its estimated size exceeds it. 0 means no limit.
+		MaxBufferBytes int
+		// BeforeSubmit is called with each batch, and returns the series to send instead. Distributions are rolled up after it.
+		BeforeSubmit func([]Series) []Series
+		// MaxTagsPerMetric caps the number of distinct tag combinations of the metrics it names, across the batches.
+		MaxTagsPerMetric map[string]int
+		// DefaultMaxTagsPerMetric is the cap of the metrics missing from MaxTagsPerMetric. 0 means no limit.
+		DefaultMaxTagsPerMetric int
+		// HealthMetrics adds the flush_success and flush_errors counts to the batches, tagged with HealthMetricsTags.
+		HealthMetrics     bool
+		HealthMetricsTags []string
+		// Aggregator aggregates the metrics between two batches, it defaults to a Batcher.
+		Aggregator Aggregator
+		// QueueCapacity is the number of metrics waiting to be batched that AddMetric queues, before applying the
+		// QueuePolicy. 0 or less means defaultQueueCapacity.
+		QueueCapacity int
+		QueuePolicy   QueuePolicy
+		// FlushOnlyAtEnd starts no processing goroutine and no timer: the metrics are batched as they are added, and
+		// sent by Flush and FinishProcessing only. The queue and MaxBufferBytes don't apply then.
+		FlushOnlyAtEnd bool
 	}
 )
 
-// MakeProcessor creates a new metrics context
-func MakeProcessor(ctx context.Context, client Client, timeService TimeService, batchInterval time.Duration, shouldRetryOnFail bool, circuitBreakerInterval time.Duration, circuitBreakerTimeout time.Duration, circuitBreakerTotalFailures uint32) Processor {
-	batcher := MakeBatcher(batchInterval)
+const (
+	// QueuePolicyBlock makes AddMetric wait until there is room in the queue, slowing down its caller
+	QueuePolicyBlock QueuePolicy = iota
+	// QueuePolicyDropNewest drops the metric being added
+	QueuePolicyDropNewest
+	// QueuePolicyDropOldest drops the oldest metric of the queue, to make room for the one being added
+	QueuePolicyDropOldest
+)
 
-	breaker := MakeCircuitBreaker(circuitBreakerInterval, circuitBreakerTimeout, circuitBreakerTotalFailures)
+// MakeProcessor creates a new metrics context
+func MakeProcessor(ctx context.Context, client Client, timeService TimeService, options ProcessorOptions) Processor {
+	breaker := MakeCircuitBreaker(options.CircuitBreakerInterval, options.CircuitBreakerTimeout, options.CircuitBreakerTotalFailures)
+	queueCapacity := options.QueueCapacity
+	if queueCapacity <= 0 {
+		queueCapacity = defaultQueueCapacity
+	}
 
-	return &processor{
+	p := &processor{
 		context:           ctx,
-		metricsChan:       make(chan Metric, 2000),
-		batchInterval:     batchInterval,
+		metricsChan:       make(chan Metric, queueCapacity),
+		queuePolicy:       options.QueuePolicy,
+		flushChan:         make(chan chan error),
+		batchInterval:     options.BatchInterval,
+		flushJitter:       options.FlushJitter,
 		waitGroup:         sync.WaitGroup{},
 		client:            client,
-		batcher:           batcher,
-		shouldRetryOnFail: shouldRetryOnFail,
+		shouldRetryOnFail: options.ShouldRetryOnFail,
 		timeService:       timeService,
 		isProcessing:      false,
 		breaker:           breaker,
+		onFlushError:      options.OnFlushError,
+		onFlushSuccess:    options.OnFlushSuccess,
+		discard:           options.DiscardMetrics,
+		rollup:            options.RollupDistributions,
+		maxBufferBytes:    options.MaxBufferBytes,
+		beforeSubmit:      options.BeforeSubmit,
+		cardinality:       makeCardinalityGuard(options.MaxTagsPerMetric, options.DefaultMaxTagsPerMetric),
+		healthMetrics:     options.HealthMetrics,
+		healthMetricsTags: options.HealthMetricsTags,
+		aggregator:        options.Aggregator,
+		flushOnlyAtEnd:    options.FlushOnlyAtEnd,
+	}
+	if p.aggregator == nil {
+		p.aggregator = MakeBatcher(p.batchInterval)
+	}
+	return p
+}
+
+// addToBatch adds a metric to the aggregator, unless its tags are over the limit of MaxTagsPerMetric
+func (p *processor) addToBatch(metric Metric) {
+	series, ok := metricToSeries(metric)
+	if !ok {
+		return
 	}
+	bk := metric.ToBatchKey()
+	if p.cardinality != nil && !p.cardinality.allow(bk.name, getTagKey(bk.tags)) {
+		return
+	}
+	if _, ok := p.aggregator.(sizedAggregator); !ok {
+		p.addedSize += estimatedSeriesSize(bk) + estimatedPointSize*len(series.Points)
+	}
+	p.aggregator.Add(series)
+}
+
+// batchSize estimates the size of the batch once serialized, in bytes
+func (p *processor) batchSize() int {
+	if aggregator, ok := p.aggregator.(sizedAggregator); ok {
+		return aggregator.EstimatedSize() + p.unsentSize
+	}
+	// Each series is counted as a new one, as the aggregator may not merge them
+	return p.addedSize + p.unsentSize
+}
+
+// resetBatch starts a new batch once the current one is sent or dropped, the aggregator starting one when flushed
+func (p *processor) resetBatch() {
+	p.unsent = nil
+	p.addedSize = 0
+	p.unsentSize = 0
 }
 
 func MakeCircuitBreaker(circuitBreakerInterval time.Duration, circuitBreakerTimeout time.Duration, circuitBreakerTotalFailures uint32) *gobreaker.CircuitBreaker {
@@ -80,27 +252,93 @@ func MakeCircuitBreaker(circuitBreakerInterval time.Duration, circuitBreakerTime
 	return gobreaker.NewCircuitBreaker(st)
 }
 
-func (p *processor) AddMetric(metric Metric) {
+func (p *processor) AddMetric(metric Metric) bool {
+	p.finishMu.Lock()
+	defer p.finishMu.Unlock()
+	if p.finished {
+		return false
+	}
+	if p.flushOnlyAtEnd {
+		p.added = append(p.added, metric)
+		return true
+	}
 	// We use a large buffer in the metrics channel, to make this operation non-blocking.
-	// However, if the channel does fill up, this will become a blocking operation.
-	p.metricsChan <- metric
+	// However, if the channel does fill up, the queue policy decides whether it blocks or drops a metric.
+	switch p.queuePolicy {
+	case QueuePolicyDropNewest:
+		select {
+		case p.metricsChan <- metric:
+		default:
+			p.countDropped()
+		}
+	case QueuePolicyDropOldest:
+		for {
+			select {
+			case p.metricsChan <- metric:
+				return true
+			default:
+			}
+			// The processing goroutine may have made room in the meantime, in which case nothing is dropped
+			select {
+			case <-p.metricsChan:
+				p.countDropped()
+			default:
+			}
+		}
+	default:
+		p.metricsChan <- metric
+	}
+	return true
+}
+
+// countDropped counts a metric dropped by the queue policy, warning about the first one dropped since the last flush
+func (p *processor) countDropped() {
+	if p.dropped.Add(1) == 1 {
+		logger.Warn(fmt.Sprintf("the queue of %d metrics is full, dropping metrics", cap(p.metricsChan)))
+	}
 }
 
 func (p *processor) StartProcessing() {
+	if !p.isProcessing && p.flushOnlyAtEnd {
+		p.isProcessing = true
+		p.windowStart = p.timeService.Now()
+		return
+	}
 	if !p.isProcessing {
 		p.isProcessing = true
+		p.windowStart = p.timeService.Now()
+		p.exited = make(chan struct{})
 		p.waitGroup.Add(1)
-		go p.processMetrics()
+		go p.processMetrics(p.exited)
 	}
 
 }
 
 func (p *processor) FinishProcessing() {
+	p.finish(nil)
+}
+
+func (p *processor) FinishProcessingWithContext(ctx context.Context) {
+	p.finish(ctx)
+}
+
+// finish sends the last batch, bound to ctx unless it's nil, and stops the processing
+func (p *processor) finish(ctx context.Context) {
+	if p.flushOnlyAtEnd {
+		p.finishBatching(ctx)
+		return
+	}
 	if !p.isProcessing {
 		p.StartProcessing()
 	}
 	// Closes the metrics channel, and waits for the last send to complete
-	close(p.metricsChan)
+	p.finishMu.Lock()
+	if !p.finished {
+		p.finished = true
+		p.finishCtx = ctx
+		close(p.metricsChan)
+	}
+	p.finishMu.Unlock()
 	p.waitGroup.Wait()
 }
 
@@ -108,9 +346,78 @@ func (p *processor) IsProcessing() bool {
 	return p.isProcessing
 }
 
-func (p *processor) processMetrics() {
+func (p *processor) Flush(ctx context.Context) error {
+	if p.flushOnlyAtEnd {
+		p.sendMu.Lock()
+		defer p.sendMu.Unlock()
+		if !p.batchAddedMetrics(false) {
+			return nil
+		}
+		return p.sendBatch(false)
+	}
+	if p.exited == nil {
+		// Nothing was batched
+		return nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case p.flushChan <- reply:
+	case <-p.exited:
+		// The last batch was sent already
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	ticker := p.timeService.NewTicker(p.batchInterval)
+// finishBatching sends the last batch of a processor flushing only at the end, from the calling goroutine
+func (p *processor) finishBatching(ctx context.Context) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if !p.batchAddedMetrics(true) {
+		return
+	}
+	p.finishCtx = ctx
+	if p.context.Err() != nil {
+		// The context of the invocation can't be used anymore, the last flush gets a short one of its own
+		var cancel context.CancelFunc
+		p.cancelledFlushCtx, cancel = context.WithTimeout(context.WithoutCancel(p.context), defaultCancelledFlushTimeout)
+		defer cancel()
+	}
+	p.sendBatch(true)
+	p.isProcessing = false
+}
+
+// batchAddedMetrics moves the metrics added to a processor flushing only at the end into the batch, holding finishMu
+// only to take them, so AddMetric doesn't wait for the send. It returns false when the processor is finished, and
+// finishes it when finish is set.
+func (p *processor) batchAddedMetrics(finish bool) bool {
+	p.finishMu.Lock()
+	if p.finished {
+		p.finishMu.Unlock()
+		return false
+	}
+	p.finished = finish
+	added := p.added
+	p.added = nil
+	p.finishMu.Unlock()
+
+	for _, metric := range added {
+		p.addToBatch(metric)
+	}
+	return true
+}
+
+func (p *processor) processMetrics(exited chan struct{}) {
+	defer close(exited)
+
+	ticker := p.timeService.NewTicker(p.flushInterval())
 
 	doneChan := p.context.Done()
 	shouldExit := false
@@ -119,7 +426,7 @@ func (p *processor) processMetrics() {
 		// Batches metrics until timeout is reached
 		select {
 		case <-doneChan:
-			// This process is being cancelled by the context,(probably due to a lambda deadline), exit without flushing.
+			// This process is being cancelled by the context (probably due to a lambda deadline), do a last flush and exit.
 			shouldExit = true
 		case m, ok := <-p.metricsChan:
 			if !ok {
@@ -127,42 +434,36 @@ func (p *processor) processMetrics() {
 				shouldSendBatch = true
 				shouldExit = true
 			} else {
-				p.batcher.AddMetric(m)
+				p.addToBatch(m)
+				shouldSendBatch = p.isBufferFull()
 			}
 		case <-ticker.C:
-			// We are ready to send a batch to our backend
+			// We are ready to send a batch to our backend, including the metrics that were added before the tick
 			shouldSendBatch = true
+			shouldExit = p.addPendingMetrics()
+		case reply := <-p.flushChan:
+			// A closed channel is seen again by the next iteration, which exits
+			p.addPendingMetrics()
+			reply <- p.sendBatch(false)
+			continue
 		}
 		// Since the go select statement picks randomly if multiple values are available, it's possible the done channel was
 		// closed, but another channel was selected instead. We double check the done channel, to make sure this isn't he case.
 		select {
 		case <-doneChan:
 			shouldExit = true
-			shouldSendBatch = false
+			shouldSendBatch = true
+			p.addPendingMetrics()
+			// The context of the invocation can't be used anymore, the last flush gets a short one of its own
+			var cancel context.CancelFunc
+			p.cancelledFlushCtx, cancel = context.WithTimeout(context.WithoutCancel(p.context), defaultCancelledFlushTimeout)
+			defer cancel()
 		default:
 			// Non-blocking
 		}
 
 		if shouldSendBatch {
-			_, err := p.breaker.Execute(func() (interface{}, error) {
-				if shouldExit && p.shouldRetryOnFail {
-					// If we are shutting down, and we just failed to send our last batch, do a retry
-					bo := backoff.WithMaxRetries(backoff.NewConstantBackOff(defaultRetryInterval), 2)
-					err := backoff.Retry(p.sendMetricsBatch, bo)
-					if err != nil {
-						return nil, fmt.Errorf("after retry: %v", err)
-					}
-				} else {
-					err := p.sendMetricsBatch()
-					if err != nil {
-						return nil, fmt.Errorf("with no retry: %v", err)
-					}
-				}
-				return nil, nil
-			})
-			if err != nil {
-				logger.Error(fmt.Errorf("failed to flush metrics to datadog API: %v", err))
-			}
+			p.sendBatch(shouldExit)
 		}
 	}
 	ticker.Stop()
@@ -170,20 +471,255 @@ func (p *processor) processMetrics() {
 	p.waitGroup.Done()
 }
 
-func (p *processor) sendMetricsBatch() error {
-	mts := p.batcher.ToAPIMetrics()
-	if len(mts) > 0 {
-		oldBatcher := p.batcher
-		p.batcher = MakeBatcher(p.batchInterval)
-
-		err := p.client.SendMetrics(mts)
-		if err != nil {
-			if p.shouldRetryOnFail {
-				// If we want to retry on error, keep the metrics in the batcher until they are sent correctly.
-				p.batcher = oldBatcher
+func (p *processor) Send(metrics []APIMetric) error {
+	send := func() error {
+		return p.client.SendMetrics(metrics)
+	}
+	_, err := p.breaker.Execute(func() (interface{}, error) {
+		if !p.shouldRetryOnFail {
+			return nil, send()
+		}
+		if err := backoff.Retry(send, makeRetryBackOff(p.context, p.timeService.Now)); err != nil {
+			return nil, fmt.Errorf("after retry: %w", err)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// randInt63n returns a random number in [0, n), it's replaced in tests
+var randInt63n = rand.Int63n
+
+// flushInterval returns the period of the flushes: the batch interval, plus a random jitter drawn once per processor,
+// so the processors started at the same time don't flush at the same time
+func (p *processor) flushInterval() time.Duration {
+	if p.flushJitter <= 0 {
+		return p.batchInterval
+	}
+	return p.batchInterval + time.Duration(randInt63n(int64(p.flushJitter)))
+}
+
+// batchWindow returns the duration of the window of the current batch when it's flushed at now, or the batch interval
+// when the start of the window isn't known
+func (p *processor) batchWindow(now time.Time) time.Duration {
+	if p.windowStart.IsZero() || !now.After(p.windowStart) {
+		return p.batchInterval
+	}
+	return now.Sub(p.windowStart)
+}
+
+// sendBatch sends the current batch, retrying the last one if shouldRetryOnFail is set, and reports the outcome
+func (p *processor) sendBatch(isLastBatch bool) error {
+	p.stats = FlushStats{}
+	if isLastBatch && p.cancelledFlushCtx == nil {
+		// The metrics channel was closed, after finishCtx was set
+		p.lastBatchCtx = p.finishCtx
+	}
+	_, err := p.breaker.Execute(func() (interface{}, error) {
+		if isLastBatch && p.shouldRetryOnFail && p.cancelledFlushCtx == nil {
+			// If we are shutting down, and we just failed to send our last batch, do a retry
+			retryCtx := p.context
+			if p.lastBatchCtx != nil {
+				retryCtx = p.lastBatchCtx
+			}
+			bo := makeRetryBackOff(retryCtx, p.timeService.Now)
+			err := backoff.Retry(p.sendMetricsBatch, bo)
+			if err != nil {
+				return nil, fmt.Errorf("after retry: %w", err)
 			}
-			return err
+		} else {
+			err := p.sendMetricsBatch()
+			if err != nil {
+				return nil, fmt.Errorf("with no retry: %w", err)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		p.failedFlushes++
+		logger.Error(fmt.Errorf("failed to flush metrics to datadog API: %v", err))
+		if p.onFlushError != nil {
+			p.onFlushError(err)
+		}
+	} else if p.onFlushSuccess != nil && p.stats.Series > 0 {
+		p.onFlushSuccess(p.stats)
+	}
+	return err
+}
+
+// isBufferFull returns true when the estimated size of the batch exceeds maxBufferBytes
+func (p *processor) isBufferFull() bool {
+	if p.maxBufferBytes <= 0 || p.batchSize() < p.maxBufferBytes {
+		return false
+	}
+	logger.Debug(fmt.Sprintf("sending the metrics batch early, its estimated size of %d bytes exceeds %d bytes", p.batchSize(), p.maxBufferBytes))
+	return true
+}
+
+// addPendingMetrics adds the metrics waiting in the channel to the batch, without blocking.
+// It returns true if the channel was closed.
+func (p *processor) addPendingMetrics() bool {
+	for {
+		select {
+		case m, ok := <-p.metricsChan:
+			if !ok {
+				return true
+			}
+			p.addToBatch(m)
+		default:
+			return false
+		}
+	}
+}
+
+// deadlineBackOff stops retrying once waiting for the next retry would leave less than defaultRetryDeadlineMargin before the deadline
+type deadlineBackOff struct {
+	backoff.BackOff
+	deadline time.Time
+	now      func() time.Time
+}
+
+func (b *deadlineBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop {
+		return next
+	}
+	if remaining := b.deadline.Sub(b.now()); remaining < next+defaultRetryDeadlineMargin {
+		logger.Warn(fmt.Sprintf("not retrying to send metrics, only %s remain before the lambda deadline", remaining))
+		return backoff.Stop
+	}
+	return next
+}
+
+// makeRetryBackOff retries up to defaultMaxRetries times, and never past the deadline of ctx, if it has one
+func makeRetryBackOff(ctx context.Context, now func() time.Time) backoff.BackOff {
+	var bo backoff.BackOff = backoff.WithMaxRetries(backoff.NewConstantBackOff(defaultRetryInterval), defaultMaxRetries)
+	if deadline, ok := ctx.Deadline(); ok {
+		bo = &deadlineBackOff{BackOff: bo, deadline: deadline, now: now}
+	}
+	return bo
+}
+
+// toAPIMetrics converts the current batch into API metrics, passing it through the beforeSubmit hook if there is one.
+// The batch of the aggregator is kept in unsent until it's sent, as it can only be flushed once.
+func (p *processor) toAPIMetrics(window time.Duration) []APIMetric {
+	p.unsent = append(p.unsent, p.aggregator.Flush()...)
+	series := p.unsent
+	if len(series) == 0 {
+		return []APIMetric{}
+	}
+	if p.beforeSubmit != nil {
+		// The hook gets copies, unsent being passed to it again if the batch is retried
+		series = p.beforeSubmit(copySeries(series))
+	}
+	mts := []APIMetric{}
+	for _, s := range series {
+		if s.Type == DistributionType && p.rollup {
+			d := Distribution{Name: s.Name, Tags: s.Tags, Host: s.Host, Values: s.Points}
+			mts = append(mts, d.ToRollupAPIMetrics(window)...)
+			continue
+		}
+		if s.Type == CountType && s.Interval == 0 {
+			// Counts added by the hook are over the batch, unless it says otherwise
+			s.Interval = window.Seconds()
 		}
+		mts = append(mts, s.ToAPIMetric())
+	}
+	return mts
+}
+
+func (p *processor) sendMetricsBatch() error {
+	// The window of the batch ends now, the next one starts unless the batch is kept to be retried
+	now := p.timeService.Now()
+	window := p.batchWindow(now)
+	oldWindowStart := p.windowStart
+	p.windowStart = now
+
+	mts := p.toAPIMetrics(window)
+	if len(mts) == 0 {
+		// The batch is empty, or the hook dropped every series of it
+		p.resetBatch()
+		return nil
+	}
+	if p.discard {
+		p.resetBatch()
+		logger.Debug(fmt.Sprintf("discarding a batch of %d series, metrics aren't submitted in this environment", len(mts)))
+		return nil
+	}
+	oldUnsent := p.unsent
+	p.resetBatch()
+
+	// The health metrics are only sent along with the batch, so their own failure just counts as the failure of the batch
+	dropped := p.dropped.Swap(0)
+	payload := append(append(mts, p.makeHealthMetrics(window)...), p.makeDroppedMetrics(dropped, window)...)
+	var size int
+	var err error
+	sendCtx := p.cancelledFlushCtx
+	if sendCtx == nil {
+		sendCtx = p.lastBatchCtx
+	}
+	if client, ok := p.client.(contextClient); ok && sendCtx != nil {
+		size, err = client.SendMetricsWithContext(sendCtx, payload)
+	} else if client, ok := p.client.(sizeReportingClient); ok {
+		size, err = client.SendMetricsWithSize(payload)
+	} else {
+		err = p.client.SendMetrics(payload)
+	}
+	if err != nil {
+		if p.shouldRetryOnFail {
+			// If we want to retry on error, keep the series flushed by the aggregator until they are sent correctly.
+			p.unsent = oldUnsent
+			p.unsentSize = estimatedSeriesListSize(oldUnsent)
+			p.windowStart = oldWindowStart
+		}
+		// The drops are counted with the next batch sent
+		p.dropped.Add(dropped)
+		return err
+	}
+
+	p.failedFlushes = 0
+	p.stats = FlushStats{Series: len(mts), Bytes: size}
+	for _, mt := range mts {
+		p.stats.Points += len(mt.Points)
 	}
 	return nil
 }
+
+// makeHealthMetrics returns the count of the batch being sent, as flush_success, and of the flushes that failed before
+// it, as flush_errors, over the window of the batch, when the health metrics are enabled
+func (p *processor) makeHealthMetrics(window time.Duration) []APIMetric {
+	if !p.healthMetrics {
+		return nil
+	}
+	timestamp := float64(p.timeService.Now().Unix())
+	interval := intervalSeconds(window)
+	makeCount := func(name string, value int) APIMetric {
+		return APIMetric{
+			Name:       name,
+			Tags:       p.healthMetricsTags,
+			MetricType: CountType,
+			Interval:   interval,
+			Points:     []interface{}{[]interface{}{timestamp, float64(value)}},
+		}
+	}
+	mts := []APIMetric{makeCount(flushSuccessMetric, 1)}
+	if p.failedFlushes > 0 {
+		mts = append(mts, makeCount(flushErrorsMetric, p.failedFlushes))
+	}
+	return mts
+}
+
+// makeDroppedMetrics returns the count of the metrics dropped by the queue policy over the window of the batch, as
+// queue_dropped, when there are any
+func (p *processor) makeDroppedMetrics(dropped int64, window time.Duration) []APIMetric {
+	if dropped == 0 {
+		return nil
+	}
+	return []APIMetric{{
+		Name:       queueDroppedMetric,
+		Tags:       p.healthMetricsTags,
+		MetricType: CountType,
+		Interval:   intervalSeconds(window),
+		Points:     []interface{}{[]interface{}{float64(p.timeService.Now().Unix()), float64(dropped)}},
+	}}
+}
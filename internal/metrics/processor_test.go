@@ -12,9 +12,11 @@ import (
 	"context"
 	"errors"
 	"math"
+	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,6 +30,8 @@ type (
 	mockTimeService struct {
 		now        time.Time
 		tickerChan chan time.Time
+		// tickerDurations are the durations of the tickers created
+		tickerDurations []time.Duration
 	}
 )
 
@@ -45,6 +49,16 @@ func makeMockTimeService() mockTimeService {
 	}
 }
 
+func makeTestProcessorOptions() ProcessorOptions {
+	return ProcessorOptions{
+		BatchInterval:               1000,
+		ShouldRetryOnFail:           false,
+		CircuitBreakerInterval:      time.Hour * 1000,
+		CircuitBreakerTimeout:       time.Hour * 1000,
+		CircuitBreakerTotalFailures: math.MaxUint32,
+	}
+}
+
 func (mc *mockClient) SendMetrics(mts []APIMetric) error {
 	mc.sendMetricsCalledCount++
 	mc.batches <- mts
@@ -52,6 +66,7 @@ func (mc *mockClient) SendMetrics(mts []APIMetric) error {
 }
 
 func (ts *mockTimeService) NewTicker(duration time.Duration) *time.Ticker {
+	ts.tickerDurations = append(ts.tickerDurations, duration)
 	return &time.Ticker{
 		C: ts.tickerChan,
 	}
@@ -68,7 +83,7 @@ func TestProcessorBatches(t *testing.T) {
 	mts.now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 	nowUnix := float64(mts.now.Unix())
 
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := MakeProcessor(context.Background(), &mc, &mts, makeTestProcessorOptions())
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -114,7 +129,7 @@ func TestProcessorBatchesPerTick(t *testing.T) {
 	secondTimeUnix := float64(secondTime.Unix())
 	mts.now = firstTime
 
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	processor := MakeProcessor(context.Background(), &mc, &mts, makeTestProcessorOptions())
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -189,7 +204,9 @@ func TestProcessorPerformsRetry(t *testing.T) {
 	mts.now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 
 	shouldRetry := true
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, shouldRetry, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	options := makeTestProcessorOptions()
+	options.ShouldRetryOnFail = shouldRetry
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -214,7 +231,9 @@ func TestProcessorCancelsWithContext(t *testing.T) {
 
 	shouldRetry := true
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	processor := MakeProcessor(ctx, &mc, &mts, 1000, shouldRetry, time.Hour*1000, time.Hour*1000, math.MaxUint32)
+	options := makeTestProcessorOptions()
+	options.ShouldRetryOnFail = shouldRetry
+	processor := MakeProcessor(ctx, &mc, &mts, options)
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -223,13 +242,40 @@ func TestProcessorCancelsWithContext(t *testing.T) {
 	}
 
 	processor.AddMetric(&d1)
-	// After calling cancelFunc, no metrics should be processed/sent
+	// After calling cancelFunc, the metrics are sent in a last flush, without retrying
 	cancelFunc()
-	//<-time.Tick(time.Millisecond * 100)
 
 	processor.FinishProcessing()
 
-	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Len(t, <-mc.batches, 1)
+}
+
+func TestProcessorExitsAndFlushesWhenCancelled(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	pr := MakeProcessor(ctx, &mc, &mts, makeTestProcessorOptions())
+	pr.StartProcessing()
+
+	pr.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	cancelFunc()
+
+	exited := make(chan struct{})
+	go func() {
+		pr.(*processor).waitGroup.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the processor didn't exit when its context was cancelled")
+	}
+
+	// The metric was either batched before the cancellation, or drained from the channel by the last flush
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "metric-1", batch[0].Name)
 }
 
 func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
@@ -240,7 +286,9 @@ func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
 
 	// Will open the circuit breaker at number of total failures > 1
 	circuitBreakerTotalFailures := uint32(1)
-	processor := MakeProcessor(context.Background(), &mc, &mts, 1000, false, time.Hour*1000, time.Hour*1000, circuitBreakerTotalFailures)
+	options := makeTestProcessorOptions()
+	options.CircuitBreakerTotalFailures = circuitBreakerTotalFailures
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
 
 	d1 := Distribution{
 		Name:   "metric-1",
@@ -257,3 +305,689 @@ func TestProcessorBatchesWithOpeningCircuitBreaker(t *testing.T) {
 	// It should have retried 3 times, but circuit breaker opened at the second time
 	assert.Equal(t, 1, mc.sendMetricsCalledCount)
 }
+
+func TestProcessorStopsRetryingBeforeDeadline(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	ctx, cancelFunc := context.WithDeadline(context.Background(), mts.now.Add(defaultRetryDeadlineMargin/2))
+	defer cancelFunc()
+	flushErrors := []error{}
+	options := makeTestProcessorOptions()
+	options.ShouldRetryOnFail = true
+	options.OnFlushError = func(err error) { flushErrors = append(flushErrors, err) }
+	processor := MakeProcessor(ctx, &mc, &mts, options)
+
+	d1 := Distribution{
+		Name:   "metric-1",
+		Tags:   []string{"a", "b", "c"},
+		Values: []MetricValue{{Timestamp: mts.now, Value: 1}},
+	}
+
+	mc.err = errors.New("Some error")
+
+	processor.AddMetric(&d1)
+
+	processor.FinishProcessing()
+
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+	assert.Len(t, flushErrors, 1)
+}
+
+func TestProcessorOnFlushSuccess(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	stats := []FlushStats{}
+	options := makeTestProcessorOptions()
+	options.OnFlushSuccess = func(s FlushStats) { stats = append(stats, s) }
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+
+	processor.AddMetric(&Distribution{
+		Name:   "metric-1",
+		Tags:   []string{"a"},
+		Values: []MetricValue{{Timestamp: mts.now, Value: 1}, {Timestamp: mts.now, Value: 2}},
+	})
+	processor.AddMetric(&Distribution{
+		Name:   "metric-1",
+		Tags:   []string{"a"},
+		Values: []MetricValue{{Timestamp: mts.now, Value: 3}},
+	})
+	processor.AddMetric(&Distribution{
+		Name:   "metric-2",
+		Tags:   []string{"b"},
+		Values: []MetricValue{{Timestamp: mts.now, Value: 4}},
+	})
+	processor.FinishProcessing()
+
+	// The mock client doesn't report the size of the payloads
+	assert.Equal(t, []FlushStats{{Series: 2, Points: 4, Bytes: 0}}, stats)
+}
+
+func TestProcessorOnFlushSuccessNotCalledOnError(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("Some error")
+	mts := makeMockTimeService()
+	called := false
+	options := makeTestProcessorOptions()
+	options.OnFlushSuccess = func(FlushStats) { called = true }
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+
+	assert.False(t, called)
+}
+
+func TestMakeRetryBackOffWithoutDeadline(t *testing.T) {
+	bo := makeRetryBackOff(context.Background(), time.Now)
+	for i := 0; i < defaultMaxRetries; i++ {
+		assert.Equal(t, defaultRetryInterval, bo.NextBackOff())
+	}
+	assert.Equal(t, backoff.Stop, bo.NextBackOff())
+}
+
+func TestProcessorFlushesEarlyWhenBufferIsFull(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	// Large enough for a single series of one point, but not for two
+	options.MaxBufferBytes = 150
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+
+	// No tick happened, and processing isn't finished, so only the size of the batch can trigger this flush
+	select {
+	case batch := <-mc.batches:
+		assert.Len(t, batch, 2)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the batch wasn't flushed early")
+	}
+
+	processor.AddMetric(&Distribution{Name: "metric-3", Values: []MetricValue{{Timestamp: mts.now, Value: 3}}})
+	processor.FinishProcessing()
+
+	lastBatch := <-mc.batches
+	assert.Len(t, lastBatch, 1)
+	assert.Equal(t, "metric-3", lastBatch[0].Name)
+}
+
+func TestProcessorBeforeSubmit(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	nowUnix := float64(mts.now.Unix())
+	options := makeTestProcessorOptions()
+	options.BeforeSubmit = func(batch []Series) []Series {
+		result := []Series{}
+		for _, s := range batch {
+			if s.Name == "metric-2" {
+				continue
+			}
+			s.Tags = append(s.Tags, "derived:tag")
+			result = append(result, s)
+		}
+		return result
+	}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"a"}, Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	processor.FinishProcessing()
+
+	assert.Equal(t, []APIMetric{{
+		Name:       "metric-1",
+		Tags:       []string{"a", "derived:tag"},
+		MetricType: DistributionType,
+		Points:     []interface{}{[]interface{}{nowUnix, []interface{}{float64(1)}}},
+	}}, <-mc.batches)
+}
+
+func TestProcessorBeforeSubmitDropsEverything(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.BeforeSubmit = func([]Series) []Series { return []Series{} }
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	mts.tickerChan <- mts.now
+	processor.FinishProcessing()
+
+	assert.Equal(t, 0, mc.sendMetricsCalledCount)
+}
+
+func TestProcessorSetsBatchIntervalOnCounts(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	nowUnix := float64(mts.now.Unix())
+	options := makeTestProcessorOptions()
+	options.BatchInterval = 10 * time.Second
+	options.BeforeSubmit = func(batch []Series) []Series {
+		count := Series{Name: "metric-1.total", Type: CountType, Points: []MetricValue{{Timestamp: mts.now, Value: float64(len(batch[0].Points))}}}
+		return []Series{count}
+	}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}, {Timestamp: mts.now, Value: 2}}})
+	processor.FinishProcessing()
+
+	interval := float64(10)
+	assert.Equal(t, []APIMetric{{
+		Name:       "metric-1.total",
+		MetricType: CountType,
+		Interval:   &interval,
+		Points:     []interface{}{[]interface{}{nowUnix, float64(2)}},
+	}}, <-mc.batches)
+}
+
+func TestProcessorSetsTheWindowOfTheBatchOnCounts(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.BatchInterval = 10 * time.Second
+	options.HealthMetrics = true
+	options.BeforeSubmit = func(batch []Series) []Series {
+		count := Series{Name: "metric-1.total", Type: CountType, Points: []MetricValue{{Timestamp: mts.now, Value: float64(len(batch[0].Points))}}}
+		return []Series{count}
+	}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	intervals := func() map[string]float64 {
+		result := map[string]float64{}
+		for _, mt := range <-mc.batches {
+			result[mt.Name] = *mt.Interval
+		}
+		return result
+	}
+
+	// A flush before the end of the batch interval
+	mts.now = mts.now.Add(3 * time.Second)
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.NoError(t, processor.Flush(context.Background()))
+	assert.Equal(t, map[string]float64{"metric-1.total": 3, flushSuccessMetric: 3}, intervals())
+
+	// The end of the invocation, the next window started at the previous flush
+	mts.now = mts.now.Add(4 * time.Second)
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+	assert.Equal(t, map[string]float64{"metric-1.total": 4, flushSuccessMetric: 4}, intervals())
+}
+
+func TestProcessorSetsTheWindowOfTheBatchOnRollups(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.BatchInterval = 10 * time.Second
+	options.RollupDistributions = true
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	mts.now = mts.now.Add(2 * time.Second)
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+
+	var interval *float64
+	for _, mt := range <-mc.batches {
+		if mt.Name == "metric-1.count" {
+			interval = mt.Interval
+		}
+	}
+	if assert.NotNil(t, interval) {
+		assert.Equal(t, 2.0, *interval)
+	}
+}
+
+func TestProcessorFlush(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	processor := MakeProcessor(context.Background(), &mc, &mts, makeTestProcessorOptions())
+	assert.NoError(t, processor.Flush(context.Background()))
+
+	processor.StartProcessing()
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.NoError(t, processor.Flush(context.Background()))
+	assert.Equal(t, 1, mc.sendMetricsCalledCount)
+
+	// The processing goes on after a flush
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	processor.FinishProcessing()
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	assert.NoError(t, processor.Flush(context.Background()))
+}
+
+func TestProcessorFlushReturnsError(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("some error")
+	mts := makeMockTimeService()
+	processor := MakeProcessor(context.Background(), &mc, &mts, makeTestProcessorOptions())
+	processor.StartProcessing()
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.Error(t, processor.Flush(context.Background()))
+	processor.FinishProcessing()
+}
+
+func TestProcessorHealthMetrics(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("some error")
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.HealthMetrics = true
+	options.HealthMetricsTags = []string{"functionname:my-function"}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	healthMetrics := func() map[string]float64 {
+		counts := map[string]float64{}
+		for _, mt := range <-mc.batches {
+			if mt.Name == flushSuccessMetric || mt.Name == flushErrorsMetric {
+				assert.Equal(t, CountType, mt.MetricType)
+				assert.Equal(t, []string{"functionname:my-function"}, mt.Tags)
+				counts[mt.Name] = mt.Points[0].([]interface{})[1].(float64)
+			}
+		}
+		return counts
+	}
+
+	// Two failed flushes, the failure of the first one is counted by the second one
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.Error(t, processor.Flush(context.Background()))
+	assert.Equal(t, map[string]float64{flushSuccessMetric: 1}, healthMetrics())
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.Error(t, processor.Flush(context.Background()))
+	assert.Equal(t, map[string]float64{flushSuccessMetric: 1, flushErrorsMetric: 1}, healthMetrics())
+
+	// The next successful flush reports them
+	mc.err = nil
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	assert.NoError(t, processor.Flush(context.Background()))
+	assert.Equal(t, map[string]float64{flushSuccessMetric: 1, flushErrorsMetric: 2}, healthMetrics())
+
+	// Only once
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+	assert.Equal(t, map[string]float64{flushSuccessMetric: 1}, healthMetrics())
+}
+
+func TestProcessorWithoutHealthMetrics(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	processor := MakeProcessor(context.Background(), &mc, &mts, makeTestProcessorOptions())
+	processor.StartProcessing()
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "metric-1", batch[0].Name)
+}
+
+// onceAggregator flushes the series added to it, once
+type onceAggregator struct {
+	series []Series
+}
+
+func (a *onceAggregator) Add(series Series) {
+	a.series = append(a.series, series)
+}
+
+func (a *onceAggregator) Flush() []Series {
+	series := a.series
+	a.series = nil
+	return series
+}
+
+func (a *onceAggregator) Shutdown() {}
+
+func TestProcessorResubmitsTheBatchOfAFailedFlush(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	options := makeTestProcessorOptions()
+	options.ShouldRetryOnFail = true
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	mc.err = errors.New("Some error")
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}, {Timestamp: mts.now, Value: 2}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 3}}})
+	assert.Error(t, processor.Flush(context.Background()))
+	<-mc.batches
+
+	mc.err = nil
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 4}}})
+	processor.FinishProcessing()
+
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	batch := <-mc.batches
+	values := map[string][]interface{}{}
+	for _, mt := range batch {
+		for _, point := range mt.Points {
+			values[mt.Name] = append(values[mt.Name], point.([]interface{})[1].([]interface{})...)
+		}
+	}
+	assert.ElementsMatch(t, []interface{}{float64(1), float64(2), float64(4)}, values["metric-1"])
+	assert.ElementsMatch(t, []interface{}{float64(3)}, values["metric-2"])
+}
+
+func TestProcessorRetriesTheBatchOfTheAggregator(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	options := makeTestProcessorOptions()
+	options.ShouldRetryOnFail = true
+	options.Aggregator = &onceAggregator{}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+
+	mc.err = errors.New("Some error")
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+
+	assert.Equal(t, 3, mc.sendMetricsCalledCount)
+	for i := 0; i < 3; i++ {
+		batch := <-mc.batches
+		assert.Len(t, batch, 1)
+		assert.Equal(t, "metric-1", batch[0].Name)
+	}
+}
+
+func TestProcessorAppliesTheLimitsToACustomAggregator(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+
+	options := makeTestProcessorOptions()
+	options.Aggregator = &onceAggregator{}
+	// Large enough for a single series of one point, but not for two
+	options.MaxBufferBytes = 150
+	options.MaxTagsPerMetric = map[string]int{"metric-1": 1}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.StartProcessing()
+
+	processor.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.AddMetric(&Distribution{Name: "metric-1", Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: mts.now, Value: 2}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 3}}})
+
+	// The second combination of metric-1 is dropped, and the size of the batch triggers this flush
+	select {
+	case batch := <-mc.batches:
+		assert.Len(t, batch, 2)
+		assert.Equal(t, []string{"user:1"}, batch[0].Tags)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the batch wasn't flushed early")
+	}
+	processor.FinishProcessing()
+}
+
+func TestProcessorFlushJitter(t *testing.T) {
+	jitters := []int64{299, 0, 150}
+	randInt63n = func(n int64) int64 {
+		assert.Equal(t, int64(300), n)
+		jitter := jitters[0]
+		jitters = jitters[1:]
+		return jitter
+	}
+	defer func() { randInt63n = rand.Int63n }()
+
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.FlushJitter = 300
+	for i := 0; i < 3; i++ {
+		processor := MakeProcessor(context.Background(), &mc, &mts, options)
+		processor.StartProcessing()
+		processor.FinishProcessing()
+	}
+
+	assert.Equal(t, []time.Duration{1299, 1000, 1150}, mts.tickerDurations)
+}
+
+func TestProcessorFlushIntervalStaysWithinTheJitter(t *testing.T) {
+	options := makeTestProcessorOptions()
+	options.BatchInterval = time.Second
+	options.FlushJitter = 300 * time.Millisecond
+	intervals := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		p := MakeProcessor(context.Background(), &mockClient{}, &mockTimeService{}, options).(*processor)
+		interval := p.flushInterval()
+		assert.GreaterOrEqual(t, interval, time.Second)
+		assert.Less(t, interval, 1300*time.Millisecond)
+		intervals[interval] = true
+	}
+	assert.Greater(t, len(intervals), 1)
+
+	options.FlushJitter = 0
+	p := MakeProcessor(context.Background(), &mockClient{}, &mockTimeService{}, options).(*processor)
+	assert.Equal(t, time.Second, p.flushInterval())
+}
+
+// queuedBatch returns the names of the metrics of the next batch, and the count of its queue_dropped metric
+func queuedBatch(t *testing.T, mc *mockClient) ([]string, float64) {
+	names := []string{}
+	dropped := 0.0
+	for _, mt := range <-mc.batches {
+		if mt.Name == queueDroppedMetric {
+			assert.Equal(t, CountType, mt.MetricType)
+			assert.Equal(t, []string{"functionname:my-function"}, mt.Tags)
+			dropped = mt.Points[0].([]interface{})[1].(float64)
+			continue
+		}
+		names = append(names, mt.Name)
+	}
+	return names, dropped
+}
+
+func TestProcessorQueuePolicyDropsWhenTheQueueIsFull(t *testing.T) {
+	policies := map[QueuePolicy][]string{
+		QueuePolicyDropNewest: {"metric-1", "metric-2"},
+		QueuePolicyDropOldest: {"metric-2", "metric-3"},
+	}
+	for policy, expected := range policies {
+		mc := makeMockClient()
+		mts := makeMockTimeService()
+		options := makeTestProcessorOptions()
+		options.QueueCapacity = 2
+		options.QueuePolicy = policy
+		options.HealthMetricsTags = []string{"functionname:my-function"}
+		// The queue isn't drained until the processing starts
+		processor := MakeProcessor(context.Background(), &mc, &mts, options)
+		for _, name := range []string{"metric-1", "metric-2", "metric-3"} {
+			assert.True(t, processor.AddMetric(&Distribution{Name: name, Values: []MetricValue{{Timestamp: mts.now, Value: 1}}}))
+		}
+		processor.FinishProcessing()
+
+		names, dropped := queuedBatch(t, &mc)
+		assert.ElementsMatch(t, expected, names, policy)
+		assert.Equal(t, 1.0, dropped, policy)
+	}
+}
+
+func TestProcessorQueuePolicyCountsTheDropsWithTheNextBatchSent(t *testing.T) {
+	mc := makeMockClient()
+	mc.err = errors.New("some error")
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.QueueCapacity = 1
+	options.QueuePolicy = QueuePolicyDropNewest
+	options.HealthMetricsTags = []string{"functionname:my-function"}
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.StartProcessing()
+	assert.Error(t, processor.Flush(context.Background()))
+	_, dropped := queuedBatch(t, &mc)
+	assert.Equal(t, 1.0, dropped)
+
+	mc.err = nil
+	processor.AddMetric(&Distribution{Name: "metric-3", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.FinishProcessing()
+	names, dropped := queuedBatch(t, &mc)
+	assert.Equal(t, []string{"metric-3"}, names)
+	assert.Equal(t, 1.0, dropped)
+}
+
+func TestProcessorQueuePolicyBlockWaitsForRoom(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.QueueCapacity = 2
+	options.QueuePolicy = QueuePolicyBlock
+	processor := MakeProcessor(context.Background(), &mc, &mts, options)
+	processor.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	processor.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+
+	added := make(chan struct{})
+	go func() {
+		processor.AddMetric(&Distribution{Name: "metric-3", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+		close(added)
+	}()
+	select {
+	case <-added:
+		assert.Fail(t, "the metric was added to a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The processing drains the queue, which makes room for the blocked metric
+	processor.StartProcessing()
+	<-added
+	processor.FinishProcessing()
+
+	names, dropped := queuedBatch(t, &mc)
+	assert.ElementsMatch(t, []string{"metric-1", "metric-2", "metric-3"}, names)
+	assert.Equal(t, 0.0, dropped)
+}
+
+func TestProcessorFlushOnlyAtEnd(t *testing.T) {
+	mc := makeMockClient()
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.FlushOnlyAtEnd = true
+	p := MakeProcessor(context.Background(), &mc, &mts, options).(*processor)
+	p.StartProcessing()
+	assert.True(t, p.IsProcessing())
+
+	assert.True(t, p.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}}))
+	assert.NoError(t, p.Flush(context.Background()))
+	assert.Equal(t, "metric-1", (<-mc.batches)[0].Name)
+
+	assert.True(t, p.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}}))
+	p.FinishProcessing()
+	batch := <-mc.batches
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "metric-2", batch[0].Name)
+
+	assert.False(t, p.IsProcessing())
+	assert.False(t, p.AddMetric(&Distribution{Name: "metric-3", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}}))
+	assert.NoError(t, p.Flush(context.Background()))
+	p.FinishProcessing()
+	assert.Equal(t, 2, mc.sendMetricsCalledCount)
+	// No processing goroutine, which creates the batch timer, was started
+	assert.Empty(t, mts.tickerDurations)
+	assert.Nil(t, p.exited)
+}
+
+// blockingClient holds the sends until release is closed, sending to started once each of them is in progress
+type blockingClient struct {
+	mockClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClient) SendMetrics(mts []APIMetric) error {
+	c.started <- struct{}{}
+	<-c.release
+	return c.mockClient.SendMetrics(mts)
+}
+
+func TestProcessorFlushOnlyAtEndAddsMetricsDuringTheSend(t *testing.T) {
+	client := &blockingClient{mockClient: makeMockClient(), started: make(chan struct{}, 10), release: make(chan struct{})}
+	mts := makeMockTimeService()
+	options := makeTestProcessorOptions()
+	options.FlushOnlyAtEnd = true
+	p := MakeProcessor(context.Background(), client, &mts, options)
+	p.StartProcessing()
+	p.AddMetric(&Distribution{Name: "metric-1", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+
+	flushed := make(chan error)
+	go func() { flushed <- p.Flush(context.Background()) }()
+	<-client.started
+
+	added := make(chan bool)
+	go func() {
+		added <- p.AddMetric(&Distribution{Name: "metric-2", Values: []MetricValue{{Timestamp: mts.now, Value: 1}}})
+	}()
+	select {
+	case ok := <-added:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "AddMetric waited for the send")
+	}
+
+	close(client.release)
+	assert.NoError(t, <-flushed)
+	p.FinishProcessing()
+	assert.Equal(t, "metric-1", (<-client.batches)[0].Name)
+	assert.Equal(t, "metric-2", (<-client.batches)[0].Name)
+}
+
+// makeCardinalityTestProcessor returns a processor with the tag limits of MaxTagsPerMetric and DefaultMaxTagsPerMetric
+func makeCardinalityTestProcessor(limits map[string]int, defaultLimit int) *processor {
+	options := makeTestProcessorOptions()
+	options.MaxTagsPerMetric = limits
+	options.DefaultMaxTagsPerMetric = defaultLimit
+	return MakeProcessor(context.Background(), &mockClient{}, &mockTimeService{}, options).(*processor)
+}
+
+func TestProcessorAddsMetricsUnderTagCardinalityLimit(t *testing.T) {
+	tm := time.Now()
+	p := makeCardinalityTestProcessor(map[string]int{"metric-1": 2}, 0)
+
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: tm, Value: 2}}})
+
+	assert.Len(t, p.aggregator.Flush(), 2)
+}
+
+func TestProcessorDropsMetricsOverTagCardinalityLimit(t *testing.T) {
+	tm := time.Now()
+	p := makeCardinalityTestProcessor(map[string]int{"metric-1": 1}, 0)
+
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: tm, Value: 2}}})
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 3}}})
+	// Other metrics aren't limited
+	p.addToBatch(&Distribution{Name: "metric-2", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 4}}})
+	p.addToBatch(&Distribution{Name: "metric-2", Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: tm, Value: 5}}})
+
+	series := p.aggregator.Flush()
+	assert.Len(t, series, 3)
+	for _, s := range series {
+		if s.Name == "metric-1" {
+			assert.Equal(t, []string{"user:1"}, s.Tags)
+			assert.Len(t, s.Points, 2)
+		}
+	}
+
+	// The combinations are remembered across batches
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: tm, Value: 6}}})
+	p.addToBatch(&Distribution{Name: "metric-1", Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 7}}})
+	series = p.aggregator.Flush()
+	assert.Len(t, series, 1)
+	assert.Equal(t, []string{"user:1"}, series[0].Tags)
+}
+
+func TestProcessorAddsMetricsWithDefaultTagCardinalityLimit(t *testing.T) {
+	tm := time.Now()
+	p := makeCardinalityTestProcessor(map[string]int{"metric-2": 2}, 1)
+
+	for _, name := range []string{"metric-1", "metric-2"} {
+		p.addToBatch(&Distribution{Name: name, Tags: []string{"user:1"}, Values: []MetricValue{{Timestamp: tm, Value: 1}}})
+		p.addToBatch(&Distribution{Name: name, Tags: []string{"user:2"}, Values: []MetricValue{{Timestamp: tm, Value: 2}}})
+	}
+
+	assert.Len(t, p.aggregator.Flush(), 3)
+}
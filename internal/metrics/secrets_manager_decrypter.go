@@ -0,0 +1,75 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+type (
+	secretsManagerDecrypter struct {
+		secretsManagerClient secretValueGetter
+	}
+
+	secretValueGetter interface {
+		GetSecretValue(context.Context, *secretsmanager.GetSecretValueInput, ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	}
+)
+
+// MakeSecretsManagerDecrypter creates a new decrypter which fetches the secret with the given ARN from the AWS Secrets Manager service
+func MakeSecretsManagerDecrypter(secretARN string) Decrypter {
+	var opts []func(*config.LoadOptions) error
+	// The secret can be stored in another region than the function's.
+	if region := regionFromARN(secretARN); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		logger.Error(fmt.Errorf("could not create a new aws config: %v", err))
+		panic(err)
+	}
+	return &secretsManagerDecrypter{
+		secretsManagerClient: secretsmanager.NewFromConfig(cfg),
+	}
+}
+
+func (sd *secretsManagerDecrypter) Decrypt(secretARN string) (string, error) {
+	return getSecretValue(sd.secretsManagerClient, secretARN)
+}
+
+// getSecretValue fetches the plain text value of the secret with the given ARN.
+// For this to work properly, the Lambda function must have the appropriate IAM permissions.
+func getSecretValue(client secretValueGetter, secretARN string) (string, error) {
+	response, err := client.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{
+		SecretId: &secretARN,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret value from secrets manager: %v", err)
+	}
+	if response.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", secretARN)
+	}
+	return *response.SecretString, nil
+}
+
+// regionFromARN returns the region of the resource the ARN points to, if any.
+// ex: arn:aws:secretsmanager:us-east-1:123497558138:secret:my-secret
+func regionFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
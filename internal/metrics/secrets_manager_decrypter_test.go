@@ -0,0 +1,47 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+const mockSecretARN = "arn:aws:secretsmanager:eu-west-1:123497558138:secret:my-secret"
+
+type mockSecretsManagerClient struct {
+	secrets map[string]string
+}
+
+func (m mockSecretsManagerClient) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	secret, ok := m.secrets[*params.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: &secret}, nil
+}
+
+func TestGetSecretValue(t *testing.T) {
+	client := mockSecretsManagerClient{secrets: map[string]string{mockSecretARN: expectedDecryptedAPIKey}}
+	result, err := getSecretValue(client, mockSecretARN)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDecryptedAPIKey, result)
+}
+
+func TestGetSecretValueNotFound(t *testing.T) {
+	client := mockSecretsManagerClient{}
+	_, err := getSecretValue(client, mockSecretARN)
+	assert.EqualError(t, err, "failed to get secret value from secrets manager: ResourceNotFoundException")
+}
+
+func TestRegionFromARN(t *testing.T) {
+	assert.Equal(t, "eu-west-1", regionFromARN(mockSecretARN))
+	assert.Equal(t, "", regionFromARN("my-secret"))
+}
@@ -0,0 +1,178 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// Series is a metric that was aggregated by the caller, and is submitted as is, bypassing the processor
+type Series struct {
+	Name     string
+	Type     MetricType
+	Tags     []string
+	Host     *string
+	Interval float64
+	Points   []MetricValue
+	// Resources are only sent with the v2 series intake, the resources of the listener are used when empty
+	Resources []Resource
+}
+
+// Validate returns an error describing the first problem found with the series, if any
+func (s *Series) Validate() error {
+	if s.Name == "" {
+		return errors.New("metric name is empty")
+	}
+	switch s.Type {
+	case DistributionType, GaugeType, CountType:
+	default:
+		return fmt.Errorf("metric %s has unsupported type %q", s.Name, s.Type)
+	}
+	if len(s.Points) == 0 {
+		return fmt.Errorf("metric %s has no points", s.Name)
+	}
+	for i, point := range s.Points {
+		if point.Timestamp.IsZero() {
+			return fmt.Errorf("metric %s has no timestamp for point %d", s.Name, i)
+		}
+		if math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+			return fmt.Errorf("metric %s has invalid value %v for point %d", s.Name, point.Value, i)
+		}
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("metric %s has negative interval", s.Name)
+	}
+	return nil
+}
+
+// ToAPIMetric converts a series into an API ready format.
+func (s *Series) ToAPIMetric() APIMetric {
+	points := make([]interface{}, len(s.Points))
+	for i, val := range s.Points {
+		currentTime := float64(val.Timestamp.Unix())
+		if s.Type == DistributionType {
+			points[i] = []interface{}{currentTime, []interface{}{val.Value}}
+		} else {
+			points[i] = []interface{}{currentTime, val.Value}
+		}
+	}
+
+	var interval *float64
+	if s.Interval > 0 {
+		interval = &s.Interval
+	}
+
+	return APIMetric{
+		Name:       s.Name,
+		Host:       s.Host,
+		Tags:       s.Tags,
+		MetricType: s.Type,
+		Interval:   interval,
+		Points:     points,
+		Resources:  s.Resources,
+	}
+}
+
+// SubmitSeries validates and sends series straight away, through the same transport used for other metrics.
+// Nothing is sent if any of the series is invalid.
+func (l *Listener) SubmitSeries(series []Series) error {
+	for i := range series {
+		if err := series[i].Validate(); err != nil {
+			return fmt.Errorf("invalid series at index %d: %w", i, err)
+		}
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	if l.config.DiscardMetrics {
+		logger.Debug(fmt.Sprintf("discarding %d series, metrics aren't submitted in this environment", len(series)))
+		return nil
+	}
+
+	if l.config.DualWrite {
+		// The forwarder reads every metric as a distribution, the other series are only sent to the API or the extension
+		for _, s := range series {
+			if s.Type == DistributionType {
+				l.writeSeriesToLogForwarder(s)
+			}
+		}
+	}
+	if l.isAgentRunning {
+		return l.submitSeriesToAgent(series)
+	}
+	if l.config.ShouldUseLogForwarder && !l.config.DualWrite {
+		return l.submitSeriesToLogForwarder(series)
+	}
+
+	apiMetrics := make([]APIMetric, len(series))
+	for i := range series {
+		apiMetrics[i] = series[i].ToAPIMetric()
+	}
+	if l.processor != nil {
+		return l.processor.Send(apiMetrics)
+	}
+	// Outside of an invocation there is no processor, nor its circuit breaker
+	send := func() error {
+		return l.apiClient.SendMetrics(apiMetrics)
+	}
+	if !l.config.ShouldRetryOnFailure {
+		return send()
+	}
+	bo := makeRetryBackOff(l.apiClient.context, l.timeService.Now)
+	if err := backoff.Retry(send, bo); err != nil {
+		return fmt.Errorf("after retry: %w", err)
+	}
+	return nil
+}
+
+func (l *Listener) submitSeriesToAgent(series []Series) error {
+	for _, s := range series {
+		for _, point := range s.Points {
+			var err error
+			switch s.Type {
+			case DistributionType:
+				err = l.statsdClient.Distribution(s.Name, point.Value, s.Tags, 1)
+			case GaugeType:
+				err = l.statsdClient.GaugeWithTimestamp(s.Name, point.Value, s.Tags, 1, point.Timestamp)
+			case CountType:
+				err = l.statsdClient.CountWithTimestamp(s.Name, int64(point.Value), s.Tags, 1, point.Timestamp)
+			}
+			if err != nil {
+				return fmt.Errorf("could not send metric %s: %w", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Listener) submitSeriesToLogForwarder(series []Series) error {
+	// The forwarder reads every metric as a distribution, so other types can't be sent with it.
+	for _, s := range series {
+		if s.Type != DistributionType {
+			return fmt.Errorf("metric %s has type %q, only distributions can be sent via the log forwarder", s.Name, s.Type)
+		}
+	}
+	for _, s := range series {
+		l.writeSeriesToLogForwarder(s)
+	}
+	return nil
+}
+
+// writeSeriesToLogForwarder writes the points of a distribution series for the log forwarder
+func (l *Listener) writeSeriesToLogForwarder(s Series) {
+	for _, point := range s.Points {
+		l.writeToLogForwarder(s.Name, point.Value, point.Timestamp, s.Tags)
+	}
+}
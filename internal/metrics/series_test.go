@@ -0,0 +1,178 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/extension"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesValidate(t *testing.T) {
+	now := time.Now()
+	valid := []MetricValue{{Timestamp: now, Value: 1}}
+
+	testCases := []struct {
+		name   string
+		series Series
+		err    string
+	}{
+		{"valid", Series{Name: "m", Type: GaugeType, Points: valid}, ""},
+		{"empty name", Series{Type: GaugeType, Points: valid}, "metric name is empty"},
+		{"unknown type", Series{Name: "m", Type: "rate", Points: valid}, `metric m has unsupported type "rate"`},
+		{"no points", Series{Name: "m", Type: CountType}, "metric m has no points"},
+		{"no timestamp", Series{Name: "m", Type: CountType, Points: []MetricValue{{Value: 1}}}, "metric m has no timestamp for point 0"},
+		{"nan value", Series{Name: "m", Type: DistributionType, Points: []MetricValue{{Timestamp: now, Value: math.NaN()}}}, "metric m has invalid value NaN for point 0"},
+		{"negative interval", Series{Name: "m", Type: CountType, Points: valid, Interval: -1}, "metric m has negative interval"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.series.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSeriesToAPIMetric(t *testing.T) {
+	now := time.Unix(1000, 0)
+	count := Series{Name: "my.count", Type: CountType, Tags: []string{"a:b"}, Interval: 10, Points: []MetricValue{{Timestamp: now, Value: 3}}}
+	dist := Series{Name: "my.dist", Type: DistributionType, Points: []MetricValue{{Timestamp: now, Value: 3}}}
+
+	interval := 10.0
+	assert.Equal(t, APIMetric{
+		Name:       "my.count",
+		Tags:       []string{"a:b"},
+		MetricType: CountType,
+		Interval:   &interval,
+		Points:     []interface{}{[]interface{}{float64(1000), float64(3)}},
+	}, count.ToAPIMetric())
+	assert.Equal(t, []interface{}{[]interface{}{float64(1000), []interface{}{float64(3)}}}, dist.ToAPIMetric().Points)
+}
+
+func TestSubmitSeriesWithAPI(t *testing.T) {
+	routes := []string{}
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes = append(routes, r.URL.Path)
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	err := listener.SubmitSeries([]Series{
+		{Name: "my.gauge", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+	})
+	listener.HandlerFinished(ctx, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/series"}, routes)
+	assert.Equal(t, `{"series":[{"metric":"my.gauge","type":"gauge","points":[[1000,2]]}]}`, body)
+}
+
+func TestSubmitSeriesRejectsInvalidSeries(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL}, &extension.ExtensionManager{})
+	err := listener.SubmitSeries([]Series{
+		{Name: "my.gauge", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Now(), Value: 2}}},
+		{Name: "my.gauge", Type: GaugeType},
+	})
+
+	assert.EqualError(t, err, "invalid series at index 1: metric my.gauge has no points")
+	assert.False(t, called)
+}
+
+func TestSubmitSeriesWithLogForwarder(t *testing.T) {
+	listener := MakeListener(Config{ShouldUseLogForwarder: true}, &extension.ExtensionManager{})
+
+	var err error
+	output := captureOutput(func() {
+		err = listener.SubmitSeries([]Series{
+			{Name: "my.dist", Type: DistributionType, Tags: []string{"a:b"}, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+		})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, output, `{"m":"my.dist","v":2,"e":1000,"t":["a:b"]}`)
+
+	err = listener.SubmitSeries([]Series{
+		{Name: "my.gauge", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestSubmitSeriesWithAPIUsesTheCircuitBreaker(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, CircuitBreakerTotalFailures: 1}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	series := []Series{
+		{Name: "my.gauge", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+	}
+	assert.Error(t, listener.SubmitSeries(series))
+	assert.Error(t, listener.SubmitSeries(series))
+	err := listener.SubmitSeries(series)
+	listener.HandlerFinished(ctx, nil)
+
+	assert.EqualError(t, err, "circuit breaker is open")
+	assert.Equal(t, 2, calls)
+}
+
+func TestSubmitSeriesWithDualWrite(t *testing.T) {
+	bodies := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies += string(b)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	listener := MakeListener(Config{APIKey: "12345", Site: server.URL, ShouldUseLogForwarder: true, DualWrite: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage{})
+	var err error
+	output := captureOutput(func() {
+		err = listener.SubmitSeries([]Series{
+			{Name: "my.dist", Type: DistributionType, Tags: []string{"a:b"}, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 2}}},
+			{Name: "my.gauge", Type: GaugeType, Points: []MetricValue{{Timestamp: time.Unix(1000, 0), Value: 3}}},
+		})
+	})
+	listener.HandlerFinished(ctx, nil)
+
+	assert.NoError(t, err)
+	assert.Contains(t, output, `{"m":"my.dist","v":2,"e":1000,"t":["a:b"]}`)
+	assert.NotContains(t, output, `"m":"my.gauge"`)
+	assert.Contains(t, bodies, `"metric":"my.dist"`)
+	assert.Contains(t, bodies, `"metric":"my.gauge"`)
+}
@@ -0,0 +1,196 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The sketches use the key mapping of the Datadog Agent, so the intake merges them with the ones of the agent. A value v
+// is counted in the bin of key round(log(v) / log(gamma)) + sketchBias, gamma being 1 + 2 * sketchRelativeAccuracy.
+const (
+	sketchRelativeAccuracy = 1.0 / 128.0
+	sketchMinValue         = 1e-9
+	sketchMaxKey           = math.MaxInt16
+	// sketchBucketSeconds is the width of the time buckets the points of a distribution are aggregated in
+	sketchBucketSeconds = 10
+)
+
+var (
+	sketchLogGamma = math.Log1p(2 * sketchRelativeAccuracy)
+	sketchBias     = -int(math.Floor(math.Log(sketchMinValue)/sketchLogGamma)) + 1
+)
+
+// sketch summarizes the values of a distribution, with the count of the values in logarithmic bins, whose relative
+// width bounds the error of the quantiles to sketchRelativeAccuracy
+type sketch struct {
+	timestamp int64
+	count     int64
+	min       float64
+	max       float64
+	sum       float64
+	bins      map[int32]uint32
+}
+
+func makeSketch(timestamp int64) *sketch {
+	return &sketch{
+		timestamp: timestamp,
+		min:       math.Inf(1),
+		max:       math.Inf(-1),
+		bins:      map[int32]uint32{},
+	}
+}
+
+func (s *sketch) add(value float64) {
+	s.count++
+	s.sum += value
+	s.min = math.Min(s.min, value)
+	s.max = math.Max(s.max, value)
+	s.bins[sketchKey(value)]++
+}
+
+// sketchKey returns the key of the bin of value, negative for negative values and 0 for the ones close to 0
+func sketchKey(value float64) int32 {
+	if value < 0 {
+		return -sketchKey(-value)
+	}
+	if value < sketchMinValue {
+		return 0
+	}
+	// Rounding to even keeps sketchKey(sketchValue(k)) == k
+	key := int(math.RoundToEven(math.Log(value)/sketchLogGamma)) + sketchBias
+	if key > sketchMaxKey {
+		return sketchMaxKey
+	}
+	if key < 1 {
+		return 1
+	}
+	return int32(key)
+}
+
+// sketchValue returns the value the values of the bin of key are approximated by
+func sketchValue(key int32) float64 {
+	if key < 0 {
+		return -sketchValue(-key)
+	}
+	if key == 0 {
+		return 0
+	}
+	return math.Exp(float64(int(key)-sketchBias) * sketchLogGamma)
+}
+
+// makeSketches aggregates the points of a distribution into a sketch per time bucket
+func makeSketches(metric APIMetric) ([]*sketch, error) {
+	byBucket := map[int64]*sketch{}
+	for _, point := range metric.Points {
+		pair, ok := point.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("metric %s has a malformed point %v", metric.Name, point)
+		}
+		timestamp, okTimestamp := pair[0].(float64)
+		values, okValues := pair[1].([]interface{})
+		if !okTimestamp || !okValues {
+			return nil, fmt.Errorf("metric %s has a malformed point %v", metric.Name, point)
+		}
+		bucket := int64(timestamp) - int64(timestamp)%sketchBucketSeconds
+		s, ok := byBucket[bucket]
+		if !ok {
+			s = makeSketch(bucket)
+			byBucket[bucket] = s
+		}
+		for _, v := range values {
+			value, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("metric %s has a malformed point %v", metric.Name, point)
+			}
+			s.add(value)
+		}
+	}
+
+	sketches := make([]*sketch, 0, len(byBucket))
+	for _, s := range byBucket {
+		if s.count > 0 {
+			sketches = append(sketches, s)
+		}
+	}
+	sort.Slice(sketches, func(i, j int) bool { return sketches[i].timestamp < sketches[j].timestamp })
+	return sketches, nil
+}
+
+// marshalSketchPayload encodes distributions as the SketchPayload protobuf message of the sketches intake:
+//
+//	SketchPayload { repeated Sketch sketches = 1; }
+//	Sketch { string metric = 1; string host = 2; repeated string tags = 4; repeated Dogsketch dogsketches = 7; }
+//	Dogsketch { int64 ts = 1; int64 cnt = 2; double min = 3; double max = 4; double avg = 5; double sum = 6;
+//	            repeated sint32 k = 7; repeated uint32 n = 8; }
+func marshalSketchPayload(metrics []APIMetric) ([]byte, error) {
+	var payload []byte
+	for _, metric := range metrics {
+		sketches, err := makeSketches(metric)
+		if err != nil {
+			return nil, err
+		}
+		if len(sketches) == 0 {
+			continue
+		}
+
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendString(message, metric.Name)
+		if metric.Host != nil {
+			message = protowire.AppendTag(message, 2, protowire.BytesType)
+			message = protowire.AppendString(message, *metric.Host)
+		}
+		for _, tag := range metric.Tags {
+			message = protowire.AppendTag(message, 4, protowire.BytesType)
+			message = protowire.AppendString(message, tag)
+		}
+		for _, s := range sketches {
+			message = protowire.AppendTag(message, 7, protowire.BytesType)
+			message = protowire.AppendBytes(message, marshalDogsketch(s))
+		}
+
+		payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+		payload = protowire.AppendBytes(payload, message)
+	}
+	return payload, nil
+}
+
+func marshalDogsketch(s *sketch) []byte {
+	keys := make([]int32, 0, len(s.bins))
+	for key := range s.bins {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var packedKeys, packedCounts []byte
+	for _, key := range keys {
+		packedKeys = protowire.AppendVarint(packedKeys, protowire.EncodeZigZag(int64(key)))
+		packedCounts = protowire.AppendVarint(packedCounts, uint64(s.bins[key]))
+	}
+
+	var message []byte
+	message = protowire.AppendTag(message, 1, protowire.VarintType)
+	message = protowire.AppendVarint(message, uint64(s.timestamp))
+	message = protowire.AppendTag(message, 2, protowire.VarintType)
+	message = protowire.AppendVarint(message, uint64(s.count))
+	for i, value := range []float64{s.min, s.max, s.sum / float64(s.count), s.sum} {
+		message = protowire.AppendTag(message, protowire.Number(3+i), protowire.Fixed64Type)
+		message = protowire.AppendFixed64(message, math.Float64bits(value))
+	}
+	message = protowire.AppendTag(message, 7, protowire.BytesType)
+	message = protowire.AppendBytes(message, packedKeys)
+	message = protowire.AppendTag(message, 8, protowire.BytesType)
+	message = protowire.AppendBytes(message, packedCounts)
+	return message
+}
@@ -0,0 +1,243 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package metrics
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type decodedSketch struct {
+	metric string
+	host   string
+	tags   []string
+	ts     []int64
+	count  int64
+	min    float64
+	max    float64
+	sum    float64
+	keys   []int32
+	counts []uint32
+}
+
+// decodeSketchPayload decodes the sketches of a SketchPayload, merging the dogsketches of each sketch
+func decodeSketchPayload(t *testing.T, payload []byte) []decodedSketch {
+	sketches := []decodedSketch{}
+	forEachField(t, payload, func(num protowire.Number, typ protowire.Type, value []byte) {
+		assert.Equal(t, protowire.Number(1), num)
+		s := decodedSketch{min: math.Inf(1), max: math.Inf(-1)}
+		forEachField(t, value, func(num protowire.Number, typ protowire.Type, value []byte) {
+			switch num {
+			case 1:
+				s.metric = string(value)
+			case 2:
+				s.host = string(value)
+			case 4:
+				s.tags = append(s.tags, string(value))
+			case 7:
+				decodeDogsketch(t, value, &s)
+			}
+		})
+		sketches = append(sketches, s)
+	})
+	return sketches
+}
+
+func decodeDogsketch(t *testing.T, message []byte, s *decodedSketch) {
+	forEachField(t, message, func(num protowire.Number, typ protowire.Type, value []byte) {
+		switch num {
+		case 1:
+			ts, _ := protowire.ConsumeVarint(value)
+			s.ts = append(s.ts, int64(ts))
+		case 2:
+			count, _ := protowire.ConsumeVarint(value)
+			s.count += int64(count)
+		case 3:
+			v, _ := protowire.ConsumeFixed64(value)
+			s.min = math.Min(s.min, math.Float64frombits(v))
+		case 4:
+			v, _ := protowire.ConsumeFixed64(value)
+			s.max = math.Max(s.max, math.Float64frombits(v))
+		case 6:
+			v, _ := protowire.ConsumeFixed64(value)
+			s.sum += math.Float64frombits(v)
+		case 7:
+			for len(value) > 0 {
+				v, n := protowire.ConsumeVarint(value)
+				s.keys = append(s.keys, int32(protowire.DecodeZigZag(v)))
+				value = value[n:]
+			}
+		case 8:
+			for len(value) > 0 {
+				v, n := protowire.ConsumeVarint(value)
+				s.counts = append(s.counts, uint32(v))
+				value = value[n:]
+			}
+		}
+	})
+}
+
+// forEachField calls f with each field of message, the value of varint and fixed64 fields being their raw bytes
+func forEachField(t *testing.T, message []byte, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if !assert.GreaterOrEqual(t, n, 0) {
+			return
+		}
+		message = message[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			v, m := protowire.ConsumeBytes(message)
+			value, n = v, m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, message)
+			value = message[:n]
+		}
+		if !assert.GreaterOrEqual(t, n, 0) {
+			return
+		}
+		message = message[n:]
+		f(num, typ, value)
+	}
+}
+
+// quantile returns the approximation of the q quantile of the values of the sketch, like the intake computes it
+func (s decodedSketch) quantile(q float64) float64 {
+	rank := q * float64(s.count-1)
+	cumulated := 0.0
+	for i, key := range s.keys {
+		cumulated += float64(s.counts[i])
+		if cumulated > rank {
+			return sketchValue(key)
+		}
+	}
+	return s.max
+}
+
+func TestSketchKey(t *testing.T) {
+	for _, value := range []float64{1e-6, 0.5, 1, 3, 42, 1234.5, 1e9} {
+		key := sketchKey(value)
+		assert.Equal(t, key, sketchKey(sketchValue(key)))
+		assert.InEpsilon(t, value, sketchValue(key), sketchRelativeAccuracy, value)
+		assert.Equal(t, -key, sketchKey(-value))
+	}
+	assert.Equal(t, int32(0), sketchKey(0))
+}
+
+func TestMarshalSketchPayloadQuantiles(t *testing.T) {
+	host := "my-host"
+	values := []interface{}{}
+	exact := []float64{}
+	for i := 1; i <= 10000; i++ {
+		value := float64(i) / 10
+		values = append(values, value)
+		exact = append(exact, value)
+	}
+	sort.Float64s(exact)
+	am := []APIMetric{{
+		Name:       "metric-1",
+		Host:       &host,
+		Tags:       []string{"a:b"},
+		MetricType: DistributionType,
+		Points:     []interface{}{[]interface{}{float64(1001), values}},
+	}}
+
+	payload, err := marshalSketchPayload(am)
+	assert.NoError(t, err)
+
+	sketches := decodeSketchPayload(t, payload)
+	assert.Len(t, sketches, 1)
+	s := sketches[0]
+	assert.Equal(t, "metric-1", s.metric)
+	assert.Equal(t, "my-host", s.host)
+	assert.Equal(t, []string{"a:b"}, s.tags)
+	assert.Equal(t, []int64{1000}, s.ts)
+	assert.Equal(t, int64(10000), s.count)
+	assert.Equal(t, 0.1, s.min)
+	assert.Equal(t, 1000.0, s.max)
+	assert.InDelta(t, 5000500.0, s.sum, 1e-3)
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99} {
+		expected := exact[int(q*float64(len(exact)-1))]
+		assert.InEpsilon(t, expected, s.quantile(q), 2*sketchRelativeAccuracy, q)
+	}
+	// Much smaller than the points
+	points, _ := marshalAPIMetricsModel(am)
+	assert.Less(t, len(payload)*10, len(points))
+}
+
+func TestMarshalSketchPayloadBucketsPoints(t *testing.T) {
+	am := []APIMetric{{
+		Name:       "metric-1",
+		MetricType: DistributionType,
+		Points: []interface{}{
+			[]interface{}{float64(1001), []interface{}{float64(1)}},
+			[]interface{}{float64(1009), []interface{}{float64(2)}},
+			[]interface{}{float64(1010), []interface{}{float64(3)}},
+		},
+	}}
+
+	payload, err := marshalSketchPayload(am)
+	assert.NoError(t, err)
+
+	sketches := decodeSketchPayload(t, payload)
+	assert.Len(t, sketches, 1)
+	assert.Equal(t, []int64{1000, 1010}, sketches[0].ts)
+	assert.Equal(t, int64(3), sketches[0].count)
+}
+
+func TestMarshalSketchPayloadMalformedPoint(t *testing.T) {
+	_, err := marshalSketchPayload([]APIMetric{{Name: "metric-1", MetricType: DistributionType, Points: []interface{}{"invalid"}}})
+	assert.Error(t, err)
+}
+
+func TestSendMetricsWithSketches(t *testing.T) {
+	routes := []string{}
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes = append(routes, r.URL.Path)
+		if r.URL.Path == "/api/beta/sketches" {
+			body, _ = io.ReadAll(r.Body)
+			assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+			assert.Equal(t, mockAPIKey, r.Header.Get("DD-API-KEY"))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	am := []APIMetric{
+		{
+			Name:       "metric-1",
+			MetricType: DistributionType,
+			Points:     []interface{}{[]interface{}{float64(1), []interface{}{float64(2)}}},
+		},
+		{
+			Name:       "metric-1.max",
+			MetricType: GaugeType,
+			Points:     []interface{}{[]interface{}{float64(1), float64(2)}},
+		},
+	}
+
+	cl := MakeAPIClient(context.Background(), APIClientOptions{baseAPIURL: server.URL + "/api/v1", apiKey: mockAPIKey, sketches: true})
+	err := cl.SendMetrics(am)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/api/beta/sketches", "/api/v1/series"}, routes)
+	sketches := decodeSketchPayload(t, body)
+	assert.Len(t, sketches, 1)
+	assert.Equal(t, "metric-1", sketches[0].metric)
+}
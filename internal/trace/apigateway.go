@@ -0,0 +1,74 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type apiGatewayEvent struct {
+	// REST API (v1) payload fields
+	Resource   string `json:"resource"`
+	HTTPMethod string `json:"httpMethod"`
+	// HTTP API (v2) payload fields
+	Version  string `json:"version"`
+	RouteKey string `json:"routeKey"`
+
+	RequestContext struct {
+		APIID string `json:"apiId"`
+		Stage string `json:"stage"`
+		HTTP  struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// defaultRouteKey is the route key of HTTP API requests that don't match any other route.
+const defaultRouteKey = "$default"
+
+// getAPIGatewaySpanTags returns the http.route, http.method, stage and resource span tags of an API Gateway
+// REST (v1) or HTTP (v2) API event. It returns nil when the event isn't an API Gateway request.
+// The route is the resource path template, e.g. /users/{id}, rather than the path that was requested.
+func getAPIGatewaySpanTags(ev json.RawMessage) map[string]string {
+	event := apiGatewayEvent{}
+	if err := json.Unmarshal(ev, &event); err != nil || event.RequestContext.APIID == "" {
+		return nil
+	}
+
+	var method, route, resource string
+	switch {
+	case event.Version == "2.0" && event.RouteKey != "":
+		method = event.RequestContext.HTTP.Method
+		// Route keys are "<METHOD> <path template>", or "$default"
+		resource = event.RouteKey
+		if parts := strings.SplitN(event.RouteKey, " ", 2); len(parts) == 2 {
+			route = parts[1]
+			resource = route
+		}
+	case event.Resource != "" && event.HTTPMethod != "":
+		method = event.HTTPMethod
+		resource = event.Resource
+		route = event.Resource
+	default:
+		return nil
+	}
+
+	tags := map[string]string{
+		"http.method": strings.ToUpper(method),
+		"resource":    resource,
+	}
+	if route != "" && route != defaultRouteKey {
+		tags["http.route"] = route
+	}
+	if event.RequestContext.Stage != "" {
+		tags["stage"] = event.RequestContext.Stage
+	}
+	return tags
+}
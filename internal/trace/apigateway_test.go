@@ -0,0 +1,62 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAPIGatewaySpanTagsV1(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/apig-v1-event.json")
+
+	tags := getAPIGatewaySpanTags(*ev)
+
+	assert.Equal(t, map[string]string{
+		"http.route":  "/users/{id}",
+		"http.method": "GET",
+		"stage":       "prod",
+		"resource":    "/users/{id}",
+	}, tags)
+}
+
+func TestGetAPIGatewaySpanTagsV2(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/apig-v2-event.json")
+
+	tags := getAPIGatewaySpanTags(*ev)
+
+	assert.Equal(t, map[string]string{
+		"http.route":  "/users/{id}",
+		"http.method": "POST",
+		"stage":       "prod",
+		"resource":    "/users/{id}",
+	}, tags)
+}
+
+func TestGetAPIGatewaySpanTagsV2DefaultRoute(t *testing.T) {
+	ev := json.RawMessage(`{"version":"2.0","routeKey":"$default","requestContext":{"apiId":"1234567890","stage":"$default","http":{"method":"get"}}}`)
+
+	tags := getAPIGatewaySpanTags(ev)
+
+	assert.Equal(t, map[string]string{
+		"http.method": "GET",
+		"stage":       "$default",
+		"resource":    "$default",
+	}, tags)
+}
+
+func TestGetAPIGatewaySpanTagsNotAPIGateway(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/non-proxy-no-headers.json")
+	assert.Nil(t, getAPIGatewaySpanTags(*ev))
+
+	ev = loadRawJSON(t, "../testdata/invalid.json")
+	assert.Nil(t, getAPIGatewaySpanTags(*ev))
+}
@@ -0,0 +1,104 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// baggageHeader is the W3C header used to propagate baggage
+const baggageHeader = "baggage"
+
+// baggageContextKey is the key used to store baggage items in a context object
+var baggageContextKey = new(contextKeytype)
+
+// ContextWithBaggage returns a copy of ctx carrying the baggage item key=value. The item is set as a tag on the
+// function execution span, and on any span started with StartSpanFromContext using the returned context.
+func ContextWithBaggage(ctx context.Context, key, value string) context.Context {
+	existing := BaggageFromContext(ctx)
+	items := make(map[string]string, len(existing)+1)
+	for k, v := range existing {
+		items[k] = v
+	}
+	items[key] = value
+
+	if functionExecutionSpan != nil {
+		functionExecutionSpan.SetTag(key, value)
+	}
+	return context.WithValue(ctx, baggageContextKey, items)
+}
+
+// BaggageFromContext returns the baggage items stored in ctx. The returned map must not be modified.
+func BaggageFromContext(ctx context.Context) map[string]string {
+	if items, ok := ctx.Value(baggageContextKey).(map[string]string); ok {
+		return items
+	}
+	return map[string]string{}
+}
+
+// StartSpanFromContext starts a span as a child of the span in ctx, tagged with the baggage items stored in ctx.
+// The service of the span is renamed according to the service mapping.
+func StartSpanFromContext(ctx context.Context, operationName string, opts ...tracer.StartSpanOption) (tracer.Span, context.Context) {
+	for key, value := range BaggageFromContext(ctx) {
+		opts = append(opts, tracer.Tag(key, value))
+	}
+	if len(serviceMapping) > 0 {
+		opts = append(opts, mapService(serviceMapping))
+	}
+	if onSpanFinish == nil {
+		return tracer.StartSpanFromContext(ctx, operationName, opts...)
+	}
+	start := time.Now()
+	parent, _ := tracer.SpanFromContext(ctx)
+	span, ctx := tracer.StartSpanFromContext(ctx, operationName, opts...)
+	span = recordSpan(span, parent, operationName, start, opts)
+	return span, tracer.ContextWithSpan(ctx, span)
+}
+
+// mapService returns a span option renaming the service set by the previous options, if it is in mapping
+func mapService(mapping map[string]string) tracer.StartSpanOption {
+	return func(cfg *ddtrace.StartSpanConfig) {
+		service, ok := cfg.Tags[ext.ServiceName].(string)
+		if !ok {
+			return
+		}
+		if mapped, ok := mapping[service]; ok {
+			cfg.Tags[ext.ServiceName] = mapped
+		}
+	}
+}
+
+// AddBaggageHeader adds the W3C baggage header for the baggage items stored in ctx to headers, if there are any.
+func AddBaggageHeader(ctx context.Context, headers map[string]string) {
+	items := BaggageFromContext(ctx)
+	if len(items) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	members := make([]string, len(keys))
+	for i, key := range keys {
+		members[i] = fmt.Sprintf("%s=%s", url.QueryEscape(key), url.PathEscape(items[key]))
+	}
+	headers[baggageHeader] = strings.Join(members, ",")
+}
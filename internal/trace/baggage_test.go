@@ -0,0 +1,78 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+func TestContextWithBaggageIsInherited(t *testing.T) {
+	ctx := ContextWithBaggage(context.Background(), "tenant", "acme")
+	child := ContextWithBaggage(ctx, "region", "eu")
+
+	assert.Equal(t, map[string]string{"tenant": "acme"}, BaggageFromContext(ctx))
+	assert.Equal(t, map[string]string{"tenant": "acme", "region": "eu"}, BaggageFromContext(child))
+	assert.Empty(t, BaggageFromContext(context.Background()))
+}
+
+func TestContextWithBaggageTagsSpans(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	functionExecutionSpan = tracer.StartSpan("aws.lambda")
+	defer func() { functionExecutionSpan = nil }()
+
+	ctx := ContextWithBaggage(context.Background(), "tenant", "acme")
+	span, ctx := StartSpanFromContext(ctx, "child")
+	grandchild, _ := StartSpanFromContext(ctx, "grandchild")
+	grandchild.Finish()
+	span.Finish()
+	functionExecutionSpan.Finish()
+
+	finishedSpans := mt.FinishedSpans()
+	assert.Len(t, finishedSpans, 3)
+	for _, finishedSpan := range finishedSpans {
+		assert.Equal(t, "acme", finishedSpan.Tag("tenant"))
+	}
+}
+
+func TestAddBaggageHeader(t *testing.T) {
+	headers := map[string]string{}
+	AddBaggageHeader(context.Background(), headers)
+	assert.Empty(t, headers)
+
+	ctx := ContextWithBaggage(context.Background(), "tenant", "acme corp")
+	ctx = ContextWithBaggage(ctx, "env", "prod")
+	AddBaggageHeader(ctx, headers)
+	assert.Equal(t, map[string]string{baggageHeader: "env=prod,tenant=acme%20corp"}, headers)
+}
+
+func TestStartSpanFromContextAppliesServiceMapping(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	serviceMapping = map[string]string{"arn:aws:sqs:us-east-1:123456789012:orders": "orders-queue"}
+	defer func() { serviceMapping = nil }()
+
+	mapped, _ := StartSpanFromContext(context.Background(), "mapped", tracer.ServiceName("arn:aws:sqs:us-east-1:123456789012:orders"))
+	mapped.Finish()
+	unmapped, _ := StartSpanFromContext(context.Background(), "unmapped", tracer.ServiceName("payments"))
+	unmapped.Finish()
+
+	finishedSpans := mt.FinishedSpans()
+	assert.Len(t, finishedSpans, 2)
+	assert.Equal(t, "orders-queue", finishedSpans[0].Tag(ext.ServiceName))
+	assert.Equal(t, "payments", finishedSpans[1].Tag(ext.ServiceName))
+}
@@ -0,0 +1,48 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// getHeadersFromClientContext extracts the Datadog trace headers from the client context of a direct invocation. The
+// custom fields of the client context are strings, so the headers are read from a JSON encoded `_datadog` field if
+// present, otherwise from the `x-datadog-*` custom fields.
+func getHeadersFromClientContext(ctx context.Context) map[string]string {
+	headers := map[string]string{}
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok || len(lc.ClientContext.Custom) == 0 {
+		return headers
+	}
+
+	source := lc.ClientContext.Custom
+	if datadog := source[datadogEventKey]; datadog != "" {
+		decoded := map[string]string{}
+		if err := json.Unmarshal([]byte(datadog), &decoded); err != nil {
+			logger.Debug(fmt.Sprintf("Couldn't decode the trace headers of the client context: %v", err))
+			return headers
+		}
+		source = decoded
+	}
+
+	for k, v := range source {
+		key := strings.ToLower(k)
+		if strings.HasPrefix(key, datadogHeaderPrefix) {
+			headers[key] = v
+		}
+	}
+	return headers
+}
@@ -0,0 +1,64 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func contextWithClientContextCustom(custom map[string]string) context.Context {
+	return lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		ClientContext: lambdacontext.ClientContext{Custom: custom},
+	})
+}
+
+func TestGetHeadersFromClientContext(t *testing.T) {
+	expected := map[string]string{
+		"x-datadog-trace-id":          "1231452342",
+		"x-datadog-parent-id":         "45678910",
+		"x-datadog-sampling-priority": "2",
+	}
+
+	ctx := contextWithClientContextCustom(map[string]string{
+		"_datadog": `{"x-datadog-trace-id":"1231452342","x-datadog-parent-id":"45678910","x-datadog-sampling-priority":"2"}`,
+		"tenant":   "acme",
+	})
+	assert.Equal(t, expected, getHeadersFromClientContext(ctx))
+
+	ctx = contextWithClientContextCustom(map[string]string{
+		"X-Datadog-Trace-Id":          "1231452342",
+		"x-datadog-parent-id":         "45678910",
+		"x-datadog-sampling-priority": "2",
+		"tenant":                      "acme",
+	})
+	assert.Equal(t, expected, getHeadersFromClientContext(ctx))
+}
+
+func TestGetHeadersFromClientContextWithoutHeaders(t *testing.T) {
+	assert.Empty(t, getHeadersFromClientContext(context.Background()))
+	assert.Empty(t, getHeadersFromClientContext(contextWithClientContextCustom(nil)))
+	assert.Empty(t, getHeadersFromClientContext(contextWithClientContextCustom(map[string]string{"_datadog": "not json"})))
+}
+
+func TestDefaultTraceExtractorPrefersEventHeadersOverClientContext(t *testing.T) {
+	ctx := contextWithClientContextCustom(map[string]string{
+		"_datadog": `{"x-datadog-trace-id":"1","x-datadog-parent-id":"2"}`,
+	})
+
+	headers := DefaultTraceExtractor(ctx, json.RawMessage(`{"headers":{"x-datadog-trace-id":"3","x-datadog-parent-id":"4"}}`))
+	assert.Equal(t, "3", headers[traceIDHeader])
+
+	headers = DefaultTraceExtractor(ctx, json.RawMessage(`{"x-datadog-trace-id":"5","x-datadog-parent-id":"6"}`))
+	assert.Equal(t, "1", headers[traceIDHeader])
+}
@@ -0,0 +1,65 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// parseCloudwatchLogsEvent decodes the base64 gzipped payload of a CloudWatch Logs subscription event.
+// It returns false when the event isn't a CloudWatch Logs event or its payload can't be decoded.
+func parseCloudwatchLogsEvent(ev json.RawMessage) (events.CloudwatchLogsData, bool) {
+	event := events.CloudwatchLogsEvent{}
+	if err := json.Unmarshal(ev, &event); err != nil || event.AWSLogs.Data == "" {
+		return events.CloudwatchLogsData{}, false
+	}
+	data, err := event.AWSLogs.Parse()
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Couldn't decode the CloudWatch Logs event: %v", err))
+		return events.CloudwatchLogsData{}, false
+	}
+	return data, true
+}
+
+// getCloudwatchLogsSpanTags returns the log_group and log_stream span tags of a CloudWatch Logs event.
+// It returns nil when the event isn't a CloudWatch Logs event.
+func getCloudwatchLogsSpanTags(ev json.RawMessage) map[string]string {
+	data, ok := parseCloudwatchLogsEvent(ev)
+	if !ok {
+		return nil
+	}
+	return map[string]string{
+		"log_group":  data.LogGroup,
+		"log_stream": data.LogStream,
+	}
+}
+
+// getHeadersFromCloudwatchLogsEvent extracts the Datadog trace headers from the first JSON log message
+// of a CloudWatch Logs event that carries them, in the same format as a generic event.
+func getHeadersFromCloudwatchLogsEvent(ev json.RawMessage) map[string]string {
+	data, ok := parseCloudwatchLogsEvent(ev)
+	if !ok {
+		return nil
+	}
+	for _, logEvent := range data.LogEvents {
+		message := strings.TrimSpace(logEvent.Message)
+		if !strings.HasPrefix(message, "{") {
+			continue
+		}
+		if headers := getHeadersFromGenericEvent(json.RawMessage(message)); headers[traceIDHeader] != "" {
+			return headers
+		}
+	}
+	return nil
+}
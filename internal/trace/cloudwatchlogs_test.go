@@ -0,0 +1,41 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCloudwatchLogsSpanTags(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/cloudwatch-logs-event.json")
+
+	tags := getCloudwatchLogsSpanTags(*ev)
+
+	assert.Equal(t, map[string]string{
+		"log_group":  "/aws/lambda/producer",
+		"log_stream": "2026/10/14/[$LATEST]4b1f8ad7c0e34e0b9b2f6e1c7a4fd3a1",
+	}, tags)
+}
+
+func TestGetCloudwatchLogsSpanTagsNotCloudwatchLogsEvent(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/apig-v1-event.json")
+	assert.Nil(t, getCloudwatchLogsSpanTags(*ev))
+
+	ev = loadRawJSON(t, "../testdata/invalid.json")
+	assert.Nil(t, getCloudwatchLogsSpanTags(*ev))
+}
+
+func TestCloudwatchLogsEventWithInvalidPayload(t *testing.T) {
+	ev := loadRawJSON(t, "../testdata/cloudwatch-logs-invalid-event.json")
+
+	assert.Nil(t, getCloudwatchLogsSpanTags(*ev))
+	assert.Nil(t, getHeadersFromCloudwatchLogsEvent(*ev))
+}
@@ -12,13 +12,24 @@ const (
 	traceIDHeader          = "x-datadog-trace-id"
 	parentIDHeader         = "x-datadog-parent-id"
 	samplingPriorityHeader = "x-datadog-sampling-priority"
+
+	datadogHeaderPrefix = "x-datadog-"
+	datadogEventKey     = "_datadog"
+
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+	b3Header          = "b3"
+	b3TraceIDHeader   = "x-b3-traceid"
+	b3SpanIDHeader    = "x-b3-spanid"
+	b3SampledHeader   = "x-b3-sampled"
+	b3FlagsHeader     = "x-b3-flags"
 )
 
 const (
 	userReject = "-1"
-	// autoReject = "0"
-	// autoKeep = "1"
-	userKeep = "2"
+	autoReject = "0"
+	autoKeep   = "1"
+	userKeep   = "2"
 )
 
 const (
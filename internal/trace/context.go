@@ -9,6 +9,7 @@
 package trace
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
@@ -28,6 +29,8 @@ import (
 type (
 	eventWithHeaders struct {
 		Headers map[string]string `json:"headers"`
+		// MultiValueHeaders are sent by API Gateway REST APIs and by ALBs with multi value headers enabled
+		MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
 	}
 
 	// TraceContext is map of headers containing a Datadog trace context.
@@ -47,8 +50,8 @@ var DefaultTraceExtractor = getHeadersFromEventHeaders
 
 // contextWithRootTraceContext uses the incoming event and context object payloads to determine
 // the root TraceContext and then adds that TraceContext to the context object.
-func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeXrayTraces bool, extractor ContextExtractor) (context.Context, error) {
-	datadogTraceContext, gotDatadogTraceContext := getTraceContext(ctx, extractor(ctx, ev))
+func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeXrayTraces bool, extractor ContextExtractor, propagationStyles []string) (context.Context, error) {
+	datadogTraceContext, gotDatadogTraceContext := extractTraceContext(ctx, extractor(ctx, ev), propagationStyles)
 
 	xrayTraceContext, errGettingXrayContext := convertXrayTraceContextFromLambdaContext(ctx)
 	if errGettingXrayContext != nil {
@@ -80,6 +83,15 @@ func contextWithRootTraceContext(ctx context.Context, ev json.RawMessage, mergeX
 	return context.WithValue(ctx, traceContextKey, mergedTraceContext), nil
 }
 
+// RootTraceContext returns the root TraceContext the Listener added to ctx, if any.
+func RootTraceContext(ctx context.Context) (TraceContext, bool) {
+	traceCtx, ok := ctx.Value(traceContextKey).(TraceContext)
+	if !ok || traceCtx[traceIDHeader] == "" {
+		return nil, false
+	}
+	return traceCtx, true
+}
+
 // ConvertCurrentXrayTraceContext returns the current X-Ray trace context converted to Datadog headers, taking into account
 // the current subsegment. It is designed for sending Datadog trace headers from functions instrumented with the X-Ray SDK.
 func ConvertCurrentXrayTraceContext(ctx context.Context) TraceContext {
@@ -129,6 +141,8 @@ func createDummySubsegmentForXrayConverter(ctx context.Context, traceCtx TraceCo
 
 func getTraceContext(ctx context.Context, headers map[string]string) (TraceContext, bool) {
 	tc := TraceContext{}
+	// Custom extractors may return the headers as they were received
+	headers = lowercaseKeys(headers)
 
 	traceID := headers[traceIDHeader]
 	if traceID == "" {
@@ -171,21 +185,85 @@ func getTraceContext(ctx context.Context, headers map[string]string) (TraceConte
 // and creates a dummy X-Ray subsegment containing this information.
 // This is used as the DefaultTraceExtractor.
 func getHeadersFromEventHeaders(ctx context.Context, ev json.RawMessage) map[string]string {
+	lowercaseHeaders := getEventHeaders(ev)
+
+	if lowercaseHeaders[traceIDHeader] == "" {
+		// Direct invocations can carry the trace headers in their client context
+		if clientContextHeaders := getHeadersFromClientContext(ctx); clientContextHeaders[traceIDHeader] != "" {
+			return clientContextHeaders
+		}
+		// CloudWatch Logs events are gzipped, the trace headers can only be in the JSON log messages
+		if logsHeaders := getHeadersFromCloudwatchLogsEvent(ev); logsHeaders[traceIDHeader] != "" {
+			return logsHeaders
+		}
+		// As a last resort, look for trace headers in a generic map event,
+		// as sent by custom or direct invocations.
+		if genericHeaders := getHeadersFromGenericEvent(ev); genericHeaders[traceIDHeader] != "" {
+			return genericHeaders
+		}
+	}
+
+	return lowercaseHeaders
+}
+
+// getEventHeaders returns the headers of an event with headers, like API Gateway and ALB requests, with lowercase keys.
+// The first value of a multi value header wins over the single value one.
+func getEventHeaders(ev json.RawMessage) map[string]string {
 	eh := eventWithHeaders{}
+	if err := json.Unmarshal(ev, &eh); err != nil {
+		return map[string]string{}
+	}
 
+	headers := lowercaseKeys(eh.Headers)
+	for k, values := range eh.MultiValueHeaders {
+		if len(values) > 0 && values[0] != "" {
+			headers[strings.ToLower(k)] = values[0]
+		}
+	}
+	return headers
+}
+
+// lowercaseKeys returns a copy of headers with lowercase keys, header names being case-insensitive
+func lowercaseKeys(headers map[string]string) map[string]string {
+	lowercaseHeaders := make(map[string]string, len(headers))
+	for k, v := range headers {
+		lowercaseHeaders[strings.ToLower(k)] = v
+	}
+	return lowercaseHeaders
+}
+
+// getHeadersFromGenericEvent extracts the Datadog trace headers from an event that doesn't match any
+// known AWS event type. The headers are read from a `_datadog` object if present, otherwise from the
+// top-level `x-datadog-*` keys of the event.
+func getHeadersFromGenericEvent(ev json.RawMessage) map[string]string {
 	headers := map[string]string{}
 
-	err := json.Unmarshal(ev, &eh)
-	if err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(ev))
+	decoder.UseNumber()
+	event := map[string]interface{}{}
+	if err := decoder.Decode(&event); err != nil {
 		return headers
 	}
 
-	lowercaseHeaders := map[string]string{}
-	for k, v := range eh.Headers {
-		lowercaseHeaders[strings.ToLower(k)] = v
+	source := event
+	if datadog, ok := event[datadogEventKey].(map[string]interface{}); ok {
+		source = datadog
 	}
 
-	return lowercaseHeaders
+	for k, v := range source {
+		key := strings.ToLower(k)
+		if !strings.HasPrefix(key, datadogHeaderPrefix) {
+			continue
+		}
+		switch value := v.(type) {
+		case string:
+			headers[key] = value
+		case json.Number:
+			headers[key] = value.String()
+		}
+	}
+
+	return headers
 }
 
 func convertXrayTraceContextFromLambdaContext(ctx context.Context) (TraceContext, error) {
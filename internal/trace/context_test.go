@@ -99,6 +99,42 @@ func TestGetDatadogTraceContextForTraceMetadataWithMixedCaseHeaders(t *testing.T
 	assert.Equal(t, expected, headers)
 }
 
+func TestGetDatadogTraceContextWithMixedCaseHeadersPerEventType(t *testing.T) {
+	testcases := []struct {
+		name  string
+		event string
+	}{
+		{"api gateway v1", `{"resource":"/","httpMethod":"GET","headers":{"x-DATADOG-trace-ID":"9","X-Datadog-Parent-Id":"9"},"multiValueHeaders":{"X-Datadog-Trace-Id":["1231452342"],"x-datadog-PARENT-id":["45678910"],"X-DATADOG-SAMPLING-PRIORITY":["2"]}}`},
+		{"api gateway v2", `{"version":"2.0","routeKey":"GET /","headers":{"X-Datadog-Trace-Id":"1231452342","x-datadog-parent-ID":"45678910","X-Datadog-Sampling-Priority":"2"}}`},
+		{"alb with multi value headers", `{"requestContext":{"elb":{}},"multiValueHeaders":{"X-Datadog-Trace-Id":["1231452342","9"],"X-DataDog-Parent-Id":["45678910"],"x-datadog-sampling-priority":["2"]}}`},
+		{"generic", `{"X-Datadog-Trace-ID":"1231452342","X-DATADOG-PARENT-ID":"45678910","x-Datadog-Sampling-Priority":2}`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			headers, ok := getTraceContext(ctx, getHeadersFromEventHeaders(ctx, json.RawMessage(tc.event)))
+			assert.True(t, ok)
+
+			expected := TraceContext{
+				traceIDHeader:          "1231452342",
+				parentIDHeader:         "45678910",
+				samplingPriorityHeader: "2",
+			}
+			assert.Equal(t, expected, headers)
+		})
+	}
+}
+
+func TestGetTraceContextWithMixedCaseHeadersFromCustomExtractor(t *testing.T) {
+	headers, ok := getTraceContext(context.Background(), map[string]string{"X-Datadog-Trace-Id": "1", "X-Datadog-Parent-Id": "2"})
+
+	assert.True(t, ok)
+	assert.Equal(t, "1", headers[traceIDHeader])
+	assert.Equal(t, "2", headers[parentIDHeader])
+}
+
 func TestGetDatadogTraceContextForTraceMetadataWithMissingSamplingPriority(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/non-proxy-with-missing-sampling-priority.json")
@@ -114,6 +150,44 @@ func TestGetDatadogTraceContextForTraceMetadataWithMissingSamplingPriority(t *te
 	assert.Equal(t, expected, headers)
 }
 
+func TestGetDatadogTraceContextForGenericMapEvent(t *testing.T) {
+	testcases := []struct {
+		name     string
+		filename string
+	}{
+		{"datadog object", "../testdata/generic-map-with-datadog-headers.json"},
+		{"top-level keys", "../testdata/generic-map-with-top-level-headers.json"},
+		{"cloudwatch logs message", "../testdata/cloudwatch-logs-event.json"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+			ev := loadRawJSON(t, tc.filename)
+
+			headers, ok := getTraceContext(ctx, getHeadersFromEventHeaders(ctx, *ev))
+			assert.True(t, ok)
+
+			expected := TraceContext{
+				traceIDHeader:          "1231452342",
+				parentIDHeader:         "45678910",
+				samplingPriorityHeader: "2",
+			}
+			assert.Equal(t, expected, headers)
+		})
+	}
+}
+
+func TestGetDatadogTraceContextPrefersEventHeadersOverGenericMap(t *testing.T) {
+	ctx := context.Background()
+	ev := json.RawMessage(`{"headers":{"x-datadog-trace-id":"1","x-datadog-parent-id":"2"},"_datadog":{"x-datadog-trace-id":"3","x-datadog-parent-id":"4"}}`)
+
+	headers, ok := getTraceContext(ctx, getHeadersFromEventHeaders(ctx, ev))
+	assert.True(t, ok)
+	assert.Equal(t, "1", headers[traceIDHeader])
+	assert.Equal(t, "2", headers[parentIDHeader])
+}
+
 func TestGetDatadogTraceContextForInvalidData(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/invalid.json")
@@ -249,7 +323,7 @@ func TestContextWithRootTraceContextNoDatadogContext(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-no-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, DefaultTraceExtractor)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, DefaultTraceExtractor, nil)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{}
@@ -260,7 +334,7 @@ func TestContextWithRootTraceContextWithDatadogContext(t *testing.T) {
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, DefaultTraceExtractor)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, false, DefaultTraceExtractor, nil)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
@@ -275,7 +349,7 @@ func TestContextWithRootTraceContextMergeXrayTracesNoDatadogContext(t *testing.T
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-no-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, DefaultTraceExtractor)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, DefaultTraceExtractor, nil)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
@@ -290,7 +364,7 @@ func TestContextWithRootTraceContextMergeXrayTracesWithDatadogContext(t *testing
 	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
 	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
 
-	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, DefaultTraceExtractor)
+	newCTX, _ := contextWithRootTraceContext(ctx, *ev, true, DefaultTraceExtractor, nil)
 	traceContext, _ := newCTX.Value(traceContextKey).(TraceContext)
 
 	expected := TraceContext{
@@ -300,3 +374,20 @@ func TestContextWithRootTraceContextMergeXrayTracesWithDatadogContext(t *testing
 	}
 	assert.Equal(t, expected, traceContext)
 }
+
+func TestRootTraceContext(t *testing.T) {
+	_, ok := RootTraceContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := mockLambdaXRayTraceContext(context.Background(), mockXRayTraceID, mockXRayEntityID, true)
+	ev := loadRawJSON(t, "../testdata/apig-event-with-headers.json")
+	ctx, _ = contextWithRootTraceContext(ctx, *ev, false, DefaultTraceExtractor, nil)
+
+	traceCtx, ok := RootTraceContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{
+		traceIDHeader:          "1231452342",
+		parentIDHeader:         "45678910",
+		samplingPriorityHeader: "2",
+	}, traceCtx)
+}
@@ -0,0 +1,125 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+)
+
+type (
+	// InvocationFilter returns true for the invocations that are ignored, they get no function execution span
+	InvocationFilter func(ctx context.Context, ev json.RawMessage) bool
+
+	// requestPathEvent holds the path of API Gateway REST (v1) and ALB requests, and of API Gateway HTTP (v2) requests
+	requestPathEvent struct {
+		Path    string `json:"path"`
+		RawPath string `json:"rawPath"`
+	}
+
+	// invocation holds the span resource of an invocation and whether it's ignored, each computed once on first use
+	invocation struct {
+		spanResource func() string
+		ignored      func() bool
+	}
+)
+
+// invocationContextKey is the key of the invocation in the context passed on by the trace listener
+var invocationContextKey = new(contextKeytype)
+
+// contextWithInvocation returns a copy of ctx with the invocation of msg, so the listeners share its span resource and
+// whether it's ignored, instead of computing them again
+func contextWithInvocation(ctx context.Context, msg json.RawMessage, spanResourceFunc SpanResourceFunc, ignoreInvocation InvocationFilter) context.Context {
+	inv := &invocation{}
+	invocationCtx := context.WithValue(ctx, invocationContextKey, inv)
+	inv.spanResource = sync.OnceValue(func() string {
+		if spanResourceFunc == nil {
+			return ""
+		}
+		return spanResourceFunc(ctx, msg)
+	})
+	inv.ignored = sync.OnceValue(func() bool {
+		return ignoreInvocation != nil && ignoreInvocation(invocationCtx, msg)
+	})
+	return invocationCtx
+}
+
+// IsIgnoredInvocation returns true when the invocation of ctx matches the Config.IgnoreInvocation of the trace listener,
+// which must have been started before with ctx. The decision is only made once per invocation.
+func IsIgnoredInvocation(ctx context.Context, msg json.RawMessage) bool {
+	inv, ok := ctx.Value(invocationContextKey).(*invocation)
+	return ok && inv.ignored()
+}
+
+// getSpanResource returns the span resource of the invocation of ctx, computing it with spanResourceFunc when ctx
+// doesn't carry it
+func getSpanResource(ctx context.Context, ev json.RawMessage, spanResourceFunc SpanResourceFunc) string {
+	if inv, ok := ctx.Value(invocationContextKey).(*invocation); ok {
+		return inv.spanResource()
+	}
+	if spanResourceFunc == nil {
+		return ""
+	}
+	return spanResourceFunc(ctx, ev)
+}
+
+// MakeInvocationFilter returns a filter ignoring the invocations whose span resource, as computed by spanResourceFunc,
+// or whose request route or path matches one of patterns. It returns nil when there is no pattern.
+// A pattern is a glob, like /health/*, and one ending with "*" also matches any resource it prefixes, like /health/a/b.
+func MakeInvocationFilter(patterns []string, spanResourceFunc SpanResourceFunc) InvocationFilter {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, ev json.RawMessage) bool {
+		for _, resource := range getInvocationResources(ctx, ev, spanResourceFunc) {
+			if matchesResource(patterns, resource) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// getInvocationResources returns the resources an invocation can be recognized by
+func getInvocationResources(ctx context.Context, ev json.RawMessage, spanResourceFunc SpanResourceFunc) []string {
+	resources := []string{}
+	if resource := getSpanResource(ctx, ev, spanResourceFunc); resource != "" {
+		resources = append(resources, resource)
+	}
+	tags := getAPIGatewaySpanTags(ev)
+	for _, key := range []string{"http.route", "resource"} {
+		if tags[key] != "" {
+			resources = append(resources, tags[key])
+		}
+	}
+	event := requestPathEvent{}
+	if err := json.Unmarshal(ev, &event); err == nil {
+		for _, p := range []string{event.Path, event.RawPath} {
+			if p != "" {
+				resources = append(resources, p)
+			}
+		}
+	}
+	return resources
+}
+
+func matchesResource(patterns []string, resource string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, resource); err == nil && matched {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(resource, prefix) {
+			return true
+		}
+	}
+	return false
+}
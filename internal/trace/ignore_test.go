@@ -0,0 +1,51 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeInvocationFilter(t *testing.T) {
+	apiGatewayEvent := loadRawJSON(t, "../testdata/apig-v1-event.json")
+	constantResource := func(ctx context.Context, event interface{}) string { return "GET /ping" }
+
+	testCases := []struct {
+		name             string
+		patterns         []string
+		spanResourceFunc SpanResourceFunc
+		event            json.RawMessage
+		expected         bool
+	}{
+		{"alb path", []string{"/health"}, nil, json.RawMessage(`{"requestContext":{"elb":{}},"path":"/health"}`), true},
+		{"http api raw path", []string{"/health"}, nil, json.RawMessage(`{"version":"2.0","rawPath":"/health"}`), true},
+		{"api gateway route", []string{"/users/{id}"}, nil, *apiGatewayEvent, true},
+		{"glob", []string{"/health/*"}, nil, json.RawMessage(`{"path":"/health/live"}`), true},
+		{"glob doesn't cross slashes", []string{"/health/?"}, nil, json.RawMessage(`{"path":"/health/live"}`), false},
+		{"prefix", []string{"/health*"}, nil, json.RawMessage(`{"path":"/health/live/db"}`), true},
+		{"span resource", []string{"GET /ping"}, constantResource, json.RawMessage(`{}`), true},
+		{"other path", []string{"/health*"}, nil, json.RawMessage(`{"path":"/orders"}`), false},
+		{"not a request", []string{"/health"}, nil, json.RawMessage(`{"Records":[]}`), false},
+		{"invalid event", []string{"/health"}, nil, json.RawMessage(`invalid`), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := MakeInvocationFilter(tc.patterns, tc.spanResourceFunc)
+			assert.Equal(t, tc.expected, filter(context.Background(), tc.event))
+		})
+	}
+}
+
+func TestMakeInvocationFilterWithoutPatterns(t *testing.T) {
+	assert.Nil(t, MakeInvocationFilter(nil, nil))
+}
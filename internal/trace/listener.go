@@ -12,7 +12,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"math/rand"
 	"strings"
 
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
@@ -32,9 +32,28 @@ type (
 		mergeXrayTraces          bool
 		universalInstrumentation bool
 		otelTracerEnabled        bool
-		extensionManager         *extension.ExtensionManager
+		extensionManager         extensionClient
 		traceContextExtractor    ContextExtractor
 		tracerOptions            []tracer.StartOption
+		captureHandlerErrors     bool
+		serviceMapping           map[string]string
+		apiGatewaySpanTags       bool
+		idGenerator              IDGenerator
+		spanResourceFunc         SpanResourceFunc
+		outsideLambda            bool
+		propagateHeaders         []string
+		ignoreInvocation         InvocationFilter
+		tagFunctionVersion       bool
+		onSpanFinish             SpanFinishFunc
+		propagationStyleExtract  []string
+		service                  string
+	}
+
+	// extensionClient is the part of the extension.ExtensionManager used by the Listener
+	extensionClient interface {
+		IsExtensionRunning() bool
+		SendStartInvocationRequest(ctx context.Context, eventPayload json.RawMessage) context.Context
+		SendEndInvocationRequest(ctx context.Context, functionExecutionSpan ddtrace.Span, cfg ddtrace.FinishConfig)
 	}
 
 	// Config gives options for how the Listener should work
@@ -45,7 +64,40 @@ type (
 		OtelTracerEnabled        bool
 		TraceContextExtractor    ContextExtractor
 		TracerOptions            []tracer.StartOption
+		CaptureHandlerErrors     bool
+		// ServiceMapping renames services on spans, from the key to the value
+		ServiceMapping map[string]string
+		// APIGatewaySpanTags tags the function execution span with the route, method, stage and resource of API Gateway events
+		APIGatewaySpanTags bool
+		// IDGenerator generates the ID of the function execution span, it defaults to a random generator
+		IDGenerator IDGenerator
+		// SpanResourceFunc computes the resource name of the function execution span, it defaults to the function name
+		SpanResourceFunc SpanResourceFunc
+		// OutsideLambda skips reading the X-Ray trace context of the invocation, which only exists in AWS Lambda
+		OutsideLambda bool
+		// PropagateHeaders are the headers of the event captured into the context, see ContextWithPropagatedHeaders
+		PropagateHeaders []string
+		// IgnoreInvocation returns true for the invocations that get no function execution span, like health checks
+		IgnoreInvocation InvocationFilter
+		// TagFunctionVersion tags the function execution span with the executed version and the invoked alias
+		TagFunctionVersion bool
+		// OnSpanFinish is called with the function execution span and the spans started with StartSpanFromContext
+		// once they're finished
+		OnSpanFinish SpanFinishFunc
+		// PropagationStyleExtract are the propagation styles the trace context of the invocation is extracted from, in
+		// order, like PropagationStyleDatadog. It defaults to DefaultPropagationStyleExtract.
+		PropagationStyleExtract []string
+		// Service is the service of the spans, it defaults to "aws.lambda"
+		Service string
 	}
+
+	// IDGenerator returns a non-zero 64-bit span ID. When the function execution span starts a new trace,
+	// its span ID is also used as the trace ID.
+	IDGenerator func() uint64
+
+	// SpanResourceFunc returns the resource name of the function execution span of an invocation. The event is the
+	// json.RawMessage payload of the invocation. An empty name falls back to the function name.
+	SpanResourceFunc func(ctx context.Context, event interface{}) string
 )
 
 // The function execution span is the top-level span representing the current Lambda function execution
@@ -53,8 +105,21 @@ var functionExecutionSpan ddtrace.Span
 
 var tracerInitialized = false
 
+// serviceMapping is the service mapping the tracer was started with, it is also applied to spans started with StartSpanFromContext
+var serviceMapping map[string]string
+
 // MakeListener initializes a new trace lambda Listener
 func MakeListener(config Config, extensionManager *extension.ExtensionManager) Listener {
+	idGenerator := config.IDGenerator
+	if idGenerator == nil {
+		idGenerator = randomID
+	}
+
+	for _, style := range config.PropagationStyleExtract {
+		if !isPropagationStyle(style) {
+			logger.Warn(fmt.Sprintf("ignoring the unknown propagation style %q", style))
+		}
+	}
 
 	return Listener{
 		ddTraceEnabled:           config.DDTraceEnabled,
@@ -64,23 +129,54 @@ func MakeListener(config Config, extensionManager *extension.ExtensionManager) L
 		extensionManager:         extensionManager,
 		traceContextExtractor:    config.TraceContextExtractor,
 		tracerOptions:            config.TracerOptions,
+		captureHandlerErrors:     config.CaptureHandlerErrors,
+		serviceMapping:           config.ServiceMapping,
+		apiGatewaySpanTags:       config.APIGatewaySpanTags,
+		idGenerator:              idGenerator,
+		spanResourceFunc:         config.SpanResourceFunc,
+		outsideLambda:            config.OutsideLambda,
+		propagateHeaders:         config.PropagateHeaders,
+		ignoreInvocation:         config.IgnoreInvocation,
+		tagFunctionVersion:       config.TagFunctionVersion,
+		onSpanFinish:             config.OnSpanFinish,
+		propagationStyleExtract:  config.PropagationStyleExtract,
+		service:                  config.Service,
 	}
 }
 
 // HandlerStarted sets up tracing and starts the function execution span if Datadog tracing is enabled
 func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	// The headers are propagated even when tracing is disabled
+	ctx = ContextWithPropagatedHeaders(ctx, msg, l.propagateHeaders)
+	ctx = ContextWithSamplingDecision(ctx)
+	// The metrics listener, started after this one, shares the span resource and whether the invocation is ignored
+	ctx = contextWithInvocation(ctx, msg, l.spanResourceFunc, l.ignoreInvocation)
+
+	// The span of the previous invocation must not be finished again
+	functionExecutionSpan = nil
+	onSpanFinish = l.onSpanFinish
 	if !l.ddTraceEnabled {
 		return ctx
 	}
+	if IsIgnoredInvocation(ctx, msg) {
+		logger.Debug("ignoring the invocation, it matches Config.IgnoreResources")
+		return ctx
+	}
 
 	if l.universalInstrumentation && l.extensionManager.IsExtensionRunning() {
 		ctx = l.extensionManager.SendStartInvocationRequest(ctx, msg)
 	}
 
-	ctx, _ = contextWithRootTraceContext(ctx, msg, l.mergeXrayTraces, l.traceContextExtractor)
+	if l.outsideLambda {
+		// Only an incoming Datadog trace can be continued, there is no X-Ray trace to merge with
+		datadogTraceContext, _ := extractTraceContext(ctx, l.traceContextExtractor(ctx, msg), l.propagationStyleExtract)
+		ctx = context.WithValue(ctx, traceContextKey, datadogTraceContext)
+	} else {
+		ctx, _ = contextWithRootTraceContext(ctx, msg, l.mergeXrayTraces, l.traceContextExtractor, l.propagationStyleExtract)
+	}
 
 	if !tracerInitialized {
-		serviceName := os.Getenv("DD_SERVICE")
+		serviceName := l.service
 		if serviceName == "" {
 			serviceName = "aws.lambda"
 		}
@@ -91,6 +187,11 @@ func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) cont
 			tracer.WithGlobalTag("_dd.origin", "lambda"),
 			tracer.WithSendRetries(2),
 		}, l.tracerOptions...)
+		for from, to := range l.serviceMapping {
+			opts = append(opts, tracer.WithServiceMapping(from, to))
+		}
+		serviceMapping = l.serviceMapping
+		tracerService = serviceName
 		if l.otelTracerEnabled {
 			provider := ddotel.NewTracerProvider(
 				opts...,
@@ -105,7 +206,31 @@ func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) cont
 	}
 
 	isDdServerlessSpan := l.universalInstrumentation && l.extensionManager.IsExtensionRunning()
-	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, l.mergeXrayTraces, isDdServerlessSpan)
+	spanOpts := []tracer.StartSpanOption{tracer.WithSpanID(l.idGenerator())}
+	// The resource of the span dropped by the extension is kept, so the extension still recognizes it
+	if !isDdServerlessSpan {
+		if resourceName := getSpanResource(ctx, msg, l.spanResourceFunc); resourceName != "" {
+			spanOpts = append(spanOpts, tracer.ResourceName(resourceName))
+		}
+	}
+	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, l.mergeXrayTraces, isDdServerlessSpan, spanOpts...)
+	if isDdServerlessSpan {
+		ctx = contextWithExtensionTraceContext(ctx, functionExecutionSpan)
+	}
+	if l.tagFunctionVersion {
+		for key, value := range getFunctionVersionSpanTags(ctx) {
+			functionExecutionSpan.SetTag(key, value)
+		}
+	}
+	// The resource of API Gateway events wins over the one of the function version
+	if l.apiGatewaySpanTags {
+		for key, value := range getAPIGatewaySpanTags(msg) {
+			functionExecutionSpan.SetTag(key, value)
+		}
+	}
+	for key, value := range getCloudwatchLogsSpanTags(msg) {
+		functionExecutionSpan.SetTag(key, value)
+	}
 
 	// Add the span to the context so the user can create child spans
 	ctx = tracer.ContextWithSpan(ctx, functionExecutionSpan)
@@ -113,11 +238,19 @@ func (l *Listener) HandlerStarted(ctx context.Context, msg json.RawMessage) cont
 	return ctx
 }
 
-// HandlerFinished ends the function execution span and stops the tracer
+// HandlerFinished ends the function execution span and flushes the tracer. The tracer buffers the finished spans
+// until their trace completes, so the spans of the invocation are submitted together, in one payload.
 func (l *Listener) HandlerFinished(ctx context.Context, err error) {
 	if functionExecutionSpan != nil {
-		functionExecutionSpan.Finish(tracer.WithError(err))
+		// When enabled, the error returned by the handler sets the error, error.message,
+		// error.type and error.stack tags on the function execution span.
+		var spanErr error
+		if l.captureHandlerErrors {
+			spanErr = err
+		}
+		functionExecutionSpan.Finish(tracer.WithError(spanErr))
 
+		// The extension marks its invocation span as an error whatever CaptureHandlerErrors is
 		finishConfig := ddtrace.FinishConfig{Error: err}
 
 		if l.universalInstrumentation && l.extensionManager.IsExtensionRunning() {
@@ -130,9 +263,13 @@ func (l *Listener) HandlerFinished(ctx context.Context, err error) {
 
 // startFunctionExecutionSpan starts a span that represents the current Lambda function execution
 // and returns the span so that it can be finished when the function execution is complete
-func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, isDdServerlessSpan bool) (tracer.Span, context.Context) {
+func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, isDdServerlessSpan bool, opts ...tracer.StartSpanOption) (tracer.Span, context.Context) {
 	// Extract information from context
-	lambdaCtx, _ := lambdacontext.FromContext(ctx)
+	lambdaCtx, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		// Outside AWS Lambda, the function has no ARN nor request ID
+		lambdaCtx = &lambdacontext.LambdaContext{}
+	}
 	rootTraceContext, ok := ctx.Value(traceContextKey).(TraceContext)
 	if !ok {
 		logger.Error(fmt.Errorf("Error extracting trace context from context object"))
@@ -155,8 +292,7 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, isDdS
 		resourceName = string(extension.DdSeverlessSpan)
 	}
 
-	span := tracer.StartSpan(
-		"aws.lambda", // This operation name will be replaced with the value of the service tag by the Forwarder
+	opts = append([]tracer.StartSpanOption{
 		tracer.SpanType("serverless"),
 		tracer.ChildOf(parentSpanContext),
 		tracer.ResourceName(resourceName),
@@ -168,6 +304,10 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, isDdS
 		tracer.Tag("functionname", strings.ToLower(lambdacontext.FunctionName)),
 		tracer.Tag("datadog_lambda", version.DDLambdaVersion),
 		tracer.Tag("dd_trace", version.DDTraceVersion),
+	}, opts...)
+	span := startSpan(
+		"aws.lambda", // This operation name will be replaced with the value of the service tag by the Forwarder
+		opts...,
 	)
 
 	if parentSpanContext != nil && mergeXrayTraces {
@@ -180,6 +320,51 @@ func startFunctionExecutionSpan(ctx context.Context, mergeXrayTraces bool, isDdS
 	return span, ctx
 }
 
+// contextWithExtensionTraceContext stores the trace context of span where the extension manager reads it at the end of
+// the invocation. The invocation span the extension creates then takes the trace ID, span ID and parent of span, which
+// it replaces, so the spans started from span appear under it. The trace context returned by the extension at the start
+// of the invocation may be another one, e.g. when a custom TraceContextExtractor read the incoming trace context.
+func contextWithExtensionTraceContext(ctx context.Context, span tracer.Span) context.Context {
+	ctx = context.WithValue(ctx, extension.DdTraceId, fmt.Sprint(span.Context().TraceID()))
+	ctx = context.WithValue(ctx, extension.DdSpanId, fmt.Sprint(span.Context().SpanID()))
+	if rootTraceContext, ok := RootTraceContext(ctx); ok {
+		ctx = context.WithValue(ctx, extension.DdParentId, rootTraceContext[parentIDHeader])
+		if samplingPriority := rootTraceContext[samplingPriorityHeader]; samplingPriority != "" {
+			ctx = context.WithValue(ctx, extension.DdSamplingPriority, samplingPriority)
+		}
+	}
+	return ctx
+}
+
+// getFunctionVersionSpanTags returns the executedversion tag, the version of the function that ran, and the resource
+// tag, the function name along with the alias or version it was invoked with, like the enhanced metrics have
+func getFunctionVersionSpanTags(ctx context.Context) map[string]string {
+	tags := map[string]string{}
+	if lambdacontext.FunctionVersion != "" {
+		tags["executedversion"] = lambdacontext.FunctionVersion
+	}
+	resource := lambdacontext.FunctionName
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		// ex: arn:aws:lambda:us-east-1:123497558138:function:golang-layer:alias
+		if splitArn := strings.Split(lc.InvokedFunctionArn, ":"); len(splitArn) > 7 && splitArn[7] != "" {
+			resource = fmt.Sprintf("%s:%s", resource, strings.TrimPrefix(splitArn[7], "$"))
+		}
+	}
+	if resource != "" {
+		tags["resource"] = resource
+	}
+	return tags
+}
+
+// randomID is the default IDGenerator, it returns random positive 63-bit IDs like the tracer does
+func randomID() uint64 {
+	for {
+		if id := uint64(rand.Int63()); id != 0 {
+			return id
+		}
+	}
+}
+
 func separateVersionFromFunctionArn(functionArn string) (arnWithoutVersion string, functionVersion string) {
 	arnSegments := strings.Split(functionArn, ":")
 	if cap(arnSegments) < 7 {
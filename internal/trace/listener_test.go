@@ -9,14 +9,28 @@
 package trace
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 func TestSeparateVersionFromFunctionArnWithVersion(t *testing.T) {
@@ -174,3 +188,448 @@ func TestStartFunctionExecutionSpanWithExtension(t *testing.T) {
 	assert.Equal(t, string(extension.DdSeverlessSpan), finishedSpan.Tag("resource.name"))
 	assert.Equal(t, fmt.Sprint(span.Context().SpanID()), ctx.Value(extension.DdSpanId).(string))
 }
+
+func TestContextWithExtensionTraceContextLinksChildSpans(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+	ctx = context.WithValue(ctx, traceContextKey, traceContextFromEvent)
+	// The trace context returned by the extension at the start of the invocation
+	ctx = context.WithValue(ctx, extension.DdTraceId, "1")
+	ctx = context.WithValue(ctx, extension.DdParentId, "2")
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", false)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span, ctx := startFunctionExecutionSpan(ctx, false, true)
+	ctx = contextWithExtensionTraceContext(ctx, span)
+	child, _ := StartSpanFromContext(tracer.ContextWithSpan(ctx, span), "child")
+	child.Finish()
+	span.Finish()
+
+	finishedChild := mt.FinishedSpans()[0]
+	assert.Equal(t, "child", finishedChild.OperationName())
+	// The extension replaces span with its invocation span, so the child appears under it
+	assert.Equal(t, fmt.Sprint(finishedChild.TraceID()), ctx.Value(extension.DdTraceId))
+	assert.Equal(t, fmt.Sprint(finishedChild.ParentID()), ctx.Value(extension.DdSpanId))
+	assert.Equal(t, "45678910", ctx.Value(extension.DdParentId))
+}
+
+func TestListenerHandlerFinishedTagsHandlerError(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, traceContextKey, traceContextFromEvent)
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", true)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{captureHandlerErrors: true, extensionManager: &extension.ExtensionManager{}}
+	handlerErr := errors.New("something went wrong")
+	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, false, false)
+	listener.HandlerFinished(ctx, handlerErr)
+	functionExecutionSpan = nil
+
+	finishedSpan := mt.FinishedSpans()[0]
+	assert.Equal(t, handlerErr, finishedSpan.Tag(ext.Error))
+}
+
+func TestListenerHandlerFinishedNoHandlerError(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, traceContextKey, traceContextFromEvent)
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", true)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{captureHandlerErrors: true, extensionManager: &extension.ExtensionManager{}}
+	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, false, false)
+	listener.HandlerFinished(ctx, nil)
+	functionExecutionSpan = nil
+
+	finishedSpan := mt.FinishedSpans()[0]
+	assert.Nil(t, finishedSpan.Tag(ext.Error))
+}
+
+func TestListenerHandlerFinishedCaptureHandlerErrorsDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx = lambdacontext.NewContext(ctx, &mockLambdaContext)
+	ctx = context.WithValue(ctx, traceContextKey, traceContextFromEvent)
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", true)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := Listener{captureHandlerErrors: false, extensionManager: &extension.ExtensionManager{}}
+	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, false, false)
+	listener.HandlerFinished(ctx, errors.New("something went wrong"))
+	functionExecutionSpan = nil
+
+	finishedSpan := mt.FinishedSpans()[0]
+	assert.Nil(t, finishedSpan.Tag(ext.Error))
+}
+
+// recordingExtension is a running extension recording the finish config of the invocations ended
+type recordingExtension struct {
+	extension.ExtensionManager
+	finishConfigs []ddtrace.FinishConfig
+}
+
+func (e *recordingExtension) IsExtensionRunning() bool { return true }
+
+func (e *recordingExtension) SendEndInvocationRequest(ctx context.Context, functionExecutionSpan ddtrace.Span, cfg ddtrace.FinishConfig) {
+	e.finishConfigs = append(e.finishConfigs, cfg)
+}
+
+func TestListenerHandlerFinishedCaptureHandlerErrorsDisabledReportsTheErrorToTheExtension(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+	ctx = context.WithValue(ctx, traceContextKey, traceContextFromEvent)
+	//nolint
+	ctx = context.WithValue(ctx, "cold_start", true)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	extensionManager := &recordingExtension{}
+	listener := Listener{captureHandlerErrors: false, universalInstrumentation: true, extensionManager: extensionManager}
+	functionExecutionSpan, ctx = startFunctionExecutionSpan(ctx, false, false)
+	handlerErr := errors.New("something went wrong")
+	listener.HandlerFinished(ctx, handlerErr)
+	functionExecutionSpan = nil
+
+	assert.Nil(t, mt.FinishedSpans()[0].Tag(ext.Error))
+	if assert.Len(t, extensionManager.finishConfigs, 1) {
+		assert.Equal(t, handlerErr, extensionManager.finishConfigs[0].Error)
+	}
+}
+
+// setIDGenerator replaces the IDGenerator of the Listener, to get deterministic IDs
+func (l *Listener) setIDGenerator(idGenerator IDGenerator) {
+	l.idGenerator = idGenerator
+}
+
+func TestListenerHandlerStartedUsesIDGenerator(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+	listener := MakeListener(Config{DDTraceEnabled: true, TraceContextExtractor: DefaultTraceExtractor}, &extension.ExtensionManager{})
+	listener.setIDGenerator(func() uint64 { return 1234 })
+	ctx = listener.HandlerStarted(ctx, json.RawMessage(`{}`))
+	defer func() { functionExecutionSpan = nil }()
+
+	span, ok := tracer.SpanFromContext(ctx)
+	assert.True(t, ok)
+	headers := http.Header{}
+	assert.NoError(t, tracer.Inject(span.Context(), tracer.HTTPHeadersCarrier(headers)))
+
+	// The function execution span starts a new trace, so its ID is also the trace ID
+	assert.Equal(t, "1234", headers.Get(traceIDHeader))
+	assert.Equal(t, "1234", headers.Get(parentIDHeader))
+	assert.Equal(t, "1234", ctx.Value(extension.DdSpanId))
+}
+
+func TestRandomIDIsNonZero(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		assert.NotZero(t, randomID())
+	}
+}
+
+func TestListenerHandlerStartedUsesSpanResourceFunc(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	lambdacontext.FunctionName = "MockFunctionName"
+	event := loadRawJSON(t, "../testdata/apig-v1-event.json")
+	routeResource := func(ctx context.Context, event interface{}) string {
+		var ev struct {
+			HTTPMethod string `json:"httpMethod"`
+			Resource   string `json:"resource"`
+		}
+		if err := json.Unmarshal(event.(json.RawMessage), &ev); err != nil {
+			return ""
+		}
+		if ev.Resource == "" {
+			return ""
+		}
+		return ev.HTTPMethod + " " + ev.Resource
+	}
+
+	testCases := []struct {
+		name             string
+		event            json.RawMessage
+		spanResourceFunc SpanResourceFunc
+		expected         string
+	}{
+		{"API Gateway event", *event, routeResource, "GET /users/{id}"},
+		{"falls back to the function name when empty", json.RawMessage(`{}`), routeResource, "MockFunctionName"},
+		{"falls back to the function name when nil", *event, nil, "MockFunctionName"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mt := mocktracer.Start()
+			defer mt.Stop()
+			ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+			listener := MakeListener(Config{DDTraceEnabled: true, TraceContextExtractor: DefaultTraceExtractor, SpanResourceFunc: tc.spanResourceFunc}, &extension.ExtensionManager{})
+			listener.HandlerStarted(ctx, tc.event)
+			functionExecutionSpan.Finish()
+			functionExecutionSpan = nil
+
+			spans := mt.FinishedSpans()
+			assert.Len(t, spans, 1)
+			assert.Equal(t, tc.expected, spans[0].Tag(ext.ResourceName))
+		})
+	}
+}
+
+func TestListenerHandlerStartedOutsideLambda(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+
+	for _, outsideLambda := range []bool{true, false} {
+		t.Run(fmt.Sprintf("outside lambda %t", outsideLambda), func(t *testing.T) {
+			mt := mocktracer.Start()
+			defer mt.Stop()
+			var buf bytes.Buffer
+			logger.SetOutput(&buf)
+			defer logger.SetOutput(os.Stderr)
+
+			listener := MakeListener(Config{DDTraceEnabled: true, TraceContextExtractor: DefaultTraceExtractor, OutsideLambda: outsideLambda}, &extension.ExtensionManager{})
+			listener.HandlerStarted(context.Background(), json.RawMessage(`{}`))
+			functionExecutionSpan.Finish()
+			functionExecutionSpan = nil
+
+			assert.Len(t, mt.FinishedSpans(), 1)
+			if outsideLambda {
+				assert.NotContains(t, buf.String(), "X-Ray")
+			} else {
+				assert.Contains(t, buf.String(), "Couldn't convert X-Ray trace context")
+			}
+		})
+	}
+}
+
+func TestListenerHandlerStartedIgnoresInvocations(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+	listener := MakeListener(Config{
+		DDTraceEnabled:        true,
+		TraceContextExtractor: DefaultTraceExtractor,
+		IgnoreInvocation:      MakeInvocationFilter([]string{"/health"}, nil),
+	}, &extension.ExtensionManager{})
+
+	listener.HandlerStarted(ctx, json.RawMessage(`{"path":"/health"}`))
+	listener.HandlerFinished(ctx, nil)
+	assert.Empty(t, mt.FinishedSpans())
+
+	listener.HandlerStarted(ctx, json.RawMessage(`{"path":"/orders"}`))
+	listener.HandlerFinished(ctx, nil)
+	assert.Len(t, mt.FinishedSpans(), 1)
+	functionExecutionSpan = nil
+}
+
+func TestListenerHandlerStartedComputesTheSpanResourceOnce(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+	calls := 0
+	spanResourceFunc := func(ctx context.Context, event interface{}) string {
+		calls++
+		return "GET /orders"
+	}
+	listener := MakeListener(Config{
+		DDTraceEnabled:        true,
+		TraceContextExtractor: DefaultTraceExtractor,
+		SpanResourceFunc:      spanResourceFunc,
+		IgnoreInvocation:      MakeInvocationFilter([]string{"/health"}, spanResourceFunc),
+	}, &extension.ExtensionManager{})
+
+	msg := json.RawMessage(`{"path":"/orders"}`)
+	ctx = listener.HandlerStarted(ctx, msg)
+	// The other listeners get the decision of the trace listener
+	assert.False(t, IsIgnoredInvocation(ctx, msg))
+	listener.HandlerFinished(ctx, nil)
+	functionExecutionSpan = nil
+
+	assert.Equal(t, 1, calls)
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET /orders", spans[0].Tag(ext.ResourceName))
+}
+
+func TestListenerHandlerStartedTagsFunctionVersion(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	defer func(name, version string) {
+		lambdacontext.FunctionName, lambdacontext.FunctionVersion = name, version
+	}(lambdacontext.FunctionName, lambdacontext.FunctionVersion)
+	lambdacontext.FunctionName = "MyFunction"
+	lambdacontext.FunctionVersion = "7"
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:MyFunction:canary"}
+
+	for _, tagFunctionVersion := range []bool{true, false} {
+		t.Run(fmt.Sprintf("tag function version %t", tagFunctionVersion), func(t *testing.T) {
+			mt := mocktracer.Start()
+			defer mt.Stop()
+			ctx := lambdacontext.NewContext(context.Background(), lc)
+
+			listener := MakeListener(Config{DDTraceEnabled: true, TraceContextExtractor: DefaultTraceExtractor, TagFunctionVersion: tagFunctionVersion}, &extension.ExtensionManager{})
+			listener.HandlerStarted(ctx, json.RawMessage(`{}`))
+			listener.HandlerFinished(ctx, nil)
+			functionExecutionSpan = nil
+
+			spans := mt.FinishedSpans()
+			assert.Len(t, spans, 1)
+			if tagFunctionVersion {
+				assert.Equal(t, "7", spans[0].Tag("executedversion"))
+				assert.Equal(t, "MyFunction:canary", spans[0].Tag("resource"))
+			} else {
+				assert.Nil(t, spans[0].Tag("executedversion"))
+				assert.Nil(t, spans[0].Tag("resource"))
+			}
+		})
+	}
+}
+
+func TestGetFunctionVersionSpanTagsWithLatest(t *testing.T) {
+	defer func(name, version string) {
+		lambdacontext.FunctionName, lambdacontext.FunctionVersion = name, version
+	}(lambdacontext.FunctionName, lambdacontext.FunctionVersion)
+	lambdacontext.FunctionName = "MyFunction"
+	lambdacontext.FunctionVersion = "$LATEST"
+	lc := &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:MyFunction:$LATEST"}
+
+	tags := getFunctionVersionSpanTags(lambdacontext.NewContext(context.Background(), lc))
+
+	assert.Equal(t, map[string]string{"executedversion": "$LATEST", "resource": "MyFunction:LATEST"}, tags)
+}
+
+func TestListenerOnSpanFinish(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	defer func() { onSpanFinish = nil }()
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	lambdacontext.FunctionName = "MockFunctionName"
+	ctx := lambdacontext.NewContext(context.Background(), &mockLambdaContext)
+
+	finished := []SpanData{}
+	listener := MakeListener(Config{
+		DDTraceEnabled:        true,
+		TraceContextExtractor: DefaultTraceExtractor,
+		OnSpanFinish:          func(span SpanData) { finished = append(finished, span) },
+	}, &extension.ExtensionManager{})
+	ctx = listener.HandlerStarted(ctx, json.RawMessage(`{}`))
+	child, _ := StartSpanFromContext(ctx, "child", tracer.ServiceName("payments"), tracer.Tag("order", 42))
+	child.SetTag(ext.ResourceName, "charge")
+	child.Finish()
+	child.Finish()
+	listener.HandlerFinished(ctx, nil)
+	functionExecutionSpan = nil
+
+	assert.Len(t, mt.FinishedSpans(), 2)
+	assert.Len(t, finished, 2)
+	assert.Equal(t, "child", finished[0].Name)
+	assert.Equal(t, "charge", finished[0].Resource)
+	assert.Equal(t, "payments", finished[0].Service)
+	assert.Equal(t, 42, finished[0].Tags["order"])
+	assert.Equal(t, "aws.lambda", finished[1].Name)
+	assert.Equal(t, "MockFunctionName", finished[1].Resource)
+	assert.Equal(t, "mockfunctionname", finished[1].Tags["functionname"])
+	assert.False(t, finished[1].Start.After(finished[0].Start))
+	assert.GreaterOrEqual(t, finished[1].Duration, finished[0].Duration)
+}
+
+func TestListenerHandlerStartedExtractsW3CTraceContext(t *testing.T) {
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = true
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	listener := MakeListener(Config{DDTraceEnabled: true, TraceContextExtractor: DefaultTraceExtractor, OutsideLambda: true}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(context.Background(), json.RawMessage(`{"headers":{"traceparent":"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}`))
+	listener.HandlerFinished(ctx, nil)
+	functionExecutionSpan = nil
+
+	assert.Len(t, mt.FinishedSpans(), 1)
+	traceContext, ok := RootTraceContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, makeTraceContext("9532127138774266268", "13235353014750950193", "1"), traceContext)
+}
+
+func TestListenerSubmitsTheSpansOfAnInvocationTogether(t *testing.T) {
+	t.Setenv("DD_INSTRUMENTATION_TELEMETRY_ENABLED", "false")
+	var mu sync.Mutex
+	var payloads [][]byte
+	var traceCounts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The tracer checks the connection to the agent with an empty payload when it starts
+		if strings.HasSuffix(r.URL.Path, "/traces") && r.Header.Get("X-Datadog-Trace-Count") != "0" {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			payloads = append(payloads, body)
+			traceCounts = append(traceCounts, r.Header.Get("X-Datadog-Trace-Count"))
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer func(initialized bool) { tracerInitialized = initialized }(tracerInitialized)
+	tracerInitialized = false
+	defer tracer.Stop()
+	listener := MakeListener(Config{
+		DDTraceEnabled:        true,
+		TraceContextExtractor: DefaultTraceExtractor,
+		TracerOptions:         []tracer.StartOption{tracer.WithAgentAddr(strings.TrimPrefix(server.URL, "http://")), tracer.WithLambdaMode(false)},
+	}, &extension.ExtensionManager{})
+	ctx := listener.HandlerStarted(lambdacontext.NewContext(context.Background(), &mockLambdaContext), json.RawMessage(`{}`))
+	defer func() { functionExecutionSpan = nil }()
+
+	for i := 0; i < 5; i++ {
+		span, _ := StartSpanFromContext(ctx, fmt.Sprintf("child-%d", i))
+		span.Finish()
+	}
+	mu.Lock()
+	// The tracer buffers the spans until the trace is complete
+	assert.Empty(t, payloads)
+	mu.Unlock()
+	listener.HandlerFinished(ctx, nil)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(payloads) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, payloads, 1)
+	assert.Equal(t, []string{"1"}, traceCounts)
+	for i := 0; i < 5; i++ {
+		assert.True(t, bytes.Contains(payloads[0], []byte(fmt.Sprintf("child-%d", i))), "child-%d", i)
+	}
+	assert.True(t, bytes.Contains(payloads[0], []byte("aws.lambda")))
+}
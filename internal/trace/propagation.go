@@ -0,0 +1,253 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// extractedTraceContextKey is the key used to store the TraceContext extracted by ContextWithTraceHeaders
+var extractedTraceContextKey = new(contextKeytype)
+
+// propagatedHeadersKey is the key used to store the headers captured by ContextWithPropagatedHeaders
+var propagatedHeadersKey = new(contextKeytype)
+
+// The propagation styles, the header formats the Listener can extract the trace context of an invocation from
+const (
+	PropagationStyleDatadog      = "datadog"
+	PropagationStyleTraceContext = "tracecontext"
+	PropagationStyleB3           = "b3"
+	PropagationStyleB3Multi      = "b3multi"
+)
+
+// DefaultPropagationStyleExtract are the propagation styles the Listener extracts the trace context from by default
+var DefaultPropagationStyleExtract = []string{PropagationStyleDatadog, PropagationStyleTraceContext}
+
+// extractTraceContext reads the trace context of an invocation from headers, in the first of the propagation styles
+// that matches, DefaultPropagationStyleExtract when styles is nil. The Datadog style falls back to the trace context
+// returned by the extension.
+func extractTraceContext(ctx context.Context, headers map[string]string, styles []string) (TraceContext, bool) {
+	if styles == nil {
+		styles = DefaultPropagationStyleExtract
+	}
+	lowercaseHeaders := make(map[string]string, len(headers))
+	for k, v := range headers {
+		lowercaseHeaders[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	for _, style := range styles {
+		var tc TraceContext
+		ok := false
+		switch strings.ToLower(strings.TrimSpace(style)) {
+		case PropagationStyleDatadog:
+			tc, ok = getTraceContext(ctx, lowercaseHeaders)
+		case PropagationStyleTraceContext:
+			tc, ok = parseW3CHeaders(lowercaseHeaders)
+		case PropagationStyleB3, PropagationStyleB3Multi:
+			tc, ok = parseB3Headers(lowercaseHeaders)
+		}
+		if ok {
+			return tc, true
+		}
+	}
+	return TraceContext{}, false
+}
+
+// isPropagationStyle reports whether style is one of the propagation styles extractTraceContext supports
+func isPropagationStyle(style string) bool {
+	switch strings.ToLower(strings.TrimSpace(style)) {
+	case PropagationStyleDatadog, PropagationStyleTraceContext, PropagationStyleB3, PropagationStyleB3Multi:
+		return true
+	}
+	return false
+}
+
+// ParseTraceHeaders reads a trace context from Datadog headers, or else from W3C trace context or B3 headers.
+// The header names are case insensitive.
+func ParseTraceHeaders(headers map[string]string) (TraceContext, bool) {
+	lowercaseHeaders := make(map[string]string, len(headers))
+	for k, v := range headers {
+		lowercaseHeaders[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	for _, parse := range []func(map[string]string) (TraceContext, bool){parseDatadogHeaders, parseW3CHeaders, parseB3Headers} {
+		if tc, ok := parse(lowercaseHeaders); ok {
+			return tc, true
+		}
+	}
+	return nil, false
+}
+
+// ContextWithTraceHeaders returns a copy of ctx carrying the trace context parsed from headers, see ParseTraceHeaders.
+// It returns ctx unchanged when headers don't hold a valid trace context.
+func ContextWithTraceHeaders(ctx context.Context, headers map[string]string) (context.Context, bool) {
+	tc, ok := ParseTraceHeaders(headers)
+	if !ok {
+		return ctx, false
+	}
+	return context.WithValue(ctx, extractedTraceContextKey, tc), true
+}
+
+// ExtractedTraceContext returns the TraceContext added to ctx by ContextWithTraceHeaders, if any.
+func ExtractedTraceContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(extractedTraceContextKey).(TraceContext)
+	return tc, ok
+}
+
+func parseDatadogHeaders(headers map[string]string) (TraceContext, bool) {
+	traceID, parentID := headers[traceIDHeader], headers[parentIDHeader]
+	if !isNonZeroUint64(traceID) || !isNonZeroUint64(parentID) {
+		return nil, false
+	}
+	samplingPriority := headers[samplingPriorityHeader]
+	if _, err := strconv.Atoi(samplingPriority); err != nil {
+		samplingPriority = autoKeep
+	}
+	return makeTraceContext(traceID, parentID, samplingPriority), true
+}
+
+// parseW3CHeaders reads a `traceparent` header, in the version-traceid-parentid-flags format.
+// The sampling priority chosen by Datadog, in the `s` field of the `dd` member of `tracestate`, is kept if there is one.
+func parseW3CHeaders(headers map[string]string) (TraceContext, bool) {
+	parts := strings.Split(headers[traceparentHeader], "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	traceID, ok := parseHexID(parts[1])
+	if !ok {
+		return nil, false
+	}
+	parentID, ok := parseHexID(parts[2])
+	if !ok {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+
+	samplingPriority := autoReject
+	if flags&1 == 1 {
+		samplingPriority = autoKeep
+	}
+	if priority, ok := parseTracestatePriority(headers[tracestateHeader]); ok && (priority > 0) == (flags&1 == 1) {
+		samplingPriority = strconv.Itoa(priority)
+	}
+	return makeTraceContext(traceID, parentID, samplingPriority), true
+}
+
+func parseTracestatePriority(tracestate string) (int, bool) {
+	for _, member := range strings.Split(tracestate, ",") {
+		value, found := strings.CutPrefix(strings.TrimSpace(member), "dd=")
+		if !found {
+			continue
+		}
+		for _, field := range strings.Split(value, ";") {
+			if priority, found := strings.CutPrefix(field, "s:"); found {
+				p, err := strconv.Atoi(priority)
+				return p, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseB3Headers reads a single `b3` header, in the traceid-spanid-sampled format, or else the `x-b3-*` headers.
+func parseB3Headers(headers map[string]string) (TraceContext, bool) {
+	traceIDHex, spanIDHex, sampled := headers[b3TraceIDHeader], headers[b3SpanIDHeader], headers[b3SampledHeader]
+	if headers[b3FlagsHeader] == "1" {
+		sampled = "d"
+	}
+	if single := headers[b3Header]; single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return nil, false
+		}
+		traceIDHex, spanIDHex, sampled = parts[0], parts[1], ""
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	}
+	if (len(traceIDHex) != 16 && len(traceIDHex) != 32) || len(spanIDHex) != 16 {
+		return nil, false
+	}
+	traceID, ok := parseHexID(traceIDHex)
+	if !ok {
+		return nil, false
+	}
+	parentID, ok := parseHexID(spanIDHex)
+	if !ok {
+		return nil, false
+	}
+
+	samplingPriority := autoKeep
+	switch sampled {
+	case "0", "false":
+		samplingPriority = autoReject
+	case "d":
+		samplingPriority = userKeep
+	}
+	return makeTraceContext(traceID, parentID, samplingPriority), true
+}
+
+// parseHexID converts the lower 64 bits of a hex ID to a decimal Datadog ID. IDs of zero are invalid.
+func parseHexID(hexID string) (string, bool) {
+	if len(hexID) > 16 {
+		hexID = hexID[len(hexID)-16:]
+	}
+	id, err := strconv.ParseUint(hexID, 16, 64)
+	if err != nil || id == 0 {
+		return "", false
+	}
+	return strconv.FormatUint(id, 10), true
+}
+
+func isNonZeroUint64(id string) bool {
+	value, err := strconv.ParseUint(id, 10, 64)
+	return err == nil && value != 0
+}
+
+func makeTraceContext(traceID, parentID, samplingPriority string) TraceContext {
+	return TraceContext{
+		traceIDHeader:          traceID,
+		parentIDHeader:         parentID,
+		samplingPriorityHeader: samplingPriority,
+	}
+}
+
+// ContextWithPropagatedHeaders returns a copy of ctx carrying the values of the headers named in names, read from the
+// headers of the event ev. It returns ctx unchanged when the event has none of them.
+func ContextWithPropagatedHeaders(ctx context.Context, ev json.RawMessage, names []string) context.Context {
+	if len(names) == 0 {
+		return ctx
+	}
+	eventHeaders := getEventHeaders(ev)
+	headers := map[string]string{}
+	for _, name := range names {
+		if value := eventHeaders[strings.ToLower(name)]; value != "" {
+			headers[name] = value
+		}
+	}
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, propagatedHeadersKey, headers)
+}
+
+// PropagatedHeaders returns the headers captured by ContextWithPropagatedHeaders, by the names they were configured
+// with. The returned map must not be modified.
+func PropagatedHeaders(ctx context.Context) map[string]string {
+	if headers, ok := ctx.Value(propagatedHeadersKey).(map[string]string); ok {
+		return headers
+	}
+	return map[string]string{}
+}
@@ -0,0 +1,171 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected TraceContext
+	}{
+		{
+			name:     "datadog",
+			headers:  map[string]string{"X-Datadog-Trace-Id": "1231452342", "X-Datadog-Parent-Id": "45678910", "X-Datadog-Sampling-Priority": "2"},
+			expected: makeTraceContext("1231452342", "45678910", "2"),
+		},
+		{
+			name:     "datadog without sampling priority",
+			headers:  map[string]string{"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910"},
+			expected: makeTraceContext("1231452342", "45678910", "1"),
+		},
+		{
+			name: "datadog takes precedence",
+			headers: map[string]string{
+				"x-datadog-trace-id":  "1231452342",
+				"x-datadog-parent-id": "45678910",
+				"traceparent":         "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			},
+			expected: makeTraceContext("1231452342", "45678910", "1"),
+		},
+		{
+			name:     "w3c sampled",
+			headers:  map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			expected: makeTraceContext("9532127138774266268", "13235353014750950193", "1"),
+		},
+		{
+			name:     "w3c not sampled",
+			headers:  map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+			expected: makeTraceContext("9532127138774266268", "13235353014750950193", "0"),
+		},
+		{
+			name: "w3c with datadog tracestate",
+			headers: map[string]string{
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"tracestate":  "rojo=00f067aa0ba902b7, dd=s:2;o:rum",
+			},
+			expected: makeTraceContext("9532127138774266268", "13235353014750950193", "2"),
+		},
+		{
+			name:     "b3 single",
+			headers:  map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-d"},
+			expected: makeTraceContext("7277407061855694839", "16453819474850114513", "2"),
+		},
+		{
+			name: "b3 multi",
+			headers: map[string]string{
+				"X-B3-TraceId": "463ac35c9f6413ad",
+				"X-B3-SpanId":  "a2fb4a1d1a96d312",
+				"X-B3-Sampled": "0",
+			},
+			expected: makeTraceContext("5060571933882717101", "11744061942159299346", "0"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, ok := ParseTraceHeaders(tt.headers)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, tc)
+		})
+	}
+}
+
+func TestParseTraceHeadersInvalid(t *testing.T) {
+	for name, headers := range map[string]map[string]string{
+		"missing":              {"content-type": "application/json"},
+		"datadog without span": {"x-datadog-trace-id": "1231452342"},
+		"datadog not numeric":  {"x-datadog-trace-id": "abc", "x-datadog-parent-id": "45678910"},
+		"w3c invalid version":  {"traceparent": "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"w3c zero trace id":    {"traceparent": "00-00000000000000000000000000000000-b7ad6b7169203331-01"},
+		"w3c truncated":        {"traceparent": "00-0af7651916cd43dd8448eb211c80319c"},
+		"b3 not hex":           {"b3": "zzf198ee56343ba8-e457b5a2e4d86bd1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, ok := ParseTraceHeaders(headers)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestContextWithTraceHeaders(t *testing.T) {
+	ctx, ok := ContextWithTraceHeaders(context.Background(), map[string]string{"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910"})
+	assert.True(t, ok)
+	tc, ok := ExtractedTraceContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "1231452342", tc[traceIDHeader])
+
+	ctx, ok = ContextWithTraceHeaders(context.Background(), nil)
+	assert.False(t, ok)
+	_, ok = ExtractedTraceContext(ctx)
+	assert.False(t, ok)
+}
+
+func TestContextWithPropagatedHeaders(t *testing.T) {
+	ev := json.RawMessage(`{"headers":{"X-Request-Id":"req-1","X-Tenant":"other"},"multiValueHeaders":{"x-tenant":["acme","ignored"]}}`)
+
+	ctx := ContextWithPropagatedHeaders(context.Background(), ev, []string{"x-request-id", "X-Tenant", "x-missing"})
+
+	assert.Equal(t, map[string]string{"x-request-id": "req-1", "X-Tenant": "acme"}, PropagatedHeaders(ctx))
+}
+
+func TestContextWithPropagatedHeadersWithoutHeaders(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Equal(t, ctx, ContextWithPropagatedHeaders(ctx, json.RawMessage(`{"headers":{}}`), []string{"x-request-id"}))
+	assert.Equal(t, ctx, ContextWithPropagatedHeaders(ctx, json.RawMessage(`invalid`), []string{"x-request-id"}))
+	assert.Empty(t, PropagatedHeaders(ctx))
+}
+
+func TestExtractTraceContext(t *testing.T) {
+	datadog := map[string]string{"x-datadog-trace-id": "1231452342", "x-datadog-parent-id": "45678910"}
+	w3c := map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	both := map[string]string{
+		"x-datadog-trace-id":  "1231452342",
+		"x-datadog-parent-id": "45678910",
+		"traceparent":         "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	b3 := map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		styles   []string
+		expected TraceContext
+	}{
+		{name: "w3c only", headers: w3c, expected: makeTraceContext("9532127138774266268", "13235353014750950193", "1")},
+		{name: "datadog only", headers: datadog, expected: makeTraceContext("1231452342", "45678910", "1")},
+		{name: "datadog wins by default", headers: both, expected: makeTraceContext("1231452342", "45678910", "1")},
+		{
+			name:     "first style wins",
+			headers:  both,
+			styles:   []string{"tracecontext", "datadog"},
+			expected: makeTraceContext("9532127138774266268", "13235353014750950193", "1"),
+		},
+		{name: "style not enabled", headers: w3c, styles: []string{"datadog"}},
+		{name: "b3 not enabled by default", headers: b3},
+		{name: "b3", headers: b3, styles: []string{"B3"}, expected: makeTraceContext("7277407061855694839", "16453819474850114513", "1")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			traceContext, ok := extractTraceContext(context.Background(), tc.headers, tc.styles)
+			assert.Equal(t, tc.expected != nil, ok)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, traceContext)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// samplingPriorityKey is the key used to store the samplingDecision of an invocation
+var samplingPriorityKey = new(contextKeytype)
+
+// samplingDecision is the sampling priority set during an invocation, shared by the contexts derived from its context
+type samplingDecision struct {
+	mu       sync.Mutex
+	priority *int
+}
+
+// ContextWithSamplingDecision returns a copy of ctx where SetSamplingPriority can record the sampling priority of the
+// invocation, for the contexts derived from it
+func ContextWithSamplingDecision(ctx context.Context) context.Context {
+	return context.WithValue(ctx, samplingPriorityKey, &samplingDecision{})
+}
+
+// SetSamplingPriority overrides the sampling priority of the trace of ctx: it's set on the span of ctx, or else on the
+// function execution span, and propagated by the trace headers of the invocation. It returns false when ctx isn't the
+// context of an invocation, only the span being updated then.
+func SetSamplingPriority(ctx context.Context, priority int) bool {
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		span.SetTag(ext.SamplingPriority, priority)
+	} else if functionExecutionSpan != nil {
+		functionExecutionSpan.SetTag(ext.SamplingPriority, priority)
+	}
+
+	decision, ok := ctx.Value(samplingPriorityKey).(*samplingDecision)
+	if !ok {
+		return false
+	}
+	decision.mu.Lock()
+	defer decision.mu.Unlock()
+	decision.priority = &priority
+	return true
+}
+
+// SamplingPriority returns the sampling priority set with SetSamplingPriority for the invocation of ctx, if any
+func SamplingPriority(ctx context.Context) (int, bool) {
+	decision, ok := ctx.Value(samplingPriorityKey).(*samplingDecision)
+	if !ok {
+		return 0, false
+	}
+	decision.mu.Lock()
+	defer decision.mu.Unlock()
+	if decision.priority == nil {
+		return 0, false
+	}
+	return *decision.priority, true
+}
+
+// ApplySamplingPriority replaces the sampling priority of the trace headers with the one set with SetSamplingPriority,
+// if any. Headers without a trace are left unchanged.
+func ApplySamplingPriority(ctx context.Context, headers map[string]string) {
+	if priority, ok := SamplingPriority(ctx); ok && headers[traceIDHeader] != "" {
+		headers[samplingPriorityHeader] = strconv.Itoa(priority)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+func TestSetSamplingPriority(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span, ctx := tracer.StartSpanFromContext(ContextWithSamplingDecision(context.Background()), "span")
+	child, childCtx := tracer.StartSpanFromContext(ctx, "child")
+	assert.True(t, SetSamplingPriority(childCtx, ext.PriorityUserKeep))
+	child.Finish()
+	span.Finish()
+
+	// The decision is shared with the parent context
+	priority, ok := SamplingPriority(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, ext.PriorityUserKeep, priority)
+	assert.Equal(t, ext.PriorityUserKeep, mt.FinishedSpans()[0].Tag(ext.SamplingPriority))
+
+	headers := map[string]string{traceIDHeader: "1", parentIDHeader: "2", samplingPriorityHeader: "1"}
+	ApplySamplingPriority(ctx, headers)
+	assert.Equal(t, "2", headers[samplingPriorityHeader])
+}
+
+func TestSetSamplingPriorityOutsideInvocation(t *testing.T) {
+	assert.False(t, SetSamplingPriority(context.Background(), ext.PriorityUserReject))
+	_, ok := SamplingPriority(context.Background())
+	assert.False(t, ok)
+
+	headers := map[string]string{}
+	ApplySamplingPriority(ContextWithSamplingDecision(context.Background()), headers)
+	assert.Empty(t, headers)
+}
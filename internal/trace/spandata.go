@@ -0,0 +1,153 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package trace
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+type (
+	// SpanData describes a finished span, with its final tags and timing
+	SpanData struct {
+		Name     string
+		Resource string
+		Service  string
+		Start    time.Time
+		Duration time.Duration
+		// Tags are the tags of the span, without its resource, service and operation name
+		Tags map[string]interface{}
+	}
+
+	// SpanFinishFunc is called with each finished span, once it's submitted to the tracer
+	SpanFinishFunc func(SpanData)
+
+	// recordingSpan records the name, resource, service, start and tags of a span, to report them to its
+	// SpanFinishFunc when it finishes
+	recordingSpan struct {
+		ddtrace.Span
+		onFinish SpanFinishFunc
+
+		mu       sync.Mutex
+		data     SpanData
+		finished bool
+	}
+)
+
+// onSpanFinish is the SpanFinishFunc of the listener, spans are only recorded when it's set
+var onSpanFinish SpanFinishFunc
+
+// tracerService is the service the tracer was started with, the default service of the recorded spans
+var tracerService string
+
+// startSpan starts a span, recording it when onSpanFinish is set
+func startSpan(operationName string, opts ...tracer.StartSpanOption) tracer.Span {
+	start := time.Now()
+	span := tracer.StartSpan(operationName, opts...)
+	return recordSpan(span, nil, operationName, start, opts)
+}
+
+// recordSpan returns span wrapped to report it to onSpanFinish, or span itself when onSpanFinish isn't set. The
+// service of the span defaults to the one of parent, then to tracerService.
+func recordSpan(span tracer.Span, parent tracer.Span, operationName string, start time.Time, opts []tracer.StartSpanOption) tracer.Span {
+	if onSpanFinish == nil {
+		return span
+	}
+	cfg := ddtrace.StartSpanConfig{Tags: map[string]interface{}{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.StartTime.IsZero() {
+		start = cfg.StartTime
+	}
+
+	rs := &recordingSpan{
+		Span:     span,
+		onFinish: onSpanFinish,
+		data:     SpanData{Name: operationName, Service: tracerService, Start: start, Tags: map[string]interface{}{}},
+	}
+	if parent, ok := parent.(*recordingSpan); ok {
+		parent.mu.Lock()
+		rs.data.Service = parent.data.Service
+		parent.mu.Unlock()
+	}
+	for key, value := range cfg.Tags {
+		rs.setTag(key, value)
+	}
+	return rs
+}
+
+// SetTag sets the tag on the span and records it
+func (s *recordingSpan) SetTag(key string, value interface{}) {
+	s.Span.SetTag(key, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setTag(key, value)
+}
+
+func (s *recordingSpan) setTag(key string, value interface{}) {
+	switch key {
+	case ext.SpanName:
+		s.data.Name, _ = value.(string)
+	case ext.ResourceName:
+		s.data.Resource, _ = value.(string)
+	case ext.ServiceName:
+		s.data.Service, _ = value.(string)
+	default:
+		s.data.Tags[key] = value
+	}
+}
+
+// SetOperationName sets the operation name of the span and records it
+func (s *recordingSpan) SetOperationName(operationName string) {
+	s.Span.SetOperationName(operationName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Name = operationName
+}
+
+// Finish finishes the span, then reports it to the SpanFinishFunc, only the first time it's finished
+func (s *recordingSpan) Finish(opts ...ddtrace.FinishOption) {
+	finishTime := time.Now()
+	s.Span.Finish(opts...)
+
+	cfg := ddtrace.FinishConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.FinishTime.IsZero() {
+		finishTime = cfg.FinishTime
+	}
+
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	if cfg.Error != nil {
+		s.data.Tags[ext.Error] = cfg.Error
+	}
+	if s.data.Resource == "" {
+		s.data.Resource = s.data.Name
+	}
+	s.data.Duration = finishTime.Sub(s.data.Start)
+	data := s.data
+	data.Tags = make(map[string]interface{}, len(s.data.Tags))
+	for key, value := range s.data.Tags {
+		data.Tags[key] = value
+	}
+	s.mu.Unlock()
+
+	s.onFinish(data)
+}
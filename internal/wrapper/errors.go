@@ -0,0 +1,44 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+type ignoringErrorsListener struct {
+	listeners []HandlerListener
+	ignore    func(err error) bool
+}
+
+// IgnoreErrors returns a listener calling listeners, in order, with a nil error instead of the errors of the handler
+// ignore returns true for. The handler still returns them.
+func IgnoreErrors(ignore func(err error) bool, listeners ...HandlerListener) HandlerListener {
+	return &ignoringErrorsListener{listeners: listeners, ignore: ignore}
+}
+
+func (l *ignoringErrorsListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	for _, listener := range l.listeners {
+		ctx = listener.HandlerStarted(ctx, msg)
+	}
+	return ctx
+}
+
+func (l *ignoringErrorsListener) HandlerFinished(ctx context.Context, err error) {
+	if err != nil && l.ignore(err) {
+		logger.Debug("the error of the handler isn't reported: " + err.Error())
+		err = nil
+	}
+	for _, listener := range l.listeners {
+		listener.HandlerFinished(ctx, err)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreErrors(t *testing.T) {
+	errNotFound := errors.New("not found")
+	listener := mockHandlerListener{}
+	ignoring := IgnoreErrors(func(err error) bool { return errors.Is(err, errNotFound) }, &listener)
+
+	var handlerErr error
+	handler := func(ctx context.Context) error { return handlerErr }
+	wrapped := WrapHandlerWithListeners(handler, ignoring).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	handlerErr = fmt.Errorf("order o-1: %w", errNotFound)
+	_, err := wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.ErrorIs(t, err, errNotFound)
+	assert.NotNil(t, listener.inputCTX)
+	assert.NotNil(t, listener.outputCTX)
+	assert.NoError(t, listener.outputErr)
+
+	handlerErr = errors.New("boom")
+	_, err = wrapped(context.Background(), json.RawMessage(`{}`))
+	assert.Equal(t, handlerErr, err)
+	assert.Equal(t, handlerErr, listener.outputErr)
+}
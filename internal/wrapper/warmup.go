@@ -0,0 +1,65 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+)
+
+// warmupSource is the source of the events of serverless-plugin-warmup
+const warmupSource = "serverless-plugin-warmup"
+
+// skippingListener calls its listeners for every invocation except the ones skip returns true for
+type skippingListener struct {
+	listeners []HandlerListener
+	skip      func(msg json.RawMessage) bool
+	skipped   bool
+}
+
+// SkipInvocations returns a listener calling listeners, in order, except for the invocations skip returns true for
+func SkipInvocations(skip func(msg json.RawMessage) bool, listeners ...HandlerListener) HandlerListener {
+	return &skippingListener{listeners: listeners, skip: skip}
+}
+
+func (l *skippingListener) HandlerStarted(ctx context.Context, msg json.RawMessage) context.Context {
+	l.skipped = l.skip(msg)
+	if l.skipped {
+		logger.Debug("skipping the instrumentation of the invocation")
+		return ctx
+	}
+	for _, listener := range l.listeners {
+		ctx = listener.HandlerStarted(ctx, msg)
+	}
+	return ctx
+}
+
+func (l *skippingListener) HandlerFinished(ctx context.Context, err error) {
+	if l.skipped {
+		return
+	}
+	for _, listener := range l.listeners {
+		listener.HandlerFinished(ctx, err)
+	}
+}
+
+// IsWarmupEvent returns true for the keep-warm events of lambda-warmer, {"warmer": true}, and of
+// serverless-plugin-warmup, {"source": "serverless-plugin-warmup"}
+func IsWarmupEvent(msg json.RawMessage) bool {
+	event := struct {
+		Warmer bool   `json:"warmer"`
+		Source string `json:"source"`
+	}{}
+	if err := json.Unmarshal(msg, &event); err != nil {
+		return false
+	}
+	return event.Warmer || event.Source == warmupSource
+}
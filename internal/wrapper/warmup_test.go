@@ -0,0 +1,53 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipInvocations(t *testing.T) {
+	first, second := mockHandlerListener{}, mockHandlerListener{}
+	listener := SkipInvocations(IsWarmupEvent, &first, &second)
+	handler := func(ctx context.Context) error { return nil }
+	wrapped := WrapHandlerWithListeners(handler, listener).(func(context.Context, json.RawMessage) (interface{}, error))
+
+	_, err := wrapped(context.Background(), json.RawMessage(`{"warmer":true}`))
+	assert.NoError(t, err)
+	assert.Nil(t, first.inputCTX)
+	assert.Nil(t, second.outputCTX)
+
+	_, err = wrapped(context.Background(), json.RawMessage(`{"name":"alice"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"name":"alice"}`), first.inputMSG)
+	assert.NotNil(t, first.outputCTX)
+	assert.Equal(t, json.RawMessage(`{"name":"alice"}`), second.inputMSG)
+	assert.NotNil(t, second.outputCTX)
+}
+
+func TestIsWarmupEvent(t *testing.T) {
+	testCases := []struct {
+		event    string
+		expected bool
+	}{
+		{`{"warmer":true,"concurrency":3}`, true},
+		{`{"source":"serverless-plugin-warmup"}`, true},
+		{`{"warmer":false}`, false},
+		{`{"source":"aws.events"}`, false},
+		{`[1,2]`, false},
+		{`invalid`, false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, IsWarmupEvent(json.RawMessage(tc.event)), tc.event)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/DataDog/datadog-lambda-go/internal/extension"
 	"github.com/DataDog/datadog-lambda-go/internal/logger"
@@ -26,6 +27,11 @@ var (
 	CurrentContext context.Context
 )
 
+type contextKeyType int
+
+// handlerDurationKey is the key used to store how long the handler ran, for the HandlerFinished of the listeners
+var handlerDurationKey = new(contextKeyType)
+
 type (
 	// HandlerListener is a point where listener logic can be injected into a handler
 	HandlerListener interface {
@@ -40,6 +46,19 @@ type (
 	}
 )
 
+// IsColdStart returns true when ctx is the context of the first invocation of the wrapped handler
+func IsColdStart(ctx context.Context) bool {
+	isColdStart, _ := ctx.Value("cold_start").(bool)
+	return isColdStart
+}
+
+// HandlerDuration returns how long the handler of the invocation ran, excluding the listeners. It is only set in the
+// context passed to HandlerFinished.
+func HandlerDuration(ctx context.Context) (time.Duration, bool) {
+	duration, ok := ctx.Value(handlerDurationKey).(time.Duration)
+	return duration, ok
+}
+
 // WrapHandlerWithListeners wraps a lambda handler, and calls listeners before and after every invocation.
 func WrapHandlerWithListeners(handler interface{}, listeners ...HandlerListener) interface{} {
 	err := validateHandler(handler)
@@ -58,7 +77,9 @@ func WrapHandlerWithListeners(handler interface{}, listeners ...HandlerListener)
 			ctx = listener.HandlerStarted(ctx, msg)
 		}
 		CurrentContext = ctx
+		start := time.Now()
 		result, err := callHandler(ctx, msg, handler)
+		ctx = context.WithValue(ctx, handlerDurationKey, time.Since(start))
 		for _, listener := range listeners {
 			ctx = context.WithValue(ctx, extension.DdLambdaResponse, result)
 			listener.HandlerFinished(ctx, err)
@@ -83,7 +104,9 @@ func (h *DatadogHandler) Invoke(ctx context.Context, payload []byte) ([]byte, er
 	}
 
 	CurrentContext = ctx
+	start := time.Now()
 	result, err := h.handler.Invoke(ctx, payload)
+	ctx = context.WithValue(ctx, handlerDurationKey, time.Since(start))
 	for _, listener := range h.listeners {
 		listener.HandlerFinished(ctx, err)
 	}
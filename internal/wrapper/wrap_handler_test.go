@@ -15,6 +15,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -26,6 +27,7 @@ type (
 		inputCTX  context.Context
 		inputMSG  json.RawMessage
 		outputCTX context.Context
+		outputErr error
 	}
 
 	mockNonProxyEvent struct {
@@ -42,6 +44,7 @@ func (mhl *mockHandlerListener) HandlerStarted(ctx context.Context, msg json.Raw
 
 func (mhl *mockHandlerListener) HandlerFinished(ctx context.Context, err error) {
 	mhl.outputCTX = ctx
+	mhl.outputErr = err
 }
 
 func runHandlerWithJSON(t *testing.T, filename string, handler interface{}) (*mockHandlerListener, interface{}, error) {
@@ -298,3 +301,17 @@ func TestWrapHandlerInterfaceWithListeners(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, uint8('5'), response[0])
 }
+
+func TestWrapHandlerSetsHandlerDuration(t *testing.T) {
+	handler := func(ctx context.Context, request events.APIGatewayProxyRequest) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return 5, nil
+	}
+
+	mhl, _, _ := runHandlerWithJSON(t, "../testdata/apig-event-no-headers.json", handler)
+	_, ok := HandlerDuration(mhl.inputCTX)
+	assert.False(t, ok)
+	duration, ok := HandlerDuration(mhl.outputCTX)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, duration, 5*time.Millisecond)
+}
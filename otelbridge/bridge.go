@@ -0,0 +1,90 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+// Package otelbridge bridges the Datadog spans created by ddlambda and the spans of the OpenTelemetry Go SDK,
+// so each can parent the other within a handler and their trace IDs align.
+// It is a separate package, so only the functions that use it depend on the OpenTelemetry trace API.
+package otelbridge
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// propagator builds Datadog span contexts out of OpenTelemetry ones
+var propagator = tracer.NewPropagator(&tracer.PropagatorConfig{})
+
+// ContextWithDatadogSpan returns a copy of ctx in which the Datadog span of ctx, e.g. the function execution span, is the
+// remote parent of the OpenTelemetry spans started from it. ctx is returned unchanged when it has no Datadog span.
+func ContextWithDatadogSpan(ctx context.Context) context.Context {
+	span, ok := tracer.SpanFromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	spanCtx := span.Context()
+
+	var traceID oteltrace.TraceID
+	if w3c, ok := spanCtx.(ddtrace.SpanContextW3C); ok {
+		traceID = w3c.TraceID128Bytes()
+	} else {
+		binary.BigEndian.PutUint64(traceID[8:], spanCtx.TraceID())
+	}
+	var spanID oteltrace.SpanID
+	binary.BigEndian.PutUint64(spanID[:], spanCtx.SpanID())
+
+	var flags oteltrace.TraceFlags
+	if priority, ok := spanCtx.(interface{ SamplingPriority() (int, bool) }); ok {
+		if p, ok := priority.SamplingPriority(); !ok || p > 0 {
+			flags = oteltrace.FlagsSampled
+		}
+	}
+
+	return oteltrace.ContextWithRemoteSpanContext(ctx, oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: flags,
+		Remote:     true,
+	}))
+}
+
+// DatadogSpanContext returns the OpenTelemetry span context of ctx as a Datadog span context, to start Datadog spans as
+// its children with tracer.ChildOf. It returns false when ctx has no valid OpenTelemetry span context.
+func DatadogSpanContext(ctx context.Context) (ddtrace.SpanContext, bool) {
+	otelCtx := oteltrace.SpanContextFromContext(ctx)
+	if !otelCtx.IsValid() {
+		return nil, false
+	}
+	traceID := otelCtx.TraceID()
+	spanID := otelCtx.SpanID()
+
+	samplingPriority := "0"
+	if otelCtx.IsSampled() {
+		samplingPriority = "1"
+	}
+	carrier := tracer.TextMapCarrier{
+		tracer.DefaultTraceIDHeader:  strconv.FormatUint(binary.BigEndian.Uint64(traceID[8:]), 10),
+		tracer.DefaultParentIDHeader: strconv.FormatUint(binary.BigEndian.Uint64(spanID[:]), 10),
+		tracer.DefaultPriorityHeader: samplingPriority,
+	}
+	if upper := traceID[:8]; binary.BigEndian.Uint64(upper) != 0 {
+		// The upper 64 bits of 128-bit trace IDs are propagated as a tag
+		carrier["x-datadog-tags"] = "_dd.p.tid=" + hex.EncodeToString(upper)
+	}
+
+	spanCtx, err := propagator.Extract(carrier)
+	if err != nil {
+		return nil, false
+	}
+	return spanCtx, true
+}
@@ -0,0 +1,75 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package otelbridge
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+type discardLogger struct{}
+
+func (discardLogger) Log(string) {}
+
+func startTracer(t *testing.T) {
+	tracer.Start(tracer.WithLogger(discardLogger{}), tracer.WithLogStartup(false))
+	t.Cleanup(tracer.Stop)
+}
+
+func TestContextWithDatadogSpan(t *testing.T) {
+	startTracer(t)
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "aws.lambda")
+	defer span.Finish()
+
+	ctx = ContextWithDatadogSpan(ctx)
+	_, otelSpan := noop.NewTracerProvider().Tracer("test").Start(ctx, "child")
+
+	otelCtx := otelSpan.SpanContext()
+	assert.True(t, otelCtx.IsValid())
+	assert.True(t, otelCtx.IsSampled())
+	assert.Equal(t, span.Context().(ddtrace.SpanContextW3C).TraceID128(), otelCtx.TraceID().String())
+	assert.Equal(t, fmt.Sprintf("%016x", span.Context().SpanID()), otelCtx.SpanID().String())
+}
+
+func TestContextWithDatadogSpanWithoutSpan(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ctx, ContextWithDatadogSpan(ctx))
+}
+
+func TestDatadogSpanContext(t *testing.T) {
+	startTracer(t)
+	traceID, _ := oteltrace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := oteltrace.SpanIDFromHex("b7ad6b7169203331")
+	ctx := oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+	}))
+
+	spanCtx, ok := DatadogSpanContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0xb7ad6b7169203331), spanCtx.SpanID())
+
+	child := tracer.StartSpan("child", tracer.ChildOf(spanCtx))
+	defer child.Finish()
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", child.Context().(ddtrace.SpanContextW3C).TraceID128())
+	assert.Equal(t, uint64(0x8448eb211c80319c), child.Context().TraceID())
+}
+
+func TestDatadogSpanContextWithoutSpan(t *testing.T) {
+	_, ok := DatadogSpanContext(context.Background())
+	assert.False(t, ok)
+}
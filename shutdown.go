@@ -0,0 +1,84 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DataDog/datadog-lambda-go/internal/logger"
+	"github.com/DataDog/datadog-lambda-go/internal/metrics"
+)
+
+// shutdownFlushTimeout bounds the final flush, Lambda only gives the runtime a few hundred milliseconds after SIGTERM.
+const shutdownFlushTimeout = 300 * time.Millisecond
+
+var shutdownHandler struct {
+	sync.Mutex
+	signals chan os.Signal
+	stop    chan struct{}
+}
+
+// terminate ends the process once the final flush is done, by delivering SIGTERM again without a handler installed.
+var terminate = func() {
+	if process, err := os.FindProcess(os.Getpid()); err == nil {
+		_ = process.Signal(syscall.SIGTERM)
+	}
+}
+
+// installShutdownHandler flushes the metrics of listener when the process receives SIGTERM.
+// Only the first handler is installed, until Shutdown removes it.
+func installShutdownHandler(listener *metrics.Listener) {
+	shutdownHandler.Lock()
+	defer shutdownHandler.Unlock()
+	if shutdownHandler.signals != nil {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(signals, syscall.SIGTERM)
+	shutdownHandler.signals = signals
+	shutdownHandler.stop = stop
+
+	go func() {
+		select {
+		case <-signals:
+			logger.Debug("received SIGTERM, flushing metrics before shutting down")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+			if err := listener.FinalFlush(ctx); err != nil {
+				logger.Error(fmt.Errorf("couldn't flush metrics before shutting down: %w", err))
+			}
+			cancel()
+			Shutdown()
+			terminate()
+		case <-stop:
+		}
+	}()
+}
+
+// Shutdown removes the SIGTERM handler installed by Config.FlushOnShutdown, restoring the default behavior of the signal.
+// It is safe to call when no handler is installed.
+func Shutdown() {
+	shutdownHandler.Lock()
+	defer shutdownHandler.Unlock()
+	if shutdownHandler.signals == nil {
+		return
+	}
+
+	signal.Stop(shutdownHandler.signals)
+	close(shutdownHandler.stop)
+	shutdownHandler.signals = nil
+	shutdownHandler.stop = nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushOnShutdownFlushesOnSIGTERM(t *testing.T) {
+	var mu sync.Mutex
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep the background flush running when the signal is received
+		time.Sleep(100 * time.Millisecond)
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		body += string(b)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	terminated := make(chan string, 1)
+	defer func(original func()) { terminate = original }(terminate)
+	terminate = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		terminated <- body
+	}
+	defer Shutdown()
+
+	_, err := InvokeDryRun(func(ctx context.Context) {
+		Metric("my-metric", 1, "my:tag")
+	}, &Config{
+		APIKey:          "abc-123",
+		Site:            server.URL,
+		AsyncFlush:      true,
+		FlushOnShutdown: true,
+	})
+	assert.NoError(t, err)
+
+	// Simulate the signal, the race detector doesn't know a signal delivered by the OS happens after the invocation
+	shutdownHandler.Lock()
+	shutdownHandler.signals <- syscall.SIGTERM
+	shutdownHandler.Unlock()
+
+	select {
+	case flushed := <-terminated:
+		assert.True(t, strings.Contains(flushed, `"metric":"my-metric"`), "the metrics should be flushed before terminating")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "the process wasn't terminated after SIGTERM")
+	}
+}
+
+func TestInstallShutdownHandlerOnce(t *testing.T) {
+	defer Shutdown()
+
+	cfg := &Config{APIKey: "abc-123", FlushOnShutdown: true}
+	initializeListeners(cfg)
+	signals := shutdownHandler.signals
+	assert.NotNil(t, signals)
+
+	initializeListeners(cfg)
+	assert.Equal(t, signals, shutdownHandler.signals)
+
+	Shutdown()
+	assert.Nil(t, shutdownHandler.signals)
+	Shutdown()
+}
+
+func TestNoShutdownHandlerByDefault(t *testing.T) {
+	initializeListeners(&Config{APIKey: "abc-123"})
+	assert.Nil(t, shutdownHandler.signals)
+}
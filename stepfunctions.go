@@ -0,0 +1,50 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// stepFunctionContextKey is the field of the output holding the trace headers, where the wrapper of the next lambda
+// reads them from
+const stepFunctionContextKey = "_datadog"
+
+// InjectStepFunctionContext returns output with a `_datadog` field holding the trace headers of ctx, as returned by
+// GetTraceHeaders, so the lambda of the next state of a Step Functions state machine continues the trace. The output
+// must be encoded as a JSON object, like a map or a struct: it's returned as a map[string]interface{}, with its
+// numbers as json.Number. output is returned unchanged when ctx has no trace context.
+func InjectStepFunctionContext(ctx context.Context, output interface{}) (interface{}, error) {
+	headers := GetTraceHeaders(ctx)
+	if headers[tracer.DefaultTraceIDHeader] == "" {
+		return output, nil
+	}
+
+	encoded, err := json.Marshal(output)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode the output: %w", err)
+	}
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("the output isn't a JSON object: %w", err)
+	}
+	if fields == nil {
+		// A nil output is encoded as null
+		fields = map[string]interface{}{}
+	}
+	fields[stepFunctionContextKey] = headers
+	return fields, nil
+}
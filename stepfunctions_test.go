@@ -0,0 +1,88 @@
+/*
+ * Unless explicitly stated otherwise all files in this repository are licensed
+ * under the Apache License Version 2.0.
+ *
+ * This product includes software developed at Datadog (https://www.datadoghq.com/).
+ * Copyright 2021 Datadog, Inc.
+ */
+
+package ddlambda
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-lambda-go/internal/trace"
+)
+
+var stepFunctionTraceHeaders = map[string]string{
+	"x-datadog-trace-id":          "1231452342",
+	"x-datadog-parent-id":         "45678910",
+	"x-datadog-sampling-priority": "2",
+}
+
+// extractStepFunctionContext reads the trace headers of output like the wrapper of the next lambda does
+func extractStepFunctionContext(t *testing.T, output interface{}) map[string]string {
+	encoded, err := json.Marshal(output)
+	assert.NoError(t, err)
+	return trace.DefaultTraceExtractor(context.Background(), encoded)
+}
+
+func TestInjectStepFunctionContextIntoMap(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), stepFunctionTraceHeaders)
+	input := map[string]interface{}{"orderId": "o-1", "total": 42}
+
+	output, err := InjectStepFunctionContext(ctx, input)
+	assert.NoError(t, err)
+
+	fields := output.(map[string]interface{})
+	assert.Equal(t, "o-1", fields["orderId"])
+	assert.Equal(t, json.Number("42"), fields["total"])
+	assert.Contains(t, fields, "_datadog")
+	assert.NotContains(t, input, "_datadog")
+	headers := extractStepFunctionContext(t, output)
+	assert.Equal(t, "1231452342", headers["x-datadog-trace-id"])
+	assert.Equal(t, "45678910", headers["x-datadog-parent-id"])
+	assert.Equal(t, "2", headers["x-datadog-sampling-priority"])
+}
+
+func TestInjectStepFunctionContextIntoStruct(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), stepFunctionTraceHeaders)
+	type order struct {
+		OrderID string `json:"orderId"`
+		Total   int    `json:"total"`
+	}
+
+	output, err := InjectStepFunctionContext(ctx, order{OrderID: "o-1", Total: 42})
+	assert.NoError(t, err)
+
+	var decoded order
+	encoded, _ := json.Marshal(output)
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, order{OrderID: "o-1", Total: 42}, decoded)
+	headers := extractStepFunctionContext(t, output)
+	assert.Equal(t, "1231452342", headers["x-datadog-trace-id"])
+	assert.Equal(t, "45678910", headers["x-datadog-parent-id"])
+}
+
+func TestInjectStepFunctionContextIntoNil(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), stepFunctionTraceHeaders)
+	output, err := InjectStepFunctionContext(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1231452342", extractStepFunctionContext(t, output)["x-datadog-trace-id"])
+}
+
+func TestInjectStepFunctionContextIntoNonObject(t *testing.T) {
+	ctx := ExtractTraceContext(context.Background(), stepFunctionTraceHeaders)
+	_, err := InjectStepFunctionContext(ctx, []string{"a"})
+	assert.Error(t, err)
+}
+
+func TestInjectStepFunctionContextWithoutTraceContext(t *testing.T) {
+	output, err := InjectStepFunctionContext(context.Background(), []string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, output)
+}